@@ -5,10 +5,10 @@ import KanbanView from "./components/KanbanView";
 import TaskView from "./components/TaskView";
 import ArchivedTasks from "./components/ArchivedTasks";
 import TaskViewModal from "./components/TaskViewModal";
+import LoginScreen from "./components/LoginScreen";
 import users from "./data/users";
+import { apiFetch, getToken, logout } from "./lib/api";
 
-// Dynamic API base URL - uses current host for network access
-const API_BASE = `http://${window.location.hostname}:8080`;
 
 // Upload a single attachment to the backend.
 // File-type attachments are sent as multipart; links as JSON.
@@ -20,7 +20,7 @@ const uploadAttachment = async (taskId, att) => {
     form.append("mime_type", att._file.type || "application/octet-stream");
     form.append("size", String(att._file.size));
     form.append("file", att._file, att._file.name);
-    const res = await fetch(`${API_BASE}/tasks/${taskId}/attachments`, {
+    const res = await apiFetch(`/tasks/${taskId}/attachments`, {
       method: "POST",
       body: form,
     });
@@ -33,7 +33,7 @@ const uploadAttachment = async (taskId, att) => {
   }
   // Link type — plain JSON
   const { _file, ...cleanAtt } = att;
-  const res = await fetch(`${API_BASE}/tasks/${taskId}/attachments`, {
+  const res = await apiFetch(`/tasks/${taskId}/attachments`, {
     method: "POST",
     headers: { "Content-Type": "application/json" },
     body: JSON.stringify(toSnakeCase(cleanAtt)),
@@ -86,6 +86,8 @@ function App() {
   const [loading, setLoading] = useState(true);
   const [error, setError] = useState(null);
   const [viewedTask, setViewedTask] = useState(null);
+  // Every API route but login needs the token of a signed-in user.
+  const [authed, setAuthed] = useState(() => !!getToken());
   
   // PERFORMANCE: Cache for attachment URLs loaded on-demand (refs = stable, no re-render needed)
   const attachmentCacheRef = useRef(new Map());
@@ -129,11 +131,18 @@ function App() {
     return () => window.removeEventListener("taskNotificationFallback", handleFallbackAlert);
   }, []);
 
-  // Fetch tasks from backend on mount
+  // Back to the login screen when the session expires or is revoked
   useEffect(() => {
-    fetchTasks();
+    const handleAuthExpired = () => setAuthed(false);
+    window.addEventListener("authExpired", handleAuthExpired);
+    return () => window.removeEventListener("authExpired", handleAuthExpired);
   }, []);
 
+  // Fetch tasks from backend once signed in
+  useEffect(() => {
+    if (authed) fetchTasks();
+  }, [authed]);
+
   // Save theme to localStorage whenever it changes
   useEffect(() => {
     localStorage.setItem('theme', theme);
@@ -142,7 +151,7 @@ function App() {
   const fetchTasks = async () => {
     try {
       setLoading(true);
-      const response = await fetch(`${API_BASE}/tasks`);
+      const response = await apiFetch(`/tasks`);
       if (!response.ok) {
         throw new Error(`HTTP error! status: ${response.status}`);
       }
@@ -187,7 +196,7 @@ function App() {
     loadingAttachmentsRef.current.add(taskId);
     
     try {
-      const response = await fetch(`${API_BASE}/tasks/${taskId}/attachments`);
+      const response = await apiFetch(`/tasks/${taskId}/attachments`);
       if (response.ok) {
         const attachments = await response.json();
         const camelAttachments = toCamelCase(attachments);
@@ -228,7 +237,7 @@ function App() {
 
   const clearTasks = async () => {
     try {
-      const response = await fetch(`${API_BASE}/tasks/clear`, {
+      const response = await apiFetch(`/tasks/clear`, {
         method: 'POST'
       });
       if (response.ok) {
@@ -242,6 +251,18 @@ function App() {
     }
   };
 
+  const handleLogout = async () => {
+    try {
+      await logout();
+    } catch (err) {
+      console.error("Failed to log out:", err);
+    }
+    setTasks([]);
+    setViewedTask(null);
+    attachmentCacheRef.current.clear();
+    setAuthed(false);
+  };
+
   const toggleTheme = () => {
     setTheme((prevTheme) => (prevTheme === "light" ? "dark" : "light"));
   };
@@ -266,7 +287,7 @@ function App() {
       bodyData.created_at = new Date().toISOString();
       bodyData.updated_at = new Date().toISOString();
       const snakeData = toSnakeCase(bodyData);
-      const response = await fetch(`${API_BASE}/tasks`, {
+      const response = await apiFetch(`/tasks`, {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
         body: JSON.stringify(snakeData)
@@ -289,7 +310,7 @@ function App() {
           }
         }
         // Fetch attachments for the new task
-        const attRes = await fetch(`${API_BASE}/tasks/${newTask.id}/attachments`);
+        const attRes = await apiFetch(`/tasks/${newTask.id}/attachments`);
         if (attRes.ok) {
           const attData = await attRes.json();
           newTask.attachments = toCamelCase(attData);
@@ -331,7 +352,7 @@ function App() {
       delete taskUpdateData.attachments;
       
       const snakeData = toSnakeCase(taskUpdateData);
-      const response = await fetch(`${API_BASE}/tasks/${taskId}`, {
+      const response = await apiFetch(`/tasks/${taskId}`, {
         method: 'PUT',
         headers: { 'Content-Type': 'application/json' },
         body: JSON.stringify(snakeData)
@@ -348,7 +369,7 @@ function App() {
         const stillExists = attachments.find(att => att.id === existingAtt.id);
         if (!stillExists && existingAtt.id) {
           try {
-            await fetch(`${API_BASE}/tasks/${taskId}/attachments/${existingAtt.id}`, {
+            await apiFetch(`/tasks/${taskId}/attachments/${existingAtt.id}`, {
               method: 'DELETE'
             });
           } catch (delErr) {
@@ -371,7 +392,7 @@ function App() {
       }
       
       // Fetch updated attachments
-      const attRes = await fetch(`${API_BASE}/tasks/${taskId}/attachments`);
+      const attRes = await apiFetch(`/tasks/${taskId}/attachments`);
       if (attRes.ok) {
         const attData = await attRes.json();
         updatedTask.attachments = toCamelCase(attData);
@@ -416,7 +437,7 @@ function App() {
   // Delete task
   const handleDelete = async (taskId) => {
     try {
-      const response = await fetch(`${API_BASE}/tasks/${taskId}`, { method: 'DELETE' });
+      const response = await apiFetch(`/tasks/${taskId}`, { method: 'DELETE' });
       if (!response.ok) {
         throw new Error(`HTTP error! status: ${response.status}`);
       }
@@ -450,13 +471,11 @@ function App() {
   const handleArchive = async (taskId) => {
     const task = tasks.find(t => t.id === taskId);
     if (!task) return;
-    const updatedTask = { ...task, archived: !task.archived };
     try {
-      const snakeData = toSnakeCase(updatedTask);
-      const response = await fetch(`${API_BASE}/tasks/${taskId}`, {
+      const response = await apiFetch(`/tasks/${taskId}`, {
         method: 'PUT',
         headers: { 'Content-Type': 'application/json' },
-        body: JSON.stringify(snakeData)
+        body: JSON.stringify({ archived: !task.archived })
       });
       if (!response.ok) {
         throw new Error(`HTTP error! status: ${response.status}`);
@@ -473,6 +492,18 @@ function App() {
     }
   };
 
+  if (!authed) {
+    return (
+      <LoginScreen
+        theme={theme}
+        onLogin={() => {
+          setError(null);
+          setAuthed(true);
+        }}
+      />
+    );
+  }
+
   if (loading) {
     return (
       <div className="flex min-h-screen items-center justify-center bg-gray-100">
@@ -562,6 +593,13 @@ function App() {
       >
         {theme === "light" ? "🌞" : "🌙"}
       </button>
+      <button
+        type="button"
+        onClick={handleLogout}
+        className={`fixed top-4 right-16 px-3 py-2 rounded-full shadow-lg z-50 text-sm transition-all duration-300 ${theme === "light" ? "bg-gray-200 hover:bg-gray-300 text-gray-800" : "bg-gray-700 hover:bg-gray-600 text-gray-200"}`}
+      >
+        Sign out
+      </button>
 
       {fallbackAlerts.length > 0 && (
         <div className="fixed bottom-4 right-4 z-[80] flex flex-col gap-2 max-w-sm">
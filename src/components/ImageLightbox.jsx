@@ -2,7 +2,7 @@ import React from "react";
 import ReactDOM from "react-dom";
 import { X } from "lucide-react";
 
-export default function ImageLightbox({ imageUrl, imageName, isOpen, onClose }) {
+export default function ImageLightbox({ imageUrl, imageName, isVideo = false, isOpen, onClose }) {
   if (!isOpen) return null;
 
   const handleBackgroundClick = (e) => {
@@ -36,16 +36,28 @@ export default function ImageLightbox({ imageUrl, imageName, isOpen, onClose })
         className="relative max-w-[70vw] max-h-[70vh] flex flex-col items-center"
         onClick={(e) => e.stopPropagation()}
       >
-        <img
-          src={imageUrl}
-          alt={imageName || "Image preview"}
-          className="max-w-full max-h-[calc(70vh-60px)] object-contain rounded-lg shadow-2xl"
-          onError={(e) => {
-            e.target.src = `data:image/svg+xml,${encodeURIComponent(
-              '<svg xmlns="http://www.w3.org/2000/svg" width="400" height="300" viewBox="0 0 400 300"><rect fill="#374151" width="400" height="300"/><text fill="#9CA3AF" font-family="Arial" font-size="14" x="50%" y="50%" text-anchor="middle" dy=".3em">Image failed to load</text></svg>'
-            )}`;
-          }}
-        />
+        {isVideo ? (
+          // The download endpoint supports Range requests, so the browser
+          // fetches only what it plays and can seek anywhere.
+          <video
+            src={imageUrl}
+            controls
+            autoPlay
+            preload="metadata"
+            className="max-w-full max-h-[calc(70vh-60px)] rounded-lg shadow-2xl bg-black"
+          />
+        ) : (
+          <img
+            src={imageUrl}
+            alt={imageName || "Image preview"}
+            className="max-w-full max-h-[calc(70vh-60px)] object-contain rounded-lg shadow-2xl"
+            onError={(e) => {
+              e.target.src = `data:image/svg+xml,${encodeURIComponent(
+                '<svg xmlns="http://www.w3.org/2000/svg" width="400" height="300" viewBox="0 0 400 300"><rect fill="#374151" width="400" height="300"/><text fill="#9CA3AF" font-family="Arial" font-size="14" x="50%" y="50%" text-anchor="middle" dy=".3em">Image failed to load</text></svg>'
+              )}`;
+            }}
+          />
+        )}
         {imageName && (
           <p className="mt-4 text-white text-sm bg-gray-800 px-4 py-2 rounded-lg">
             {imageName}
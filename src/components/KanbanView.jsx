@@ -5,9 +5,8 @@ import { CSS } from "@dnd-kit/utilities";
 import AddTaskModal from "./AddTaskModal";
 import AddSubtaskModal from "./AddSubtaskModal";
 import TaskCard from "./TaskCard";
+import { apiFetch } from "../lib/api";
 
-// Dynamic API base URL - uses current host for network access
-const API_BASE = `http://${window.location.hostname}:8080`;
 
 export default function KanbanView({ theme, tasks, setTasks, onEdit, onDelete, onArchive, onTaskClick }) {
   const [showSubtaskModal, setShowSubtaskModal] = useState(false);
@@ -135,7 +134,7 @@ export default function KanbanView({ theme, tasks, setTasks, onEdit, onDelete, o
   const createTask = async (taskData) => {
     try {
       setLoading(true);
-      const response = await fetch(`${API_BASE}/tasks`, {
+      const response = await apiFetch(`/tasks`, {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
         body: JSON.stringify({
@@ -164,7 +163,7 @@ export default function KanbanView({ theme, tasks, setTasks, onEdit, onDelete, o
   const updateTask = async (taskId, taskData) => {
     try {
       setLoading(true);
-      const response = await fetch(`${API_BASE}/tasks/${taskId}`, {
+      const response = await apiFetch(`/tasks/${taskId}`, {
         method: 'PUT',
         headers: { 'Content-Type': 'application/json' },
         body: JSON.stringify(taskData)
@@ -189,7 +188,7 @@ export default function KanbanView({ theme, tasks, setTasks, onEdit, onDelete, o
   const createSubtask = async (taskId, subtaskData) => {
     try {
       setLoading(true);
-      const response = await fetch(`${API_BASE}/tasks/${taskId}/subtasks`, {
+      const response = await apiFetch(`/tasks/${taskId}/subtasks`, {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
         body: JSON.stringify(subtaskData)
@@ -214,7 +213,7 @@ export default function KanbanView({ theme, tasks, setTasks, onEdit, onDelete, o
   const updateSubtask = async (taskId, subtaskId, subtaskData) => {
     try {
       setLoading(true);
-      const response = await fetch(`${API_BASE}/tasks/${taskId}/subtasks/${subtaskId}`, {
+      const response = await apiFetch(`/tasks/${taskId}/subtasks/${subtaskId}`, {
         method: 'PUT',
         headers: { 'Content-Type': 'application/json' },
         body: JSON.stringify(subtaskData)
@@ -239,7 +238,7 @@ export default function KanbanView({ theme, tasks, setTasks, onEdit, onDelete, o
   const deleteSubtask = async (taskId, subtaskId) => {
     try {
       setLoading(true);
-      const response = await fetch(`${API_BASE}/tasks/${taskId}/subtasks/${subtaskId}`, {
+      const response = await apiFetch(`/tasks/${taskId}/subtasks/${subtaskId}`, {
         method: 'DELETE'
       });
       
@@ -0,0 +1,67 @@
+// src/components/LoginScreen.jsx
+import { useState } from "react";
+import { login } from "../lib/api";
+
+export default function LoginScreen({ theme, onLogin }) {
+  const [name, setName] = useState("");
+  const [password, setPassword] = useState("");
+  const [error, setError] = useState(null);
+  const [submitting, setSubmitting] = useState(false);
+
+  const handleSubmit = async (e) => {
+    e.preventDefault();
+    setSubmitting(true);
+    setError(null);
+    try {
+      const user = await login(name.trim(), password);
+      onLogin(user);
+    } catch (err) {
+      setError(err.message);
+    } finally {
+      setSubmitting(false);
+    }
+  };
+
+  const inputClass = `w-full p-2 rounded border ${theme === "light" ? "bg-white border-gray-300 text-gray-900" : "bg-gray-800 border-gray-600 text-white"}`;
+
+  return (
+    <div className={`flex min-h-screen items-center justify-center ${theme === "light" ? "bg-gray-100" : "bg-gray-900"}`}>
+      <form
+        onSubmit={handleSubmit}
+        className={`w-full max-w-sm p-6 rounded-lg shadow-lg ${theme === "light" ? "bg-white text-gray-800" : "bg-gray-800 text-gray-200"}`}
+      >
+        <h2 className="text-xl font-bold mb-4">Sign in</h2>
+        <label className="block mb-3">
+          <span className="block text-sm mb-1">Name</span>
+          <input
+            type="text"
+            autoComplete="username"
+            value={name}
+            onChange={(e) => setName(e.target.value)}
+            className={inputClass}
+            required
+          />
+        </label>
+        <label className="block mb-4">
+          <span className="block text-sm mb-1">Password</span>
+          <input
+            type="password"
+            autoComplete="current-password"
+            value={password}
+            onChange={(e) => setPassword(e.target.value)}
+            className={inputClass}
+            required
+          />
+        </label>
+        {error && <p className="mb-3 text-sm text-red-600">{error}</p>}
+        <button
+          type="submit"
+          disabled={submitting}
+          className="w-full px-4 py-2 bg-blue-600 text-white rounded hover:bg-blue-700 disabled:opacity-50"
+        >
+          {submitting ? "Signing in..." : "Sign in"}
+        </button>
+      </form>
+    </div>
+  );
+}
@@ -10,6 +10,7 @@ import {
 } from "lucide-react";
 import useLocalStorageTasks from "../hooks/use-tasks";
 import users from "../data/users";
+import { apiFetch } from "../lib/api";
 
 export default function Sidebar({ currentView, setView, theme }) {
 
@@ -41,7 +42,7 @@ export default function Sidebar({ currentView, setView, theme }) {
   // Fetch recent tasks from backend - simplified version
   const fetchRecentTasks = useCallback(async () => {
     try {
-      const res = await fetch(`http://${window.location.hostname}:8080/tasks/recent`);
+      const res = await apiFetch("/tasks/recent");
       if (res.ok) {
         const data = await res.json();
         setRecentTasks(Array.isArray(data) ? data : []);
@@ -1,5 +1,6 @@
 import React, { useState, useEffect, useRef, useMemo } from "react";
 import users from "../data/users";
+import { fileUrl } from "../lib/api";
 import { Pencil, Trash2, Plus, Archive, Pin, Link as LinkIcon, FileText } from "lucide-react";
 
 const priorityBorderColors = {
@@ -643,7 +644,6 @@ export default function TaskCard({
             <div className="flex flex-wrap gap-1">
               {task.attachments.map((att, index) => {
                 const key = att.id || `attachment-${index}`;
-                const apiBase = `http://${window.location.hostname}:8080`;
 
                 if (att.type === "link" && att.url) {
                   return (
@@ -663,7 +663,7 @@ export default function TaskCard({
                 }
 
                 if (att.type === "file" && att.id) {
-                  const downloadUrl = `${apiBase}/tasks/${task.id}/attachments/${att.id}/download`;
+                  const downloadUrl = fileUrl(`/tasks/${task.id}/attachments/${att.id}/download`);
                   return (
                     <a
                       key={key}
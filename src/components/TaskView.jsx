@@ -4,9 +4,8 @@ import TaskCard from "./TaskCard";
 import AddTaskModal from "./AddTaskModal";
 import AddSubtaskModal from "./AddSubtaskModal";
 import users from "../data/users";
+import { apiFetch } from "../lib/api";
 
-// Dynamic API base URL - uses current host for network access
-const API_BASE = `http://${window.location.hostname}:8080`;
 
 export default function TaskView({ theme, tasks, setTasks, onCreate, onEdit, onDelete, onArchive, onTaskClick, onLoadAttachments }) {
   const [highlightedTaskId, setHighlightedTaskId] = useState(null);
@@ -108,7 +107,7 @@ export default function TaskView({ theme, tasks, setTasks, onCreate, onEdit, onD
       setLoading(true);
       console.log("Creating subtask for task:", taskId, "with data:", subtaskData);
       
-      const response = await fetch(`${API_BASE}/tasks/${taskId}/subtasks`, {
+      const response = await apiFetch(`/tasks/${taskId}/subtasks`, {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
         body: JSON.stringify(subtaskData)
@@ -141,7 +140,7 @@ export default function TaskView({ theme, tasks, setTasks, onCreate, onEdit, onD
   const updateSubtask = async (taskId, subtaskId, subtaskData) => {
     try {
       setLoading(true);
-      const response = await fetch(`${API_BASE}/tasks/${taskId}/subtasks/${subtaskId}`, {
+      const response = await apiFetch(`/tasks/${taskId}/subtasks/${subtaskId}`, {
         method: 'PUT',
         headers: { 'Content-Type': 'application/json' },
         body: JSON.stringify(subtaskData)
@@ -166,7 +165,7 @@ export default function TaskView({ theme, tasks, setTasks, onCreate, onEdit, onD
   const deleteSubtask = async (taskId, subtaskId) => {
     try {
       setLoading(true);
-      const response = await fetch(`${API_BASE}/tasks/${taskId}/subtasks/${subtaskId}`, {
+      const response = await apiFetch(`/tasks/${taskId}/subtasks/${subtaskId}`, {
         method: 'DELETE'
       });
       
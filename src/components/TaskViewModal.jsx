@@ -3,6 +3,7 @@ import { X, Edit2, Trash2, Link as LinkIcon, FileText, Image as ImageIcon, Clock
 import { Dialog, DialogContent, DialogHeader, DialogTitle } from "@/components/ui/dialog";
 import { Button } from "@/components/ui/button";
 import ImageLightbox from "./ImageLightbox";
+import { apiFetch, fileUrl } from "../lib/api";
 
 // Helper to parse assignees safely
 const parseAssignees = (assignees) => {
@@ -294,7 +295,6 @@ export default function TaskViewModal({ task, users, isOpen, onClose, onEdit, on
               <h3 className="text-sm font-semibold text-gray-400 mb-3">Attachments</h3>
               <div className="space-y-2">
                 {localTask.attachments.map((att, index) => {
-                  const apiBase = `http://${window.location.hostname}:8080`;
                   const key = att.id || `att-${index}`;
                   const sizeLabel = att.size
                     ? typeof att.size === 'number'
@@ -324,8 +324,8 @@ export default function TaskViewModal({ task, users, isOpen, onClose, onEdit, on
 
                   // File type — build backend URLs
                   if (att.type === "file" && att.id) {
-                    const downloadUrl = `${apiBase}/tasks/${localTask.id}/attachments/${att.id}/download`;
-                    const inlineUrl = `${apiBase}/tasks/${localTask.id}/attachments/${att.id}/download?inline=1`;
+                    const downloadUrl = fileUrl(`/tasks/${localTask.id}/attachments/${att.id}/download`);
+                    const inlineUrl = fileUrl(`/tasks/${localTask.id}/attachments/${att.id}/download?inline=1`);
                     const mime = att.mimeType || att.mime_type || "";
                     // Use extension fallback when mime is empty OR a generic placeholder
                     const needsExtFallback = !mime || mime === "application/octet-stream";
@@ -368,10 +368,18 @@ export default function TaskViewModal({ task, users, isOpen, onClose, onEdit, on
                             <FileText size={16} className="text-blue-400" />
                             <span>{att.name || 'Video'}</span>
                             {sizeLabel && <span className="text-xs text-gray-500">{sizeLabel}</span>}
+                            <button
+                              type="button"
+                              onClick={() => setLightboxImage({ url: inlineUrl, name: att.name, isVideo: true })}
+                              className="ml-auto text-xs text-gray-400 hover:text-white"
+                            >
+                              Expand
+                            </button>
                           </div>
                           <video
                             src={inlineUrl}
                             controls
+                            preload="metadata"
                             className="w-full rounded-lg border border-gray-600 bg-gray-900"
                           />
                         </div>
@@ -513,8 +521,7 @@ export default function TaskViewModal({ task, users, isOpen, onClose, onEdit, on
                           checked={subtask.completed}
                           onChange={async () => {
                             try {
-                              const API_BASE = `http://${window.location.hostname}:8080`;
-                              const response = await fetch(`${API_BASE}/tasks/${localTask.id}/subtasks/${subtask.id}`, {
+                              const response = await apiFetch(`/tasks/${localTask.id}/subtasks/${subtask.id}`, {
                                 method: 'PUT',
                                 headers: { 'Content-Type': 'application/json' },
                                 body: JSON.stringify({ completed: !subtask.completed })
@@ -576,8 +583,7 @@ export default function TaskViewModal({ task, users, isOpen, onClose, onEdit, on
                           <button
                             onClick={async () => {
                               try {
-                                const API_BASE = `http://${window.location.hostname}:8080`;
-                                const response = await fetch(`${API_BASE}/tasks/${localTask.id}/subtasks/${subtask.id}`, {
+                                const response = await apiFetch(`/tasks/${localTask.id}/subtasks/${subtask.id}`, {
                                   method: 'DELETE'
                                 });
                                 
@@ -622,6 +628,7 @@ export default function TaskViewModal({ task, users, isOpen, onClose, onEdit, on
     <ImageLightbox
       imageUrl={lightboxImage?.url}
       imageName={lightboxImage?.name}
+      isVideo={!!lightboxImage?.isVideo}
       isOpen={!!lightboxImage}
       onClose={handleLightboxClose}
     />
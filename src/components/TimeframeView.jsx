@@ -4,9 +4,8 @@ import TaskCard from "./TaskCard";
 import AddTaskModal from "./AddTaskModal";
 import AddSubtaskModal from "./AddSubtaskModal";
 import users from "../data/users";
+import { apiFetch } from "../lib/api";
 
-// Dynamic API base URL - uses current host for network access
-const API_BASE = `http://${window.location.hostname}:8080`;
 
 export default function TimeframeView({ theme, tasks, setTasks, onCreate, onEdit, onDelete, onArchive, onTaskClick }) {
   const [highlightedTaskId, setHighlightedTaskId] = useState(null);
@@ -116,7 +115,7 @@ export default function TimeframeView({ theme, tasks, setTasks, onCreate, onEdit
   const deleteSubtask = async (taskId, subtaskId) => {
     try {
       setLoading(true);
-      const response = await fetch(`${API_BASE}/tasks/${taskId}/subtasks/${subtaskId}`, {
+      const response = await apiFetch(`/tasks/${taskId}/subtasks/${subtaskId}`, {
         method: 'DELETE'
       });
       
@@ -0,0 +1,64 @@
+// Dynamic API base URL - uses current host for network access
+export const API_BASE = `http://${window.location.hostname}:8080`;
+
+const TOKEN_KEY = "authToken";
+
+export function getToken() {
+  return localStorage.getItem(TOKEN_KEY);
+}
+
+export function setToken(token) {
+  if (token) {
+    localStorage.setItem(TOKEN_KEY, token);
+  } else {
+    localStorage.removeItem(TOKEN_KEY);
+  }
+}
+
+// apiFetch is fetch for API paths with the bearer token of the signed-in
+// user. A 401 means the session is gone: the token is dropped and an
+// "authExpired" event sends the app back to the login screen.
+export async function apiFetch(path, options = {}) {
+  const headers = new Headers(options.headers || {});
+  const token = getToken();
+  if (token) {
+    headers.set("Authorization", `Bearer ${token}`);
+  }
+  const res = await fetch(`${API_BASE}${path}`, { ...options, headers });
+  if (res.status === 401 && token) {
+    setToken(null);
+    window.dispatchEvent(new CustomEvent("authExpired"));
+  }
+  return res;
+}
+
+// fileUrl is the URL of a download link, which the browser opens without
+// our headers, so the token goes in the query instead.
+export function fileUrl(path) {
+  const token = getToken();
+  if (!token) return `${API_BASE}${path}`;
+  const sep = path.includes("?") ? "&" : "?";
+  return `${API_BASE}${path}${sep}access_token=${encodeURIComponent(token)}`;
+}
+
+export async function login(name, password) {
+  const res = await fetch(`${API_BASE}/auth/login`, {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ name, password }),
+  });
+  const body = await res.json().catch(() => ({}));
+  if (!res.ok) {
+    throw new Error(body.error || `Login failed (${res.status})`);
+  }
+  setToken(body.token);
+  return body.user;
+}
+
+export async function logout() {
+  try {
+    await apiFetch("/auth/logout", { method: "POST" });
+  } finally {
+    setToken(null);
+  }
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultActivityLimit = 50
+	maxActivityLimit     = 200
+)
+
+// parseActivityQuery reads the filters of the activity endpoints:
+//
+//	task, actor            ids
+//	entity                 task, subtask or attachment
+//	action                 created, updated, trashed, restored or purged
+//	since, until           RFC 3339 or YYYY-MM-DD; until is exclusive
+//	limit, cursor          page size and the X-Next-Cursor of the last page
+func parseActivityQuery(c *gin.Context) (ActivityQuery, error) {
+	q := ActivityQuery{Limit: defaultActivityLimit}
+	var errs []error
+	id := func(name string) int64 {
+		v := c.Query(name)
+		if v == "" {
+			return 0
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			errs = append(errs, fmt.Errorf("%s: must be a positive number", name))
+		}
+		return n
+	}
+	date := func(name string) time.Time {
+		t, err := timeParam(c, name)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return t
+	}
+
+	q.TaskID = id("task")
+	q.ActorID = id("actor")
+	q.BeforeSeq = id("cursor")
+	q.Since = date("since")
+	q.Until = date("until")
+	switch entity := EntityKind(c.Query("entity")); entity {
+	case "", EntityTask, EntitySubtask, EntityAttachment:
+		q.Entity = entity
+	default:
+		errs = append(errs, errors.New("entity: must be task, subtask or attachment"))
+	}
+	switch action := c.Query("action"); action {
+	case "", ActivityCreated, ActivityUpdated, ActivityTrashed, ActivityRestored, ActivityPurged:
+		q.Action = action
+	default:
+		errs = append(errs, errors.New("action: must be created, updated, trashed, restored or purged"))
+	}
+	if limit := id("limit"); limit > 0 {
+		q.Limit = min(int(limit), maxActivityLimit)
+	}
+	return q, errors.Join(errs...)
+}
+
+// registerActivityRoutes adds the per-task history and the global feed.
+func (s *server) registerActivityRoutes(r gin.IRouter) {
+	list := func(c *gin.Context, q ActivityQuery) {
+		// Fetch one extra entry to learn whether there is a next page.
+		pageSize := q.Limit
+		q.Limit++
+		entries, err := s.store.ListActivity(c.Request.Context(), q)
+		if err != nil {
+			log.Println("ListActivity error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(entries) > pageSize {
+			entries = entries[:pageSize]
+			c.Header("X-Next-Cursor", strconv.FormatInt(entries[pageSize-1].Seq, 10))
+		}
+		c.JSON(http.StatusOK, entries)
+	}
+
+	// GET /tasks/:id/history
+	// Changes to the task and its subtasks and attachments, newest first.
+	r.GET("/tasks/:id/history", s.allowTask(ActionRead), func(c *gin.Context) {
+		taskID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid task ID"})
+			return
+		}
+		q, err := parseActivityQuery(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		q.TaskID = taskID
+		list(c, q)
+	})
+
+	// GET /activity
+	// The whole board's activity, newest first.
+	r.GET("/activity", s.allow(ActionActivityRead), func(c *gin.Context) {
+		q, err := parseActivityQuery(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		list(c, q)
+	})
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const minPasswordLength = 8
+
+var (
+	errInvalidCredentials = errors.New("invalid name or password")
+	errInvalidToken       = errors.New("invalid or expired token")
+	errUserDeactivated    = errors.New("this account has been deactivated")
+)
+
+// authenticator issues and checks bearer tokens. A token is
+// base64url(claims) + "." + base64url(HMAC-SHA256(claims)); the claims point
+// at a Session document so that logging out revokes the token server-side.
+type authenticator struct {
+	store  TaskStore
+	secret []byte
+	ttl    time.Duration
+	// dummyHash is compared against when the user does not exist so that a
+	// failed login takes the same time either way.
+	dummyHash []byte
+}
+
+func newAuthenticator(store TaskStore, cfg AuthConfig) (*authenticator, error) {
+	secret := []byte(cfg.TokenSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		log.Println("auth: no token secret configured, using a random one; tokens will not survive a restart")
+	}
+	dummy, err := bcrypt.GenerateFromPassword([]byte("not-a-real-password"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	return &authenticator{store: store, secret: secret, ttl: time.Duration(cfg.TokenTTL), dummyHash: dummy}, nil
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+type tokenClaims struct {
+	SessionID string `json:"sid"`
+	UserID    int64  `json:"uid"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func (a *authenticator) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func (a *authenticator) issueToken(claims tokenClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(a.sign(payload)), nil
+}
+
+func (a *authenticator) parseToken(token string) (tokenClaims, error) {
+	enc := base64.RawURLEncoding
+	payloadPart, sigPart, ok := strings.Cut(token, ".")
+	if !ok {
+		return tokenClaims{}, errInvalidToken
+	}
+	payload, err := enc.DecodeString(payloadPart)
+	if err != nil {
+		return tokenClaims{}, errInvalidToken
+	}
+	sig, err := enc.DecodeString(sigPart)
+	if err != nil || !hmac.Equal(sig, a.sign(payload)) {
+		return tokenClaims{}, errInvalidToken
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return tokenClaims{}, errInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return tokenClaims{}, errInvalidToken
+	}
+	return claims, nil
+}
+
+// login checks a name/password pair and opens a new session.
+func (a *authenticator) login(ctx context.Context, name, password string) (string, Session, User, error) {
+	user, err := a.store.FindUserByName(ctx, name)
+	if errors.Is(err, ErrNotFound) || (err == nil && user.PasswordHash == "") {
+		_ = bcrypt.CompareHashAndPassword(a.dummyHash, []byte(password))
+		return "", Session{}, User{}, errInvalidCredentials
+	}
+	if err != nil {
+		return "", Session{}, User{}, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return "", Session{}, User{}, errInvalidCredentials
+	}
+	if !user.active() {
+		return "", Session{}, User{}, errUserDeactivated
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", Session{}, User{}, err
+	}
+	now := time.Now().UTC()
+	sess := Session{
+		ID:        hex.EncodeToString(id),
+		UserID:    user.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(a.ttl),
+	}
+	if err := a.store.CreateSession(ctx, sess); err != nil {
+		return "", Session{}, User{}, err
+	}
+	token, err := a.issueToken(tokenClaims{SessionID: sess.ID, UserID: user.ID, ExpiresAt: sess.ExpiresAt.Unix()})
+	return token, sess, user, err
+}
+
+// authenticate resolves a bearer token to its live session and user.
+func (a *authenticator) authenticate(ctx context.Context, token string) (Session, User, error) {
+	claims, err := a.parseToken(token)
+	if err != nil {
+		return Session{}, User{}, err
+	}
+	sess, err := a.store.GetSession(ctx, claims.SessionID)
+	if errors.Is(err, ErrNotFound) || (err == nil && sess.UserID != claims.UserID) {
+		return Session{}, User{}, errInvalidToken
+	}
+	if err != nil {
+		return Session{}, User{}, err
+	}
+	user, err := a.store.GetUser(ctx, sess.UserID)
+	if errors.Is(err, ErrNotFound) || (err == nil && !user.active()) {
+		return Session{}, User{}, errInvalidToken
+	}
+	return sess, user, err
+}
+
+// bootstrap makes sure the configured first user exists, is an admin and has
+// a password.
+func (a *authenticator) bootstrap(ctx context.Context, name, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	user, err := a.store.FindUserByName(ctx, name)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		user = User{Name: name, Role: RoleAdmin, PasswordHash: hash}
+		if err := a.store.CreateUser(ctx, &user); err != nil {
+			return err
+		}
+		log.Printf("auth: created bootstrap user %q (id %d)", name, user.ID)
+	case err != nil:
+		return err
+	case user.PasswordHash == "":
+		if err := a.store.SetUserPassword(ctx, user.ID, hash); err != nil {
+			return err
+		}
+		log.Printf("auth: set password for bootstrap user %q (id %d)", name, user.ID)
+	}
+	if user.Role != RoleAdmin {
+		if _, err := a.store.UpdateUser(ctx, user.ID, map[string]any{"role": RoleAdmin}); err != nil {
+			return err
+		}
+		log.Printf("auth: made bootstrap user %q an admin", name)
+	}
+	return nil
+}
+
+type authContextKey struct{}
+
+type authInfo struct {
+	session Session
+	user    User
+}
+
+// userFromContext returns the authenticated user of the request that ctx
+// belongs to.
+func userFromContext(ctx context.Context) (User, bool) {
+	info, ok := ctx.Value(authContextKey{}).(authInfo)
+	return info.user, ok
+}
+
+func currentUser(c *gin.Context) User {
+	u, _ := userFromContext(c.Request.Context())
+	return u
+}
+
+func currentSession(c *gin.Context) Session {
+	info, _ := c.Request.Context().Value(authContextKey{}).(authInfo)
+	return info.session
+}
+
+// bearerToken extracts the token from the Authorization header. Download
+// links are opened by the browser directly (img/video src, <a href>), which
+// cannot set headers, so those GETs may pass ?access_token= instead.
+func bearerToken(c *gin.Context) string {
+	if h := c.GetHeader("Authorization"); h != "" {
+		scheme, token, ok := strings.Cut(h, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	// Browsers cannot set headers on downloads and EventSource streams.
+	if c.Request.Method == http.MethodGet && (strings.HasSuffix(c.FullPath(), "/download") || c.FullPath() == "/events") {
+		return c.Query("access_token")
+	}
+	return ""
+}
+
+// middleware rejects requests without a valid bearer token. On success the
+// user and session are stored on the request context.
+func (a *authenticator) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c)
+		if token == "" {
+			c.Header("WWW-Authenticate", `Bearer realm="task-backend"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			return
+		}
+		sess, user, err := a.authenticate(c.Request.Context(), token)
+		if errors.Is(err, errInvalidToken) {
+			c.Header("WWW-Authenticate", `Bearer realm="task-backend", error="invalid_token"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Println("auth: authenticate error:", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "authentication failed"})
+			return
+		}
+		ctx := context.WithValue(c.Request.Context(), authContextKey{}, authInfo{session: sess, user: user})
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// registerAuthRoutes adds POST /auth/login to the public router and the
+// session endpoints to the authenticated one.
+func (s *server) registerAuthRoutes(public, authed gin.IRouter) {
+	auth := s.auth
+
+	// POST /auth/login
+	public.POST("/auth/login", func(c *gin.Context) {
+		var body struct {
+			Name     string `json:"name"`
+			Password string `json:"password"`
+		}
+		if err := c.BindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		token, sess, user, err := auth.login(c.Request.Context(), body.Name, body.Password)
+		if errors.Is(err, errInvalidCredentials) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, errUserDeactivated) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Println("/auth/login error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "login failed"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"token":      token,
+			"token_type": "Bearer",
+			"expires_at": sess.ExpiresAt,
+			"user":       user,
+		})
+	})
+
+	// POST /auth/logout
+	authed.POST("/auth/logout", func(c *gin.Context) {
+		if err := s.store.DeleteSession(c.Request.Context(), currentSession(c).ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "logged out"})
+	})
+
+	// GET /me
+	authed.GET("/me", func(c *gin.Context) {
+		c.JSON(http.StatusOK, currentUser(c))
+	})
+
+	// PUT /me/password
+	// Changing the password signs out every other session of the user.
+	authed.PUT("/me/password", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		var body struct {
+			CurrentPassword string `json:"current_password"`
+			NewPassword     string `json:"new_password"`
+		}
+		if err := c.BindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		user := currentUser(c)
+		if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(body.CurrentPassword)) != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "current password is incorrect"})
+			return
+		}
+		hash, err := hashPassword(body.NewPassword)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := s.store.SetUserPassword(ctx, user.ID, hash); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := s.store.DeleteUserSessions(ctx, user.ID, currentSession(c).ID); err != nil {
+			log.Println("DeleteUserSessions error:", err)
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "password changed"})
+	})
+}
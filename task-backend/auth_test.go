@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokens(t *testing.T) {
+	a, err := newAuthenticator(newMemoryStore(), AuthConfig{TokenSecret: "test-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour).Unix()
+	token, err := a.issueToken(tokenClaims{SessionID: "s1", UserID: 3, ExpiresAt: later})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, err := a.parseToken(token); err != nil || claims.SessionID != "s1" || claims.UserID != 3 {
+		t.Errorf("parseToken = %+v, %v", claims, err)
+	}
+
+	expired, _ := a.issueToken(tokenClaims{SessionID: "s1", UserID: 3, ExpiresAt: time.Now().Unix()})
+	other, _ := newAuthenticator(newMemoryStore(), AuthConfig{TokenSecret: "other-secret"})
+	foreign, _ := other.issueToken(tokenClaims{SessionID: "s1", UserID: 3, ExpiresAt: later})
+	payload, sig, _ := strings.Cut(token, ".")
+	forged, _ := a.issueToken(tokenClaims{SessionID: "s1", UserID: 1, ExpiresAt: later})
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+	for name, tok := range map[string]string{
+		"expired":          expired,
+		"another secret":   foreign,
+		"changed payload":  forgedPayload + "." + sig,
+		"no signature":     payload,
+		"not base64":       payload + ".!!",
+		"empty":            "",
+		"signature only":   "." + sig,
+		"truncated digest": payload + "." + sig[:10],
+	} {
+		if _, err := a.parseToken(tok); !errors.Is(err, errInvalidToken) {
+			t.Errorf("%s: parseToken = %v, want errInvalidToken", name, err)
+		}
+	}
+}
+
+func TestLoginAndSessions(t *testing.T) {
+	ts := newTestServer(t)
+	ada, token := ts.addUser("ada", RoleMember)
+
+	for _, tt := range []struct {
+		name, password string
+		want           int
+	}{
+		{"ada", "wrong password", http.StatusUnauthorized},
+		{"nobody", testPassword, http.StatusUnauthorized},
+		{"ada", testPassword, http.StatusOK},
+	} {
+		w := ts.do("POST", "/auth/login", "", map[string]any{"name": tt.name, "password": tt.password})
+		if w.Code != tt.want {
+			t.Errorf("login as %q with %q = %d, want %d", tt.name, tt.password, w.Code, tt.want)
+		}
+	}
+
+	var me User
+	decode(t, ts.do("GET", "/me", token, nil), &me)
+	if me.ID != ada.ID {
+		t.Errorf("GET /me = %+v", me)
+	}
+
+	// Another session survives logging out of this one.
+	other, _, _, err := ts.auth.login(context.Background(), "ada", testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := ts.do("POST", "/auth/logout", token, nil); w.Code != http.StatusOK {
+		t.Fatalf("logout: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do("GET", "/me", token, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /me after logout = %d, want 401", w.Code)
+	}
+	if w := ts.do("GET", "/me", other, nil); w.Code != http.StatusOK {
+		t.Errorf("GET /me with another session = %d, want 200", w.Code)
+	}
+
+	// A password change keeps the session it was made in and ends the rest.
+	third, _, _, err := ts.auth.login(context.Background(), "ada", testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := ts.do("PUT", "/me/password", other, map[string]any{"current_password": testPassword, "new_password": "longer-secret"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT /me/password: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do("GET", "/me", other, nil); w.Code != http.StatusOK {
+		t.Errorf("GET /me in the changing session = %d, want 200", w.Code)
+	}
+	if w := ts.do("GET", "/me", third, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /me in another session = %d, want 401", w.Code)
+	}
+	if w := ts.do("POST", "/auth/login", "", map[string]any{"name": "ada", "password": testPassword}); w.Code != http.StatusUnauthorized {
+		t.Errorf("login with the old password = %d, want 401", w.Code)
+	}
+}
+
+func TestAccessTokenQuery(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.addUser("ada", RoleMember)
+	task := ts.createTask(token, map[string]any{"title": "Plans"})
+	w := ts.do("POST", taskPath(task.ID, "attachments"), token, map[string]any{"type": "link", "name": "Doc", "url": "https://example.com"})
+	var att Attachment
+	decode(t, w, &att)
+
+	// Only downloads take the token from the query.
+	if w := ts.do("GET", "/tasks?access_token="+token, "", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /tasks with ?access_token = %d, want 401", w.Code)
+	}
+	download := taskPath(task.ID, "attachments", strconv.FormatInt(att.ID, 10), "download")
+	if w := ts.do("GET", download+"?access_token="+token, "", nil); w.Code == http.StatusUnauthorized {
+		t.Errorf("GET download with ?access_token = %d", w.Code)
+	}
+}
+
+// The frontend sends its token in the Authorization header, which a CORS
+// preflight must allow by name.
+func TestCORSAllowsAuthorization(t *testing.T) {
+	ts := newTestServer(t)
+	req := httptest.NewRequest("OPTIONS", "/tasks", nil)
+	req.Header.Set("Origin", "http://localhost:5173")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	req.Header.Set("Access-Control-Request-Headers", "authorization")
+	w := httptest.NewRecorder()
+	ts.handler.ServeHTTP(w, req)
+	if got := w.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(strings.ToLower(got), "authorization") {
+		t.Errorf("Access-Control-Allow-Headers = %q", got)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// BlobStore keeps the bytes of file attachments; attachments record the key
+// Put returns in their url. Which one is used is set by storage.backend.
+// Keys are only meaningful to the backend that made them: switching
+// backends does not move files that are already stored.
+type BlobStore interface {
+	// Put stores the size bytes of r as a new blob named like name and
+	// returns its key. r is rewound to retry. progress, if not nil, is told
+	// how many bytes have been sent.
+	Put(ctx context.Context, name string, r io.ReadSeeker, size int64, progress func(n int64)) (string, error)
+	// Get reads a blob from offset on; ErrNotFound if there is none.
+	Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error)
+	// Stat returns the size and modification time of a blob; ErrNotFound if
+	// there is none.
+	Stat(ctx context.Context, key string) (BlobInfo, error)
+	// Delete removes a blob. A blob that is already gone counts as deleted.
+	Delete(ctx context.Context, key string) error
+}
+
+// BlobInfo describes a stored blob. Size is -1 and ModTime is zero when the
+// backend cannot tell them cheaply.
+type BlobInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// newBlobStore returns the configured attachment storage.
+func newBlobStore(cfg Config) (BlobStore, error) {
+	switch cfg.Storage.Backend {
+	case "fileserver":
+		return newFileServer(cfg.FileServer), nil
+	case "local":
+		return newLocalBlobs(cfg.Storage.Local.Dir)
+	case "s3":
+		return newS3Blobs(cfg.Storage.S3), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", cfg.Storage.Backend)
+}
+
+// newBlobKey makes a key for a new blob: a month folder, so that no
+// directory grows too big, and a random prefix to the cleaned-up name.
+func newBlobKey(name string) string {
+	var b [8]byte
+	rand.Read(b[:])
+	clean := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+	clean = strings.TrimLeft(clean, ".")
+	if len(clean) > 100 {
+		clean = clean[len(clean)-100:]
+	}
+	if clean == "" {
+		clean = "file"
+	}
+	return time.Now().UTC().Format("2006/01") + "/" + hex.EncodeToString(b[:]) + "-" + clean
+}
+
+// putShared stores a file by content: when one with the same SHA-256 is
+// stored already it takes a reference to that one, otherwise it stores r
+// and records it. It returns the key; the caller releases the reference if
+// no attachment ends up using it.
+func putShared(ctx context.Context, store TaskStore, blobs BlobStore, name string, r io.ReadSeeker, size int64, sum string, progress func(n int64)) (string, error) {
+	ref, err := store.AcquireBlob(ctx, sum)
+	if err == nil {
+		if progress != nil {
+			progress(size)
+		}
+		return ref.Key, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return "", err
+	}
+	key, err := blobs.Put(ctx, name, r, size, progress)
+	if err != nil {
+		return "", err
+	}
+	ref, err = store.AddBlob(ctx, BlobRef{SHA256: sum, Key: key, Size: size, CreatedAt: time.Now().UTC()})
+	if err != nil {
+		return "", err
+	}
+	if ref.Key != key {
+		// The same file was stored at the same time; ours is not needed.
+		if err := store.EnqueueFileDeletions(ctx, key); err != nil {
+			log.Println("duplicate file deletion error:", err)
+		}
+	}
+	return ref.Key, nil
+}
+
+// errBlobCorrupt is returned by a verifying blobReader in place of the last
+// bytes of a blob that does not match its hash.
+var errBlobCorrupt = errors.New("stored file does not match its SHA-256")
+
+// blobReader reads a blob of known size as an io.ReadSeeker, for
+// http.ServeContent. Reads continue the open download when they can, skip
+// a little ahead in it, and otherwise open a new one at the offset.
+type blobReader struct {
+	ctx    context.Context
+	blobs  BlobStore
+	key    string
+	size   int64
+	offset int64 // of the next Read
+	body   io.ReadCloser
+	pos    int64 // of body
+
+	// With verify, reads that go through the blob in order from the start
+	// are hashed; hashed is how far.
+	sum     string
+	hash    hash.Hash
+	hashed  int64
+	corrupt bool
+}
+
+// blobSkipLimit is how far ahead a read skips in the open download rather
+// than opening a new one.
+const blobSkipLimit = 1 << 20
+
+func newBlobReader(ctx context.Context, blobs BlobStore, key string, size int64) *blobReader {
+	return &blobReader{ctx: ctx, blobs: blobs, key: key, size: size}
+}
+
+// verify checks a read of the whole blob against its hex SHA-256: the read
+// fails with errBlobCorrupt instead of returning the last bytes, and
+// corrupt is set. Partial reads cannot be checked.
+func (f *blobReader) verify(sum string) {
+	f.sum, f.hash = sum, sha256.New()
+}
+
+func (f *blobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, errors.New("blobReader.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("blobReader.Seek: negative position")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *blobReader) Read(p []byte) (int, error) {
+	if f.corrupt {
+		return 0, errBlobCorrupt
+	}
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+	if err := f.start(); err != nil {
+		return 0, err
+	}
+	if f.pos < f.offset {
+		n, err := io.CopyN(io.Discard, f.body, f.offset-f.pos)
+		f.pos += n
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+	}
+	if rest := f.size - f.offset; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := f.body.Read(p)
+	if f.hash != nil {
+		if f.hashed != f.offset {
+			f.hash = nil
+		} else {
+			f.hash.Write(p[:n])
+			f.hashed += int64(n)
+			if f.hashed == f.size && hex.EncodeToString(f.hash.Sum(nil)) != f.sum {
+				f.corrupt = true
+				return 0, errBlobCorrupt
+			}
+		}
+	}
+	f.pos += int64(n)
+	f.offset += int64(n)
+	if err == io.EOF && f.offset < f.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// start opens a download at the current offset, unless the open one can
+// reach it.
+func (f *blobReader) start() error {
+	if f.body != nil && (f.pos > f.offset || f.offset-f.pos > blobSkipLimit) {
+		f.body.Close()
+		f.body = nil
+	}
+	if f.body != nil {
+		return nil
+	}
+	body, err := f.blobs.Get(f.ctx, f.key, f.offset)
+	if err != nil {
+		return err
+	}
+	f.body, f.pos = body, f.offset
+	return nil
+}
+
+func (f *blobReader) Close() error {
+	if f.body == nil {
+		return nil
+	}
+	return f.body.Close()
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// s3UnsignedPayload lets uploads stream in one pass instead of being
+	// read once to hash them.
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3EmptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// s3Blobs is a BlobStore in a bucket of Amazon S3 or an S3-compatible
+// store such as MinIO. Requests are signed with AWS Signature Version 4.
+type s3Blobs struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	client    *http.Client
+}
+
+func newS3Blobs(cfg S3Config) *s3Blobs {
+	endpoint, _ := url.Parse(strings.TrimRight(cfg.Endpoint, "/")) // checked by Config.validate
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = time.Duration(cfg.Timeout)
+	return &s3Blobs{endpoint: endpoint, region: cfg.Region, bucket: cfg.Bucket, accessKey: cfg.AccessKey,
+		secretKey: cfg.SecretKey, pathStyle: cfg.PathStyle, client: &http.Client{Transport: transport}}
+}
+
+// objectURL addresses a key as endpoint/bucket/key with path-style
+// addressing, or as bucket.endpoint/key.
+func (s *s3Blobs) objectURL(key string) string {
+	host, path := s.endpoint.Host, s.endpoint.EscapedPath()
+	if s.pathStyle {
+		path += "/" + s3Escape(s.bucket)
+	} else {
+		host = s.bucket + "." + host
+	}
+	return s.endpoint.Scheme + "://" + host + path + "/" + s3Escape(key)
+}
+
+// s3Escape encodes a key as SigV4 expects: everything but unreserved
+// characters and slashes.
+func s3Escape(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (s *s3Blobs) request(ctx context.Context, method, key string, body io.Reader, payload string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key), body)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, payload, time.Now())
+	return req, nil
+}
+
+// sign adds a Signature Version 4 Authorization header to req. Only the
+// host and the x-amz-* headers are signed.
+func (s *s3Blobs) sign(req *http.Request, payload string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payload + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payload,
+	}, "\n")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{day, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Error describes a failed response, S3's XML error included.
+func s3Error(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("object store returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+func (s *s3Blobs) Put(ctx context.Context, name string, r io.ReadSeeker, size int64, progress func(n int64)) (string, error) {
+	key := newBlobKey(name)
+	var lastErr error
+	for attempt := 1; attempt <= 2; attempt++ {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		// S3 wants a Content-Length; a body of unknown length would go
+		// chunked. An empty one must be NoBody for the length to be sent.
+		var body io.Reader = http.NoBody
+		if size > 0 {
+			body = io.NopCloser(&countingReader{r: r, report: progress})
+		}
+		req, err := s.request(ctx, "PUT", key, body, s3UnsignedPayload)
+		if err != nil {
+			return "", err
+		}
+		req.ContentLength = size
+		resp, err := s.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			lastErr = fmt.Errorf("could not reach object store: %w", err)
+			log.Printf("s3 put attempt %d network error: %v", attempt, lastErr)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = s3Error(resp)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		return key, nil
+	}
+	return "", lastErr
+}
+
+func (s *s3Blobs) Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	req, err := s.request(ctx, "GET", key, nil, s3EmptyPayload)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach object store: %w", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// offset is at the end.
+		resp.Body.Close()
+		return io.NopCloser(strings.NewReader("")), nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	defer resp.Body.Close()
+	return nil, s3Error(resp)
+}
+
+func (s *s3Blobs) Stat(ctx context.Context, key string) (BlobInfo, error) {
+	req, err := s.request(ctx, "HEAD", key, nil, s3EmptyPayload)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return BlobInfo{}, fmt.Errorf("could not reach object store: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return BlobInfo{}, ErrNotFound
+	default:
+		return BlobInfo{}, fmt.Errorf("object store returned %d", resp.StatusCode)
+	}
+	info := BlobInfo{Size: resp.ContentLength}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t.UTC()
+	}
+	return info, nil
+}
+
+func (s *s3Blobs) Delete(ctx context.Context, key string) error {
+	req, err := s.request(ctx, "DELETE", key, nil, s3EmptyPayload)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not reach object store: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode/100 == 2 {
+		return nil
+	}
+	return s3Error(resp)
+}
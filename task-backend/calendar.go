@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // time zones must load on hosts without a zoneinfo database
+)
+
+// WorkCalendar is a time zone and working calendar as users and the
+// workspace configure them. Empty fields of a user's calendar fall back to
+// the workspace's.
+type WorkCalendar struct {
+	// TimeZone is an IANA name such as "Africa/Lagos", or "Local" for the
+	// server's zone.
+	TimeZone string `bson:"time_zone,omitempty" json:"time_zone,omitempty" yaml:"time_zone" toml:"time_zone"`
+	// WorkingDays lists the working weekdays as mon, tue, ... sun.
+	WorkingDays []string `bson:"working_days,omitempty" json:"working_days,omitempty" yaml:"working_days" toml:"working_days"`
+	// Holidays lists days off as YYYY-MM-DD dates.
+	Holidays []string `bson:"holidays,omitempty" json:"holidays,omitempty" yaml:"holidays" toml:"holidays"`
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func parseWeekday(name string) (time.Weekday, error) {
+	for i, n := range weekdayNames {
+		if strings.EqualFold(strings.TrimSpace(name), n) {
+			return time.Weekday(i), nil
+		}
+	}
+	return 0, fmt.Errorf("%q is not a weekday (want mon, tue, wed, thu, fri, sat or sun)", name)
+}
+
+// validate checks the fields that are set, collecting every problem.
+func (wc WorkCalendar) validate() error {
+	var errs []error
+	if wc.TimeZone != "" {
+		if _, err := time.LoadLocation(wc.TimeZone); err != nil {
+			errs = append(errs, fmt.Errorf("time_zone: unknown time zone %q", wc.TimeZone))
+		}
+	}
+	for _, d := range wc.WorkingDays {
+		if _, err := parseWeekday(d); err != nil {
+			errs = append(errs, fmt.Errorf("working_days: %w", err))
+		}
+	}
+	for _, h := range wc.Holidays {
+		if _, err := time.Parse(time.DateOnly, h); err != nil {
+			errs = append(errs, fmt.Errorf("holidays: %q is not a YYYY-MM-DD date", h))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Calendar is a WorkCalendar resolved for schedule evaluation. A nil
+// *Calendar is UTC with every day a working day.
+type Calendar struct {
+	loc      *time.Location
+	working  [7]bool
+	holidays map[string]bool
+	// rollForward moves due dates that land on a day off to the next
+	// working day.
+	rollForward bool
+}
+
+// resolve turns wc into a Calendar, taking what wc leaves empty from base,
+// or the defaults (the server's zone, every day working) if base is nil.
+func (wc WorkCalendar) resolve(base *Calendar) (*Calendar, error) {
+	if err := wc.validate(); err != nil {
+		return nil, err
+	}
+	cal := &Calendar{loc: time.Local, working: [7]bool{true, true, true, true, true, true, true}}
+	if base != nil {
+		*cal = *base
+	}
+	if wc.TimeZone != "" {
+		cal.loc, _ = time.LoadLocation(wc.TimeZone)
+	}
+	if len(wc.WorkingDays) > 0 {
+		cal.working = [7]bool{}
+		for _, d := range wc.WorkingDays {
+			day, _ := parseWeekday(d)
+			cal.working[day] = true
+		}
+	}
+	if len(wc.Holidays) > 0 {
+		cal.holidays = map[string]bool{}
+		for _, h := range wc.Holidays {
+			cal.holidays[h] = true
+		}
+	}
+	return cal, nil
+}
+
+func (c *Calendar) location() *time.Location {
+	if c == nil {
+		return time.UTC
+	}
+	return c.loc
+}
+
+// dayOff reports whether the calendar day of t is not a working day.
+func (c *Calendar) dayOff(t time.Time) bool {
+	if c == nil {
+		return false
+	}
+	t = t.In(c.loc)
+	return !c.working[t.Weekday()] || c.holidays[t.Format(time.DateOnly)]
+}
+
+// nextWorkingDay returns t, or the same time of day on the first working
+// day after it. A calendar without working days leaves t as it is.
+func (c *Calendar) nextWorkingDay(t time.Time) time.Time {
+	next := t
+	for i := 0; i < 366 && c.dayOff(next); i++ {
+		next = next.In(c.loc).AddDate(0, 0, 1)
+	}
+	if c.dayOff(next) {
+		return t
+	}
+	return next
+}
+
+// calendars resolves the calendar that applies to an item: its main
+// assignee's, or the workspace's for unassigned items.
+type calendars struct {
+	workspace *Calendar
+	users     map[int64]*Calendar
+}
+
+func loadCalendars(ctx context.Context, store TaskStore, workspace *Calendar) (*calendars, error) {
+	users, err := store.ListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cs := &calendars{workspace: workspace, users: map[int64]*Calendar{}}
+	for _, u := range users {
+		cal, err := u.WorkCalendar.resolve(workspace)
+		if err != nil {
+			// Stored calendars are validated on the way in; fall back
+			// rather than fail every evaluation.
+			cal = workspace
+		}
+		cs.users[u.ID] = cal
+	}
+	return cs, nil
+}
+
+func (cs *calendars) forAssignee(assignee *int) *Calendar {
+	if assignee != nil {
+		if cal, ok := cs.users[int64(*assignee)]; ok {
+			return cal
+		}
+	}
+	return cs.workspace
+}
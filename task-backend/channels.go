@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Channel sends notifications somewhere outside the API. Send errors are
+// retried by the delivery worker.
+type Channel interface {
+	// reaches reports whether user can be sent anything through the
+	// channel, e.g. has an email address.
+	reaches(user User) bool
+	send(ctx context.Context, user User, n Notification) error
+}
+
+// emailChannel sends notifications as plain-text mail through an SMTP relay.
+// The connection is upgraded with STARTTLS when the server offers it.
+type emailChannel struct {
+	cfg     SMTPConfig
+	timeout time.Duration
+	cal     *Calendar
+}
+
+func (ch *emailChannel) reaches(user User) bool { return user.Email != "" }
+
+func (ch *emailChannel) send(ctx context.Context, user User, n Notification) error {
+	ctx, cancel := context.WithTimeout(ctx, ch.timeout)
+	defer cancel()
+	host, _, _ := net.SplitHostPort(ch.cfg.Addr)
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", ch.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if ch.cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", ch.cfg.Username, ch.cfg.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(ch.cfg.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(user.Email); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(ch.message(user, n)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// message renders n as an RFC 5322 message to user.
+func (ch *emailChannel) message(user User, n Notification) []byte {
+	cal, err := user.WorkCalendar.resolve(ch.cal)
+	if err != nil {
+		cal = ch.cal
+	}
+	var body strings.Builder
+	body.WriteString(n.Text + "\r\n")
+	if n.Deadline != nil {
+		fmt.Fprintf(&body, "\r\nDeadline: %s\r\n", n.Deadline.In(cal.location()).Format("Mon 2 Jan 2006 15:04 MST"))
+	}
+	fmt.Fprintf(&body, "\r\nTask #%d\r\n", n.TaskID)
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", ch.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", user.Email)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", n.Text))
+	fmt.Fprintf(&msg, "Date: %s\r\n", n.CreatedAt.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <notification-%d@%s>\r\n", n.ID, mailDomain(ch.cfg.From))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(body.String())
+	return msg.Bytes()
+}
+
+func mailDomain(addr string) string {
+	if _, domain, ok := strings.Cut(strings.Trim(addr, "<> "), "@"); ok {
+		return strings.TrimRight(domain, ">")
+	}
+	return "localhost"
+}
+
+// webhookChannel POSTs notifications as JSON to the URL in the user's
+// preferences.
+type webhookChannel struct {
+	client *http.Client
+}
+
+// newWebhookClient returns the client for webhookChannel. Any user can set
+// the URL, so unless allowPrivate is set it only connects to public
+// addresses. The check is on the address dialed, after name resolution and
+// for every redirect, and no proxy is used that could dial for it.
+func newWebhookClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = dialPublic
+	}
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// dialPublic is a net.Dialer Control function that refuses addresses
+// publicIP rejects.
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("refusing to connect to %s: not a public address", host)
+	}
+	return nil
+}
+
+// publicIP reports whether ip is a unicast address outside the loopback,
+// private, shared (carrier-grade NAT) and link-local ranges.
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsMulticast() && !ip.IsUnspecified() && !sharedAddressSpace.Contains(ip)
+}
+
+// sharedAddressSpace is 100.64.0.0/10 (RFC 6598), which cloud providers use
+// for internal services.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// webhookPayload is the body of a notification webhook.
+type webhookPayload struct {
+	Event        NotificationEvent `json:"event"`
+	Notification Notification      `json:"notification"`
+	User         webhookUser       `json:"user"`
+}
+
+type webhookUser struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+func (ch *webhookChannel) reaches(user User) bool { return user.NotificationPrefs.WebhookURL != "" }
+
+func (ch *webhookChannel) send(ctx context.Context, user User, n Notification) error {
+	body, err := json.Marshal(webhookPayload{Event: n.Event, Notification: n, User: webhookUser{ID: user.ID, Name: user.Name}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, user.NotificationPrefs.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "task-backend")
+	resp, err := ch.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %d: %s", resp.StatusCode, strings.TrimSpace(string(respBytes)))
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP accepts one SMTP session without STARTTLS or AUTH and returns
+// the relay address and the envelope and message it receives.
+func fakeSMTP(t *testing.T) (string, <-chan []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	got := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		var lines []string
+		reply("220 fake ESMTP")
+		for {
+			cmd, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd = strings.TrimRight(cmd, "\r\n")
+			switch verb := strings.ToUpper(strings.Fields(cmd + " x")[0]); verb {
+			case "EHLO", "HELO":
+				reply("250 fake")
+			case "MAIL", "RCPT":
+				lines = append(lines, cmd)
+				reply("250 ok")
+			case "DATA":
+				reply("354 go ahead")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					lines = append(lines, strings.TrimRight(line, "\r\n"))
+				}
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				got <- lines
+				return
+			default:
+				reply("502 not implemented")
+			}
+		}
+	}()
+	return ln.Addr().String(), got
+}
+
+func TestEmailChannelSend(t *testing.T) {
+	addr, got := fakeSMTP(t)
+	cal, err := defaultConfig().Workspace.calendar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := &emailChannel{cfg: SMTPConfig{Addr: addr, From: "tasks@example.com"}, timeout: 5 * time.Second, cal: cal}
+	user := User{ID: 2, Name: "ada", Email: "ada@example.com", WorkCalendar: WorkCalendar{TimeZone: "Africa/Lagos"}}
+	deadline := time.Date(2026, 3, 2, 16, 0, 0, 0, time.UTC)
+	n := Notification{ID: 9, TaskID: 3, Event: EventDueSoon, Text: `Task "Pump" is due soon`,
+		Deadline: &deadline, CreatedAt: deadline.Add(-2 * time.Hour)}
+	if err := ch.send(context.Background(), user, n); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	select {
+	case lines = <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the relay got no message")
+	}
+	msg := strings.Join(lines, "\n")
+	for _, want := range []string{
+		"MAIL FROM:<tasks@example.com>",
+		"RCPT TO:<ada@example.com>",
+		"To: ada@example.com",
+		`Subject: Task "Pump" is due soon`,
+		"Message-ID: <notification-9@example.com>",
+		"Content-Type: text/plain; charset=utf-8",
+		// In the user's time zone, an hour ahead of UTC.
+		"Deadline: Mon 2 Mar 2026 17:00 WAT",
+		"Task #3",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message lacks %q:\n%s", want, msg)
+		}
+	}
+}
+
+func TestEmailMessageEncodesSubject(t *testing.T) {
+	ch := &emailChannel{cfg: SMTPConfig{From: "Tasks <tasks@example.com>"}, cal: &Calendar{}}
+	msg := string(ch.message(User{Email: "zoe@example.com"}, Notification{Text: "Zoë mentioned you"}))
+	if !strings.Contains(msg, "Subject: =?utf-8?q?Zo=C3=AB_mentioned_you?=\r\n") {
+		t.Errorf("subject not Q-encoded:\n%s", msg)
+	}
+	if !strings.Contains(msg, "@example.com>\r\n") || strings.Contains(msg, "\nDeadline:") {
+		t.Errorf("unexpected message:\n%s", msg)
+	}
+}
+
+func TestWebhookChannelSend(t *testing.T) {
+	var payload webhookPayload
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s with Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte("nope"))
+	}))
+	defer srv.Close()
+
+	user := User{ID: 4, Name: "ada", NotificationPrefs: NotificationPrefs{WebhookURL: srv.URL + "/hook"}}
+	n := Notification{ID: 1, Event: EventAssigned, TaskID: 3, Text: "You were assigned"}
+	ch := &webhookChannel{client: newWebhookClient(5*time.Second, true)}
+	if err := ch.send(context.Background(), user, n); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != EventAssigned || payload.User.ID != 4 || payload.User.Name != "ada" || payload.Notification.Text != n.Text {
+		t.Errorf("payload = %+v", payload)
+	}
+
+	status = http.StatusBadGateway
+	if err := ch.send(context.Background(), user, n); err == nil || !strings.Contains(err.Error(), "502: nope") {
+		t.Errorf("send to a failing hook = %v", err)
+	}
+
+	// The test server is on loopback, which users' hooks may not reach by
+	// default.
+	guarded := &webhookChannel{client: newWebhookClient(5*time.Second, false)}
+	if err := guarded.send(context.Background(), user, n); err == nil || !strings.Contains(err.Error(), "not a public address") {
+		t.Errorf("send to loopback = %v, want it refused", err)
+	}
+}
+
+func TestPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.100.100.200", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::ffff:127.0.0.1", false},
+		{"224.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := publicIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("publicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+// Command sweep-orphans removes subtasks and attachments whose task no longer
+// exists, left behind by task deletions before they cascaded. Stored files of
+// the removed attachments are queued in file_deletions, where a running
+// task-backend picks them up and deletes them from attachment storage; files
+// shared with other attachments (see blob_refs) lose a reference instead,
+// and are queued when their last one goes.
+//
+// It is safe to run while the server is up: tasks created during the run
+// keep their children, and a run that stopped part-way can be repeated.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func main() {
+	var mongoURI string
+	var dbName string
+	var dryRun bool
+	flag.StringVar(&mongoURI, "mongo", "", "MongoDB URI (or set MONGO_URI)")
+	flag.StringVar(&dbName, "db", "", "MongoDB database (or set MONGO_DATABASE)")
+	flag.BoolVar(&dryRun, "dry-run", false, "If set, do not write to MongoDB; just print what would be done")
+	flag.Parse()
+
+	if mongoURI == "" {
+		mongoURI = os.Getenv("MONGO_URI")
+	}
+	if mongoURI == "" {
+		mongoURI = "mongodb://localhost:27017"
+	}
+	if dbName == "" {
+		dbName = os.Getenv("MONGO_DATABASE")
+	}
+	if dbName == "" {
+		dbName = "task_manager_db"
+	}
+
+	log.Println("MONGO_DATABASE:", dbName)
+	if dryRun {
+		log.Println("DRY RUN: no writes will be performed to MongoDB")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURI))
+	if err != nil {
+		log.Fatalf("failed to connect mongo: %v", err)
+	}
+	defer func() { _ = client.Disconnect(context.Background()) }()
+	db := client.Database(dbName)
+
+	// The server may create tasks while this runs. Only tasks up to the
+	// highest id seen can be orphaned at all, and each task is looked up
+	// again right before its children go, for tasks whose id was drawn
+	// before the snapshot but stored after it.
+	rawIDs, err := db.Collection("tasks").Distinct(ctx, "id", bson.M{})
+	if err != nil {
+		log.Fatalf("failed to read task ids: %v", err)
+	}
+	var maxID int64
+	for _, raw := range rawIDs {
+		if id, ok := asID(raw); ok && id > maxID {
+			maxID = id
+		}
+	}
+	log.Printf("found %d tasks (highest id %d)", len(rawIDs), maxID)
+	orphaned := bson.M{"task_id": bson.M{"$nin": rawIDs, "$lte": maxID}}
+	var orphanTaskIDs []int64
+	for _, name := range []string{"attachments", "subtasks"} {
+		raw, err := db.Collection(name).Distinct(ctx, "task_id", orphaned)
+		if err != nil {
+			log.Fatalf("failed to read orphaned %s: %v", name, err)
+		}
+		for _, r := range raw {
+			if id, ok := asID(r); ok && !slices.Contains(orphanTaskIDs, id) {
+				orphanTaskIDs = append(orphanTaskIDs, id)
+			}
+		}
+	}
+
+	sw := &sweeper{client: client, db: db, dryRun: dryRun}
+	for _, taskID := range orphanTaskIDs {
+		n, err := db.Collection("tasks").CountDocuments(ctx, bson.M{"id": taskID})
+		if err != nil {
+			log.Fatalf("failed to look up task %d: %v", taskID, err)
+		}
+		if n > 0 {
+			log.Printf("task %d appeared meanwhile; keeping its children", taskID)
+			continue
+		}
+		sw.sweepTask(ctx, taskID)
+	}
+	if dryRun {
+		log.Printf("DRY RUN: %d tasks have orphaned children", len(orphanTaskIDs))
+		return
+	}
+	log.Printf("deleted %d orphaned attachments and %d orphaned subtasks, queued %d file deletions",
+		sw.attachments, sw.subtasks, sw.queued)
+}
+
+// sweeper removes the children of tasks that no longer exist.
+type sweeper struct {
+	client *mongo.Client
+	db     *mongo.Database
+	dryRun bool
+
+	attachments, subtasks, queued int
+}
+
+// sweepTask deletes the subtasks and attachments of the missing task
+// taskID. Each attachment record goes together with its hold on the stored
+// file, so running again after a failure never releases a file twice.
+func (sw *sweeper) sweepTask(ctx context.Context, taskID int64) {
+	byTask := bson.M{"task_id": taskID}
+	cur, err := sw.db.Collection("attachments").Find(ctx, byTask,
+		options.Find().SetProjection(bson.M{"id": 1, "type": 1, "url": 1, "sha256": 1}))
+	if err != nil {
+		log.Fatalf("failed to read attachments of task %d: %v", taskID, err)
+	}
+	var atts []struct {
+		ID     int64  `bson:"id"`
+		Type   string `bson:"type"`
+		URL    string `bson:"url"`
+		SHA256 string `bson:"sha256"`
+	}
+	if err := cur.All(ctx, &atts); err != nil {
+		log.Fatalf("failed to read attachments of task %d: %v", taskID, err)
+	}
+	for _, att := range atts {
+		if sw.dryRun {
+			log.Printf("DRY RUN: would delete attachment %d of task %d", att.ID, taskID)
+			continue
+		}
+		// fn may run more than once; only the last run counts.
+		var deleted, queued bool
+		err := sw.withTransaction(ctx, func(ctx context.Context) error {
+			deleted, queued = false, false
+			res, err := sw.db.Collection("attachments").DeleteOne(ctx, bson.M{"id": att.ID, "task_id": taskID})
+			if err != nil || res.DeletedCount == 0 {
+				return err
+			}
+			deleted = true
+			if att.Type != "file" || att.URL == "" {
+				return nil
+			}
+			if att.SHA256 != "" {
+				queued, err = sw.release(ctx, att.SHA256)
+				return err
+			}
+			// A file without a hash is its own, unless the url names a
+			// shared stored file.
+			shared, err := sw.db.Collection("blob_refs").CountDocuments(ctx, bson.M{"key": att.URL})
+			if err != nil || shared > 0 {
+				return err
+			}
+			queued = true
+			return sw.queue(ctx, att.URL)
+		})
+		if err != nil {
+			log.Fatalf("failed to delete attachment %d of task %d: %v", att.ID, taskID, err)
+		}
+		if deleted {
+			sw.attachments++
+		}
+		if queued {
+			sw.queued++
+		}
+	}
+
+	if sw.dryRun {
+		n, err := sw.db.Collection("subtasks").CountDocuments(ctx, byTask)
+		if err != nil {
+			log.Fatalf("failed to count subtasks of task %d: %v", taskID, err)
+		}
+		log.Printf("DRY RUN: would delete %d subtasks of task %d", n, taskID)
+		return
+	}
+	res, err := sw.db.Collection("subtasks").DeleteMany(ctx, byTask)
+	if err != nil {
+		log.Fatalf("failed to delete subtasks of task %d: %v", taskID, err)
+	}
+	sw.subtasks += int(res.DeletedCount)
+}
+
+// release drops one reference to the stored file with hash sum, queuing
+// the file for deletion when it was the last; queued tells whether it was.
+func (sw *sweeper) release(ctx context.Context, sum string) (queued bool, err error) {
+	refs := sw.db.Collection("blob_refs")
+	var ref struct {
+		Key  string `bson:"key"`
+		Refs int64  `bson:"refs"`
+	}
+	err = refs.FindOneAndUpdate(ctx, bson.M{"sha256": sum}, bson.M{"$inc": bson.M{"refs": -1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&ref)
+	if errors.Is(err, mongo.ErrNoDocuments) || (err == nil && ref.Refs > 0) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	res, err := refs.DeleteOne(ctx, bson.M{"sha256": sum, "refs": bson.M{"$lte": 0}})
+	if err != nil || res.DeletedCount == 0 {
+		return false, err
+	}
+	return true, sw.queue(ctx, ref.Key)
+}
+
+// queue adds path to file_deletions for the server to delete.
+func (sw *sweeper) queue(ctx context.Context, path string) error {
+	now := time.Now().UTC()
+	doc := bson.M{"$setOnInsert": bson.M{"path": path, "enqueued_at": now, "attempts": 0, "next_attempt_at": now}}
+	_, err := sw.db.Collection("file_deletions").UpdateOne(ctx, bson.M{"path": path}, doc, options.Update().SetUpsert(true))
+	return err
+}
+
+// asID reads a task id as Distinct returns it.
+func asID(raw any) (int64, bool) {
+	switch v := raw.(type) {
+	case int64:
+		return v, true
+	case int32:
+		return int64(v), true
+	case float64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// withTransaction runs fn in a transaction where the deployment has them.
+// A standalone server has none; then a failure inside fn after the
+// attachment is deleted leaves its file held rather than released twice.
+func (sw *sweeper) withTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	sess, err := sw.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer sess.EndSession(ctx)
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (any, error) {
+		return nil, fn(sc)
+	})
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == 20 { // IllegalOperation: not a replica set
+		return fn(ctx)
+	}
+	return err
+}
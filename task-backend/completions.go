@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CompletionStats summarises a completion history.
+type CompletionStats struct {
+	Cycles int `json:"cycles"`
+	Done   int `json:"done"`
+	Missed int `json:"missed"`
+	// Rate is Done/Cycles, 0 without cycles.
+	Rate float64 `json:"rate"`
+	// CurrentStreak counts the cycles done since the last miss;
+	// LongestStreak is the longest run of done cycles.
+	CurrentStreak int `json:"current_streak"`
+	LongestStreak int `json:"longest_streak"`
+}
+
+func completionStats(records []Completion) CompletionStats {
+	sorted := append([]Completion(nil), records...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].CycleEnd.Before(sorted[j].CycleEnd) })
+	var st CompletionStats
+	for _, r := range sorted {
+		st.Cycles++
+		if r.Done {
+			st.Done++
+			st.CurrentStreak++
+			st.LongestStreak = max(st.LongestStreak, st.CurrentStreak)
+		} else {
+			st.Missed++
+			st.CurrentStreak = 0
+		}
+	}
+	if st.Cycles > 0 {
+		st.Rate = float64(st.Done) / float64(st.Cycles)
+	}
+	return st
+}
+
+func missedCycles(records []Completion) []Completion {
+	missed := []Completion{}
+	for _, r := range records {
+		if !r.Done {
+			missed = append(missed, r)
+		}
+	}
+	return missed
+}
+
+// CompletionReport is the history of one task or subtask.
+type CompletionReport struct {
+	CompletionStats
+	MissedCycles []Completion `json:"missed_cycles"`
+	// History lists every recorded cycle, latest first.
+	History []Completion `json:"history"`
+}
+
+// ItemCompletions is the summary of one item in an AssigneeCompletions.
+type ItemCompletions struct {
+	Entity EntityKind `json:"entity"`
+	ItemID int64      `json:"item_id"`
+	TaskID int64      `json:"task_id"`
+	CompletionStats
+}
+
+// AssigneeCompletions sums up the cycles that ended while a user was the
+// main assignee, overall and per item. Streaks run over all cycles by end.
+type AssigneeCompletions struct {
+	CompletionStats
+	MissedCycles []Completion      `json:"missed_cycles"`
+	Items        []ItemCompletions `json:"items"`
+}
+
+// parseCompletionQuery reads since and until (RFC 3339 or YYYY-MM-DD), which
+// bound the start of the cycles reported.
+func parseCompletionQuery(c *gin.Context) (CompletionQuery, error) {
+	since, err1 := timeParam(c, "since")
+	until, err2 := timeParam(c, "until")
+	return CompletionQuery{Since: since, Until: until}, errors.Join(err1, err2)
+}
+
+// registerCompletionRoutes adds the completion history endpoints. Cycles are
+// recorded by the scheduler when a recurring item resets.
+func (s *server) registerCompletionRoutes(r gin.IRouter) {
+	list := func(c *gin.Context, q CompletionQuery) ([]Completion, bool) {
+		records, err := s.store.ListCompletions(c.Request.Context(), q)
+		if err != nil {
+			log.Println("ListCompletions error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return nil, false
+		}
+		return records, true
+	}
+	report := func(c *gin.Context, entity EntityKind, id int64) {
+		q, err := parseCompletionQuery(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		q.Entity, q.ItemID = entity, id
+		if records, ok := list(c, q); ok {
+			c.JSON(http.StatusOK, CompletionReport{
+				CompletionStats: completionStats(records),
+				MissedCycles:    missedCycles(records),
+				History:         records,
+			})
+		}
+	}
+
+	// GET /tasks/:id/completions
+	r.GET("/tasks/:id/completions", s.allowTask(ActionRead), func(c *gin.Context) {
+		taskID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		report(c, EntityTask, taskID)
+	})
+
+	// GET /tasks/:id/subtasks/:subtaskId/completions
+	r.GET("/tasks/:id/subtasks/:subtaskId/completions", s.allowTask(ActionRead), func(c *gin.Context) {
+		subtaskID, err := strconv.ParseInt(c.Param("subtaskId"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subtask ID"})
+			return
+		}
+		report(c, EntitySubtask, subtaskID)
+	})
+
+	// GET /users/:userId/completions
+	r.GET("/users/:userId/completions", s.allow(ActionRead), func(c *gin.Context) {
+		userID, ok := parseUserID(c)
+		if !ok {
+			return
+		}
+		q, err := parseCompletionQuery(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		q.AssigneeID = &userID
+		records, ok := list(c, q)
+		if !ok {
+			return
+		}
+		type itemKey struct {
+			entity EntityKind
+			id     int64
+		}
+		byItem := map[itemKey][]Completion{}
+		var keys []itemKey
+		for _, r := range records {
+			k := itemKey{r.Entity, r.ItemID}
+			if _, seen := byItem[k]; !seen {
+				keys = append(keys, k)
+			}
+			byItem[k] = append(byItem[k], r)
+		}
+		items := []ItemCompletions{}
+		for _, k := range keys {
+			recs := byItem[k]
+			items = append(items, ItemCompletions{Entity: k.entity, ItemID: k.id, TaskID: recs[0].TaskID, CompletionStats: completionStats(recs)})
+		}
+		c.JSON(http.StatusOK, AssigneeCompletions{
+			CompletionStats: completionStats(records),
+			MissedCycles:    missedCycles(records),
+			Items:           items,
+		})
+	})
+}
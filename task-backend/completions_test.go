@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCompletionStats(t *testing.T) {
+	base := time.Date(2026, 3, 2, 8, 0, 0, 0, time.UTC)
+	// cycles builds one record per character, a day apart, "x" done and "."
+	// missed.
+	cycles := func(pattern string) []Completion {
+		var records []Completion
+		for i, c := range pattern {
+			end := base.AddDate(0, 0, i+1)
+			records = append(records, Completion{CycleStart: end.AddDate(0, 0, -1), CycleEnd: end, Done: c == 'x'})
+		}
+		return records
+	}
+	reversed := cycles("xx.xxx.")
+	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+
+	tests := []struct {
+		name    string
+		records []Completion
+		want    CompletionStats
+	}{
+		{"none", nil, CompletionStats{}},
+		{"all done", cycles("xxxx"), CompletionStats{Cycles: 4, Done: 4, Rate: 1, CurrentStreak: 4, LongestStreak: 4}},
+		{"all missed", cycles("..."), CompletionStats{Cycles: 3, Missed: 3}},
+		{"ends on a streak", cycles("xx.xxx"), CompletionStats{Cycles: 6, Done: 5, Missed: 1, Rate: 5.0 / 6, CurrentStreak: 3, LongestStreak: 3}},
+		{"ends on a miss", cycles("xxx.x."), CompletionStats{Cycles: 6, Done: 4, Missed: 2, Rate: 4.0 / 6, CurrentStreak: 0, LongestStreak: 3}},
+		{"longest streak first", cycles("xxx.x"), CompletionStats{Cycles: 5, Done: 4, Missed: 1, Rate: 0.8, CurrentStreak: 1, LongestStreak: 3}},
+		// The store lists the latest cycle first.
+		{"latest first", reversed, CompletionStats{Cycles: 7, Done: 5, Missed: 2, Rate: 5.0 / 7, CurrentStreak: 0, LongestStreak: 3}},
+	}
+	for _, tt := range tests {
+		if got := completionStats(tt.records); got != tt.want {
+			t.Errorf("%s: completionStats = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCompletionRoutes(t *testing.T) {
+	ts := newTestServer(t)
+	ada, token := ts.addUser("ada", RoleMember)
+	task := ts.createTask(token, map[string]any{"title": "Feed the cat"})
+	mine, other := int(ada.ID), int(ada.ID)+1
+	base := time.Date(2026, 3, 2, 8, 0, 0, 0, time.UTC)
+	var records []Completion
+	for i, r := range []struct {
+		entity   EntityKind
+		id       int64
+		assignee int
+		done     bool
+	}{
+		{EntityTask, task.ID, mine, true},
+		{EntityTask, task.ID, mine, false},
+		{EntityTask, task.ID, other, true},
+		{EntityTask, task.ID, mine, true},
+		{EntitySubtask, 7, mine, true},
+		{EntitySubtask, 7, mine, true},
+	} {
+		start := base.AddDate(0, 0, i)
+		records = append(records, Completion{Entity: r.entity, ItemID: r.id, TaskID: task.ID, AssigneeID: &r.assignee,
+			CycleStart: start, CycleEnd: start.AddDate(0, 0, 1), Done: r.done})
+	}
+	if err := ts.mem.RecordCompletions(context.Background(), records...); err != nil {
+		t.Fatal(err)
+	}
+
+	var report CompletionReport
+	decode(t, ts.do("GET", taskPath(task.ID, "completions"), token, nil), &report)
+	want := CompletionStats{Cycles: 4, Done: 3, Missed: 1, Rate: 0.75, CurrentStreak: 2, LongestStreak: 2}
+	if report.CompletionStats != want || len(report.MissedCycles) != 1 || len(report.History) != 4 ||
+		!report.History[0].CycleStart.Equal(base.AddDate(0, 0, 3)) {
+		t.Errorf("task report = %+v", report)
+	}
+	// since and until bound the cycle starts.
+	decode(t, ts.do("GET", taskPath(task.ID, "completions")+"?since=2026-03-03&until=2026-03-05", token, nil), &report)
+	if report.Cycles != 2 || report.Done != 1 || report.CurrentStreak != 1 {
+		t.Errorf("task report since March 3 = %+v", report.CompletionStats)
+	}
+	decode(t, ts.do("GET", taskPath(task.ID, "subtasks", "7", "completions"), token, nil), &report)
+	if report.Cycles != 2 || report.CurrentStreak != 2 {
+		t.Errorf("subtask report = %+v", report.CompletionStats)
+	}
+
+	// The user's summary leaves out the cycle someone else was assigned.
+	var mineReport AssigneeCompletions
+	decode(t, ts.do("GET", "/users/"+strconv.FormatInt(ada.ID, 10)+"/completions", token, nil), &mineReport)
+	if mineReport.Cycles != 5 || mineReport.Missed != 1 || mineReport.CurrentStreak != 3 || mineReport.LongestStreak != 3 || len(mineReport.Items) != 2 {
+		t.Errorf("user report = %+v", mineReport)
+	}
+	for _, item := range mineReport.Items {
+		if item.Entity == EntityTask && (item.ItemID != task.ID || item.Cycles != 3 || item.Done != 2) {
+			t.Errorf("task item = %+v", item)
+		}
+	}
+
+	if w := ts.do("GET", taskPath(task.ID, "completions")+"?since=last-week", token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("GET completions?since=last-week = %d, want 400", w.Code)
+	}
+}
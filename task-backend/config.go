@@ -0,0 +1,602 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the server configuration. Values are resolved in this order, each
+// layer overriding the previous one:
+//
+//	defaults < config file (YAML or TOML) < environment variables < flags
+type Config struct {
+	Listen     string           `yaml:"listen" toml:"listen"`
+	Store      string           `yaml:"store" toml:"store"` // "mongo" or "memory"
+	Mongo      MongoConfig      `yaml:"mongo" toml:"mongo"`
+	Storage    StorageConfig    `yaml:"storage" toml:"storage"`
+	FileServer FileServerConfig `yaml:"file_server" toml:"file_server"`
+	Uploads    UploadConfig     `yaml:"uploads" toml:"uploads"`
+	Auth       AuthConfig       `yaml:"auth" toml:"auth"`
+	Trash      TrashConfig      `yaml:"trash" toml:"trash"`
+	Search     SearchConfig     `yaml:"search" toml:"search"`
+	Scheduler  SchedulerConfig  `yaml:"scheduler" toml:"scheduler"`
+	Workspace  WorkspaceConfig  `yaml:"workspace" toml:"workspace"`
+	Notify     NotifyConfig     `yaml:"notifications" toml:"notifications"`
+	Webhooks   WebhookConfig    `yaml:"webhooks" toml:"webhooks"`
+	Events     EventsConfig     `yaml:"events" toml:"events"`
+	// CORSOrigins lists the browser origins allowed to call the API. "*"
+	// allows any origin.
+	CORSOrigins []string `yaml:"cors_origins" toml:"cors_origins"`
+}
+
+type MongoConfig struct {
+	URI            string   `yaml:"uri" toml:"uri"`
+	Database       string   `yaml:"database" toml:"database"`
+	ConnectTimeout duration `yaml:"connect_timeout" toml:"connect_timeout"`
+}
+
+type StorageConfig struct {
+	// Backend is where attachment files are kept: "fileserver" (the
+	// external file server), "local" or "s3".
+	Backend string             `yaml:"backend" toml:"backend"`
+	Local   LocalStorageConfig `yaml:"local" toml:"local"`
+	S3      S3Config           `yaml:"s3" toml:"s3"`
+}
+
+type LocalStorageConfig struct {
+	// Dir is created if missing.
+	Dir string `yaml:"dir" toml:"dir"`
+}
+
+type S3Config struct {
+	// Endpoint is the base URL of the service, like
+	// https://s3.eu-west-1.amazonaws.com or http://localhost:9000.
+	Endpoint  string `yaml:"endpoint" toml:"endpoint"`
+	Region    string `yaml:"region" toml:"region"`
+	Bucket    string `yaml:"bucket" toml:"bucket"`
+	AccessKey string `yaml:"access_key" toml:"access_key"`
+	SecretKey string `yaml:"secret_key" toml:"secret_key"`
+	// PathStyle addresses objects as endpoint/bucket/key instead of
+	// bucket.endpoint/key. MinIO and most other stand-ins need it.
+	PathStyle bool `yaml:"path_style" toml:"path_style"`
+	// Timeout bounds the wait for the service to answer a request.
+	Timeout duration `yaml:"timeout" toml:"timeout"`
+}
+
+type FileServerConfig struct {
+	BaseURL string   `yaml:"base_url" toml:"base_url"`
+	Folder  string   `yaml:"folder" toml:"folder"` // upload folder on the file server
+	Timeout duration `yaml:"timeout" toml:"timeout"`
+}
+
+type UploadConfig struct {
+	// MaxConcurrent is how many file uploads one instance takes at a time.
+	// Each may hold a spooled file of up to 250 MB.
+	MaxConcurrent int `yaml:"max_concurrent" toml:"max_concurrent"`
+	// SpoolDir is where uploads are spooled before they go to the file
+	// server. Empty uses the system temp directory.
+	SpoolDir string `yaml:"spool_dir" toml:"spool_dir"`
+	// ResumableDir keeps resumable (tus) uploads until they are complete.
+	// It must outlive restarts, and be shared if there are several
+	// instances.
+	ResumableDir string `yaml:"resumable_dir" toml:"resumable_dir"`
+	// ResumableTTL is how long a resumable upload may sit idle before it
+	// expires.
+	ResumableTTL duration `yaml:"resumable_ttl" toml:"resumable_ttl"`
+}
+
+type AuthConfig struct {
+	// TokenSecret signs bearer tokens. Every instance behind the same load
+	// balancer needs the same value.
+	TokenSecret string   `yaml:"token_secret" toml:"token_secret"`
+	TokenTTL    duration `yaml:"token_ttl" toml:"token_ttl"`
+	// BootstrapAdmin and BootstrapPassword create (or give a password to) a
+	// first user on start-up so somebody can log in to a fresh database. An
+	// existing password is never overwritten.
+	BootstrapAdmin    string `yaml:"bootstrap_admin" toml:"bootstrap_admin"`
+	BootstrapPassword string `yaml:"bootstrap_password" toml:"bootstrap_password"`
+}
+
+type TrashConfig struct {
+	// Retention is how long deleted items stay restorable before the purge
+	// job deletes them for good. Zero keeps them until purged by hand.
+	Retention duration `yaml:"retention" toml:"retention"`
+}
+
+type SearchConfig struct {
+	// RefreshInterval is how often the search index is rebuilt from the
+	// database to pick up changes made through other instances. Zero turns
+	// the rebuild off, which is fine for a single instance.
+	RefreshInterval duration `yaml:"refresh_interval" toml:"refresh_interval"`
+}
+
+type SchedulerConfig struct {
+	// Interval is how often schedules are checked for resets, expired
+	// countdowns and deadlines to remind assignees of. Only one instance at
+	// a time does the work. Zero turns the scheduler off on this instance.
+	Interval duration `yaml:"interval" toml:"interval"`
+}
+
+// WorkspaceConfig is the calendar schedules follow for unassigned items and
+// for users who have not set their own.
+type WorkspaceConfig struct {
+	// TimeZone is an IANA name such as "Africa/Lagos", or "Local" for the
+	// server's zone.
+	TimeZone string `yaml:"time_zone" toml:"time_zone"`
+	// WorkingDays lists the working weekdays (mon ... sun). Empty means
+	// every day.
+	WorkingDays []string `yaml:"working_days" toml:"working_days"`
+	// Holidays lists days off as YYYY-MM-DD dates.
+	Holidays []string `yaml:"holidays" toml:"holidays"`
+	// RollDeadlines moves due dates that land on a day off to the next
+	// working day.
+	RollDeadlines bool `yaml:"roll_deadlines" toml:"roll_deadlines"`
+}
+
+func (w WorkspaceConfig) workCalendar() WorkCalendar {
+	return WorkCalendar{TimeZone: w.TimeZone, WorkingDays: w.WorkingDays, Holidays: w.Holidays}
+}
+
+// calendar resolves the workspace calendar; users' calendars build on it.
+func (w WorkspaceConfig) calendar() (*Calendar, error) {
+	cal, err := w.workCalendar().resolve(nil)
+	if err != nil {
+		return nil, err
+	}
+	cal.rollForward = w.RollDeadlines
+	return cal, nil
+}
+
+type NotifyConfig struct {
+	// DueSoon is how long before a deadline main assignees are reminded.
+	// Zero turns due-soon reminders off; overdue ones still go out.
+	DueSoon duration `yaml:"due_soon" toml:"due_soon"`
+	// Timeout bounds one email or webhook delivery.
+	Timeout duration `yaml:"timeout" toml:"timeout"`
+	// AllowPrivateWebhooks lets users' notification webhooks reach
+	// loopback, private and link-local addresses, which are refused by
+	// default so that a webhook URL cannot probe the server's network.
+	AllowPrivateWebhooks bool       `yaml:"allow_private_webhooks" toml:"allow_private_webhooks"`
+	SMTP                 SMTPConfig `yaml:"smtp" toml:"smtp"`
+}
+
+type SMTPConfig struct {
+	// Addr is the host:port of the relay. Empty turns email off.
+	Addr     string `yaml:"addr" toml:"addr"`
+	From     string `yaml:"from" toml:"from"`
+	Username string `yaml:"username" toml:"username"`
+	Password string `yaml:"password" toml:"password"`
+}
+
+type WebhookConfig struct {
+	// Timeout bounds one webhook delivery.
+	Timeout duration `yaml:"timeout" toml:"timeout"`
+	// Retention is how long finished deliveries stay in the delivery logs.
+	// Zero keeps them.
+	Retention duration `yaml:"retention" toml:"retention"`
+}
+
+type EventsConfig struct {
+	// PollInterval is how often the activity log is checked for changes
+	// made through other instances, to stream them to clients.
+	PollInterval duration `yaml:"poll_interval" toml:"poll_interval"`
+}
+
+// duration is a time.Duration that reads and writes as "90s", "3m" etc. in
+// config files.
+type duration time.Duration
+
+func (d duration) MarshalText() ([]byte, error) { return []byte(time.Duration(d).String()), nil }
+
+func (d *duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func defaultConfig() Config {
+	return Config{
+		Listen: ":8080",
+		Store:  "mongo",
+		Mongo: MongoConfig{
+			URI:            "mongodb://localhost:27017",
+			Database:       "task_manager_db",
+			ConnectTimeout: duration(20 * time.Second),
+		},
+		Storage: StorageConfig{
+			Backend: "fileserver",
+			Local:   LocalStorageConfig{Dir: "attachments"},
+			S3: S3Config{
+				Region:    "us-east-1",
+				PathStyle: true,
+				Timeout:   duration(time.Minute),
+			},
+		},
+		FileServer: FileServerConfig{
+			BaseURL: "http://41.76.198.1:9091",
+			Folder:  "issuesDashboard",
+			Timeout: duration(3 * time.Minute),
+		},
+		Uploads: UploadConfig{
+			MaxConcurrent: 4,
+			ResumableDir:  "resumable-uploads",
+			ResumableTTL:  duration(24 * time.Hour),
+		},
+		Auth: AuthConfig{
+			TokenTTL: duration(12 * time.Hour),
+		},
+		Trash: TrashConfig{
+			Retention: duration(30 * 24 * time.Hour),
+		},
+		Search: SearchConfig{
+			RefreshInterval: duration(5 * time.Minute),
+		},
+		Scheduler: SchedulerConfig{
+			Interval: duration(time.Minute),
+		},
+		Workspace: WorkspaceConfig{
+			TimeZone: "Local",
+		},
+		Notify: NotifyConfig{
+			DueSoon: duration(2 * time.Hour),
+			Timeout: duration(30 * time.Second),
+		},
+		Webhooks: WebhookConfig{
+			Timeout:   duration(10 * time.Second),
+			Retention: duration(30 * 24 * time.Hour),
+		},
+		Events: EventsConfig{
+			PollInterval: duration(time.Second),
+		},
+		CORSOrigins: []string{"*"},
+	}
+}
+
+// setting binds one config value to its flag and environment variable.
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	apply func(c *Config, v string) error
+}
+
+func stringSetting(dst func(c *Config) *string) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		*dst(c) = v
+		return nil
+	}
+}
+
+func durationSetting(dst func(c *Config) *duration) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		return dst(c).UnmarshalText([]byte(v))
+	}
+}
+
+func intSetting(dst func(c *Config) *int) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", v)
+		}
+		*dst(c) = n
+		return nil
+	}
+}
+
+func boolSetting(dst func(c *Config) *bool) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", v)
+		}
+		*dst(c) = b
+		return nil
+	}
+}
+
+func listSetting(dst func(c *Config) *[]string) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		var list []string
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*dst(c) = list
+		return nil
+	}
+}
+
+var settings = []setting{
+	{"listen", "TASK_LISTEN", "HTTP listen address", stringSetting(func(c *Config) *string { return &c.Listen })},
+	{"store", "TASK_STORE", `storage backend: "mongo" or "memory"`, stringSetting(func(c *Config) *string { return &c.Store })},
+	{"mongo-uri", "MONGO_URI", "MongoDB connection URI", stringSetting(func(c *Config) *string { return &c.Mongo.URI })},
+	{"mongo-db", "MONGO_DATABASE", "MongoDB database name", stringSetting(func(c *Config) *string { return &c.Mongo.Database })},
+	{"mongo-timeout", "MONGO_CONNECT_TIMEOUT", "MongoDB connect timeout", durationSetting(func(c *Config) *duration { return &c.Mongo.ConnectTimeout })},
+	{"storage", "STORAGE_BACKEND", `where attachment files are kept: "fileserver", "local" or "s3"`, stringSetting(func(c *Config) *string { return &c.Storage.Backend })},
+	{"storage-dir", "STORAGE_LOCAL_DIR", "directory for attachment files with the local backend", stringSetting(func(c *Config) *string { return &c.Storage.Local.Dir })},
+	{"s3-endpoint", "S3_ENDPOINT", "base URL of the S3-compatible service", stringSetting(func(c *Config) *string { return &c.Storage.S3.Endpoint })},
+	{"s3-region", "S3_REGION", "region of the S3 bucket", stringSetting(func(c *Config) *string { return &c.Storage.S3.Region })},
+	{"s3-bucket", "S3_BUCKET", "S3 bucket for attachment files", stringSetting(func(c *Config) *string { return &c.Storage.S3.Bucket })},
+	{"s3-access-key", "S3_ACCESS_KEY", "S3 access key ID", stringSetting(func(c *Config) *string { return &c.Storage.S3.AccessKey })},
+	{"s3-secret-key", "S3_SECRET_KEY", "S3 secret access key", stringSetting(func(c *Config) *string { return &c.Storage.S3.SecretKey })},
+	{"s3-path-style", "S3_PATH_STYLE", "use path-style S3 URLs (true or false)", boolSetting(func(c *Config) *bool { return &c.Storage.S3.PathStyle })},
+	{"s3-timeout", "S3_TIMEOUT", "how long to wait for S3 to answer a request", durationSetting(func(c *Config) *duration { return &c.Storage.S3.Timeout })},
+	{"file-server", "FILE_SERVER_URL", "base URL of the attachment file server", stringSetting(func(c *Config) *string { return &c.FileServer.BaseURL })},
+	{"file-server-folder", "FILE_SERVER_FOLDER", "upload folder on the file server", stringSetting(func(c *Config) *string { return &c.FileServer.Folder })},
+	{"file-server-timeout", "FILE_SERVER_TIMEOUT", "timeout for file server requests", durationSetting(func(c *Config) *duration { return &c.FileServer.Timeout })},
+	{"upload-max-concurrent", "UPLOAD_MAX_CONCURRENT", "how many file uploads to take at a time", intSetting(func(c *Config) *int { return &c.Uploads.MaxConcurrent })},
+	{"upload-spool-dir", "UPLOAD_SPOOL_DIR", "directory uploads are spooled to (empty for the system temp directory)", stringSetting(func(c *Config) *string { return &c.Uploads.SpoolDir })},
+	{"upload-resumable-dir", "UPLOAD_RESUMABLE_DIR", "directory for unfinished resumable uploads", stringSetting(func(c *Config) *string { return &c.Uploads.ResumableDir })},
+	{"upload-resumable-ttl", "UPLOAD_RESUMABLE_TTL", "how long an idle resumable upload is kept", durationSetting(func(c *Config) *duration { return &c.Uploads.ResumableTTL })},
+	{"token-secret", "AUTH_TOKEN_SECRET", "secret used to sign bearer tokens", stringSetting(func(c *Config) *string { return &c.Auth.TokenSecret })},
+	{"token-ttl", "AUTH_TOKEN_TTL", "lifetime of a login session", durationSetting(func(c *Config) *duration { return &c.Auth.TokenTTL })},
+	{"bootstrap-admin", "AUTH_BOOTSTRAP_ADMIN", "name of a user to create on start-up if missing", stringSetting(func(c *Config) *string { return &c.Auth.BootstrapAdmin })},
+	{"bootstrap-password", "AUTH_BOOTSTRAP_PASSWORD", "initial password for the bootstrap user", stringSetting(func(c *Config) *string { return &c.Auth.BootstrapPassword })},
+	{"trash-retention", "TRASH_RETENTION", "how long deleted items stay in the trash (0 keeps them)", durationSetting(func(c *Config) *duration { return &c.Trash.Retention })},
+	{"search-refresh", "SEARCH_REFRESH_INTERVAL", "how often to rebuild the search index (0 disables)", durationSetting(func(c *Config) *duration { return &c.Search.RefreshInterval })},
+	{"scheduler-interval", "SCHEDULER_INTERVAL", "how often to apply schedule resets (0 disables)", durationSetting(func(c *Config) *duration { return &c.Scheduler.Interval })},
+	{"time-zone", "WORKSPACE_TIME_ZONE", `workspace IANA time zone ("Local" for the server's)`, stringSetting(func(c *Config) *string { return &c.Workspace.TimeZone })},
+	{"working-days", "WORKSPACE_WORKING_DAYS", "comma-separated workspace working days (mon,...,sun; empty for every day)", listSetting(func(c *Config) *[]string { return &c.Workspace.WorkingDays })},
+	{"holidays", "WORKSPACE_HOLIDAYS", "comma-separated workspace holidays (YYYY-MM-DD)", listSetting(func(c *Config) *[]string { return &c.Workspace.Holidays })},
+	{"roll-deadlines", "WORKSPACE_ROLL_DEADLINES", "move due dates on days off to the next working day (true or false)", boolSetting(func(c *Config) *bool { return &c.Workspace.RollDeadlines })},
+	{"notify-due-soon", "NOTIFY_DUE_SOON", "how long before a deadline to remind the assignee (0 disables)", durationSetting(func(c *Config) *duration { return &c.Notify.DueSoon })},
+	{"notify-timeout", "NOTIFY_TIMEOUT", "timeout for one email or webhook delivery", durationSetting(func(c *Config) *duration { return &c.Notify.Timeout })},
+	{"notify-allow-private-webhooks", "NOTIFY_ALLOW_PRIVATE_WEBHOOKS", "let notification webhooks reach loopback, private and link-local addresses", boolSetting(func(c *Config) *bool { return &c.Notify.AllowPrivateWebhooks })},
+	{"smtp-addr", "SMTP_ADDR", "host:port of the SMTP relay for email notifications (empty disables email)", stringSetting(func(c *Config) *string { return &c.Notify.SMTP.Addr })},
+	{"smtp-from", "SMTP_FROM", "sender address of notification emails", stringSetting(func(c *Config) *string { return &c.Notify.SMTP.From })},
+	{"smtp-username", "SMTP_USERNAME", "SMTP user name (empty for no authentication)", stringSetting(func(c *Config) *string { return &c.Notify.SMTP.Username })},
+	{"smtp-password", "SMTP_PASSWORD", "SMTP password", stringSetting(func(c *Config) *string { return &c.Notify.SMTP.Password })},
+	{"webhook-timeout", "WEBHOOK_TIMEOUT", "timeout for one outgoing webhook delivery", durationSetting(func(c *Config) *duration { return &c.Webhooks.Timeout })},
+	{"webhook-retention", "WEBHOOK_RETENTION", "how long webhook delivery logs are kept (0 keeps them)", durationSetting(func(c *Config) *duration { return &c.Webhooks.Retention })},
+	{"events-poll-interval", "EVENTS_POLL_INTERVAL", "how often to check for changes to stream to clients", durationSetting(func(c *Config) *duration { return &c.Events.PollInterval })},
+	{"cors-origins", "CORS_ORIGINS", `comma-separated list of allowed browser origins ("*" for any)`, listSetting(func(c *Config) *[]string { return &c.CORSOrigins })},
+}
+
+// loadConfig resolves the configuration from args (without the program
+// name), the environment and the optional config file named by -config or
+// TASK_CONFIG. printOnly reports whether -print-config was given.
+func loadConfig(args []string) (cfg Config, printOnly bool, err error) {
+	fs := flag.NewFlagSet("task-backend", flag.ContinueOnError)
+	configPath := fs.String("config", "", "path to a YAML or TOML config file (or set TASK_CONFIG)")
+	fs.BoolVar(&printOnly, "print-config", false, "print the resolved configuration with secrets redacted and exit")
+	flagValues := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		flagValues[s.flag] = fs.String(s.flag, "", s.usage+" (or set "+s.env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, false, err
+	}
+
+	cfg = defaultConfig()
+
+	path := *configPath
+	if path == "" {
+		path = os.Getenv("TASK_CONFIG")
+	}
+	if path != "" {
+		if err := loadConfigFile(path, &cfg); err != nil {
+			return Config{}, false, err
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok && v != "" {
+			if err := s.apply(&cfg, v); err != nil {
+				return Config{}, false, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name {
+				if err := s.apply(&cfg, *flagValues[s.flag]); err != nil {
+					flagErr = errors.Join(flagErr, fmt.Errorf("-%s: %w", s.flag, err))
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return Config{}, false, flagErr
+	}
+
+	return cfg, printOnly, cfg.validate()
+}
+
+func loadConfigFile(path string, cfg *Config) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(raw, cfg)
+	case ".toml":
+		err = toml.Unmarshal(raw, cfg)
+	default:
+		return fmt.Errorf("config file %s: unsupported extension (want .yaml, .yml or .toml)", path)
+	}
+	if err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c Config) validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("listen: %w", err))
+	}
+	switch c.Store {
+	case "memory":
+	case "mongo":
+		if u, err := url.Parse(c.Mongo.URI); err != nil || (u.Scheme != "mongodb" && u.Scheme != "mongodb+srv") {
+			errs = append(errs, errors.New("mongo.uri: must be a mongodb:// or mongodb+srv:// URI"))
+		}
+		if c.Mongo.Database == "" {
+			errs = append(errs, errors.New("mongo.database: required"))
+		}
+		if c.Mongo.ConnectTimeout <= 0 {
+			errs = append(errs, errors.New("mongo.connect_timeout: must be positive"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("store: unknown backend %q (want mongo or memory)", c.Store))
+	}
+	switch c.Storage.Backend {
+	case "fileserver":
+		if u, err := url.Parse(c.FileServer.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, errors.New("file_server.base_url: must be an absolute http(s) URL"))
+		}
+		if c.FileServer.Folder == "" || strings.ContainsAny(c.FileServer.Folder, `/\`) {
+			errs = append(errs, errors.New("file_server.folder: must be a single non-empty path segment"))
+		}
+		if c.FileServer.Timeout <= 0 {
+			errs = append(errs, errors.New("file_server.timeout: must be positive"))
+		}
+	case "local":
+		if c.Storage.Local.Dir == "" {
+			errs = append(errs, errors.New("storage.local.dir: required"))
+		}
+	case "s3":
+		s3 := c.Storage.S3
+		if u, err := url.Parse(s3.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" {
+			errs = append(errs, errors.New("storage.s3.endpoint: must be an absolute http(s) URL"))
+		}
+		if s3.Region == "" {
+			errs = append(errs, errors.New("storage.s3.region: required"))
+		}
+		if s3.Bucket == "" || strings.ContainsAny(s3.Bucket, `/\ `) {
+			errs = append(errs, errors.New("storage.s3.bucket: must be a bucket name"))
+		}
+		if s3.AccessKey == "" || s3.SecretKey == "" {
+			errs = append(errs, errors.New("storage.s3: access_key and secret_key are required"))
+		}
+		if s3.Timeout <= 0 {
+			errs = append(errs, errors.New("storage.s3.timeout: must be positive"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("storage.backend: unknown backend %q (want fileserver, local or s3)", c.Storage.Backend))
+	}
+	if c.Uploads.MaxConcurrent <= 0 {
+		errs = append(errs, errors.New("uploads.max_concurrent: must be positive"))
+	}
+	if c.Uploads.SpoolDir != "" {
+		if fi, err := os.Stat(c.Uploads.SpoolDir); err != nil || !fi.IsDir() {
+			errs = append(errs, errors.New("uploads.spool_dir: must be an existing directory"))
+		}
+	}
+	if c.Uploads.ResumableDir == "" {
+		errs = append(errs, errors.New("uploads.resumable_dir: required"))
+	}
+	if c.Uploads.ResumableTTL <= 0 {
+		errs = append(errs, errors.New("uploads.resumable_ttl: must be positive"))
+	}
+	// The in-memory store is for local runs, where a random per-process
+	// secret is fine. Anything persistent needs a stable one.
+	if c.Store != "memory" && len(c.Auth.TokenSecret) < 32 {
+		errs = append(errs, errors.New("auth.token_secret: must be at least 32 characters"))
+	}
+	if c.Auth.TokenTTL <= 0 {
+		errs = append(errs, errors.New("auth.token_ttl: must be positive"))
+	}
+	if (c.Auth.BootstrapAdmin == "") != (c.Auth.BootstrapPassword == "") {
+		errs = append(errs, errors.New("auth: bootstrap_admin and bootstrap_password must be set together"))
+	}
+	if c.Auth.BootstrapPassword != "" && len(c.Auth.BootstrapPassword) < minPasswordLength {
+		errs = append(errs, fmt.Errorf("auth.bootstrap_password: must be at least %d characters", minPasswordLength))
+	}
+	if c.Trash.Retention < 0 {
+		errs = append(errs, errors.New("trash.retention: must not be negative"))
+	}
+	if c.Search.RefreshInterval < 0 {
+		errs = append(errs, errors.New("search.refresh_interval: must not be negative"))
+	}
+	if c.Scheduler.Interval < 0 {
+		errs = append(errs, errors.New("scheduler.interval: must not be negative"))
+	}
+	if c.Workspace.TimeZone == "" {
+		errs = append(errs, errors.New("workspace.time_zone: required"))
+	}
+	if err := c.Workspace.workCalendar().validate(); err != nil {
+		errs = append(errs, fmt.Errorf("workspace.%w", err))
+	}
+	if c.Notify.DueSoon < 0 {
+		errs = append(errs, errors.New("notifications.due_soon: must not be negative"))
+	}
+	if c.Notify.Timeout <= 0 {
+		errs = append(errs, errors.New("notifications.timeout: must be positive"))
+	}
+	if c.Notify.SMTP.Addr != "" {
+		if _, _, err := net.SplitHostPort(c.Notify.SMTP.Addr); err != nil {
+			errs = append(errs, fmt.Errorf("notifications.smtp.addr: %w", err))
+		}
+		if addr, err := mail.ParseAddress(c.Notify.SMTP.From); err != nil || addr.Address != c.Notify.SMTP.From {
+			errs = append(errs, errors.New("notifications.smtp.from: must be an email address like tasks@example.com"))
+		}
+	}
+	if c.Webhooks.Timeout <= 0 {
+		errs = append(errs, errors.New("webhooks.timeout: must be positive"))
+	}
+	if c.Webhooks.Retention < 0 {
+		errs = append(errs, errors.New("webhooks.retention: must not be negative"))
+	}
+	if c.Events.PollInterval <= 0 {
+		errs = append(errs, errors.New("events.poll_interval: must be positive"))
+	}
+	for _, origin := range c.CORSOrigins {
+		if origin == "*" {
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			errs = append(errs, fmt.Errorf("cors_origins: %q is not an origin like http://host:port", origin))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// redacted returns a copy of c that is safe to print or log.
+func (c Config) redacted() Config {
+	c.Mongo.URI = redactURL(c.Mongo.URI)
+	c.Auth.TokenSecret = redactSecret(c.Auth.TokenSecret)
+	c.Notify.SMTP.Password = redactSecret(c.Notify.SMTP.Password)
+	c.Auth.BootstrapPassword = redactSecret(c.Auth.BootstrapPassword)
+	c.Storage.S3.AccessKey = redactSecret(c.Storage.S3.AccessKey)
+	c.Storage.S3.SecretKey = redactSecret(c.Storage.S3.SecretKey)
+	return c
+}
+
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "REDACTED"
+	}
+	if _, hasPassword := u.User.Password(); hasPassword {
+		u.User = url.UserPassword(u.User.Username(), "REDACTED")
+	}
+	return u.String()
+}
+
+func redactSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "REDACTED"
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DueItem is a task or subtask with the deadline its schedule gives it.
+type DueItem struct {
+	Entity EntityKind `json:"entity"`
+	ID     int64      `json:"id"`
+	TaskID int64      `json:"task_id"`
+	Title  string     `json:"title"`
+	// TaskTitle is set on subtasks.
+	TaskTitle      string       `json:"task_title,omitempty"`
+	MainAssigneeID *int         `json:"main_assignee_id,omitempty"`
+	Mode           ScheduleMode `json:"mode"`
+	Deadline       time.Time    `json:"deadline"`
+	Overdue        bool         `json:"overdue"`
+	// RemainingSeconds is negative once the deadline has passed.
+	RemainingSeconds int64 `json:"remaining_seconds"`
+}
+
+// AssigneeDueItems is one group of a response grouped by assignee.
+type AssigneeDueItems struct {
+	// AssigneeID is null for unassigned items.
+	AssigneeID *int      `json:"assignee_id"`
+	Items      []DueItem `json:"items"`
+}
+
+// openDueItems evaluates the schedules of the open work on the board:
+// unarchived, incomplete tasks and the incomplete subtasks of those. Items
+// without a deadline or with an unreadable schedule are skipped. Each item
+// is evaluated in its main assignee's calendar, or the workspace's.
+func openDueItems(ctx context.Context, store TaskStore, now time.Time, workspace *Calendar) ([]DueItem, error) {
+	cals, err := loadCalendars(ctx, store, workspace)
+	if err != nil {
+		return nil, err
+	}
+	archived, completed := false, false
+	tasks, err := store.ListTasks(ctx, TaskQuery{Archived: &archived, Completed: &completed})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, len(tasks))
+	for i, t := range tasks {
+		ids[i] = t.ID
+	}
+	var subtasks []Subtask
+	if len(ids) > 0 {
+		if subtasks, err = store.ListSubtasks(ctx, ids...); err != nil {
+			return nil, err
+		}
+	}
+	byTask := map[int64][]Subtask{}
+	for _, sub := range subtasks {
+		byTask[sub.TaskID] = append(byTask[sub.TaskID], sub)
+	}
+
+	items := []DueItem{}
+	add := func(item DueItem, raw *string, created time.Time) {
+		if raw == nil {
+			return
+		}
+		s, err := parseSchedule(*raw)
+		if err != nil {
+			log.Printf("due: %s %d: %v", item.Entity, item.ID, err)
+			return
+		}
+		cal := cals.forAssignee(item.MainAssigneeID)
+		_, deadline, ok := s.Deadline(now, created, cal)
+		if !ok {
+			return
+		}
+		item.Mode = s.Mode
+		item.Deadline = deadline
+		item.Overdue = s.IsOverdue(now, created, cal)
+		item.RemainingSeconds = int64(deadline.Sub(now) / time.Second)
+		items = append(items, item)
+	}
+	for _, t := range tasks {
+		add(DueItem{Entity: EntityTask, ID: t.ID, TaskID: t.ID, Title: t.Title, MainAssigneeID: t.MainAssigneeID}, t.Schedule, t.CreatedAt)
+		for _, sub := range byTask[t.ID] {
+			if sub.Completed {
+				continue
+			}
+			// Subtasks have no creation time; the task's stands in.
+			add(DueItem{Entity: EntitySubtask, ID: sub.ID, TaskID: t.ID, Title: sub.Title, TaskTitle: t.Title, MainAssigneeID: sub.MainAssigneeID}, sub.Schedule, t.CreatedAt)
+		}
+	}
+	slices.SortStableFunc(items, func(a, b DueItem) int { return a.Deadline.Compare(b.Deadline) })
+	return items, nil
+}
+
+// groupByAssignee splits items by main assignee, in assignee id order with
+// unassigned items last. Items keep their order within a group.
+func groupByAssignee(items []DueItem) []AssigneeDueItems {
+	groups := []AssigneeDueItems{}
+	for _, item := range items {
+		i := slices.IndexFunc(groups, func(g AssigneeDueItems) bool {
+			return (g.AssigneeID == nil) == (item.MainAssigneeID == nil) &&
+				(g.AssigneeID == nil || *g.AssigneeID == *item.MainAssigneeID)
+		})
+		if i < 0 {
+			groups = append(groups, AssigneeDueItems{AssigneeID: item.MainAssigneeID})
+			i = len(groups) - 1
+		}
+		groups[i].Items = append(groups[i].Items, item)
+	}
+	slices.SortFunc(groups, func(a, b AssigneeDueItems) int {
+		switch {
+		case a.AssigneeID == nil || b.AssigneeID == nil:
+			return compareBool(a.AssigneeID == nil, b.AssigneeID == nil)
+		default:
+			return cmp.Compare(*a.AssigneeID, *b.AssigneeID)
+		}
+	})
+	return groups
+}
+
+// registerDueRoutes adds the endpoints that list work by deadline. Both take
+// group=assignee to group the items by main assignee; items are ordered by
+// deadline, earliest first.
+func (s *server) registerDueRoutes(r gin.IRouter) {
+	respond := func(c *gin.Context, keep func(DueItem) bool) {
+		group := c.Query("group")
+		if group != "" && group != "assignee" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "group: must be assignee"})
+			return
+		}
+		items, err := openDueItems(c.Request.Context(), s.store, time.Now(), s.calendar)
+		if err != nil {
+			log.Println("due items error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		items = slices.DeleteFunc(items, func(item DueItem) bool { return !keep(item) })
+		if group == "assignee" {
+			c.JSON(http.StatusOK, groupByAssignee(items))
+			return
+		}
+		c.JSON(http.StatusOK, items)
+	}
+
+	// GET /tasks/overdue
+	// Open tasks and subtasks whose current deadline has passed.
+	r.GET("/tasks/overdue", s.allow(ActionRead), func(c *gin.Context) {
+		respond(c, func(item DueItem) bool { return item.Overdue })
+	})
+
+	// GET /tasks/due?within=24h
+	// Open tasks and subtasks due within the given duration (default 24h)
+	// that are not overdue yet.
+	r.GET("/tasks/due", s.allow(ActionRead), func(c *gin.Context) {
+		within := 24 * time.Hour
+		if v := c.Query("within"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "within: must be a positive duration such as 90m or 24h"})
+				return
+			}
+			within = d
+		}
+		respond(c, func(item DueItem) bool {
+			return !item.Overdue && item.RemainingSeconds <= int64(within/time.Second)
+		})
+	})
+}
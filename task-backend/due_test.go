@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func countdown(start time.Time, d time.Duration) *string {
+	s := fmt.Sprintf(`{"mode":"countdown","countdownSeconds":%d,"countdownStartAt":%q}`,
+		int64(d/time.Second), start.UTC().Format(time.RFC3339))
+	return &s
+}
+
+func TestOpenDueItems(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemoryStore()
+	now := time.Date(2026, 3, 4, 12, 0, 0, 0, time.UTC)
+	berlin := User{Name: "klaus", WorkCalendar: WorkCalendar{TimeZone: "Europe/Berlin"}}
+	if err := mem.CreateUser(ctx, &berlin); err != nil {
+		t.Fatal(err)
+	}
+	klaus, other := int(berlin.ID), int(berlin.ID)+1
+	daily, dueAt, broken := `{"mode":"default_daily"}`, `{"mode":"due","dueAt":"2026-03-07"}`, `{"mode":"weekly"}`
+	tasks := []Task{
+		{Title: "Report", Schedule: countdown(now.Add(-2*time.Hour), time.Hour), MainAssigneeID: &other},
+		{Title: "Plan", Schedule: &dueAt},
+		{Title: "Stand-up", Schedule: &daily, MainAssigneeID: &klaus},
+		{Title: "Filed", Schedule: countdown(now, time.Hour), Completed: true},
+		{Title: "Shelved", Schedule: countdown(now, time.Hour), Archived: true},
+		{Title: "Someday"},
+		{Title: "Garbled", Schedule: &broken},
+	}
+	for i := range tasks {
+		tasks[i].CreatedAt = now.AddDate(0, 0, -1)
+		if err := mem.CreateTask(ctx, &tasks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	plan := tasks[1].ID
+	for _, sub := range []Subtask{
+		{TaskID: plan, Title: "Outline", Schedule: countdown(now, 30*time.Minute), MainAssigneeID: &other},
+		{TaskID: plan, Title: "Sketch", Schedule: countdown(now, time.Minute), Completed: true},
+		{TaskID: tasks[3].ID, Title: "Under a filed task", Schedule: countdown(now, time.Minute)},
+	} {
+		if err := mem.CreateSubtask(ctx, &sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	items, err := openDueItems(ctx, mem, now, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type due struct {
+		title     string
+		overdue   bool
+		remaining int64
+	}
+	var got []due
+	for _, item := range items {
+		got = append(got, due{item.Title, item.Overdue, item.RemainingSeconds})
+	}
+	// Stand-up is due at 17:00 in Berlin, an hour earlier in UTC.
+	want := []due{{"Report", true, -3600}, {"Outline", false, 1800}, {"Stand-up", false, 4 * 3600}, {"Plan", false, 60 * 3600}}
+	if !slices.Equal(got, want) {
+		t.Errorf("openDueItems = %+v, want %+v", got, want)
+	}
+	if items[1].Entity != EntitySubtask || items[1].TaskTitle != "Plan" {
+		t.Errorf("subtask item = %+v", items[1])
+	}
+
+	var groups []string
+	for _, g := range groupByAssignee(items) {
+		var titles []string
+		for _, item := range g.Items {
+			titles = append(titles, item.Title)
+		}
+		assignee := "none"
+		if g.AssigneeID != nil {
+			assignee = fmt.Sprint(*g.AssigneeID)
+		}
+		groups = append(groups, fmt.Sprintf("%s: %v", assignee, titles))
+	}
+	wantGroups := []string{
+		fmt.Sprintf("%d: [Stand-up]", klaus),
+		fmt.Sprintf("%d: [Report Outline]", other),
+		"none: [Plan]",
+	}
+	if !slices.Equal(groups, wantGroups) {
+		t.Errorf("groupByAssignee = %q, want %q", groups, wantGroups)
+	}
+}
+
+func TestDueRoutes(t *testing.T) {
+	ts := newTestServer(t)
+	ada, token := ts.addUser("ada", RoleMember)
+	now := time.Now()
+	mine := int(ada.ID)
+	for _, f := range []map[string]any{
+		{"title": "Late", "schedule": *countdown(now.Add(-2*time.Hour), time.Hour), "main_assignee_id": mine},
+		{"title": "Soon", "schedule": *countdown(now, 2*time.Hour)},
+		{"title": "Later", "schedule": *countdown(now, 48*time.Hour), "main_assignee_id": mine},
+	} {
+		ts.createTask(token, f)
+	}
+
+	titles := func(path string) []string {
+		t.Helper()
+		w := ts.do("GET", path, token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", path, w.Code, w.Body)
+		}
+		var items []DueItem
+		decode(t, w, &items)
+		var out []string
+		for _, item := range items {
+			out = append(out, item.Title)
+		}
+		return out
+	}
+	for path, want := range map[string][]string{
+		"/tasks/overdue":        {"Late"},
+		"/tasks/due":            {"Soon"},
+		"/tasks/due?within=1h":  nil,
+		"/tasks/due?within=72h": {"Soon", "Later"},
+		"/tasks/overdue?group=": {"Late"},
+	} {
+		if got := titles(path); !slices.Equal(got, want) {
+			t.Errorf("GET %s = %q, want %q", path, got, want)
+		}
+	}
+
+	var groups []AssigneeDueItems
+	decode(t, ts.do("GET", "/tasks/due?within=72h&group=assignee", token, nil), &groups)
+	if len(groups) != 2 || groups[0].AssigneeID == nil || *groups[0].AssigneeID != mine ||
+		groups[0].Items[0].Title != "Later" || groups[1].AssigneeID != nil {
+		t.Errorf("grouped = %+v", groups)
+	}
+
+	for _, path := range []string{"/tasks/due?within=-1h", "/tasks/due?within=soon", "/tasks/overdue?group=priority"} {
+		if w := ts.do("GET", path, token, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s = %d, want 400", path, w.Code)
+		}
+	}
+}
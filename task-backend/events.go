@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// eventTailBatch is how many activity entries one poll reads at most.
+	eventTailBatch = 500
+	// eventGapGrace is how long a missing Seq is waited for. Instances take
+	// Seqs before they insert their entries, so a later entry can show up
+	// first; a Seq whose insert failed never shows up at all.
+	eventGapGrace = 5 * time.Second
+	// eventMaxReplay is how many missed changes a reconnecting client is
+	// sent. Further behind, it is told to resync instead.
+	eventMaxReplay = 1000
+	// eventBuffer is how many events a slow client may fall behind before
+	// it is disconnected; it catches up by reconnecting.
+	eventBuffer    = 256
+	eventKeepAlive = 25 * time.Second
+)
+
+// streamEvent is one change as sent over GET /events.
+type streamEvent struct {
+	seq  int64
+	name string
+	data []byte
+}
+
+// eventHub fans the activity log out to the clients of GET /events. The
+// log is shared by all instances, so tailing it picks up changes made
+// through any of them; its Seq is the event ID clients resume from.
+type eventHub struct {
+	store    TaskStore
+	interval time.Duration
+	wake     chan struct{}
+
+	mu sync.Mutex
+	// last is the Seq of the last event broadcast.
+	last int64
+	subs map[chan streamEvent]bool
+}
+
+// newEventHub starts the hub at the end of the activity log.
+func newEventHub(ctx context.Context, store TaskStore, interval time.Duration) (*eventHub, error) {
+	latest, err := store.ListActivity(ctx, ActivityQuery{Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	h := &eventHub{store: store, interval: interval, wake: make(chan struct{}, 1), subs: map[chan streamEvent]bool{}}
+	if len(latest) > 0 {
+		h.last = latest[0].Seq
+	}
+	return h, nil
+}
+
+// run tails the activity log until ctx is cancelled.
+func (h *eventHub) run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		for h.poll(ctx) {
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-h.wake:
+		}
+	}
+}
+
+// poll broadcasts the next entries of the log and reports whether there
+// may be more.
+func (h *eventHub) poll(ctx context.Context) bool {
+	h.mu.Lock()
+	last := h.last
+	h.mu.Unlock()
+	entries, err := h.store.TailActivity(ctx, last, eventTailBatch)
+	if err != nil {
+		log.Println("events: tailing activity error:", err)
+		return false
+	}
+	for _, a := range entries {
+		if a.Seq != last+1 && time.Since(a.At) < eventGapGrace {
+			return false
+		}
+		h.broadcast(h.event(ctx, a))
+		last = a.Seq
+	}
+	return len(entries) == eventTailBatch
+}
+
+func (h *eventHub) broadcast(ev streamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		select {
+		case sub <- ev:
+		default:
+			delete(h.subs, sub)
+			close(sub)
+		}
+	}
+	h.last = ev.seq
+}
+
+func (h *eventHub) nudge() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// subscribe returns a channel of the events after the returned Seq. The
+// channel is closed if the subscriber falls too far behind.
+func (h *eventHub) subscribe() (chan streamEvent, int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sub := make(chan streamEvent, eventBuffer)
+	h.subs[sub] = true
+	return sub, h.last
+}
+
+func (h *eventHub) unsubscribe(sub chan streamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[sub] {
+		delete(h.subs, sub)
+		close(sub)
+	}
+}
+
+// event turns an activity entry into a stream event named like
+// "subtask.updated". Its data is the item as the REST endpoints return it,
+// or just its id and task_id once it is deleted or purged.
+func (h *eventHub) event(ctx context.Context, a Activity) streamEvent {
+	verb := a.Action
+	if verb == ActivityTrashed {
+		verb = "deleted"
+	}
+	var data any = gin.H{"id": a.EntityID, "task_id": a.TaskID}
+	if a.Action != ActivityTrashed && a.Action != ActivityPurged {
+		switch a.Entity {
+		case EntityTask:
+			if task, err := h.store.GetTask(ctx, a.EntityID); err == nil && !task.trashed() {
+				data = task
+			}
+		case EntitySubtask:
+			if sub := findSubtask(ctx, h.store, a.TaskID, a.EntityID); sub != nil {
+				data = sub
+			}
+		case EntityAttachment:
+			if att, err := h.store.GetAttachment(ctx, a.TaskID, a.EntityID); err == nil {
+				// As in lightweight task lists, inline files are loaded on
+				// demand.
+				if len(att.URL) > 1000 {
+					att.URL = ""
+				}
+				data = att
+			}
+		}
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("events: encoding %s %d: %v", a.Entity, a.EntityID, err)
+		raw = []byte("{}")
+	}
+	return streamEvent{seq: a.Seq, name: fmt.Sprintf("%s.%s", a.Entity, verb), data: raw}
+}
+
+// activityNudger is a TaskStore that wakes the hub whenever this instance
+// appends to the activity log, so that local changes go out without waiting
+// for the next poll.
+type activityNudger struct {
+	TaskStore
+	hub *eventHub
+}
+
+func (s *activityNudger) AppendActivity(ctx context.Context, a *Activity) error {
+	err := s.TaskStore.AppendActivity(ctx, a)
+	s.hub.nudge()
+	return err
+}
+
+// registerEventRoutes adds the change stream.
+func (s *server) registerEventRoutes(r gin.IRouter) {
+	// GET /events
+	// A text/event-stream of task, subtask and attachment changes. Each
+	// event has an id; a client that reconnects with it in Last-Event-ID
+	// (or ?last_event_id=, for the first connection) is sent what it missed
+	// first. A client too far behind gets a "resync" event and should
+	// refetch. Browsers pass the token as ?access_token=.
+	r.GET("/events", s.allow(ActionRead), func(c *gin.Context) {
+		ctx := c.Request.Context()
+		lastID := c.GetHeader("Last-Event-ID")
+		if lastID == "" {
+			lastID = c.Query("last_event_id")
+		}
+		var after int64
+		if lastID != "" {
+			var err error
+			if after, err = strconv.ParseInt(lastID, 10, 64); err != nil || after < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid last event ID"})
+				return
+			}
+		}
+		sub, current := s.events.subscribe()
+		defer s.events.unsubscribe(sub)
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no") // keep nginx from buffering the stream
+		c.Status(http.StatusOK)
+		w := c.Writer
+		send := func(ev streamEvent) {
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.seq, ev.name, ev.data)
+		}
+		fmt.Fprint(w, "retry: 3000\n\n")
+
+		// Replay up to where the subscription starts, so nothing is sent
+		// twice or missed.
+		switch {
+		case lastID == "" || after >= current:
+		case current-after > eventMaxReplay:
+			fmt.Fprintf(w, "id: %d\nevent: resync\ndata: {}\n\n", current)
+		default:
+		replay:
+			for after < current {
+				entries, err := s.store.TailActivity(ctx, after, eventTailBatch)
+				if err != nil {
+					log.Println("events: replay error:", err)
+					return
+				}
+				if len(entries) == 0 {
+					break
+				}
+				for _, a := range entries {
+					if a.Seq > current {
+						break replay
+					}
+					send(s.events.event(ctx, a))
+					after = a.Seq
+				}
+			}
+		}
+		w.Flush()
+
+		keepAlive := time.NewTicker(eventKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-sub:
+				if !ok {
+					return
+				}
+				send(ev)
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+			}
+			w.Flush()
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	fileDeletionLease = 5 * time.Minute
+	maxRetryBackoff   = time.Hour
+)
+
+// runFileDeletionWorker drains the store's file deletion queue until ctx is
+// cancelled. Deletions are claimed with a lease, so several instances can
+// share one queue and a crashed worker's claim is picked up again later.
+func runFileDeletionWorker(ctx context.Context, store TaskStore, blobs BlobStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for drainFileDeletion(ctx, store, blobs) {
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// drainFileDeletion processes one due deletion and reports whether there may
+// be more.
+func drainFileDeletion(ctx context.Context, store TaskStore, blobs BlobStore) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	fd, err := store.ClaimFileDeletion(ctx, time.Now().UTC(), fileDeletionLease)
+	if errors.Is(err, ErrNotFound) {
+		return false
+	}
+	if err != nil {
+		log.Println("file deletion: claim error:", err)
+		return false
+	}
+	if err := blobs.Delete(ctx, fd.Path); err != nil {
+		next := time.Now().UTC().Add(retryBackoff(fd.Attempts))
+		log.Printf("file deletion: %s attempt %d failed: %v (retrying at %s)", fd.Path, fd.Attempts, err, next.Format(time.RFC3339))
+		if err := store.RetryFileDeletion(ctx, fd.Path, next, err.Error()); err != nil {
+			log.Println("file deletion: retry error:", err)
+		}
+		return true
+	}
+	if err := store.CompleteFileDeletion(ctx, fd.Path); err != nil {
+		log.Println("file deletion: complete error:", err)
+	}
+	return true
+}
+
+// retryBackoff is the wait after a failed attempt of a queued job. It
+// doubles from 30s per failed attempt up to an hour.
+func retryBackoff(attempts int) time.Duration {
+	d := 30 * time.Second
+	for i := 1; i < attempts && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxRetryBackoff)
+}
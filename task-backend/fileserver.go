@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileServer is the BlobStore of the external file server. Its keys are
+// the paths the file server stores files at.
+//
+// The file server only hands out whole files, base64 encoded in a JSON
+// document, and has no HEAD or Range support. Reading from an offset
+// therefore downloads and drops everything before it, so a Range request
+// for the end of a large file costs as much as the whole file; and Stat
+// cannot tell sizes. Use the local or S3 backend where that matters.
+type fileServer struct {
+	base   string
+	folder string
+	// client uses a generous timeout for proxying large file
+	// uploads/downloads to the external file server. Keep-alives are enabled
+	// (default) so connections are reused; the retry logic in upload
+	// handles the case where a pooled connection has been closed by the server.
+	client *http.Client
+	// stream is for downloads streamed to clients, which take as long as
+	// the client does; only waiting for the file server to answer is
+	// bounded.
+	stream *http.Client
+}
+
+func newFileServer(cfg FileServerConfig) *fileServer {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = time.Duration(cfg.Timeout)
+	return &fileServer{
+		base:   strings.TrimRight(cfg.BaseURL, "/"),
+		folder: cfg.Folder,
+		client: &http.Client{Timeout: time.Duration(cfg.Timeout)},
+		stream: &http.Client{Transport: transport},
+	}
+}
+
+// Put streams file to the file server and returns its stored path. The
+// multipart body is written through a pipe as it is sent, so memory use
+// does not grow with the file.
+func (fs *fileServer) Put(ctx context.Context, filename string, file io.ReadSeeker, fileSize int64, sent func(n int64)) (string, error) {
+	uploadURL := fs.base + "/upload/" + url.PathEscape(fs.folder)
+	var lastErr error
+	for attempt := 1; attempt <= 2; attempt++ {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return "", fmt.Errorf("rewinding uploaded file: %w", err)
+		}
+		pr, pw := io.Pipe()
+		writer := multipart.NewWriter(pw)
+		written := make(chan struct{})
+		go func() {
+			defer close(written)
+			part, err := writer.CreateFormFile("files", filename)
+			if err == nil {
+				_, err = io.Copy(part, &countingReader{r: file, report: sent})
+			}
+			if err == nil {
+				err = writer.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+
+		req, err := http.NewRequestWithContext(ctx, "POST", uploadURL, pr)
+		if err != nil {
+			pr.Close()
+			<-written
+			return "", err
+		}
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		// Suppress Go's automatic "Expect: 100-continue" header.
+		// Nginx rejects large requests at the header stage when it sees
+		// Expect: 100-continue + a Content-Length over client_max_body_size,
+		// but allows the same upload from browsers (which don't send Expect).
+		req.Header.Set("Expect", "")
+		// Don't set ContentLength — let Go use chunked transfer encoding.
+		// This avoids nginx rejecting based on Content-Length before reading.
+		req.ContentLength = -1
+		log.Printf("fileServer.Put attempt %d: POST %s file=%q size=%d bytes (chunked)",
+			attempt, uploadURL, filename, fileSize)
+
+		resp, err := fs.client.Do(req)
+		// Unblocks the writer if the request ended before reading it all,
+		// and waits for it to let go of file.
+		pr.Close()
+		<-written
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			lastErr = fmt.Errorf("could not reach file server: %w", err)
+			log.Printf("fileServer.Put attempt %d network error: %v", attempt, lastErr)
+			continue // retry
+		}
+
+		respBytes, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		log.Printf("fileServer.Put attempt %d: response status=%d body=%s",
+			attempt, resp.StatusCode, strings.TrimSpace(string(respBytes)))
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return "", fmt.Errorf("file server returned %d: %s", resp.StatusCode, strings.TrimSpace(string(respBytes)))
+		}
+
+		var result struct {
+			Data []string `json:"Data"`
+		}
+		if err := json.Unmarshal(respBytes, &result); err != nil {
+			return "", fmt.Errorf("file server response parse error: %w (body: %s)", err, strings.TrimSpace(string(respBytes)))
+		}
+		if len(result.Data) == 0 {
+			return "", fmt.Errorf("file server returned empty path list (body: %s)", strings.TrimSpace(string(respBytes)))
+		}
+		return result.Data[0], nil
+	}
+	return "", lastErr
+}
+
+// countingReader tells report the running total of the bytes read through
+// it.
+type countingReader struct {
+	r      io.Reader
+	n      int64
+	report func(n int64)
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if c.report != nil && n > 0 {
+		c.report(c.n)
+	}
+	return n, err
+}
+
+func (fs *fileServer) Delete(ctx context.Context, filePath string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", fs.base+"/delete?filepath="+url.QueryEscape(filePath), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := fs.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not reach file server: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("file server returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// downloadURL is where the file server serves the stored file at filePath.
+func (fs *fileServer) downloadURL(filePath string) string {
+	return fs.base + "/download?filepath=" + url.QueryEscape(filePath)
+}
+
+// download asks for the stored file at filePath and returns the successful
+// response, with its body unread.
+func (fs *fileServer) download(ctx context.Context, filePath string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fs.downloadURL(filePath), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := fs.stream.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach file server: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("file server returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// open streams the stored file at filePath. The file server sends it as a
+// base64 string in a JSON document; the returned reader decodes it as it
+// arrives rather than holding the document in memory.
+func (fs *fileServer) open(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	resp, err := fs.download(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReaderSize(resp.Body, 64<<10)
+	if err := seekJSONString(r, "FileBytes"); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	decoded := base64.NewDecoder(base64.StdEncoding, &jsonStringReader{r: r})
+	return struct {
+		io.Reader
+		io.Closer
+	}{decoded, resp.Body}, nil
+}
+
+// Get streams the stored file at filePath from offset on. The file server
+// only sends whole files, so the bytes before offset are downloaded and
+// dropped.
+func (fs *fileServer) Get(ctx context.Context, filePath string, offset int64) (io.ReadCloser, error) {
+	body, err := fs.open(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, body, offset); err != nil && err != io.EOF {
+		body.Close()
+		return nil, err
+	}
+	return body, nil
+}
+
+// Stat only checks that the file exists: it hangs up once the file server
+// answers, as the size would take reading the whole file. The size is
+// reported as -1.
+func (fs *fileServer) Stat(ctx context.Context, filePath string) (BlobInfo, error) {
+	resp, err := fs.download(ctx, filePath)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	resp.Body.Close()
+	return BlobInfo{Size: -1}, nil
+}
+
+// seekJSONString reads r up to the start of the string value of the first
+// member named key.
+func seekJSONString(r *bufio.Reader, key string) error {
+	want := `"` + key + `"`
+	matched := 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("file server response has no %s: %w", key, err)
+		}
+		switch {
+		case b == want[matched]:
+			matched++
+		case b == '"':
+			matched = 1
+			continue
+		default:
+			matched = 0
+			continue
+		}
+		if matched < len(want) {
+			continue
+		}
+		// A string followed by a colon is a member name; otherwise it was a
+		// value that happened to read the same.
+		matched = 0
+		if b, err = skipSpace(r); err != nil || b != ':' {
+			r.UnreadByte()
+			continue
+		}
+		if b, err = skipSpace(r); err != nil || b != '"' {
+			return fmt.Errorf("file server response: %s is not a string", key)
+		}
+		return nil
+	}
+}
+
+func skipSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil || (b != ' ' && b != '\t' && b != '\n' && b != '\r') {
+			return b, err
+		}
+	}
+}
+
+// jsonStringReader reads the rest of a JSON string, unescaped, up to its
+// closing quote. Only the escapes that can stand for base64 characters are
+// supported.
+type jsonStringReader struct {
+	r    *bufio.Reader
+	done bool
+}
+
+func (j *jsonStringReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && !j.done {
+		if n > 0 && j.r.Buffered() == 0 {
+			break // return what we have rather than wait for more
+		}
+		if _, err := j.r.Peek(1); err != nil {
+			return n, unexpectedEOF(err)
+		}
+		chunk, _ := j.r.Peek(min(j.r.Buffered(), len(p)-n))
+		i := bytes.IndexAny(chunk, `"\`)
+		if i < 0 {
+			n += copy(p[n:], chunk)
+			j.r.Discard(len(chunk))
+			continue
+		}
+		n += copy(p[n:], chunk[:i])
+		j.r.Discard(i)
+		if b, _ := j.r.ReadByte(); b == '"' {
+			j.done = true
+			break
+		}
+		b, err := j.unescape()
+		if err != nil {
+			return n, err
+		}
+		p[n] = b
+		n++
+	}
+	if n == 0 && j.done {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (j *jsonStringReader) unescape() (byte, error) {
+	e, err := j.r.ReadByte()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	switch e {
+	case '/', '\\', '"':
+		return e, nil
+	case 'u':
+		var hex [4]byte
+		if _, err := io.ReadFull(j.r, hex[:]); err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		if v, err := strconv.ParseUint(string(hex[:]), 16, 8); err == nil && v < 0x80 {
+			return byte(v), nil
+		}
+	}
+	return 0, fmt.Errorf("file server response: unexpected escape in file bytes")
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFileServerGetAndStat(t *testing.T) {
+	content := []byte("The quick brown fox jumps over the lazy dog")
+	// hold keeps the response to slow.txt open after its headers, as a
+	// large file would be.
+	hold := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("filepath") {
+		case "docs/fox.txt":
+			fmt.Fprintf(w, `{"FileName": "fox.txt", "FileBytes": "%s"}`, base64.StdEncoding.EncodeToString(content))
+		case "docs/slow.txt":
+			w.Write([]byte(`{"FileBytes": "`))
+			w.(http.Flusher).Flush()
+			<-hold
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	defer close(hold)
+	fs := newFileServer(FileServerConfig{BaseURL: srv.URL, Timeout: duration(5 * time.Second)})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	body, err := fs.Get(ctx, "docs/fox.txt", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || string(got) != string(content[16:]) {
+		t.Errorf("Get from 16 = %q, %v", got, err)
+	}
+
+	if info, err := fs.Stat(ctx, "docs/slow.txt"); err != nil || info.Size != -1 {
+		t.Errorf("Stat = %+v, %v", info, err)
+	}
+	if _, err := fs.Stat(ctx, "docs/gone.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat of a missing file = %v, want ErrNotFound", err)
+	}
+	if _, err := fs.Get(ctx, "docs/gone.txt", 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a missing file = %v, want ErrNotFound", err)
+	}
+}
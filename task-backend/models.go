@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Task uses a numeric `id` field so frontend doesn't need to change.
+type Task struct {
+	ID                  int64        `bson:"id" json:"id"`
+	Title               string       `json:"title" bson:"title"`
+	Description         *string      `json:"description,omitempty" bson:"description,omitempty"`
+	Priority            *string      `json:"priority,omitempty" bson:"priority,omitempty"`
+	Type                *string      `json:"type,omitempty" bson:"type,omitempty"`
+	Completed           bool         `json:"completed" bson:"completed"`
+	Archived            bool         `json:"archived" bson:"archived"`
+	Pinned              bool         `json:"pinned" bson:"pinned"`
+	CreatedAt           time.Time    `json:"created_at" bson:"created_at"`
+	MainAssigneeID      *int         `json:"main_assignee_id,omitempty" bson:"main_assignee_id,omitempty"`
+	SupportingAssignees *string      `json:"supporting_assignees,omitempty" bson:"supporting_assignees,omitempty"`
+	Schedule            *string      `json:"schedule,omitempty" bson:"schedule,omitempty"`
+	Version             int64        `json:"version" bson:"version"`
+	Subtasks            []Subtask    `json:"subtasks,omitempty" bson:"-"`
+	Attachments         []Attachment `json:"attachments,omitempty" bson:"-"`
+	Cycle               `bson:",inline"`
+	Trashed             `bson:",inline"`
+}
+
+// assignedTo reports whether a main_assignee_id refers to userID.
+func assignedTo(mainAssigneeID *int, userID int64) bool {
+	return mainAssigneeID != nil && int64(*mainAssigneeID) == userID
+}
+
+type Subtask struct {
+	ID                  int64   `bson:"id" json:"id"`
+	TaskID              int64   `json:"task_id" bson:"task_id"`
+	Title               string  `json:"title" bson:"title"`
+	Completed           bool    `json:"completed" bson:"completed"`
+	MainAssigneeID      *int    `json:"main_assignee_id,omitempty" bson:"main_assignee_id,omitempty"`
+	SupportingAssignees *string `json:"supporting_assignees,omitempty" bson:"supporting_assignees,omitempty"`
+	Schedule            *string `json:"schedule,omitempty" bson:"schedule,omitempty"`
+	Version             int64   `json:"version" bson:"version"`
+	Cycle               `bson:",inline"`
+	Trashed             `bson:",inline"`
+}
+
+type Attachment struct {
+	ID       int64   `bson:"id" json:"id"`
+	TaskID   int64   `json:"task_id" bson:"task_id"`
+	Type     string  `json:"type" bson:"type"` // "link", "file"
+	Name     string  `json:"name" bson:"name"`
+	URL      string  `json:"url" bson:"url"`
+	Size     any     `json:"size,omitempty" bson:"size,omitempty"` // Can be int64 or string from DB
+	MimeType *string `json:"mime_type,omitempty" bson:"mime_type,omitempty"`
+	// SHA256 is the hex hash of a file's content. Files with one share a
+	// stored copy (see BlobRef); older uploads have none.
+	SHA256 string `json:"sha256,omitempty" bson:"sha256,omitempty"`
+	// UploadID is the resumable upload the file came through, if any; it
+	// makes one attachment of an upload however often it is finished.
+	UploadID  string    `json:"upload_id,omitempty" bson:"upload_id,omitempty"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	Trashed   `bson:",inline"`
+}
+
+// EntityKind names the kinds of board items, as they appear in search
+// hits and the activity log.
+type EntityKind string
+
+const (
+	EntityTask       EntityKind = "task"
+	EntitySubtask    EntityKind = "subtask"
+	EntityAttachment EntityKind = "attachment"
+)
+
+// Cycle is the scheduler's bookkeeping on a task or subtask, see
+// scheduler.go.
+type Cycle struct {
+	// ResetAt is the start of the schedule's current cycle, as of the last
+	// reset the scheduler applied.
+	ResetAt *time.Time `bson:"reset_at,omitempty" json:"reset_at,omitempty"`
+	// ExpiredAt is the end of the last countdown the scheduler marked as
+	// expired. The current countdown has expired if it ends there too.
+	ExpiredAt *time.Time `bson:"expired_at,omitempty" json:"expired_at,omitempty"`
+	// CompletedAt and CompletedBy say when and by whom the item was last
+	// marked completed; they are cleared when it is unchecked or reset.
+	CompletedAt *time.Time `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+	CompletedBy *int64     `bson:"completed_by,omitempty" json:"completed_by,omitempty"`
+}
+
+// Completion records how one cycle of a recurring task or subtask ended.
+// Cycles run from CycleStart up to CycleEnd, the next reset.
+type Completion struct {
+	Entity EntityKind `bson:"entity" json:"entity"`
+	ItemID int64      `bson:"item_id" json:"item_id"`
+	TaskID int64      `bson:"task_id" json:"task_id"`
+	// AssigneeID is the main assignee when the cycle ended.
+	AssigneeID *int       `bson:"assignee_id,omitempty" json:"assignee_id,omitempty"`
+	CycleStart time.Time  `bson:"cycle_start" json:"cycle_start"`
+	CycleEnd   time.Time  `bson:"cycle_end" json:"cycle_end"`
+	Done       bool       `bson:"done" json:"done"`
+	DoneBy     *int64     `bson:"done_by,omitempty" json:"done_by,omitempty"`
+	DoneAt     *time.Time `bson:"done_at,omitempty" json:"done_at,omitempty"`
+}
+
+// Lease is a named lock that one server instance holds until ExpiresAt.
+type Lease struct {
+	Name      string    `bson:"_id" json:"name"`
+	Holder    string    `bson:"holder" json:"holder"`
+	ExpiresAt time.Time `bson:"expires_at" json:"expires_at"`
+}
+
+// Trashed is embedded in every model that can go to the trash bin instead of
+// being deleted outright. Subtasks and attachments of a trashed task are not
+// stamped themselves; they are hidden with the task and come back with it.
+type Trashed struct {
+	DeletedAt *time.Time `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+	DeletedBy *int64     `bson:"deleted_by,omitempty" json:"deleted_by,omitempty"`
+}
+
+func (t Trashed) trashed() bool { return t.DeletedAt != nil }
+
+// TrashKind names the kinds of items the trash bin holds. The values double
+// as the path segment of the /trash routes.
+type TrashKind string
+
+const (
+	TrashTasks       TrashKind = "tasks"
+	TrashSubtasks    TrashKind = "subtasks"
+	TrashAttachments TrashKind = "attachments"
+)
+
+func (k TrashKind) valid() bool {
+	switch k {
+	case TrashTasks, TrashSubtasks, TrashAttachments:
+		return true
+	}
+	return false
+}
+
+// TrashItem is one entry of the trash bin listing.
+type TrashItem struct {
+	Kind      TrashKind `json:"kind"`
+	ID        int64     `json:"id"`
+	TaskID    int64     `json:"task_id"`
+	Title     string    `json:"title"` // task or subtask title, attachment name
+	DeletedAt time.Time `json:"deleted_at"`
+	DeletedBy *int64    `json:"deleted_by,omitempty"`
+}
+
+type User struct {
+	ID        int64  `bson:"id" json:"id"`
+	Name      string `bson:"name" json:"name"`
+	FullName  string `bson:"full_name,omitempty" json:"full_name,omitempty"`
+	Initials  string `bson:"initials,omitempty" json:"initials,omitempty"`
+	Email     string `bson:"email,omitempty" json:"email,omitempty"`
+	AvatarURL string `bson:"avatar_url,omitempty" json:"avatar_url,omitempty"`
+	Role      Role   `bson:"role,omitempty" json:"role,omitempty"`
+	// WorkCalendar is the user's time zone and working calendar, which the
+	// schedules of the items they are the main assignee of follow. Empty
+	// fields fall back to the workspace's.
+	WorkCalendar `bson:",inline"`
+	// DeactivatedAt is set while the user is deactivated. Deactivated users
+	// cannot log in but stay referenced by their old tasks.
+	DeactivatedAt *time.Time `bson:"deactivated_at,omitempty" json:"deactivated_at,omitempty"`
+	// PasswordHash is a bcrypt hash. Users without one cannot log in.
+	PasswordHash string `bson:"password_hash,omitempty" json:"-"`
+	// NotificationPrefs are private to the user (they may hold a webhook
+	// URL with a token in it) and are served by /me/notification-preferences.
+	NotificationPrefs NotificationPrefs `bson:"notification_prefs,omitempty" json:"-"`
+}
+
+func (u User) active() bool { return u.DeactivatedAt == nil }
+
+// Session is a login issued by POST /auth/login. Bearer tokens carry the
+// session id, so deleting the session revokes the token.
+type Session struct {
+	ID        string    `bson:"id" json:"id"`
+	UserID    int64     `bson:"user_id" json:"user_id"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	ExpiresAt time.Time `bson:"expires_at" json:"expires_at"`
+}
+
+// FileDeletion is a queued removal of a stored file from attachment storage.
+// Deleting attachment records enqueues these in the same operation, and a
+// background worker works through them with retries.
+type FileDeletion struct {
+	Path          string    `bson:"path" json:"path"`
+	EnqueuedAt    time.Time `bson:"enqueued_at" json:"enqueued_at"`
+	Attempts      int       `bson:"attempts" json:"attempts"`
+	NextAttemptAt time.Time `bson:"next_attempt_at" json:"next_attempt_at"`
+	LastError     string    `bson:"last_error,omitempty" json:"last_error,omitempty"`
+}
+
+// BlobRef is a stored file shared by the file attachments with its content.
+// Refs counts them, trashed ones included; purging the last one queues the
+// file for deletion.
+type BlobRef struct {
+	SHA256    string    `bson:"sha256" json:"sha256"`
+	Key       string    `bson:"key" json:"key"`
+	Size      int64     `bson:"size" json:"size"`
+	Refs      int64     `bson:"refs" json:"refs"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	// CorruptAt is when a download first found the file not matching
+	// SHA256.
+	CorruptAt *time.Time `bson:"corrupt_at,omitempty" json:"corrupt_at,omitempty"`
+}
+
+func (t Task) trashItem() TrashItem {
+	return TrashItem{Kind: TrashTasks, ID: t.ID, TaskID: t.ID, Title: t.Title, DeletedAt: *t.DeletedAt, DeletedBy: t.DeletedBy}
+}
+
+func (s Subtask) trashItem() TrashItem {
+	return TrashItem{Kind: TrashSubtasks, ID: s.ID, TaskID: s.TaskID, Title: s.Title, DeletedAt: *s.DeletedAt, DeletedBy: s.DeletedBy}
+}
+
+func (a Attachment) trashItem() TrashItem {
+	return TrashItem{Kind: TrashAttachments, ID: a.ID, TaskID: a.TaskID, Title: a.Name, DeletedAt: *a.DeletedAt, DeletedBy: a.DeletedBy}
+}
+
+// Activity actions.
+const (
+	ActivityCreated  = "created"
+	ActivityUpdated  = "updated"
+	ActivityTrashed  = "trashed"
+	ActivityRestored = "restored"
+	ActivityPurged   = "purged"
+)
+
+// Activity is one entry of the append-only activity log: who did what to
+// which task, subtask or attachment, with a field-level diff.
+type Activity struct {
+	// Seq orders the log; it comes from the "activityid" sequence.
+	Seq      int64      `bson:"seq" json:"seq"`
+	At       time.Time  `bson:"at" json:"at"`
+	ActorID  int64      `bson:"actor_id" json:"actor_id"` // 0 for background jobs
+	Action   string     `bson:"action" json:"action"`
+	Entity   EntityKind `bson:"entity" json:"entity"`
+	EntityID int64      `bson:"entity_id" json:"entity_id"`
+	// TaskID is the task the entity is or belongs to.
+	TaskID  int64         `bson:"task_id" json:"task_id"`
+	Changes []FieldChange `bson:"changes,omitempty" json:"changes,omitempty"`
+}
+
+// FieldChange is the before and after value of one field. Before is nil
+// on creation, After is nil when the field was removed.
+type FieldChange struct {
+	Field  string `bson:"field" json:"field"`
+	Before any    `bson:"before" json:"before"`
+	After  any    `bson:"after" json:"after"`
+}
+
+// NotificationEvent names the things users are notified about.
+type NotificationEvent string
+
+const (
+	EventAssigned        NotificationEvent = "assigned"
+	EventMentioned       NotificationEvent = "mentioned"
+	EventDueSoon         NotificationEvent = "due_soon"
+	EventOverdue         NotificationEvent = "overdue"
+	EventCompleted       NotificationEvent = "completed"
+	EventAttachmentAdded NotificationEvent = "attachment_added"
+	// EventStateChanged covers reopening, archiving, unarchiving, deleting
+	// and restoring.
+	EventStateChanged NotificationEvent = "state_changed"
+)
+
+var notificationEvents = []NotificationEvent{EventAssigned, EventMentioned, EventDueSoon, EventOverdue, EventCompleted,
+	EventAttachmentAdded, EventStateChanged}
+
+// Notification channels. The inbox is the stored Notification itself; the
+// others are sent by the delivery worker.
+const (
+	ChannelInbox   = "inbox"
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+)
+
+var notificationChannels = []string{ChannelInbox, ChannelEmail, ChannelWebhook}
+
+// Notification tells one user about one event on a task, subtask or
+// attachment.
+type Notification struct {
+	// ID comes from the "notificationid" sequence.
+	ID       int64             `bson:"id" json:"id"`
+	UserID   int64             `bson:"user_id" json:"user_id"`
+	Event    NotificationEvent `bson:"event" json:"event"`
+	Entity   EntityKind        `bson:"entity" json:"entity"`
+	EntityID int64             `bson:"entity_id" json:"entity_id"`
+	// TaskID is the task the entity is or belongs to.
+	TaskID int64 `bson:"task_id" json:"task_id"`
+	// Link is the API path of the entity, e.g. /tasks/3/subtasks/7.
+	Link string `bson:"link" json:"link"`
+	// Text is a one-line summary such as `Ada assigned you to task "Pump"`.
+	Text    string `bson:"text" json:"text"`
+	ActorID int64  `bson:"actor_id,omitempty" json:"actor_id,omitempty"` // 0 for background jobs
+	// Deadline is set on due_soon and overdue notifications.
+	Deadline  *time.Time `bson:"deadline,omitempty" json:"deadline,omitempty"`
+	CreatedAt time.Time  `bson:"created_at" json:"created_at"`
+	// Channels lists where the notification goes; it shows in the user's
+	// inbox if this includes "inbox".
+	Channels []string `bson:"channels" json:"channels"`
+	// ReadAt is set once the user has read the notification in the inbox.
+	ReadAt *time.Time `bson:"read_at,omitempty" json:"read_at"`
+	// Key makes a notification once-only: a second one for the same user
+	// with the same key is dropped. Reminders use it to fire once per
+	// deadline.
+	Key string `bson:"key,omitempty" json:"-"`
+}
+
+// NotificationDelivery is a queued send of a notification through email or
+// a webhook. A background worker works through them with retries.
+type NotificationDelivery struct {
+	// ID is "<notification id>/<channel>".
+	ID            string       `bson:"id" json:"id"`
+	Channel       string       `bson:"channel" json:"channel"`
+	Notification  Notification `bson:"notification" json:"notification"`
+	EnqueuedAt    time.Time    `bson:"enqueued_at" json:"enqueued_at"`
+	Attempts      int          `bson:"attempts" json:"attempts"`
+	NextAttemptAt time.Time    `bson:"next_attempt_at" json:"next_attempt_at"`
+	LastError     string       `bson:"last_error,omitempty" json:"last_error,omitempty"`
+}
+
+// NotificationPrefs is how a user wants to be notified.
+type NotificationPrefs struct {
+	// Events maps an event to the channels it goes out through. Events that
+	// are not listed go through every channel the user can be reached on;
+	// an empty list turns the event off.
+	Events map[NotificationEvent][]string `bson:"events,omitempty" json:"events,omitempty"`
+	// WebhookURL receives the user's notifications as JSON POSTs. Only
+	// public addresses are reached unless the server allows private ones.
+	WebhookURL string `bson:"webhook_url,omitempty" json:"webhook_url,omitempty"`
+	// QuietHours holds email and webhook deliveries back until they end.
+	// The inbox is not affected.
+	QuietHours *QuietHours `bson:"quiet_hours,omitempty" json:"quiet_hours,omitempty"`
+}
+
+// QuietHours runs from Start to End, HH:MM in the user's time zone. A span
+// such as 22:00 to 07:00 runs over midnight.
+type QuietHours struct {
+	Start string `bson:"start" json:"start"`
+	End   string `bson:"end" json:"end"`
+}
+
+// Webhook is a subscription of an outside URL to changes of tasks, subtasks
+// and attachments.
+type Webhook struct {
+	// ID comes from the "webhookid" sequence.
+	ID  int64  `bson:"id" json:"id"`
+	URL string `bson:"url" json:"url"`
+	// Secret signs the deliveries. It is only shown once, when the webhook
+	// is created.
+	Secret string `bson:"secret" json:"-"`
+	// Events lists the events sent, such as "task.completed" or "subtask.*".
+	// Empty sends every event.
+	Events []string `bson:"events" json:"events"`
+	// Active is false while the webhook is paused; nothing is sent then.
+	Active    bool      `bson:"active" json:"active"`
+	CreatedBy int64     `bson:"created_by" json:"created_by"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+}
+
+// Webhook delivery states.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookDelivery is one event sent, or to be sent, to a webhook. Pending
+// deliveries are queued for the delivery worker; finished ones make up the
+// webhook's delivery log.
+type WebhookDelivery struct {
+	// ID comes from the "webhookdeliveryid" sequence.
+	ID        int64  `bson:"id" json:"id"`
+	WebhookID int64  `bson:"webhook_id" json:"webhook_id"`
+	Event     string `bson:"event" json:"event"`
+	// Payload is the exact request body that is signed and sent.
+	Payload   json.RawMessage `bson:"payload" json:"payload"`
+	State     string          `bson:"state" json:"state"`
+	CreatedAt time.Time       `bson:"created_at" json:"created_at"`
+	Attempts  int             `bson:"attempts" json:"attempts"`
+	// NextAttemptAt is set while the delivery is pending.
+	NextAttemptAt *time.Time `bson:"next_attempt_at,omitempty" json:"next_attempt_at,omitempty"`
+	// StatusCode is the HTTP status of the last attempt, 0 if there was no
+	// response.
+	StatusCode  int        `bson:"status_code,omitempty" json:"status_code,omitempty"`
+	LastError   string     `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	DeliveredAt *time.Time `bson:"delivered_at,omitempty" json:"delivered_at,omitempty"`
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	notifyDeliveryLease = 5 * time.Minute
+	// notifyMaxAttempts is how often a delivery is tried before it is
+	// dropped; with retryBackoff that spans about two hours.
+	notifyMaxAttempts = 8
+)
+
+// notifier turns events into notifications. It stores one per recipient,
+// which puts it in their inbox, and queues its email and webhook deliveries
+// according to the recipient's preferences. Failures are logged, never
+// returned: a change stands even if nobody could be told about it.
+type notifier struct {
+	store    TaskStore
+	channels map[string]Channel
+	// calendar is the workspace calendar, for quiet hours of users without
+	// a time zone of their own and for reminders.
+	calendar *Calendar
+	dueSoon  time.Duration
+	// wake nudges the delivery worker when deliveries were queued.
+	wake chan struct{}
+}
+
+func newNotifier(store TaskStore, cfg NotifyConfig, calendar *Calendar) *notifier {
+	timeout := time.Duration(cfg.Timeout)
+	n := &notifier{
+		store: store,
+		channels: map[string]Channel{
+			ChannelWebhook: &webhookChannel{client: newWebhookClient(timeout, cfg.AllowPrivateWebhooks)},
+		},
+		calendar: calendar,
+		dueSoon:  time.Duration(cfg.DueSoon),
+		wake:     make(chan struct{}, 1),
+	}
+	if cfg.SMTP.Addr != "" {
+		n.channels[ChannelEmail] = &emailChannel{cfg: cfg.SMTP, timeout: timeout, cal: calendar}
+	}
+	return n
+}
+
+// event is something that happened to a task, subtask or attachment.
+type event struct {
+	kind       NotificationEvent
+	entity     EntityKind
+	id, taskID int64
+	text       string
+	// actor is not told about their own doings.
+	actor    int64
+	deadline *time.Time
+	// key makes the event once-only per user, see Notification.Key.
+	key string
+}
+
+// notify tells users about ev, skipping the actor, unknown and deactivated
+// users and users who turned the event off.
+func (n *notifier) notify(ctx context.Context, ev event, users ...int64) {
+	now := time.Now().UTC()
+	var deliveries []NotificationDelivery
+	seen := map[int64]bool{}
+	for _, id := range users {
+		if id == 0 || id == ev.actor || seen[id] {
+			continue
+		}
+		seen[id] = true
+		user, err := n.store.GetUser(ctx, id)
+		if errors.Is(err, ErrNotFound) || (err == nil && !user.active()) {
+			continue
+		}
+		if err != nil {
+			log.Printf("notify: loading user %d: %v", id, err)
+			continue
+		}
+		channels := n.channelsFor(user, ev.kind)
+		if len(channels) == 0 {
+			continue
+		}
+		note := Notification{UserID: id, Event: ev.kind, Entity: ev.entity, EntityID: ev.id, TaskID: ev.taskID,
+			Link: itemPath(ev.entity, ev.id, ev.taskID), Text: ev.text, ActorID: ev.actor, Deadline: ev.deadline,
+			CreatedAt: now, Channels: channels, Key: ev.key}
+		added, err := n.store.AddNotification(ctx, &note)
+		if err != nil {
+			log.Printf("notify: storing %s for user %d: %v", ev.kind, id, err)
+			continue
+		}
+		if !added {
+			continue
+		}
+		sendAt := user.NotificationPrefs.QuietHours.until(now, n.calendarOf(user).location())
+		for _, ch := range channels {
+			if ch == ChannelInbox {
+				continue
+			}
+			deliveries = append(deliveries, NotificationDelivery{ID: fmt.Sprintf("%d/%s", note.ID, ch), Channel: ch,
+				Notification: note, EnqueuedAt: now, NextAttemptAt: sendAt})
+		}
+	}
+	if len(deliveries) == 0 {
+		return
+	}
+	if err := n.store.EnqueueNotificationDeliveries(ctx, deliveries...); err != nil {
+		log.Printf("notify: queuing deliveries of %s: %v", ev.kind, err)
+		return
+	}
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// channelsFor lists the channels user wants kind through and can be reached
+// on.
+func (n *notifier) channelsFor(user User, kind NotificationEvent) []string {
+	wanted, ok := user.NotificationPrefs.Events[kind]
+	if !ok {
+		wanted = notificationChannels
+	}
+	var channels []string
+	for _, name := range wanted {
+		if ch, ok := n.channels[name]; name == ChannelInbox || (ok && ch.reaches(user)) {
+			channels = append(channels, name)
+		}
+	}
+	return channels
+}
+
+func (n *notifier) calendarOf(user User) *Calendar {
+	cal, err := user.WorkCalendar.resolve(n.calendar)
+	if err != nil {
+		return n.calendar
+	}
+	return cal
+}
+
+// until returns the end of the quiet hours now falls in, or now outside
+// them.
+func (q *QuietHours) until(now time.Time, loc *time.Location) time.Time {
+	if q == nil {
+		return now
+	}
+	start, end := at(now, q.Start, loc), at(now, q.End, loc)
+	switch {
+	case start.Before(end):
+		if !now.Before(start) && now.Before(end) {
+			return end
+		}
+	case now.Before(end):
+		return end
+	case !now.Before(start):
+		return at(end.AddDate(0, 0, 1), q.End, loc)
+	}
+	return now
+}
+
+func (p NotificationPrefs) validate() error {
+	var errs []error
+	events := make([]NotificationEvent, 0, len(p.Events))
+	for ev := range p.Events {
+		events = append(events, ev)
+	}
+	slices.Sort(events)
+	for _, ev := range events {
+		if !slices.Contains(notificationEvents, ev) {
+			errs = append(errs, fmt.Errorf("events: unknown event %q", ev))
+		}
+		for _, ch := range p.Events[ev] {
+			if !slices.Contains(notificationChannels, ch) {
+				errs = append(errs, fmt.Errorf("events.%s: unknown channel %q (want inbox, email or webhook)", ev, ch))
+			}
+		}
+	}
+	if p.WebhookURL != "" {
+		if u, err := url.Parse(p.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, errors.New("webhook_url: must be an absolute http(s) URL"))
+		}
+	}
+	if q := p.QuietHours; q != nil {
+		_, _, err1 := clockTime(q.Start)
+		_, _, err2 := clockTime(q.End)
+		switch {
+		case err1 != nil || err2 != nil:
+			errs = append(errs, fmt.Errorf("quiet_hours: %w", errors.Join(err1, err2)))
+		case q.Start == q.End:
+			errs = append(errs, errors.New("quiet_hours: start and end must differ"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runNotificationWorker sends queued deliveries until ctx is cancelled. Like
+// file deletions they are claimed with a lease, so instances can share the
+// queue.
+func runNotificationWorker(ctx context.Context, n *notifier, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for n.deliverNext(ctx) {
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-n.wake:
+		}
+	}
+}
+
+// deliverNext sends one due delivery and reports whether there may be more.
+func (n *notifier) deliverNext(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	d, err := n.store.ClaimNotificationDelivery(ctx, time.Now().UTC(), notifyDeliveryLease)
+	if errors.Is(err, ErrNotFound) {
+		return false
+	}
+	if err != nil {
+		log.Println("notify: claim error:", err)
+		return false
+	}
+	user, err := n.store.GetUser(ctx, d.Notification.UserID)
+	ch, ok := n.channels[d.Channel]
+	switch {
+	case err != nil && !errors.Is(err, ErrNotFound):
+		log.Println("notify: loading user error:", err)
+		return false
+	case err != nil || !ok || !user.active() || !ch.reaches(user):
+		log.Printf("notify: dropping %s: user %d cannot be reached by %s any more", d.ID, d.Notification.UserID, d.Channel)
+		err = nil
+	default:
+		err = ch.send(ctx, user, d.Notification)
+	}
+	if err != nil && d.Attempts < notifyMaxAttempts {
+		next := time.Now().UTC().Add(retryBackoff(d.Attempts))
+		log.Printf("notify: %s attempt %d failed: %v (retrying at %s)", d.ID, d.Attempts, err, next.Format(time.RFC3339))
+		if err := n.store.RetryNotificationDelivery(ctx, d.ID, next, err.Error()); err != nil {
+			log.Println("notify: retry error:", err)
+		}
+		return true
+	}
+	if err != nil {
+		log.Printf("notify: giving up on %s after %d attempts: %v", d.ID, d.Attempts, err)
+	}
+	if err := n.store.CompleteNotificationDelivery(ctx, d.ID); err != nil {
+		log.Println("notify: complete error:", err)
+	}
+	return true
+}
+
+// remindDue tells the main assignees of open items whose deadline is within
+// dueSoon or has passed, once per deadline. It runs as a scheduler job.
+func (n *notifier) remindDue(ctx context.Context, now time.Time) error {
+	items, err := openDueItems(ctx, n.store, now, n.calendar)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if item.MainAssigneeID == nil {
+			continue
+		}
+		ev := event{entity: item.Entity, id: item.ID, taskID: item.TaskID, deadline: &item.Deadline}
+		label := itemLabel(item.Entity, item.Title, item.TaskTitle)
+		switch {
+		case item.Overdue:
+			ev.kind, ev.text = EventOverdue, capitalize(label)+" is overdue"
+		case n.dueSoon > 0 && time.Duration(item.RemainingSeconds)*time.Second <= n.dueSoon:
+			ev.kind, ev.text = EventDueSoon, capitalize(label)+" is due soon"
+		default:
+			continue
+		}
+		ev.key = fmt.Sprintf("%s/%s/%d/%d", ev.kind, item.Entity, item.ID, item.Deadline.Unix())
+		n.notify(ctx, ev, int64(*item.MainAssigneeID))
+	}
+	return nil
+}
+
+// itemPath is the API path of a task, subtask or attachment.
+func itemPath(entity EntityKind, id, taskID int64) string {
+	switch entity {
+	case EntitySubtask:
+		return fmt.Sprintf("/tasks/%d/subtasks/%d", taskID, id)
+	case EntityAttachment:
+		return fmt.Sprintf("/tasks/%d/attachments/%d", taskID, id)
+	}
+	return fmt.Sprintf("/tasks/%d", taskID)
+}
+
+// itemLabel names a task or subtask in notification texts.
+func itemLabel(entity EntityKind, title, taskTitle string) string {
+	if entity == EntitySubtask {
+		return fmt.Sprintf("subtask %q of task %q", title, taskTitle)
+	}
+	return fmt.Sprintf("task %q", title)
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// mentions returns the active users mentioned as @name in any of texts.
+// Names match ignoring case and may contain spaces; where names overlap the
+// longest one wins, so "@Ann Lee" does not also mention Ann.
+func mentions(users []User, texts ...string) map[int64]bool {
+	byLength := slices.Clone(users)
+	slices.SortFunc(byLength, func(a, b User) int { return len(b.Name) - len(a.Name) })
+	found := map[int64]bool{}
+	for _, text := range texts {
+		text = strings.ToLower(text)
+		for _, u := range byLength {
+			if !u.active() || u.Name == "" {
+				continue
+			}
+			needle := "@" + strings.ToLower(u.Name)
+			for from := 0; ; {
+				i := strings.Index(text[from:], needle)
+				if i < 0 {
+					break
+				}
+				i += from
+				end := i + len(needle)
+				from = end
+				if next := []rune(text[end:]); len(next) > 0 && (unicode.IsLetter(next[0]) || unicode.IsDigit(next[0])) {
+					continue
+				}
+				found[u.ID] = true
+				// Blank the mention out so shorter names do not match it.
+				text = text[:i] + strings.Repeat(" ", len(needle)) + text[end:]
+			}
+		}
+	}
+	return found
+}
+
+// newMentions returns the users mentioned in after but not in before.
+func (n *notifier) newMentions(ctx context.Context, before, after []string) []int64 {
+	if slices.Equal(before, after) {
+		return nil
+	}
+	users, err := n.store.ListUsers(ctx)
+	if err != nil {
+		log.Println("notify: listing users error:", err)
+		return nil
+	}
+	old := mentions(users, before...)
+	var ids []int64
+	for id := range mentions(users, after...) {
+		if !old[id] {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+const (
+	defaultInboxLimit = 50
+	maxInboxLimit     = 200
+)
+
+// registerNotificationRoutes adds the current user's inbox and notification
+// preferences.
+func (s *server) registerNotificationRoutes(r gin.IRouter) {
+	// respondUnread answers with how many unread entries are left.
+	respondUnread := func(c *gin.Context, marked int64) {
+		unread, err := s.store.CountUnreadNotifications(c.Request.Context(), currentUser(c).ID)
+		if err != nil {
+			log.Println("CountUnreadNotifications error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"marked": marked, "unread": unread})
+	}
+
+	// GET /me/notifications?unread=true&limit=50&cursor=
+	// The inbox, newest first. When more entries follow, the X-Next-Cursor
+	// response header holds the cursor for the next page.
+	r.GET("/me/notifications", func(c *gin.Context) {
+		q := NotificationQuery{UserID: currentUser(c).ID, Unread: c.Query("unread") == "true", Limit: defaultInboxLimit}
+		for name, dst := range map[string]*int64{"limit": new(int64), "cursor": &q.BeforeID} {
+			if v := c.Query(name); v != "" {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil || n < 1 {
+					c.JSON(http.StatusBadRequest, gin.H{"error": name + ": must be a positive number"})
+					return
+				}
+				*dst = n
+				if name == "limit" {
+					q.Limit = min(int(n), maxInboxLimit)
+				}
+			}
+		}
+		// Fetch one extra entry to learn whether there is a next page.
+		pageSize := q.Limit
+		q.Limit++
+		notes, err := s.store.ListNotifications(c.Request.Context(), q)
+		if err != nil {
+			log.Println("ListNotifications error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(notes) > pageSize {
+			notes = notes[:pageSize]
+			c.Header("X-Next-Cursor", strconv.FormatInt(notes[pageSize-1].ID, 10))
+		}
+		c.JSON(http.StatusOK, notes)
+	})
+
+	// GET /me/notifications/unread-count
+	r.GET("/me/notifications/unread-count", func(c *gin.Context) {
+		unread, err := s.store.CountUnreadNotifications(c.Request.Context(), currentUser(c).ID)
+		if err != nil {
+			log.Println("CountUnreadNotifications error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"unread": unread})
+	})
+
+	// POST /me/notifications/:notificationId/read
+	// Marking an entry that is already read is a no-op.
+	r.POST("/me/notifications/:notificationId/read", func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("notificationId"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification ID"})
+			return
+		}
+		marked, err := s.store.MarkNotificationsRead(c.Request.Context(), currentUser(c).ID, time.Now().UTC(), id)
+		if err != nil {
+			log.Println("MarkNotificationsRead error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		respondUnread(c, marked)
+	})
+
+	// POST /me/notifications/read-all
+	r.POST("/me/notifications/read-all", func(c *gin.Context) {
+		marked, err := s.store.MarkNotificationsRead(c.Request.Context(), currentUser(c).ID, time.Now().UTC())
+		if err != nil {
+			log.Println("MarkNotificationsRead error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		respondUnread(c, marked)
+	})
+
+	// GET /me/notification-preferences
+	r.GET("/me/notification-preferences", func(c *gin.Context) {
+		c.JSON(http.StatusOK, currentUser(c).NotificationPrefs)
+	})
+
+	// PUT /me/notification-preferences
+	// Replaces the preferences as a whole.
+	r.PUT("/me/notification-preferences", func(c *gin.Context) {
+		var prefs NotificationPrefs
+		if err := c.BindJSON(&prefs); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		prefs.WebhookURL = strings.TrimSpace(prefs.WebhookURL)
+		if err := prefs.validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := s.store.SetNotificationPrefs(c.Request.Context(), currentUser(c).ID, prefs); err != nil {
+			log.Println("SetNotificationPrefs error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, prefs)
+	})
+}
+
+// actorName names the user of ctx in notification texts.
+func actorName(ctx context.Context) (int64, string) {
+	if user, ok := userFromContext(ctx); ok {
+		return user.ID, cmp.Or(user.FullName, user.Name)
+	}
+	return 0, "Someone"
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestQuietHoursUntil(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := func(d, h, m int) time.Time { return time.Date(2026, 3, d, h, m, 0, 0, loc) }
+	night := &QuietHours{Start: "22:00", End: "07:00"}
+	lunch := &QuietHours{Start: "12:00", End: "13:30"}
+
+	tests := []struct {
+		name string
+		q    *QuietHours
+		now  time.Time
+		want time.Time
+	}{
+		{"no quiet hours", nil, day(2, 23, 0), day(2, 23, 0)},
+		{"before the night", night, day(2, 21, 59), day(2, 21, 59)},
+		{"night starts", night, day(2, 22, 0), day(3, 7, 0)},
+		{"late night", night, day(2, 23, 30), day(3, 7, 0)},
+		{"early morning", night, day(3, 6, 59), day(3, 7, 0)},
+		{"night ends", night, day(3, 7, 0), day(3, 7, 0)},
+		{"before lunch", lunch, day(2, 11, 0), day(2, 11, 0)},
+		{"at lunch", lunch, day(2, 12, 15), day(2, 13, 30)},
+		{"after lunch", lunch, day(2, 13, 30), day(2, 13, 30)},
+		// Clocks go forward on 29 March; quiet hours keep to wall time.
+		{"across a DST change", night, day(28, 23, 0), day(29, 7, 0)},
+	}
+	for _, tt := range tests {
+		if got := tt.q.until(tt.now, loc); !got.Equal(tt.want) {
+			t.Errorf("%s: until(%s) = %s, want %s", tt.name, tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestMentions(t *testing.T) {
+	gone := time.Now()
+	users := []User{
+		{ID: 1, Name: "Ann"},
+		{ID: 2, Name: "Ann Lee"},
+		{ID: 3, Name: "bob"},
+		{ID: 4, Name: "carl", DeactivatedAt: &gone},
+	}
+	tests := []struct {
+		texts []string
+		want  []int64
+	}{
+		{[]string{"no one"}, nil},
+		{[]string{"ping @ann"}, []int64{1}},
+		{[]string{"ping @Ann Lee please"}, []int64{2}},
+		{[]string{"@Ann Lee and @ann"}, []int64{1, 2}},
+		{[]string{"@bob.", "(@ANN)"}, []int64{1, 3}},
+		{[]string{"@bobby and @annie"}, nil},
+		{[]string{"mail bob@example.com"}, nil},
+		{[]string{"@carl is away"}, nil},
+	}
+	for _, tt := range tests {
+		got := slices.Sorted(maps.Keys(mentions(users, tt.texts...)))
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("mentions(%q) = %v, want %v", tt.texts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Role is a user's permission level. Users stored before roles existed have
+// no role and are treated as members.
+type Role string
+
+const (
+	RoleAdmin  Role = "admin"
+	RoleLead   Role = "lead"
+	RoleMember Role = "member"
+	RoleViewer Role = "viewer"
+)
+
+func (r Role) valid() bool {
+	switch r {
+	case RoleAdmin, RoleLead, RoleMember, RoleViewer:
+		return true
+	}
+	return false
+}
+
+func (u User) effectiveRole() Role {
+	if u.Role == "" {
+		return RoleMember
+	}
+	return u.Role
+}
+
+// Action is something a route does, as far as authorization is concerned.
+type Action string
+
+const (
+	ActionRead             Action = "read"
+	ActionTaskCreate       Action = "tasks.create"
+	ActionTaskUpdate       Action = "tasks.update"
+	ActionTaskDelete       Action = "tasks.delete"
+	ActionTaskClear        Action = "tasks.clear"
+	ActionSubtaskWrite     Action = "subtasks.write"
+	ActionAttachmentCreate Action = "attachments.create"
+	ActionAttachmentDelete Action = "attachments.delete"
+	ActionUserManage       Action = "users.manage"
+	ActionTrashPurge       Action = "trash.purge"
+	ActionActivityRead     Action = "activity.read"
+	ActionWebhookManage    Action = "webhooks.manage"
+	ActionStorageRead      Action = "storage.read"
+)
+
+var errForbidden = errors.New("you do not have permission to do this")
+
+// grants lists what each role may always do.
+var grants = map[Role][]Action{
+	RoleAdmin: {
+		ActionRead, ActionTaskCreate, ActionTaskUpdate, ActionTaskDelete, ActionTaskClear,
+		ActionSubtaskWrite, ActionAttachmentCreate, ActionAttachmentDelete, ActionUserManage,
+		ActionTrashPurge, ActionActivityRead, ActionWebhookManage, ActionStorageRead,
+	},
+	RoleLead: {
+		ActionRead, ActionTaskCreate, ActionTaskUpdate, ActionTaskDelete,
+		ActionSubtaskWrite, ActionAttachmentCreate, ActionAttachmentDelete, ActionActivityRead,
+	},
+	RoleMember: {
+		ActionRead, ActionTaskCreate, ActionTaskUpdate, ActionSubtaskWrite, ActionAttachmentCreate,
+	},
+	RoleViewer: {
+		ActionRead,
+	},
+}
+
+// ownerGrants lists what each role may do on a task it is the main assignee
+// of, on top of grants.
+var ownerGrants = map[Role][]Action{
+	RoleMember: {ActionTaskDelete, ActionAttachmentDelete},
+}
+
+// authorize is the single authorization policy for the API. task is the task
+// the action targets, or nil for actions that are not about one task.
+func authorize(user User, action Action, task *Task) error {
+	role := user.effectiveRole()
+	for _, a := range grants[role] {
+		if a == action {
+			return nil
+		}
+	}
+	if task != nil && assignedTo(task.MainAssigneeID, user.ID) {
+		for _, a := range ownerGrants[role] {
+			if a == action {
+				return nil
+			}
+		}
+	}
+	return errForbidden
+}
+
+// authorizeUserEdit decides whether actor may edit the user targetID. Anyone
+// may edit their own profile fields; changing a role or setting a password
+// for someone, or editing another user at all, needs ActionUserManage.
+func authorizeUserEdit(actor User, targetID int64, privileged bool) error {
+	if actor.ID == targetID && !privileged {
+		return nil
+	}
+	return authorize(actor, ActionUserManage, nil)
+}
+
+// allow is route middleware that checks action for the current user.
+func (s *server) allow(action Action) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := authorize(currentUser(c), action, nil); err != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		c.Next()
+	}
+}
+
+// allowTask is like allow for actions on the task named by the :id route
+// parameter, so ownership can be taken into account.
+func (s *server) allowTask(action Action) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		taskID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid task ID"})
+			return
+		}
+		task, err := s.store.GetTask(c.Request.Context(), taskID)
+		if errors.Is(err, ErrNotFound) || (err == nil && task.trashed()) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+			return
+		}
+		if err != nil {
+			log.Println("allowTask GetTask error:", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := authorize(currentUser(c), action, &task); err != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		c.Next()
+	}
+}
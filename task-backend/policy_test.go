@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAuthorizeRoles(t *testing.T) {
+	all := []Action{
+		ActionRead, ActionTaskCreate, ActionTaskUpdate, ActionTaskDelete, ActionTaskClear,
+		ActionSubtaskWrite, ActionAttachmentCreate, ActionAttachmentDelete, ActionUserManage,
+		ActionTrashPurge, ActionActivityRead, ActionWebhookManage, ActionStorageRead,
+	}
+	allowed := map[Role][]Action{
+		RoleAdmin: all,
+		RoleLead: {ActionRead, ActionTaskCreate, ActionTaskUpdate, ActionTaskDelete, ActionSubtaskWrite,
+			ActionAttachmentCreate, ActionAttachmentDelete, ActionActivityRead},
+		RoleMember: {ActionRead, ActionTaskCreate, ActionTaskUpdate, ActionSubtaskWrite, ActionAttachmentCreate},
+		RoleViewer: {ActionRead},
+		// Users stored before roles existed are members.
+		"": {ActionRead, ActionTaskCreate, ActionTaskUpdate, ActionSubtaskWrite, ActionAttachmentCreate},
+	}
+	for role, actions := range allowed {
+		want := map[Action]bool{}
+		for _, a := range actions {
+			want[a] = true
+		}
+		user := User{ID: 7, Role: role}
+		for _, action := range all {
+			err := authorize(user, action, nil)
+			if got := err == nil; got != want[action] {
+				t.Errorf("authorize(%q, %s) allowed = %v, want %v", role, action, got, want[action])
+			}
+		}
+	}
+}
+
+func TestAuthorizeOwnerGrants(t *testing.T) {
+	owner := 7
+	other := 8
+	owned := &Task{ID: 1, MainAssigneeID: &owner}
+	notOwned := &Task{ID: 2, MainAssigneeID: &other}
+	unassigned := &Task{ID: 3}
+
+	tests := []struct {
+		role   Role
+		action Action
+		task   *Task
+		want   bool
+	}{
+		{RoleMember, ActionTaskDelete, owned, true},
+		{RoleMember, ActionAttachmentDelete, owned, true},
+		{RoleMember, ActionTaskDelete, notOwned, false},
+		{RoleMember, ActionTaskDelete, unassigned, false},
+		{RoleMember, ActionTaskDelete, nil, false},
+		{RoleMember, ActionTaskClear, owned, false},
+		{RoleMember, ActionTrashPurge, owned, false},
+		// Viewers get nothing more for owning a task.
+		{RoleViewer, ActionTaskDelete, owned, false},
+		{RoleViewer, ActionTaskUpdate, owned, false},
+		{RoleLead, ActionTaskDelete, notOwned, true},
+	}
+	for _, tt := range tests {
+		err := authorize(User{ID: 7, Role: tt.role}, tt.action, tt.task)
+		if got := err == nil; got != tt.want {
+			t.Errorf("authorize(%s, %s, %+v) allowed = %v, want %v", tt.role, tt.action, tt.task, got, tt.want)
+		}
+	}
+}
+
+func TestAuthorizeUserEdit(t *testing.T) {
+	tests := []struct {
+		name       string
+		actor      User
+		targetID   int64
+		privileged bool
+		want       bool
+	}{
+		{"own profile", User{ID: 1, Role: RoleMember}, 1, false, true},
+		{"own profile as viewer", User{ID: 1, Role: RoleViewer}, 1, false, true},
+		{"own role", User{ID: 1, Role: RoleMember}, 1, true, false},
+		{"someone else", User{ID: 1, Role: RoleLead}, 2, false, false},
+		{"admin on someone else", User{ID: 1, Role: RoleAdmin}, 2, true, true},
+		{"admin on self", User{ID: 1, Role: RoleAdmin}, 1, true, true},
+	}
+	for _, tt := range tests {
+		err := authorizeUserEdit(tt.actor, tt.targetID, tt.privileged)
+		if got := err == nil; got != tt.want {
+			t.Errorf("%s: allowed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAllowTask(t *testing.T) {
+	mem := newMemoryStore()
+	ctx := context.Background()
+	owner := 7
+	owned := Task{Title: "owned", MainAssigneeID: &owner}
+	trashed := Task{Title: "trashed", MainAssigneeID: &owner}
+	for _, task := range []*Task{&owned, &trashed} {
+		if err := mem.CreateTask(ctx, task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mem.TrashTask(ctx, trashed.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	srv := &server{store: mem}
+
+	tests := []struct {
+		name   string
+		user   User
+		action Action
+		taskID string
+		want   int
+	}{
+		{"owner deletes", User{ID: 7, Role: RoleMember}, ActionTaskDelete, "1", http.StatusOK},
+		{"other member deletes", User{ID: 8, Role: RoleMember}, ActionTaskDelete, "1", http.StatusForbidden},
+		{"viewer reads", User{ID: 8, Role: RoleViewer}, ActionRead, "1", http.StatusOK},
+		{"viewer writes", User{ID: 8, Role: RoleViewer}, ActionSubtaskWrite, "1", http.StatusForbidden},
+		{"trashed task", User{ID: 7, Role: RoleAdmin}, ActionRead, "2", http.StatusNotFound},
+		{"missing task", User{ID: 7, Role: RoleAdmin}, ActionRead, "99", http.StatusNotFound},
+		{"bad id", User{ID: 7, Role: RoleAdmin}, ActionRead, "x", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := gin.New()
+		r.Use(func(c *gin.Context) {
+			ctx := context.WithValue(c.Request.Context(), authContextKey{}, authInfo{user: tt.user})
+			c.Request = c.Request.WithContext(ctx)
+		})
+		r.GET("/tasks/:id", srv.allowTask(tt.action), func(c *gin.Context) { c.Status(http.StatusOK) })
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/tasks/"+tt.taskID, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,945 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// server bundles the dependencies shared by the HTTP handlers.
+type server struct {
+	cfg   Config
+	store TaskStore
+	// blobs keeps the bytes of file attachments.
+	blobs BlobStore
+	// uploads limits and tracks file uploads.
+	uploads *uploads
+	// resumable keeps resumable (tus) uploads until they are complete.
+	resumable *resumableUploads
+	auth      *authenticator
+	search    *searchIndex
+	// calendar is the workspace calendar schedules are evaluated in.
+	calendar *Calendar
+	webhooks *webhooks
+	events   *eventHub
+}
+
+// registerPublicRoutes adds the endpoints that work without a token.
+func (s *server) registerPublicRoutes(r gin.IRouter) {
+	// GET /healthz
+	r.GET("/healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+}
+
+// registerRoutes wires the task, subtask and attachment endpoints. Each
+// route declares the Action it needs; see policy.go for who may do what.
+func (s *server) registerRoutes(r gin.IRouter) {
+	store, blobs := s.store, s.blobs
+
+	// GET /tasks/recent
+	r.GET("/tasks/recent", s.allow(ActionRead), func(c *gin.Context) {
+		tasks, err := store.RecentTasks(c.Request.Context(), 5)
+		if err != nil {
+			log.Println("/tasks/recent error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, tasks)
+	})
+
+	// GET /tasks
+	// Filters, sort order and paging are described at parseTaskQuery. When
+	// a limit is given and more tasks follow, the X-Next-Cursor response
+	// header holds the cursor for the next page.
+	r.GET("/tasks", s.allow(ActionRead), func(c *gin.Context) {
+		// Use a fresh context with longer timeout to avoid cancellation
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		// PERFORMANCE: Check if lightweight mode (exclude large base64 URLs)
+		lightweight := c.DefaultQuery("lightweight", "true") == "true"
+
+		query, err := parseTaskQuery(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// Fetch one extra task to learn whether there is a next page.
+		pageSize := query.Limit
+		if pageSize > 0 {
+			query.Limit++
+		}
+		tasks, err := store.ListTasks(ctx, query)
+		if err != nil {
+			log.Println("/tasks error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if pageSize > 0 && len(tasks) > pageSize {
+			tasks = tasks[:pageSize]
+			c.Header("X-Next-Cursor", encodeCursor(query.Sort, tasks[pageSize-1]))
+		}
+
+		// Batch fetch the subtasks and attachments of this page in 2 queries instead of N+1
+		allSubtasks := []Subtask{}
+		allAttachments := []Attachment{}
+		if len(tasks) > 0 {
+			ids := make([]int64, len(tasks))
+			for i, t := range tasks {
+				ids[i] = t.ID
+			}
+			if allSubtasks, err = store.ListSubtasks(ctx, ids...); err != nil {
+				log.Println("subtasks batch fetch error:", err)
+			}
+			if allAttachments, err = store.ListAttachments(ctx, ids...); err != nil {
+				log.Println("attachments batch fetch error:", err)
+			}
+		}
+		attachTaskChildren(tasks, allSubtasks, allAttachments, lightweight)
+		c.JSON(http.StatusOK, tasks)
+	})
+
+	// POST /tasks
+	r.POST("/tasks", s.allow(ActionTaskCreate), func(c *gin.Context) {
+		ctx := c.Request.Context()
+		var task Task
+		if err := c.BindJSON(&task); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if task.Schedule != nil {
+			if _, err := parseSchedule(*task.Schedule); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if task.CreatedAt.IsZero() {
+			task.CreatedAt = time.Now().UTC()
+		}
+		if err := store.CreateTask(ctx, &task); err != nil {
+			log.Println("CreateTask error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Header("ETag", etag(task.Version))
+		c.JSON(http.StatusCreated, task)
+	})
+
+	// GET /tasks/:id
+	// One task with its subtasks and attachments; ?lightweight works as for
+	// GET /tasks. The ETag is the task's version, for If-Match on PUT.
+	r.GET("/tasks/:id", s.allowTask(ActionRead), func(c *gin.Context) {
+		ctx := c.Request.Context()
+		taskID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		lightweight := c.DefaultQuery("lightweight", "true") == "true"
+		task, err := store.GetTask(ctx, taskID)
+		if err != nil {
+			log.Println("GetTask error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		subtasks, err := store.ListSubtasks(ctx, taskID)
+		if err != nil {
+			log.Println("ListSubtasks error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		attachments, err := store.ListAttachments(ctx, taskID)
+		if err != nil {
+			log.Println("ListAttachments error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		tasks := []Task{task}
+		attachTaskChildren(tasks, subtasks, attachments, lightweight)
+		c.Header("ETag", etag(task.Version))
+		c.JSON(http.StatusOK, tasks[0])
+	})
+
+	// PUT /tasks/:id
+	// Changes the fields in taskUpdateFields; other fields give 400. With
+	// If-Match, the update only applies to that version of the task;
+	// otherwise it answers 412 with the current task.
+	r.PUT("/tasks/:id", s.allow(ActionTaskUpdate), func(c *gin.Context) {
+		ctx := c.Request.Context()
+		idNum, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+			return
+		}
+		version, ok := ifMatch(c)
+		if !ok {
+			return
+		}
+		var body map[string]interface{}
+		if err := c.BindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		updateData, err := updateFields(body, taskUpdateFields, &Task{})
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		updated, err := store.UpdateTask(ctx, idNum, version, updateData)
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+			return
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			if current, err := store.GetTask(ctx, idNum); err == nil {
+				versionConflict(c, current.Version, current)
+				return
+			}
+		}
+		if err != nil {
+			log.Println("UpdateTask error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Fetch subtasks for the updated task
+		if subtasks, err := store.ListSubtasks(ctx, updated.ID); err != nil {
+			log.Println("subtasks fetch error:", err)
+		} else {
+			updated.Subtasks = subtasks
+		}
+
+		c.Header("ETag", etag(updated.Version))
+		c.JSON(http.StatusOK, updated)
+	})
+
+	// DELETE /tasks/:id
+	r.DELETE("/tasks/:id", s.allowTask(ActionTaskDelete), func(c *gin.Context) {
+		idNum, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+			return
+		}
+		err = store.TrashTask(c.Request.Context(), idNum, currentUser(c).ID)
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	})
+
+	// POST /tasks/:id/subtasks
+	r.POST("/tasks/:id/subtasks", s.allowTask(ActionSubtaskWrite), func(c *gin.Context) {
+		ctx := c.Request.Context()
+		taskIDNum, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid task ID"})
+			return
+		}
+		var raw map[string]interface{}
+		if err := c.BindJSON(&raw); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		subtask, err := subtaskFromRaw(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		subtask.TaskID = taskIDNum
+		if err := store.CreateSubtask(ctx, &subtask); err != nil {
+			log.Println("CreateSubtask error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Header("ETag", etag(subtask.Version))
+		c.JSON(http.StatusCreated, subtask)
+	})
+
+	// GET /tasks/:id/subtasks/:subtaskId
+	r.GET("/tasks/:id/subtasks/:subtaskId", s.allowTask(ActionRead), func(c *gin.Context) {
+		taskID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		subtaskID, err := strconv.ParseInt(c.Param("subtaskId"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subtask ID"})
+			return
+		}
+		sub := findSubtask(c.Request.Context(), store, taskID, subtaskID)
+		if sub == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subtask not found"})
+			return
+		}
+		c.Header("ETag", etag(sub.Version))
+		c.JSON(http.StatusOK, sub)
+	})
+
+	// PUT /tasks/:id/subtasks/:subtaskId
+	// Fields and If-Match work as for PUT /tasks/:id.
+	r.PUT("/tasks/:id/subtasks/:subtaskId", s.allowTask(ActionSubtaskWrite), func(c *gin.Context) {
+		ctx := c.Request.Context()
+		taskIDNum, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid task ID"})
+			return
+		}
+		subtaskIDNum, err := strconv.ParseInt(c.Param("subtaskId"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subtask ID"})
+			return
+		}
+		version, ok := ifMatch(c)
+		if !ok {
+			return
+		}
+		var body map[string]interface{}
+		if err := c.BindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		updateData, err := updateFields(body, subtaskUpdateFields, &Subtask{})
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		updated, err := store.UpdateSubtask(ctx, taskIDNum, subtaskIDNum, version, updateData)
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subtask not found"})
+			return
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			if current := findSubtask(ctx, store, taskIDNum, subtaskIDNum); current != nil {
+				versionConflict(c, current.Version, current)
+				return
+			}
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Header("ETag", etag(updated.Version))
+		c.JSON(http.StatusOK, updated)
+	})
+
+	// DELETE /tasks/:id/subtasks/:subtaskId
+	r.DELETE("/tasks/:id/subtasks/:subtaskId", s.allowTask(ActionSubtaskWrite), func(c *gin.Context) {
+		taskIDNum, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid task ID"})
+			return
+		}
+		subtaskIDNum, err := strconv.ParseInt(c.Param("subtaskId"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subtask ID"})
+			return
+		}
+		err = store.TrashSubtask(c.Request.Context(), taskIDNum, subtaskIDNum, currentUser(c).ID)
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subtask not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	})
+
+	// POST /tasks/clear
+	r.POST("/tasks/clear", s.allow(ActionTaskClear), func(c *gin.Context) {
+		if err := store.ClearTasks(c.Request.Context(), currentUser(c).ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "cleared"})
+	})
+
+	// GET /tasks/:id/attachments
+	r.GET("/tasks/:id/attachments", s.allowTask(ActionRead), func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		taskIDNum, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid task ID"})
+			return
+		}
+		attachments, err := store.ListAttachments(ctx, taskIDNum)
+		if err != nil {
+			log.Println("attachments fetch error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// Prevent browser from caching large attachment responses (base64 images)
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, attachments)
+	})
+
+	// POST /tasks/:id/attachments
+	// Files come as multipart, links as JSON. A file upload with an
+	// X-Upload-ID header can be followed through GET /uploads/:uploadId.
+	r.POST("/tasks/:id/attachments", s.allowTask(ActionAttachmentCreate), func(c *gin.Context) {
+		taskIDNum, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid task ID"})
+			return
+		}
+
+		var attachment Attachment
+		attachment.TaskID = taskIDNum
+		attachment.CreatedAt = time.Now().UTC()
+
+		var progress *UploadProgress
+		contentType := c.GetHeader("Content-Type")
+		if len(contentType) >= 9 && contentType[:9] == "multipart" {
+			if !s.uploads.acquire() {
+				c.Header("Retry-After", "5")
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many uploads in progress, try again shortly"})
+				return
+			}
+			defer s.uploads.release()
+			uploadID := c.GetHeader("X-Upload-ID")
+			if uploadID != "" && !validUploadID.MatchString(uploadID) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload ID"})
+				return
+			}
+			progress, err = s.uploads.begin(uploadID, currentUser(c).ID, taskIDNum, c.Request.ContentLength)
+			if err != nil {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
+			failed := func(status int, msg string) {
+				s.uploads.update(progress, func(p *UploadProgress) { p.State, p.Error = UploadFailed, msg })
+				c.JSON(status, gin.H{"error": msg})
+			}
+
+			// The file is spooled to disk rather than parsed into memory;
+			// the form fields around it are small.
+			body := http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadSize+1<<20)
+			c.Request.Body = io.NopCloser(&countingReader{r: body, report: func(n int64) {
+				s.uploads.update(progress, func(p *UploadProgress) { p.Received = n })
+			}})
+			mr, err := c.Request.MultipartReader()
+			if err != nil {
+				failed(http.StatusBadRequest, err.Error())
+				return
+			}
+			f, err := spool(mr, s.uploads.spoolDir)
+			if err != nil {
+				log.Println("upload spool error:", err)
+				failed(uploadStatus(err), "Upload failed: "+err.Error())
+				return
+			}
+			defer f.Close()
+
+			attachment.Type = f.fields["type"]
+			attachment.Name = f.fields["name"]
+			mimeType := f.fields["mime_type"]
+			attachment.MimeType = &mimeType
+			if attachment.Name == "" {
+				attachment.Name = f.filename
+			}
+
+			// A file that is stored already, for this task or another, is
+			// not sent again.
+			s.uploads.update(progress, func(p *UploadProgress) { p.State, p.Size = UploadStoring, f.size })
+			storedPath, err := putShared(c.Request.Context(), store, blobs, f.filename, f, f.size, f.sha256, func(n int64) {
+				s.uploads.update(progress, func(p *UploadProgress) { p.Stored = n })
+			})
+			if err != nil {
+				log.Println("file upload error:", err)
+				failed(http.StatusInternalServerError, fmt.Sprintf("Failed to store file: %s", err.Error()))
+				return
+			}
+			attachment.URL = storedPath
+			attachment.Size = f.size
+			attachment.SHA256 = f.sha256
+		} else {
+			// JSON body — link type
+			if err := c.BindJSON(&attachment); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			// A file attachment made here would point at a stored file
+			// it does not own, and delete it when purged.
+			if attachment.Type == "file" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Files must be uploaded as multipart/form-data"})
+				return
+			}
+			attachment.TaskID = taskIDNum
+			// Only files stored here hold a reference to shared storage.
+			attachment.SHA256 = ""
+		}
+
+		if attachment.CreatedAt.IsZero() {
+			attachment.CreatedAt = time.Now().UTC()
+		}
+
+		if err := store.CreateAttachment(c.Request.Context(), &attachment); err != nil {
+			log.Println("CreateAttachment error:", err)
+			if attachment.SHA256 != "" {
+				if err := store.ReleaseBlobs(c.Request.Context(), attachment.SHA256); err != nil {
+					log.Println("ReleaseBlobs error:", err)
+				}
+			}
+			if progress != nil {
+				s.uploads.update(progress, func(p *UploadProgress) { p.State, p.Error = UploadFailed, err.Error() })
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if progress != nil {
+			s.uploads.update(progress, func(p *UploadProgress) { p.State, p.AttachmentID = UploadDone, attachment.ID })
+		}
+		c.JSON(http.StatusCreated, attachment)
+	})
+
+	// GET /tasks/:id/attachments/:attachmentId
+	r.GET("/tasks/:id/attachments/:attachmentId", s.allowTask(ActionRead), func(c *gin.Context) {
+		taskID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		attID, err := strconv.ParseInt(c.Param("attachmentId"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attachment ID"})
+			return
+		}
+		att, err := store.GetAttachment(c.Request.Context(), taskID, attID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+			return
+		}
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, att)
+	})
+
+	// DELETE /tasks/:id/attachments/:attachmentId
+	r.DELETE("/tasks/:id/attachments/:attachmentId", s.allowTask(ActionAttachmentDelete), func(c *gin.Context) {
+		ctx := c.Request.Context()
+		taskIDNum, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid task ID"})
+			return
+		}
+		attachmentIDNum, err := strconv.ParseInt(c.Param("attachmentId"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attachment ID"})
+			return
+		}
+
+		// The stored file stays until the attachment is purged from the trash.
+		err = store.TrashAttachment(ctx, taskIDNum, attachmentIDNum, currentUser(c).ID)
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	})
+
+	// GET /tasks/:id/attachments/:attachmentId/download
+	// Streams the file from attachment storage back to the client. Files whose
+	// size is known support Range requests, so videos can be scrubbed.
+	// Stored files never change, so the ETag and Last-Modified let browsers
+	// revalidate without downloading again.
+	r.GET("/tasks/:id/attachments/:attachmentId/download", s.allowTask(ActionRead), func(c *gin.Context) {
+		ctx := c.Request.Context()
+		taskIDNum, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid task ID"})
+			return
+		}
+		attIDNum, err := strconv.ParseInt(c.Param("attachmentId"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attachment ID"})
+			return
+		}
+
+		att, err := store.GetAttachment(ctx, taskIDNum, attIDNum)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+			return
+		}
+
+		if att.Type != "file" || att.URL == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Not a file attachment"})
+			return
+		}
+
+		mimeType := attachmentMimeType(att, att.Name)
+		if mimeType == "application/octet-stream" {
+			// The stored path keeps the original file name.
+			mimeType = attachmentMimeType(att, att.URL)
+		}
+
+		// ?inline=1 → Content-Disposition: inline (for browser preview)
+		// default → Content-Disposition: attachment (force download)
+		disposition := "attachment"
+		if c.Query("inline") == "1" {
+			disposition = "inline"
+		}
+		if header := mime.FormatMediaType(disposition, map[string]string{"filename": att.Name}); header != "" {
+			disposition = header
+		}
+
+		tag := attachmentETag(att)
+		c.Header("Content-Disposition", disposition)
+		c.Header("Content-Type", mimeType)
+		c.Header("ETag", tag)
+		c.Header("Cache-Control", "private, no-cache")
+		if digest := reprDigest(att.SHA256); digest != "" {
+			c.Header("Repr-Digest", digest)
+		}
+
+		size, ok := attachmentSize(att)
+		if !ok {
+			// Without a size there is no Content-Length or Range support;
+			// the file is streamed whole.
+			if etagListed(c.GetHeader("If-None-Match"), tag) {
+				c.Status(http.StatusNotModified)
+				return
+			}
+			body, err := blobs.Get(ctx, att.URL, 0)
+			if errors.Is(err, ErrNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Stored file not found"})
+				return
+			}
+			if err != nil {
+				log.Println("file download error:", err)
+				c.JSON(http.StatusBadGateway, gin.H{"error": "File storage unavailable"})
+				return
+			}
+			defer body.Close()
+			c.Header("Accept-Ranges", "none")
+			c.Status(http.StatusOK)
+			if _, err := io.Copy(c.Writer, body); err != nil {
+				log.Println("file download stream error:", err)
+			}
+			return
+		}
+
+		// ServeContent answers Range, If-Range, If-None-Match and
+		// If-Modified-Since from the ETag, size and time, and only reads the
+		// file for what it sends. A whole file is checked against its hash
+		// as it goes; if it does not match, the response is cut short
+		// rather than completed with bad data.
+		f := newBlobReader(ctx, blobs, att.URL, size)
+		defer f.Close()
+		if att.SHA256 != "" {
+			f.verify(att.SHA256)
+			defer func() {
+				if !f.corrupt {
+					return
+				}
+				log.Printf("attachment %d: stored file %s is corrupt: it does not match SHA-256 %s", att.ID, att.URL, att.SHA256)
+				// The client may be gone by now; the mark is still due.
+				if err := store.MarkBlobCorrupt(context.WithoutCancel(ctx), att.SHA256, time.Now().UTC()); err != nil {
+					log.Println("MarkBlobCorrupt error:", err)
+				}
+			}()
+		}
+		if !etagListed(c.GetHeader("If-None-Match"), tag) {
+			// Reach the storage before ServeContent commits to a 200, where
+			// it will start reading.
+			f.Seek(rangeStart(c.GetHeader("Range"), size), io.SeekStart)
+			err := f.start()
+			if errors.Is(err, ErrNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Stored file not found"})
+				return
+			}
+			if err != nil {
+				log.Println("file download error:", err)
+				c.JSON(http.StatusBadGateway, gin.H{"error": "File storage unavailable"})
+				return
+			}
+		}
+		http.ServeContent(c.Writer, c.Request, "", att.CreatedAt, f)
+	})
+
+	// GET /storage/corrupt
+	// The stored files that downloads found not matching their hash, with
+	// the key they are stored under. They need restoring from a backup.
+	r.GET("/storage/corrupt", s.allow(ActionStorageRead), func(c *gin.Context) {
+		refs, err := store.ListCorruptBlobs(c.Request.Context())
+		if err != nil {
+			log.Println("ListCorruptBlobs error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, refs)
+	})
+}
+
+// attachTaskChildren stitches subtasks and attachments onto their tasks.
+// In lightweight mode large inline (base64) URLs are stripped; the frontend
+// loads them on demand.
+func attachTaskChildren(tasks []Task, subtasks []Subtask, attachments []Attachment, lightweight bool) {
+	// Build lookup maps for O(1) access
+	subtasksByTaskID := make(map[int64][]Subtask)
+	for _, sub := range subtasks {
+		subtasksByTaskID[sub.TaskID] = append(subtasksByTaskID[sub.TaskID], sub)
+	}
+
+	attachmentsByTaskID := make(map[int64][]Attachment)
+	for _, att := range attachments {
+		attachmentsByTaskID[att.TaskID] = append(attachmentsByTaskID[att.TaskID], att)
+	}
+
+	// Assign subtasks and attachments to tasks
+	for i := range tasks {
+		if subs, ok := subtasksByTaskID[tasks[i].ID]; ok {
+			tasks[i].Subtasks = subs
+		} else {
+			tasks[i].Subtasks = []Subtask{}
+		}
+
+		if atts, ok := attachmentsByTaskID[tasks[i].ID]; ok {
+			// Strip large base64 URLs in lightweight mode
+			if lightweight {
+				for j := range atts {
+					if len(atts[j].URL) > 1000 {
+						atts[j].URL = "" // Will be loaded on-demand
+					}
+				}
+			}
+			tasks[i].Attachments = atts
+		} else {
+			tasks[i].Attachments = []Attachment{}
+		}
+	}
+}
+
+// subtaskFromRaw builds a Subtask from a loosely typed JSON body. The
+// frontend sends supporting_assignees and schedule either as JSON strings or
+// as arrays/objects; both are stored as strings. Only an invalid schedule is
+// an error.
+func subtaskFromRaw(raw map[string]interface{}) (Subtask, error) {
+	subtask := Subtask{}
+	if title, ok := raw["title"].(string); ok {
+		subtask.Title = title
+	}
+	if completed, ok := raw["completed"].(bool); ok {
+		subtask.Completed = completed
+	}
+	if mainAssignee, ok := raw["main_assignee_id"].(float64); ok {
+		v := int(mainAssignee)
+		subtask.MainAssigneeID = &v
+	} else if mainAssignee, ok := raw["main_assignee_id"].(int); ok {
+		subtask.MainAssigneeID = &mainAssignee
+	}
+	if sa, ok := raw["supporting_assignees"]; ok {
+		switch v := sa.(type) {
+		case string:
+			subtask.SupportingAssignees = &v
+		case []interface{}:
+			b, _ := json.Marshal(v)
+			s := string(b)
+			subtask.SupportingAssignees = &s
+		}
+	}
+	schedule, err := scheduleValue(raw["schedule"])
+	subtask.Schedule = schedule
+	return subtask, err
+}
+
+// taskUpdateFields and subtaskUpdateFields are the fields PUT may change.
+// The rest belong to the server: ids, versions, the scheduler's cycle, the
+// completion stamp and the trash stamp.
+var (
+	taskUpdateFields = []string{"title", "description", "priority", "type", "completed", "archived", "pinned",
+		"main_assignee_id", "supporting_assignees", "schedule"}
+	subtaskUpdateFields = []string{"title", "completed", "main_assignee_id", "supporting_assignees", "schedule"}
+)
+
+// echoedFields are server fields that clients sending back a whole task or
+// subtask as they got it include; PUT ignores them. Trash stamps are not
+// among them, as trashed items are never served for editing.
+var echoedFields = []string{"id", "task_id", "version", "created_at", "subtasks", "attachments",
+	"reset_at", "expired_at", "completed_at", "completed_by"}
+
+// updateFields picks the fields to apply from the body of a PUT, refusing
+// any not in writable or echoedFields. The values are checked against
+// model, a pointer to the kind of item updated.
+func updateFields(body map[string]interface{}, writable []string, model any) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	for _, k := range slices.Sorted(maps.Keys(body)) {
+		switch {
+		case slices.Contains(writable, k):
+			fields[k] = body[k]
+		case !slices.Contains(echoedFields, k):
+			return nil, fmt.Errorf("%s cannot be changed", k)
+		}
+	}
+	if sa, ok := fields["supporting_assignees"].([]interface{}); ok {
+		b, _ := json.Marshal(sa)
+		fields["supporting_assignees"] = string(b)
+	}
+	if err := normalizeSchedule(fields); err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, model); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return nil, fmt.Errorf("%s must be %s, not %s", typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+		return nil, err
+	}
+	return fields, nil
+}
+
+// normalizeSchedule validates the schedule of an update body, if it has
+// one, and replaces it with the string to store.
+func normalizeSchedule(fields map[string]interface{}) error {
+	v, ok := fields["schedule"]
+	if !ok {
+		return nil
+	}
+	schedule, err := scheduleValue(v)
+	if err != nil {
+		return err
+	}
+	if schedule == nil {
+		fields["schedule"] = nil
+	} else {
+		fields["schedule"] = *schedule
+	}
+	return nil
+}
+
+// attachmentMimeType picks the Content-Type for a download, preferring the
+// type recorded at upload time.
+func attachmentMimeType(att Attachment, filename string) string {
+	if att.MimeType != nil && *att.MimeType != "" && *att.MimeType != "application/octet-stream" {
+		return *att.MimeType
+	}
+	// Fallback: detect from file extension (mime.TypeByExtension can be unreliable on Windows)
+	ext := strings.ToLower(filepath.Ext(filename))
+	knownMimes := map[string]string{
+		".jpg":  "image/jpeg",
+		".jpeg": "image/jpeg",
+		".jfif": "image/jpeg",
+		".png":  "image/png",
+		".gif":  "image/gif",
+		".webp": "image/webp",
+		".bmp":  "image/bmp",
+		".svg":  "image/svg+xml",
+		".avif": "image/avif",
+		".tiff": "image/tiff",
+		".tif":  "image/tiff",
+		".ico":  "image/x-icon",
+		".heic": "image/heic",
+		".heif": "image/heif",
+		".mp4":  "video/mp4",
+		".webm": "video/webm",
+		".mov":  "video/quicktime",
+		".avi":  "video/x-msvideo",
+		".mkv":  "video/x-matroska",
+		".ogg":  "video/ogg",
+		".pdf":  "application/pdf",
+		".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		".xls":  "application/vnd.ms-excel",
+		".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		".doc":  "application/msword",
+		".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+		".zip":  "application/zip",
+		".txt":  "text/plain",
+		".csv":  "text/csv",
+	}
+	if m, ok := knownMimes[ext]; ok {
+		return m
+	} else if detected := mime.TypeByExtension(ext); detected != "" {
+		return detected
+	}
+	return "application/octet-stream"
+}
+
+// attachmentSize returns the size of a stored file, if it is known. It is
+// a number for uploads through this server but may be a string or missing
+// on older records.
+func attachmentSize(att Attachment) (int64, bool) {
+	var n int64
+	switch v := att.Size.(type) {
+	case int64:
+		n = v
+	case int32:
+		n = int64(v)
+	case int:
+		n = int64(v)
+	case float64:
+		n = int64(v)
+	case string:
+		n, _ = strconv.ParseInt(v, 10, 64)
+	}
+	return n, n > 0
+}
+
+// attachmentETag tags a stored file. Files never change once stored, but
+// ids can be reused by the memory store, so the path is part of the tag.
+func attachmentETag(att Attachment) string {
+	sum := sha256.Sum256([]byte(att.URL))
+	return fmt.Sprintf(`"%d-%x"`, att.ID, sum[:8])
+}
+
+// reprDigest is the Repr-Digest header (RFC 9530) for a file's hex SHA-256,
+// so clients can check what they download; empty if there is no hash.
+func reprDigest(sum string) string {
+	b, err := hex.DecodeString(sum)
+	if err != nil || len(b) != sha256.Size {
+		return ""
+	}
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(b) + ":"
+}
+
+// rangeStart is where the first range of a Range header starts, 0 if
+// there is none or it cannot be read.
+func rangeStart(header string, size int64) int64 {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0
+	}
+	first, _, _ := strings.Cut(spec, ",")
+	from, to, _ := strings.Cut(strings.TrimSpace(first), "-")
+	if from == "" {
+		n, err := strconv.ParseInt(to, 10, 64)
+		if err != nil || n >= size {
+			return 0
+		}
+		return size - n
+	}
+	n, err := strconv.ParseInt(from, 10, 64)
+	if err != nil || n < 0 || n >= size {
+		return 0
+	}
+	return n
+}
+
+// etagListed reports whether an If-None-Match header lists tag.
+func etagListed(header, tag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == tag {
+			return true
+		}
+	}
+	return false
+}
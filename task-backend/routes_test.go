@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testPassword = "secret123"
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// testServer is the API on a memory store, with files kept in a temp
+// directory.
+type testServer struct {
+	*server
+	t       *testing.T
+	handler http.Handler
+	mem     *memoryStore
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.Auth.TokenSecret = "test-secret"
+	cfg.Uploads.ResumableDir = t.TempDir()
+	cfg.Uploads.SpoolDir = t.TempDir()
+	mem := newMemoryStore()
+	auth, err := newAuthenticator(mem, cfg.Auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calendar, err := cfg.Workspace.calendar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs, err := newLocalBlobs(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumable, err := newResumableUploads(cfg.Uploads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &server{cfg: cfg, store: mem, blobs: blobs, uploads: newUploads(cfg.Uploads), resumable: resumable,
+		auth: auth, search: newSearchIndex(), calendar: calendar}
+	return &testServer{server: srv, t: t, handler: srv.router(), mem: mem}
+}
+
+// addUser creates a user with testPassword and returns a token for them.
+func (ts *testServer) addUser(name string, role Role) (User, string) {
+	ts.t.Helper()
+	hash, err := hashPassword(testPassword)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	u := User{Name: name, Role: role, PasswordHash: hash}
+	if err := ts.mem.CreateUser(context.Background(), &u); err != nil {
+		ts.t.Fatal(err)
+	}
+	token, _, _, err := ts.auth.login(context.Background(), name, testPassword)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return u, token
+}
+
+// do sends a request with a JSON body (unless body is nil or already an
+// io.Reader) and the token, if any, as a bearer token.
+func (ts *testServer) do(method, path, token string, body any, headers ...string) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	var r io.Reader
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		r = b
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		r = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, r)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	ts.handler.ServeHTTP(w, req)
+	return w
+}
+
+// createTask creates a task through the API and returns it.
+func (ts *testServer) createTask(token string, fields map[string]any) Task {
+	ts.t.Helper()
+	w := ts.do("POST", "/tasks", token, fields)
+	if w.Code != http.StatusCreated {
+		ts.t.Fatalf("POST /tasks: %d %s", w.Code, w.Body)
+	}
+	var task Task
+	decode(ts.t, w, &task)
+	return task
+}
+
+func decode(t *testing.T, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body, err)
+	}
+}
+
+func taskPath(id int64, rest ...string) string {
+	p := "/tasks/" + strconv.FormatInt(id, 10)
+	for _, r := range rest {
+		p += "/" + r
+	}
+	return p
+}
+
+func TestRoutesNeedToken(t *testing.T) {
+	ts := newTestServer(t)
+	if w := ts.do("GET", "/healthz", "", nil); w.Code != http.StatusOK {
+		t.Errorf("GET /healthz = %d, want 200", w.Code)
+	}
+	if w := ts.do("GET", "/tasks", "", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /tasks without a token = %d, want 401", w.Code)
+	}
+	if w := ts.do("GET", "/tasks", "not-a-token", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /tasks with a bad token = %d, want 401", w.Code)
+	}
+}
+
+func TestTaskCRUD(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.addUser("ada", RoleMember)
+
+	task := ts.createTask(token, map[string]any{"title": "Water the plants"})
+	if task.ID == 0 || task.Title != "Water the plants" || task.Version != 1 {
+		t.Fatalf("created task = %+v", task)
+	}
+
+	w := ts.do("GET", taskPath(task.ID), token, nil)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"1"` {
+		t.Fatalf("GET task: %d, ETag %q", w.Code, w.Header().Get("ETag"))
+	}
+
+	w = ts.do("PUT", taskPath(task.ID), token, map[string]any{"title": "Water the garden"}, "If-Match", `"1"`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT task: %d %s", w.Code, w.Body)
+	}
+	var updated Task
+	decode(t, w, &updated)
+	if updated.Title != "Water the garden" || updated.Version != 2 {
+		t.Errorf("updated task = %+v", updated)
+	}
+
+	w = ts.do("PUT", taskPath(task.ID), token, map[string]any{"title": "stale"}, "If-Match", `"1"`)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("PUT with a stale If-Match = %d, want 412", w.Code)
+	}
+
+	w = ts.do("GET", "/tasks", token, nil)
+	var tasks []Task
+	decode(t, w, &tasks)
+	if len(tasks) != 1 || tasks[0].ID != task.ID {
+		t.Errorf("GET /tasks = %+v", tasks)
+	}
+
+	if w := ts.do("DELETE", taskPath(task.ID), token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("member deleting someone else's task = %d, want 403", w.Code)
+	}
+	_, admin := ts.addUser("root", RoleAdmin)
+	if w := ts.do("DELETE", taskPath(task.ID), admin, nil); w.Code != http.StatusOK {
+		t.Fatalf("DELETE task: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do("GET", taskPath(task.ID), token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET trashed task = %d, want 404", w.Code)
+	}
+}
+
+func TestSubtasksAndLinks(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.addUser("ada", RoleMember)
+	task := ts.createTask(token, map[string]any{"title": "Move house"})
+
+	w := ts.do("POST", taskPath(task.ID, "subtasks"), token, map[string]any{"title": "Pack books"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST subtask: %d %s", w.Code, w.Body)
+	}
+	var sub Subtask
+	decode(t, w, &sub)
+	if sub.TaskID != task.ID || sub.Title != "Pack books" {
+		t.Errorf("created subtask = %+v", sub)
+	}
+	w = ts.do("PUT", taskPath(task.ID, "subtasks", strconv.FormatInt(sub.ID, 10)), token, map[string]any{"completed": true})
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT subtask: %d %s", w.Code, w.Body)
+	}
+
+	w = ts.do("POST", taskPath(task.ID, "attachments"), token, map[string]any{"type": "link", "name": "Movers", "url": "https://example.com"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST link: %d %s", w.Code, w.Body)
+	}
+	w = ts.do("GET", taskPath(task.ID), token, nil)
+	var got Task
+	decode(t, w, &got)
+	if len(got.Subtasks) != 1 || !got.Subtasks[0].Completed || len(got.Attachments) != 1 {
+		t.Errorf("task children = %+v / %+v", got.Subtasks, got.Attachments)
+	}
+}
+
+func TestChildRoutesOfTrashedTask(t *testing.T) {
+	ts := newTestServer(t)
+	_, admin := ts.addUser("root", RoleAdmin)
+	task := ts.createTask(admin, map[string]any{"title": "Old"})
+	w := ts.do("POST", taskPath(task.ID, "subtasks"), admin, map[string]any{"title": "Step"})
+	var sub Subtask
+	decode(t, w, &sub)
+	w = ts.do("POST", taskPath(task.ID, "attachments"), admin, map[string]any{"type": "link", "name": "Doc", "url": "https://example.com"})
+	var att Attachment
+	decode(t, w, &att)
+	if w := ts.do("DELETE", taskPath(task.ID), admin, nil); w.Code != http.StatusOK {
+		t.Fatalf("DELETE task: %d %s", w.Code, w.Body)
+	}
+
+	subPath := taskPath(task.ID, "subtasks", strconv.FormatInt(sub.ID, 10))
+	requests := []struct {
+		method, path string
+		body         any
+	}{
+		{"POST", taskPath(task.ID, "subtasks"), map[string]any{"title": "Another"}},
+		{"PUT", subPath, map[string]any{"completed": true}},
+		{"DELETE", subPath, nil},
+		{"GET", taskPath(task.ID, "attachments"), nil},
+		{"POST", taskPath(task.ID, "attachments"), map[string]any{"type": "link", "name": "More", "url": "https://example.com"}},
+		{"GET", taskPath(task.ID, "attachments", strconv.FormatInt(att.ID, 10), "download"), nil},
+		{"GET", taskPath(task.ID, "history"), nil},
+		{"POST", taskPath(999, "subtasks"), map[string]any{"title": "Orphan"}},
+	}
+	for _, r := range requests {
+		if w := ts.do(r.method, r.path, admin, r.body); w.Code != http.StatusNotFound {
+			t.Errorf("%s %s = %d, want 404", r.method, r.path, w.Code)
+		}
+	}
+}
+
+func TestUpdateRefusesServerFields(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.addUser("ada", RoleMember)
+	task := ts.createTask(token, map[string]any{"title": "Sweep"})
+	w := ts.do("POST", taskPath(task.ID, "subtasks"), token, map[string]any{"title": "Porch"})
+	var sub Subtask
+	decode(t, w, &sub)
+	subPath := taskPath(task.ID, "subtasks", strconv.FormatInt(sub.ID, 10))
+
+	for _, body := range []map[string]any{
+		{"deleted_at": "2026-01-01T00:00:00Z"},
+		{"deleted_by": 1},
+		{"title": "x", "owner": "ada"},
+		{"title": 7},
+		{"completed": "yes"},
+	} {
+		if w := ts.do("PUT", taskPath(task.ID), token, body); w.Code != http.StatusBadRequest {
+			t.Errorf("PUT task %v = %d, want 400", body, w.Code)
+		}
+		if w := ts.do("PUT", subPath, token, body); w.Code != http.StatusBadRequest {
+			t.Errorf("PUT subtask %v = %d, want 400", body, w.Code)
+		}
+	}
+	if w := ts.do("PUT", subPath, token, map[string]any{"archived": true}); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT subtask with a task-only field = %d, want 400", w.Code)
+	}
+
+	// A task sent back whole, as the board does, updates what may change
+	// and leaves the server's fields alone.
+	w = ts.do("GET", taskPath(task.ID), token, nil)
+	var whole map[string]any
+	decode(t, w, &whole)
+	whole["archived"] = true
+	whole["version"] = 40
+	whole["completed_at"] = "2020-01-01T00:00:00Z"
+	w = ts.do("PUT", taskPath(task.ID), token, whole)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT whole task: %d %s", w.Code, w.Body)
+	}
+	var got Task
+	decode(t, w, &got)
+	if !got.Archived || got.Version != 2 || got.CompletedAt != nil || got.trashed() {
+		t.Errorf("updated task = %+v", got)
+	}
+}
+
+func TestCorruptDownloadIsFlagged(t *testing.T) {
+	ts := newTestServer(t)
+	_, admin := ts.addUser("root", RoleAdmin)
+	_, lead := ts.addUser("lee", RoleLead)
+	task := ts.createTask(admin, map[string]any{"title": "Plans"})
+	ctx := context.Background()
+	content := "the floor plan"
+	sum := sha256Hex(content)
+	key, err := putShared(ctx, ts.store, ts.blobs, "plan.txt", strings.NewReader(content), int64(len(content)), sum, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	att := Attachment{TaskID: task.ID, Type: "file", Name: "plan.txt", URL: key, Size: int64(len(content)), SHA256: sum}
+	if err := ts.store.CreateAttachment(ctx, &att); err != nil {
+		t.Fatal(err)
+	}
+	download := taskPath(task.ID, "attachments", strconv.FormatInt(att.ID, 10), "download")
+	if w := ts.do("GET", download, admin, nil); w.Body.String() != content {
+		t.Fatalf("download = %d %q", w.Code, w.Body)
+	}
+	var refs []BlobRef
+	decode(t, ts.do("GET", "/storage/corrupt", admin, nil), &refs)
+	if len(refs) != 0 {
+		t.Fatalf("corrupt blobs before = %+v", refs)
+	}
+
+	path, err := ts.blobs.(*localBlobs).path(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("the floor plot"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if w := ts.do("GET", download, admin, nil); w.Body.String() == content {
+		t.Fatalf("download of the changed file = %q", w.Body)
+	}
+	decode(t, ts.do("GET", "/storage/corrupt", admin, nil), &refs)
+	if len(refs) != 1 || refs[0].SHA256 != sum || refs[0].Key != key || refs[0].CorruptAt == nil {
+		t.Errorf("corrupt blobs = %+v", refs)
+	}
+	if w := ts.do("GET", "/storage/corrupt", lead, nil); w.Code != http.StatusForbidden {
+		t.Errorf("GET /storage/corrupt as a lead = %d, want 403", w.Code)
+	}
+
+	// The next upload of the content is stored anew and takes over the
+	// attachments of the corrupt file, which goes.
+	newKey, err := putShared(ctx, ts.store, ts.blobs, "plan.txt", strings.NewReader(content), int64(len(content)), sum, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newKey == key {
+		t.Fatal("the upload took a reference to the corrupt file")
+	}
+	if ref := ts.mem.blobRefs[sum]; ref.Key != newKey || ref.Refs != 2 || ref.CorruptAt != nil {
+		t.Errorf("blob ref after the upload = %+v", ref)
+	}
+	if w := ts.do("GET", download, admin, nil); w.Body.String() != content {
+		t.Errorf("download after the upload = %d %q", w.Code, w.Body)
+	}
+	if _, queued := ts.mem.deletions[key]; !queued {
+		t.Errorf("corrupt file %s not queued for deletion", key)
+	}
+	decode(t, ts.do("GET", "/storage/corrupt", admin, nil), &refs)
+	if len(refs) != 0 {
+		t.Errorf("corrupt blobs after the upload = %+v", refs)
+	}
+}
+
+// File attachments only come from uploads; one made from JSON could point
+// at a stored file it does not own and delete it when purged.
+func TestFileAttachmentsAreUploaded(t *testing.T) {
+	ts := newTestServer(t)
+	_, admin := ts.addUser("root", RoleAdmin)
+	task := ts.createTask(admin, map[string]any{"title": "Plans"})
+	ctx := context.Background()
+	content := "the floor plan"
+	sum := sha256Hex(content)
+	key, err := putShared(ctx, ts.store, ts.blobs, "plan.txt", strings.NewReader(content), int64(len(content)), sum, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := ts.do("POST", taskPath(task.ID, "attachments"), admin, map[string]any{"type": "file", "name": "Mine now", "url": key})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST a file attachment as JSON = %d, want 400", w.Code)
+	}
+
+	// One from before that check is purged without the file.
+	att := Attachment{TaskID: task.ID, Type: "file", Name: "Mine now", URL: key}
+	if err := ts.mem.CreateAttachment(ctx, &att); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.mem.TrashAttachment(ctx, task.ID, att.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.mem.PurgeTrashItem(ctx, TrashAttachments, att.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, queued := ts.mem.deletions[key]; queued || ts.mem.blobRefs[sum].Refs != 1 {
+		t.Errorf("purge queued %v, left refs %+v", queued, ts.mem.blobRefs[sum])
+	}
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ScheduleMode is the "mode" of a schedule as built by the task and subtask
+// modals of the frontend.
+type ScheduleMode string
+
+const (
+	// ScheduleNone has no deadline.
+	ScheduleNone ScheduleMode = "none"
+	// ScheduleDaily is due every day at DeadlineTime; the window opens at
+	// ResetTime.
+	ScheduleDaily ScheduleMode = "default_daily"
+	// ScheduleMonthly is a rolling cycle of DefaultDays days anchored at
+	// StartedAt, or at the item's creation for older schedules.
+	ScheduleMonthly ScheduleMode = "default_monthly"
+	// ScheduleCountdown ends CountdownSeconds after CountdownStartAt.
+	ScheduleCountdown ScheduleMode = "countdown"
+	// ScheduleDue is due on a date (DueAt), every RepeatDays days at DueTime,
+	// ExpiresInDays after creation, or weekly on DueWeekday.
+	ScheduleDue ScheduleMode = "due"
+)
+
+// Reset policies. A due schedule repeating every N days uses "every_N_days".
+const (
+	ResetNone    = "none"
+	ResetDaily   = "daily"
+	ResetMonthly = "monthly"
+)
+
+const (
+	defaultResetTime    = "08:00"
+	defaultDeadlineTime = "17:00"
+	defaultMonthlyDays  = 30
+	day                 = 24 * time.Hour
+)
+
+// Schedule is the typed form of the JSON string stored in Task.Schedule and
+// Subtask.Schedule. Field names follow the frontend.
+type Schedule struct {
+	Mode  ScheduleMode `json:"mode"`
+	Reset string       `json:"reset,omitempty"`
+
+	// default_daily
+	ResetTime    string `json:"resetTime,omitempty"`
+	DeadlineTime string `json:"deadlineTime,omitempty"`
+
+	// default_monthly
+	DefaultDays int        `json:"defaultDays,omitempty"`
+	StartedAt   *time.Time `json:"startedAt,omitempty"`
+
+	// countdown
+	CountdownSeconds int64      `json:"countdownSeconds,omitempty"`
+	CountdownStartAt *time.Time `json:"countdownStartAt,omitempty"`
+
+	// due
+	DueAt         string `json:"dueAt,omitempty"`
+	DueTime       string `json:"dueTime,omitempty"`
+	RepeatDays    int    `json:"repeatDays,omitempty"`
+	ExpiresInDays int    `json:"expiresInDays,omitempty"`
+	DueWeekday    *int   `json:"dueWeekday,omitempty"`
+}
+
+// parseSchedule decodes and validates a stored schedule. An empty string or
+// "null" is no schedule at all and returns nil.
+func parseSchedule(raw string) (*Schedule, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" || raw == "null" {
+		return nil, nil
+	}
+	var s Schedule
+	if err := json.Unmarshal([]byte(raw), &s); err != nil {
+		return nil, fmt.Errorf("schedule: %w", err)
+	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// scheduleValue validates the schedule of a request body, given either as a
+// JSON string or as an object, and returns it as the string to store. nil
+// clears the schedule.
+func scheduleValue(v any) (*string, error) {
+	var raw string
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		raw = v
+	case map[string]any:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("schedule: %w", err)
+		}
+		raw = string(b)
+	default:
+		return nil, errors.New("schedule: must be a JSON object or a string holding one")
+	}
+	s, err := parseSchedule(raw)
+	if err != nil || s == nil {
+		return nil, err
+	}
+	return &raw, nil
+}
+
+// clockTime parses an "HH:MM" time of day into hours and minutes.
+func clockTime(v string) (int, int, error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%q is not an HH:MM time", v)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// dueDate parses DueAt: a YYYY-MM-DD date from the date pickers, a
+// YYYY-MM-DDTHH:MM local time, or an RFC 3339 timestamp.
+func dueDate(v string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{time.DateOnly, "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, v, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a YYYY-MM-DD date", v)
+}
+
+// repeatReset parses a reset policy of the form "every_N_days".
+func repeatReset(reset string) (int, bool) {
+	n, ok := strings.CutPrefix(reset, "every_")
+	if !ok {
+		return 0, false
+	}
+	n, ok = strings.CutSuffix(n, "_days")
+	if !ok {
+		return 0, false
+	}
+	days, err := strconv.Atoi(n)
+	return days, err == nil && days > 0
+}
+
+// usedFields lists the mode specific fields that are set, by JSON name.
+func (s *Schedule) usedFields() []string {
+	var used []string
+	set := func(name string, ok bool) {
+		if ok {
+			used = append(used, name)
+		}
+	}
+	set("resetTime", s.ResetTime != "")
+	set("deadlineTime", s.DeadlineTime != "")
+	set("defaultDays", s.DefaultDays != 0)
+	set("startedAt", s.StartedAt != nil)
+	set("countdownSeconds", s.CountdownSeconds != 0)
+	set("countdownStartAt", s.CountdownStartAt != nil)
+	set("dueAt", s.DueAt != "")
+	set("dueTime", s.DueTime != "")
+	set("repeatDays", s.RepeatDays != 0)
+	set("expiresInDays", s.ExpiresInDays != 0)
+	set("dueWeekday", s.DueWeekday != nil)
+	return used
+}
+
+var scheduleModeFields = map[ScheduleMode][]string{
+	ScheduleNone:      nil,
+	ScheduleDaily:     {"resetTime", "deadlineTime"},
+	ScheduleMonthly:   {"defaultDays", "startedAt"},
+	ScheduleCountdown: {"countdownSeconds", "countdownStartAt"},
+	ScheduleDue:       {"dueAt", "dueTime", "repeatDays", "expiresInDays", "dueWeekday"},
+}
+
+// validate checks that the fields of the schedule fit its mode, collecting
+// every problem.
+func (s *Schedule) validate() error {
+	allowed, ok := scheduleModeFields[s.Mode]
+	if !ok {
+		return fmt.Errorf("schedule: unknown mode %q (want none, default_daily, default_monthly, countdown or due)", s.Mode)
+	}
+	var errs []error
+	bad := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf("schedule: "+format, args...))
+	}
+	for _, f := range s.usedFields() {
+		if !slices.Contains(allowed, f) {
+			bad("%s does not apply to mode %s", f, s.Mode)
+		}
+	}
+	repeat, isRepeat := repeatReset(s.Reset)
+	switch s.Reset {
+	case "", ResetNone, ResetDaily, ResetMonthly:
+	default:
+		if !isRepeat {
+			bad("unknown reset %q (want none, daily, monthly or every_N_days)", s.Reset)
+		}
+	}
+
+	switch s.Mode {
+	case ScheduleDaily:
+		if _, _, err := clockTime(s.ResetTime); s.ResetTime != "" && err != nil {
+			bad("resetTime: %v", err)
+		}
+		if _, _, err := clockTime(s.DeadlineTime); s.DeadlineTime != "" && err != nil {
+			bad("deadlineTime: %v", err)
+		}
+	case ScheduleMonthly:
+		if s.DefaultDays < 0 {
+			bad("defaultDays must be positive")
+		}
+	case ScheduleCountdown:
+		if s.CountdownSeconds <= 0 {
+			bad("countdownSeconds must be positive")
+		}
+	case ScheduleDue:
+		kinds := 0
+		if s.DueAt != "" {
+			kinds++
+			if _, err := dueDate(s.DueAt, time.UTC); err != nil {
+				bad("dueAt: %v", err)
+			}
+		}
+		if s.RepeatDays != 0 || s.DueTime != "" {
+			kinds++
+			if s.RepeatDays <= 0 {
+				bad("repeatDays must be positive")
+			}
+			if _, _, err := clockTime(s.DueTime); err != nil {
+				bad("dueTime: %v", err)
+			}
+			if isRepeat && repeat != s.RepeatDays {
+				bad("reset %q does not match repeatDays %d", s.Reset, s.RepeatDays)
+			}
+		}
+		if s.ExpiresInDays != 0 {
+			kinds++
+			if s.ExpiresInDays < 0 {
+				bad("expiresInDays must be positive")
+			}
+		}
+		// The subtask modal always sends a weekday; a date takes precedence.
+		if s.DueWeekday != nil {
+			if s.DueAt == "" {
+				kinds++
+			}
+			if *s.DueWeekday < 0 || *s.DueWeekday > 6 {
+				bad("dueWeekday must be 0 (Sunday) to 6 (Saturday)")
+			}
+		}
+		if kinds != 1 {
+			bad("mode due needs exactly one of dueAt, repeatDays with dueTime, expiresInDays or dueWeekday")
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// at returns the given time of day on the calendar day of t in loc.
+func at(t time.Time, clock string, loc *time.Location) time.Time {
+	h, m, _ := clockTime(clock)
+	y, mo, d := t.In(loc).Date()
+	return time.Date(y, mo, d, h, m, 0, 0, loc)
+}
+
+// Deadline returns the deadline of the cycle now falls in, which has passed
+// if the schedule is overdue, and the start of that cycle's window. created
+// is the creation time of the item the schedule belongs to; cal gives the
+// time zone that calendar days and times of day are read in, and the days
+// off. ok is false for schedules without a deadline.
+//
+// The rules follow the board's countdowns: a daily deadline is today's; a
+// monthly cycle ends when the next one starts and so is never overdue; a
+// date is due at its start; a repeating schedule is due at DueTime on every
+// RepeatDays-th day counted from creation and overdue only for the rest of
+// that day; a weekly one is due at the start of DueWeekday. Cycles of the
+// last two start the day after the previous due day.
+//
+// Daily schedules only run on working days: on a day off the cycle is the
+// next working day's. Due dates that land on a day off move to the next
+// working day if the calendar rolls deadlines forward.
+func (s *Schedule) Deadline(now, created time.Time, cal *Calendar) (start, deadline time.Time, ok bool) {
+	if s == nil {
+		return time.Time{}, time.Time{}, false
+	}
+	loc := cal.location()
+	today := at(now, "00:00", loc)
+	switch s.Mode {
+	case ScheduleDaily:
+		day := cal.nextWorkingDay(today)
+		reset, due := cmp.Or(s.ResetTime, defaultResetTime), cmp.Or(s.DeadlineTime, defaultDeadlineTime)
+		return at(day, reset, loc), at(day, due, loc), true
+	case ScheduleMonthly:
+		anchor := created
+		if s.StartedAt != nil {
+			anchor = *s.StartedAt
+		}
+		period := time.Duration(cmp.Or(s.DefaultDays, defaultMonthlyDays)) * day
+		cycles := max(0, now.Sub(anchor)) / period
+		start = anchor.Add(cycles * period)
+		return start, start.Add(period), true
+	case ScheduleCountdown:
+		start = created
+		if s.CountdownStartAt != nil {
+			start = *s.CountdownStartAt
+		}
+		return start, start.Add(time.Duration(s.CountdownSeconds) * time.Second), true
+	case ScheduleDue:
+		start, deadline, ok = s.dueDeadline(today, created, loc)
+		if ok && cal != nil && cal.rollForward {
+			deadline = cal.nextWorkingDay(deadline)
+		}
+		return start, deadline, ok
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// dueDeadline is Deadline for mode due, before rolling forward.
+func (s *Schedule) dueDeadline(today, created time.Time, loc *time.Location) (start, deadline time.Time, ok bool) {
+	switch {
+	case s.DueAt != "":
+		due, err := dueDate(s.DueAt, loc)
+		return created, due, err == nil
+	case s.RepeatDays > 0:
+		days := daysBetween(created, today, loc)
+		next := days + (s.RepeatDays-days%s.RepeatDays)%s.RepeatDays
+		dueDay := at(created, "00:00", loc).AddDate(0, 0, next)
+		return dueDay.AddDate(0, 0, 1-s.RepeatDays), at(dueDay, s.DueTime, loc), true
+	case s.ExpiresInDays > 0:
+		return created, created.Add(time.Duration(s.ExpiresInDays) * day), true
+	case s.DueWeekday != nil:
+		// Due since the start of today if today is the weekday.
+		due := today.AddDate(0, 0, (*s.DueWeekday-int(today.Weekday())+7)%7)
+		return due.AddDate(0, 0, -6), due, true
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// LastReset returns the start of the current cycle of a recurring schedule,
+// the last instant at or before now when a completed item became due again:
+// ResetTime on the last working day for daily schedules, the start of the
+// cycle for monthly ones, and the start of the day after the previous due
+// day for repeating and weekly due schedules. ok is false for schedules that
+// do not recur and before the first cycle has ended.
+func (s *Schedule) LastReset(now, created time.Time, cal *Calendar) (time.Time, bool) {
+	if s == nil {
+		return time.Time{}, false
+	}
+	loc := cal.location()
+	today := at(now, "00:00", loc)
+	switch s.Mode {
+	case ScheduleDaily:
+		clock := cmp.Or(s.ResetTime, defaultResetTime)
+		reset := at(now, clock, loc)
+		for i := 0; i < 366 && (reset.After(now) || cal.dayOff(reset)); i++ {
+			reset = at(reset.AddDate(0, 0, -1), clock, loc)
+		}
+		return reset, !reset.After(now)
+	case ScheduleMonthly:
+		start, _, _ := s.Deadline(now, created, cal)
+		return start, !start.After(now)
+	case ScheduleDue:
+		switch {
+		case s.DueAt != "":
+			return time.Time{}, false
+		case s.RepeatDays > 0:
+			days := daysBetween(created, now, loc)
+			if days < 1 {
+				return time.Time{}, false
+			}
+			return today.AddDate(0, 0, -((days - 1) % s.RepeatDays)), true
+		case s.DueWeekday != nil:
+			back := (int(today.Weekday()) - (*s.DueWeekday+1)%7 + 7) % 7
+			return today.AddDate(0, 0, -back), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// NextDeadline returns the first deadline after now: the current one if it
+// is still ahead, else the next cycle's for schedules that repeat. ok is
+// false when there is none.
+func (s *Schedule) NextDeadline(now, created time.Time, cal *Calendar) (time.Time, bool) {
+	start, deadline, ok := s.Deadline(now, created, cal)
+	if !ok || deadline.After(now) {
+		return deadline, ok
+	}
+	loc := cal.location()
+	var next time.Time
+	switch {
+	case s.Mode == ScheduleDaily:
+		// The cycle after the one starting on start's day.
+		_, next, _ = s.Deadline(at(start, "00:00", loc).AddDate(0, 0, 1), created, cal)
+	case s.Mode == ScheduleDue && s.DueAt == "" && (s.RepeatDays > 0 || s.DueWeekday != nil):
+		// The cycle after the one whose due day is before the deadline
+		// rolled forward.
+		_, raw, _ := s.dueDeadline(at(now, "00:00", loc), created, loc)
+		_, next, _ = s.Deadline(at(raw, "00:00", loc).AddDate(0, 0, 1), created, cal)
+	default:
+		return time.Time{}, false
+	}
+	return next, true
+}
+
+// IsOverdue reports whether the deadline of the current cycle has passed.
+func (s *Schedule) IsOverdue(now, created time.Time, cal *Calendar) bool {
+	_, deadline, ok := s.Deadline(now, created, cal)
+	return ok && !now.Before(deadline)
+}
+
+// TimeRemaining returns the time left until the current deadline, zero once
+// it has passed. ok is false for schedules without a deadline.
+func (s *Schedule) TimeRemaining(now, created time.Time, cal *Calendar) (time.Duration, bool) {
+	_, deadline, ok := s.Deadline(now, created, cal)
+	if !ok {
+		return 0, false
+	}
+	return max(0, deadline.Sub(now)), true
+}
+
+// daysBetween counts the calendar days in loc from the day of a to the day
+// of b.
+func daysBetween(a, b time.Time, loc *time.Location) int {
+	date := func(t time.Time) time.Time {
+		y, m, d := t.In(loc).Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	return int(date(b).Sub(date(a)) / day)
+}
+
+// ScheduleStatus is a schedule evaluated at an instant.
+type ScheduleStatus struct {
+	Schedule         *Schedule  `json:"schedule"`
+	At               time.Time  `json:"at"`
+	WindowStart      *time.Time `json:"window_start,omitempty"`
+	Deadline         *time.Time `json:"deadline,omitempty"`
+	NextDeadline     *time.Time `json:"next_deadline,omitempty"`
+	Overdue          bool       `json:"overdue"`
+	RemainingSeconds *int64     `json:"remaining_seconds,omitempty"`
+}
+
+func (s *Schedule) status(now, created time.Time, cal *Calendar) ScheduleStatus {
+	st := ScheduleStatus{Schedule: s, At: now.In(cal.location())}
+	start, deadline, ok := s.Deadline(now, created, cal)
+	if !ok {
+		return st
+	}
+	st.WindowStart, st.Deadline = &start, &deadline
+	if next, ok := s.NextDeadline(now, created, cal); ok {
+		st.NextDeadline = &next
+	}
+	st.Overdue = s.IsOverdue(now, created, cal)
+	remaining, _ := s.TimeRemaining(now, created, cal)
+	secs := int64(remaining / time.Second)
+	st.RemainingSeconds = &secs
+	return st
+}
+
+// registerScheduleRoutes adds the endpoints that evaluate the schedule of a
+// task or subtask. ?at= (RFC 3339 or YYYY-MM-DD) evaluates it at another
+// instant than now. Items are evaluated in their main assignee's calendar,
+// or the workspace's when unassigned.
+func (s *server) registerScheduleRoutes(r gin.IRouter) {
+	evaluate := func(c *gin.Context, raw *string, created time.Time, assignee *int) {
+		now, err := timeParam(c, "at")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if now.IsZero() {
+			now = time.Now()
+		}
+		var schedule *Schedule
+		if raw != nil {
+			if schedule, err = parseSchedule(*raw); err != nil {
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		cals, err := loadCalendars(c.Request.Context(), s.store, s.calendar)
+		if err != nil {
+			log.Println("loadCalendars error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, schedule.status(now, created, cals.forAssignee(assignee)))
+	}
+
+	// GET /tasks/:id/schedule
+	r.GET("/tasks/:id/schedule", s.allowTask(ActionRead), func(c *gin.Context) {
+		taskID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		task, err := s.store.GetTask(c.Request.Context(), taskID)
+		if err != nil {
+			log.Println("GetTask error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		evaluate(c, task.Schedule, task.CreatedAt, task.MainAssigneeID)
+	})
+
+	// GET /tasks/:id/subtasks/:subtaskId/schedule
+	// Subtasks have no creation time of their own; the task's stands in.
+	r.GET("/tasks/:id/subtasks/:subtaskId/schedule", s.allowTask(ActionRead), func(c *gin.Context) {
+		ctx := c.Request.Context()
+		taskID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		subtaskID, err := strconv.ParseInt(c.Param("subtaskId"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subtask ID"})
+			return
+		}
+		task, err := s.store.GetTask(ctx, taskID)
+		if err != nil {
+			log.Println("GetTask error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		subtasks, err := s.store.ListSubtasks(ctx, taskID)
+		if err != nil {
+			log.Println("ListSubtasks error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for _, sub := range subtasks {
+			if sub.ID == subtaskID {
+				evaluate(c, sub.Schedule, task.CreatedAt, sub.MainAssigneeID)
+				return
+			}
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subtask not found"})
+	})
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// utc parses a "YYYY-MM-DD HH:MM" UTC time; "" is the zero time.
+func utc(t *testing.T, v string) time.Time {
+	t.Helper()
+	if v == "" {
+		return time.Time{}
+	}
+	ts, err := time.Parse("2006-01-02 15:04", v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+func testCalendar(t *testing.T, wc WorkCalendar, rollForward bool) *Calendar {
+	t.Helper()
+	if wc.TimeZone == "" {
+		wc.TimeZone = "UTC"
+	}
+	cal, err := wc.resolve(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cal.rollForward = rollForward
+	return cal
+}
+
+func testSchedule(t *testing.T, raw string) *Schedule {
+	t.Helper()
+	s, err := parseSchedule(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// The calendars of the schedule tests. March 2026 starts on a Sunday; in
+// Berlin the clocks go forward an hour early on Sunday, March 29.
+type testCalendars struct {
+	weekdays, holiday, roll, berlin *Calendar
+}
+
+func newTestCalendars(t *testing.T) testCalendars {
+	weekdays := []string{"mon", "tue", "wed", "thu", "fri"}
+	return testCalendars{
+		weekdays: testCalendar(t, WorkCalendar{WorkingDays: weekdays}, false),
+		holiday:  testCalendar(t, WorkCalendar{WorkingDays: weekdays, Holidays: []string{"2026-03-04", "2026-03-06"}}, false),
+		roll:     testCalendar(t, WorkCalendar{WorkingDays: weekdays, Holidays: []string{"2026-03-06"}}, true),
+		berlin:   testCalendar(t, WorkCalendar{TimeZone: "Europe/Berlin"}, false),
+	}
+}
+
+const (
+	dailySchedule   = `{"mode":"default_daily","resetTime":"08:00","deadlineTime":"17:00"}`
+	weeklySchedule  = `{"mode":"due","dueWeekday":5}`
+	repeatSchedule  = `{"mode":"due","repeatDays":3,"dueTime":"10:00","reset":"every_3_days"}`
+	weekSchedule    = `{"mode":"default_monthly","defaultDays":7}`
+	sundaysSchedule = `{"mode":"due","repeatDays":7,"dueTime":"10:00"}`
+)
+
+func TestScheduleDeadline(t *testing.T) {
+	cals := newTestCalendars(t)
+	created := utc(t, "2026-03-01 15:00")
+	tests := []struct {
+		name            string
+		schedule        string
+		cal             *Calendar
+		now             string
+		start, deadline string
+		ok              bool
+	}{
+		{"no schedule", `{"mode":"none"}`, nil, "2026-03-04 12:00", "", "", false},
+		{"daily before the deadline", dailySchedule, nil, "2026-03-04 12:00", "2026-03-04 08:00", "2026-03-04 17:00", true},
+		{"daily after the deadline", dailySchedule, nil, "2026-03-04 18:00", "2026-03-04 08:00", "2026-03-04 17:00", true},
+		{"daily defaults", `{"mode":"default_daily"}`, nil, "2026-03-04 00:00", "2026-03-04 08:00", "2026-03-04 17:00", true},
+		{"daily on a Saturday", dailySchedule, cals.weekdays, "2026-03-07 10:00", "2026-03-09 08:00", "2026-03-09 17:00", true},
+		{"daily on a holiday", dailySchedule, cals.holiday, "2026-03-04 10:00", "2026-03-05 08:00", "2026-03-05 17:00", true},
+		{"daily the day before the clocks change", dailySchedule, cals.berlin, "2026-03-28 12:00", "2026-03-28 07:00", "2026-03-28 16:00", true},
+		{"daily the day the clocks change", dailySchedule, cals.berlin, "2026-03-29 12:00", "2026-03-29 06:00", "2026-03-29 15:00", true},
+		{"daily late in the evening in Berlin", dailySchedule, cals.berlin, "2026-03-29 22:30", "2026-03-30 06:00", "2026-03-30 15:00", true},
+		{"monthly just before a cycle ends", weekSchedule, nil, "2026-03-15 14:59", "2026-03-08 15:00", "2026-03-15 15:00", true},
+		{"monthly as a cycle starts", weekSchedule, nil, "2026-03-15 15:00", "2026-03-15 15:00", "2026-03-22 15:00", true},
+		{"monthly from startedAt", `{"mode":"default_monthly","startedAt":"2026-02-01T00:00:00Z"}`, nil, "2026-03-04 12:00", "2026-03-03 00:00", "2026-04-02 00:00", true},
+		{"monthly before startedAt", `{"mode":"default_monthly","startedAt":"2026-04-01T00:00:00Z"}`, nil, "2026-03-04 12:00", "2026-04-01 00:00", "2026-05-01 00:00", true},
+		{"countdown", `{"mode":"countdown","countdownSeconds":3600,"countdownStartAt":"2026-03-04T09:30:00Z"}`, nil, "2026-03-04 12:00", "2026-03-04 09:30", "2026-03-04 10:30", true},
+		{"countdown from creation", `{"mode":"countdown","countdownSeconds":60}`, nil, "2026-03-04 12:00", "2026-03-01 15:00", "2026-03-01 15:01", true},
+		{"due date", `{"mode":"due","dueAt":"2026-03-10"}`, nil, "2026-03-04 12:00", "2026-03-01 15:00", "2026-03-10 00:00", true},
+		{"due date in Berlin", `{"mode":"due","dueAt":"2026-03-30"}`, cals.berlin, "2026-03-04 12:00", "2026-03-01 15:00", "2026-03-29 22:00", true},
+		{"due date on a Saturday", `{"mode":"due","dueAt":"2026-03-07"}`, cals.weekdays, "2026-03-04 12:00", "2026-03-01 15:00", "2026-03-07 00:00", true},
+		{"due date rolled past the weekend", `{"mode":"due","dueAt":"2026-03-07"}`, cals.roll, "2026-03-04 12:00", "2026-03-01 15:00", "2026-03-09 00:00", true},
+		{"expires", `{"mode":"due","expiresInDays":2}`, nil, "2026-03-04 12:00", "2026-03-01 15:00", "2026-03-03 15:00", true},
+		{"repeat on the creation day", repeatSchedule, nil, "2026-03-01 16:00", "2026-02-27 00:00", "2026-03-01 10:00", true},
+		{"repeat the day after creation", repeatSchedule, nil, "2026-03-02 00:00", "2026-03-02 00:00", "2026-03-04 10:00", true},
+		{"repeat on the due day", repeatSchedule, nil, "2026-03-04 18:00", "2026-03-02 00:00", "2026-03-04 10:00", true},
+		{"repeat the day after the due day", repeatSchedule, nil, "2026-03-05 00:00", "2026-03-05 00:00", "2026-03-07 10:00", true},
+		{"repeat due on a Sunday rolled to Monday", sundaysSchedule, cals.roll, "2026-03-08 12:00", "2026-03-02 00:00", "2026-03-09 10:00", true},
+		{"weekly before the weekday", weeklySchedule, nil, "2026-03-04 12:00", "2026-02-28 00:00", "2026-03-06 00:00", true},
+		{"weekly on the weekday", weeklySchedule, nil, "2026-03-06 23:59", "2026-02-28 00:00", "2026-03-06 00:00", true},
+		{"weekly the day after", weeklySchedule, nil, "2026-03-07 00:00", "2026-03-07 00:00", "2026-03-13 00:00", true},
+		{"weekly rolled past a holiday", weeklySchedule, cals.roll, "2026-03-05 12:00", "2026-02-28 00:00", "2026-03-09 00:00", true},
+		{"weekly across the clock change", `{"mode":"due","dueWeekday":1}`, cals.berlin, "2026-03-28 12:00", "2026-03-23 23:00", "2026-03-29 22:00", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, deadline, ok := testSchedule(t, tt.schedule).Deadline(utc(t, tt.now), created, tt.cal)
+			if ok != tt.ok || !start.Equal(utc(t, tt.start)) || !deadline.Equal(utc(t, tt.deadline)) {
+				t.Errorf("Deadline = %v, %v, %v; want %s, %s, %v",
+					start.UTC(), deadline.UTC(), ok, tt.start, tt.deadline, tt.ok)
+			}
+		})
+	}
+}
+
+func TestScheduleLastReset(t *testing.T) {
+	cals := newTestCalendars(t)
+	created := utc(t, "2026-03-01 15:00")
+	tests := []struct {
+		name     string
+		schedule string
+		cal      *Calendar
+		now      string
+		want     string
+		ok       bool
+	}{
+		{"daily before the reset time", dailySchedule, nil, "2026-03-04 07:59", "2026-03-03 08:00", true},
+		{"daily at the reset time", dailySchedule, nil, "2026-03-04 08:00", "2026-03-04 08:00", true},
+		{"daily after a weekend", dailySchedule, cals.weekdays, "2026-03-09 07:00", "2026-03-06 08:00", true},
+		{"daily after a holiday and a weekend", dailySchedule, cals.holiday, "2026-03-09 07:00", "2026-03-05 08:00", true},
+		{"daily on the day the clocks change", dailySchedule, cals.berlin, "2026-03-29 07:00", "2026-03-29 06:00", true},
+		{"daily before the reset on that day", dailySchedule, cals.berlin, "2026-03-29 05:30", "2026-03-28 07:00", true},
+		{"monthly", weekSchedule, nil, "2026-03-15 15:00", "2026-03-15 15:00", true},
+		{"monthly before startedAt", `{"mode":"default_monthly","startedAt":"2026-04-01T00:00:00Z"}`, nil, "2026-03-04 12:00", "2026-04-01 00:00", false},
+		{"repeat on the creation day", repeatSchedule, nil, "2026-03-01 20:00", "", false},
+		{"repeat the day after creation", repeatSchedule, nil, "2026-03-02 00:00", "2026-03-02 00:00", true},
+		{"repeat on the due day", repeatSchedule, nil, "2026-03-04 18:00", "2026-03-02 00:00", true},
+		{"repeat the day after the due day", repeatSchedule, nil, "2026-03-05 00:00", "2026-03-05 00:00", true},
+		{"weekly on the weekday", weeklySchedule, nil, "2026-03-06 23:00", "2026-02-28 00:00", true},
+		{"weekly the day after", weeklySchedule, nil, "2026-03-07 00:00", "2026-03-07 00:00", true},
+		{"weekly across the clock change", `{"mode":"due","dueWeekday":1}`, cals.berlin, "2026-03-30 12:00", "2026-03-23 23:00", true},
+		{"due date", `{"mode":"due","dueAt":"2026-03-10"}`, nil, "2026-03-12 00:00", "", false},
+		{"countdown", `{"mode":"countdown","countdownSeconds":60}`, nil, "2026-03-12 00:00", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := testSchedule(t, tt.schedule).LastReset(utc(t, tt.now), created, tt.cal)
+			if ok != tt.ok || !got.Equal(utc(t, tt.want)) {
+				t.Errorf("LastReset = %v, %v; want %s, %v", got.UTC(), ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestScheduleNextDeadline(t *testing.T) {
+	cals := newTestCalendars(t)
+	created := utc(t, "2026-03-01 15:00")
+	tests := []struct {
+		name     string
+		schedule string
+		cal      *Calendar
+		now      string
+		want     string
+		ok       bool
+	}{
+		{"daily before the deadline", dailySchedule, nil, "2026-03-04 12:00", "2026-03-04 17:00", true},
+		{"daily after the deadline", dailySchedule, nil, "2026-03-04 18:00", "2026-03-05 17:00", true},
+		{"daily on a Friday evening", dailySchedule, cals.weekdays, "2026-03-06 18:00", "2026-03-09 17:00", true},
+		{"daily before a holiday", dailySchedule, cals.holiday, "2026-03-03 18:00", "2026-03-05 17:00", true},
+		{"daily before the clocks change", dailySchedule, cals.berlin, "2026-03-28 17:00", "2026-03-29 15:00", true},
+		{"monthly", weekSchedule, nil, "2026-03-15 14:59", "2026-03-15 15:00", true},
+		{"repeat on the due day", repeatSchedule, nil, "2026-03-04 18:00", "2026-03-07 10:00", true},
+		{"repeat on the creation day", repeatSchedule, nil, "2026-03-01 16:00", "2026-03-04 10:00", true},
+		{"weekly on the weekday", weeklySchedule, nil, "2026-03-06 12:00", "2026-03-13 00:00", true},
+		{"weekly before a rolled deadline", weeklySchedule, cals.roll, "2026-03-05 12:00", "2026-03-09 00:00", true},
+		{"due date ahead", `{"mode":"due","dueAt":"2026-03-10"}`, nil, "2026-03-04 12:00", "2026-03-10 00:00", true},
+		{"due date passed", `{"mode":"due","dueAt":"2026-03-01"}`, nil, "2026-03-04 12:00", "", false},
+		{"countdown passed", `{"mode":"countdown","countdownSeconds":60}`, nil, "2026-03-04 12:00", "", false},
+		{"no schedule", `{"mode":"none"}`, nil, "2026-03-04 12:00", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := testSchedule(t, tt.schedule).NextDeadline(utc(t, tt.now), created, tt.cal)
+			if ok != tt.ok || !got.Equal(utc(t, tt.want)) {
+				t.Errorf("NextDeadline = %v, %v; want %s, %v", got.UTC(), ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestEndedCycles(t *testing.T) {
+	cals := newTestCalendars(t)
+	created := utc(t, "2026-03-01 15:00")
+	tests := []struct {
+		name     string
+		schedule string
+		cal      *Calendar
+		from, to string
+		want     []string
+	}{
+		{"daily", dailySchedule, nil, "2026-03-01 08:00", "2026-03-04 08:00",
+			[]string{"2026-03-02 08:00", "2026-03-03 08:00", "2026-03-04 08:00"}},
+		{"daily over a weekend", dailySchedule, cals.weekdays, "2026-03-06 08:00", "2026-03-10 08:00",
+			[]string{"2026-03-09 08:00", "2026-03-10 08:00"}},
+		{"daily over holidays", dailySchedule, cals.holiday, "2026-03-03 08:00", "2026-03-09 08:00",
+			[]string{"2026-03-05 08:00", "2026-03-09 08:00"}},
+		{"daily across the clock change", dailySchedule, cals.berlin, "2026-03-28 07:00", "2026-03-30 06:00",
+			[]string{"2026-03-29 06:00", "2026-03-30 06:00"}},
+		{"monthly", weekSchedule, nil, "2026-03-01 15:00", "2026-03-22 15:00",
+			[]string{"2026-03-08 15:00", "2026-03-15 15:00", "2026-03-22 15:00"}},
+		{"repeat", repeatSchedule, nil, "2026-03-02 00:00", "2026-03-08 00:00",
+			[]string{"2026-03-05 00:00", "2026-03-08 00:00"}},
+		{"weekly", weeklySchedule, nil, "2026-02-28 00:00", "2026-03-14 00:00",
+			[]string{"2026-03-07 00:00", "2026-03-14 00:00"}},
+		{"one cycle", weeklySchedule, nil, "2026-03-07 00:00", "2026-03-14 00:00",
+			[]string{"2026-03-14 00:00"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, start := range testSchedule(t, tt.schedule).endedCycles(utc(t, tt.from), utc(t, tt.to), created, tt.cal) {
+				got = append(got, start.UTC().Format("2006-01-02 15:04"))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("endedCycles = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// The scheduler runs a long way back at most maxCatchUpCycles cycles.
+func TestEndedCyclesBound(t *testing.T) {
+	s := testSchedule(t, dailySchedule)
+	to := utc(t, "2026-03-04 08:00")
+	if got := s.endedCycles(to.AddDate(-5, 0, 0), to, to, nil); len(got) != maxCatchUpCycles || !got[len(got)-1].Equal(to) {
+		t.Errorf("endedCycles over five years = %d cycles ending %v", len(got), got[len(got)-1])
+	}
+}
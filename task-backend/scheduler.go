@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// schedulerLease is the lease that makes a single instance run the
+// scheduler at a time.
+const schedulerLease = "scheduler"
+
+// instanceID names this server process as a lease holder.
+func instanceID() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// schedulerJob is one piece of work the scheduler runs every interval.
+type schedulerJob func(ctx context.Context, now time.Time) error
+
+// runScheduler runs jobs in order every interval for as long as this
+// instance holds the scheduler lease. Jobs work out what to do from the
+// stored state, like schedulePass does, so a run after downtime catches up
+// and a run repeated by another instance changes nothing.
+func runScheduler(ctx context.Context, store TaskStore, holder string, interval time.Duration, jobs ...schedulerJob) {
+	ttl := max(3*interval, time.Minute)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		held, err := store.AcquireLease(ctx, schedulerLease, holder, ttl)
+		if err != nil {
+			log.Println("scheduler lease error:", err)
+		} else if held {
+			for _, job := range jobs {
+				if err := job(ctx, time.Now()); err != nil {
+					log.Println("scheduler error:", err)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			if err := store.ReleaseLease(context.Background(), schedulerLease, holder); err != nil {
+				log.Println("scheduler lease release error:", err)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// maxCatchUpCycles bounds how many ended cycles one reset records.
+const maxCatchUpCycles = 400
+
+// cycleItem is a task or subtask as far as the scheduler is concerned.
+type cycleItem struct {
+	entity     EntityKind
+	id, taskID int64
+	completed  bool
+	assignee   *int
+	cycle      Cycle
+	// created anchors schedules that count from the item's creation.
+	created time.Time
+	// cal is the main assignee's calendar, or the workspace's.
+	cal *Calendar
+}
+
+// endedCycles returns the starts of the cycles that began after from, up to
+// and including the one starting at to, oldest first.
+func (s *Schedule) endedCycles(from, to, created time.Time, cal *Calendar) []time.Time {
+	starts := []time.Time{to}
+	for len(starts) < maxCatchUpCycles {
+		prev, ok := s.LastReset(starts[0].Add(-time.Nanosecond), created, cal)
+		if !ok || !prev.After(from) {
+			break
+		}
+		starts = append([]time.Time{prev}, starts...)
+	}
+	return starts
+}
+
+// cycleFields works out the update that brings an item's Cycle up to date
+// with its schedule at now, and the completion records of the cycles that
+// ended since the last reset; an item with records entered a new cycle.
+//
+// An item the scheduler has not seen before adopts its current cycle without
+// a reset: the cycle it was completed in is not known. A completion stamped
+// after the new cycle began counts for the new cycle and survives the reset.
+func cycleFields(s *Schedule, item cycleItem, now time.Time) (map[string]any, []Completion) {
+	fields := map[string]any{}
+	var ended []Completion
+	c := item.cycle
+	if start, ok := s.LastReset(now, item.created, item.cal); ok && (c.ResetAt == nil || start.After(*c.ResetAt)) {
+		fields["reset_at"] = start
+		if c.ResetAt != nil {
+			// A completion stamped in the new cycle survives the reset. Else
+			// it counts for the cycle it was stamped in, or the oldest one.
+			doneBefore := item.completed && (c.CompletedAt == nil || c.CompletedAt.Before(start))
+			from := *c.ResetAt
+			for _, end := range s.endedCycles(from, start, item.created, item.cal) {
+				rec := Completion{Entity: item.entity, ItemID: item.id, TaskID: item.taskID, AssigneeID: item.assignee, CycleStart: from, CycleEnd: end}
+				if doneBefore && (c.CompletedAt == nil || c.CompletedAt.Before(end)) {
+					rec.Done, rec.DoneBy, rec.DoneAt = true, c.CompletedBy, c.CompletedAt
+					doneBefore = false
+				}
+				ended = append(ended, rec)
+				from = end
+			}
+			if item.completed && (c.CompletedAt == nil || c.CompletedAt.Before(start)) {
+				fields["completed"] = false
+			}
+			if s.Mode == ScheduleMonthly {
+				// Move the anchor up so that the frontend's countdown and
+				// ours keep counting from the current cycle.
+				next := *s
+				next.StartedAt = &start
+				raw, _ := json.Marshal(next)
+				fields["schedule"] = string(raw)
+			}
+		}
+	}
+	if s.Mode == ScheduleCountdown {
+		if _, end, _ := s.Deadline(now, item.created, item.cal); !now.Before(end) && (c.ExpiredAt == nil || c.ExpiredAt.Before(end)) {
+			fields["expired_at"] = end
+		}
+	}
+	return fields, ended
+}
+
+// schedulePass resets the tasks and subtasks whose schedules started a new
+// cycle, recording how the cycles that ended went, and marks countdowns that
+// ran out. It works out the current state from the schedules and the Cycle
+// stamped on each item, so it catches up after downtime and repeating it
+// changes nothing. The subtasks of a task that resets are unchecked with it,
+// or in a later pass if they cannot be updated in the same one. Archived
+// tasks and their subtasks are left alone, as are items with unreadable
+// schedules. Items follow their main assignee's calendar, or the
+// workspace's when unassigned. An item changed by someone else while the
+// pass runs is left for the next one.
+func schedulePass(ctx context.Context, store TaskStore, now time.Time, workspace *Calendar) error {
+	cals, err := loadCalendars(ctx, store, workspace)
+	if err != nil {
+		return err
+	}
+	archived := false
+	tasks, err := store.ListTasks(ctx, TaskQuery{Archived: &archived})
+	if err != nil {
+		return err
+	}
+	subtasks, err := store.ListSubtasks(ctx)
+	if err != nil {
+		return err
+	}
+	byTask := map[int64][]Subtask{}
+	for _, sub := range subtasks {
+		byTask[sub.TaskID] = append(byTask[sub.TaskID], sub)
+	}
+
+	var resets, expiries int
+	// apply brings one item up to date and returns the start of its new
+	// cycle if it was reset.
+	apply := func(raw *string, item cycleItem, extra map[string]any, update func(map[string]any) error) (*time.Time, error) {
+		fields, ended := map[string]any{}, []Completion(nil)
+		if raw != nil {
+			s, err := parseSchedule(*raw)
+			if err != nil {
+				log.Printf("scheduler: %s %d: %v", item.entity, item.id, err)
+			} else if s != nil {
+				fields, ended = cycleFields(s, item, now)
+			}
+		}
+		for k, v := range extra {
+			fields[k] = v
+		}
+		if len(fields) == 0 {
+			return nil, nil
+		}
+		if len(ended) > 0 {
+			if err := store.RecordCompletions(ctx, ended...); err != nil {
+				return nil, fmt.Errorf("recording completions of %s %d: %w", item.entity, item.id, err)
+			}
+		}
+		err := update(fields)
+		if errors.Is(err, ErrVersionConflict) {
+			// Someone changed the item since it was read. The next pass
+			// starts over from what they left; the completions just
+			// recorded come out the same then.
+			log.Printf("scheduler: %s %d changed meanwhile, left for the next pass", item.entity, item.id)
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("updating %s %d: %w", item.entity, item.id, err)
+		}
+		expiries += countIf(fields["expired_at"] != nil)
+		if len(ended) == 0 {
+			return nil, nil
+		}
+		resets++
+		start := fields["reset_at"].(time.Time)
+		return &start, nil
+	}
+
+	for _, task := range tasks {
+		item := cycleItem{entity: EntityTask, id: task.ID, taskID: task.ID, completed: task.Completed,
+			assignee: task.MainAssigneeID, cycle: task.Cycle, created: task.CreatedAt, cal: cals.forAssignee(task.MainAssigneeID)}
+		taskReset, err := apply(task.Schedule, item, nil, func(fields map[string]any) error {
+			_, err := store.UpdateTask(ctx, task.ID, task.Version, fields)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		// Subtasks completed before the task's current cycle began are
+		// unchecked, also when an earlier pass reset the task but could
+		// not update them. Completions without a time only go with a
+		// reset in this pass.
+		resetAt := task.ResetAt
+		if taskReset != nil {
+			resetAt = taskReset
+		}
+		for _, sub := range byTask[task.ID] {
+			var extra map[string]any
+			if sub.Completed && resetAt != nil &&
+				(sub.CompletedAt != nil && sub.CompletedAt.Before(*resetAt) || sub.CompletedAt == nil && taskReset != nil) {
+				extra = map[string]any{"completed": false}
+			}
+			// Subtasks have no creation time; the task's stands in.
+			item := cycleItem{entity: EntitySubtask, id: sub.ID, taskID: task.ID, completed: sub.Completed,
+				assignee: sub.MainAssigneeID, cycle: sub.Cycle, created: task.CreatedAt, cal: cals.forAssignee(sub.MainAssigneeID)}
+			_, err := apply(sub.Schedule, item, extra, func(fields map[string]any) error {
+				_, err := store.UpdateSubtask(ctx, task.ID, sub.ID, sub.Version, fields)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if resets > 0 || expiries > 0 {
+		log.Printf("scheduler: %d resets, %d countdowns expired", resets, expiries)
+	}
+	return nil
+}
+
+func countIf(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
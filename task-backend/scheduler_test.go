@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// racingStore lets edit run just before the first task update goes
+// through, as if a user saved the task while a pass was under way.
+type racingStore struct {
+	TaskStore
+	edit func()
+}
+
+func (s *racingStore) UpdateTask(ctx context.Context, id, version int64, fields map[string]any) (Task, error) {
+	if s.edit != nil {
+		edit := s.edit
+		s.edit = nil
+		edit()
+	}
+	return s.TaskStore.UpdateTask(ctx, id, version, fields)
+}
+
+func TestSchedulePassKeepsConcurrentCompletion(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemoryStore()
+	cal, err := defaultConfig().Workspace.calendar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	lastReset, doneAt := now.Add(-72*time.Hour), now.Add(-71*time.Hour)
+	// The memory store decodes updates into the stored pointers, so the
+	// task gets copies.
+	resetAt, completedAt := lastReset, doneAt
+	schedule := `{"mode":"default_daily","resetTime":"00:00"}`
+	task := Task{Title: "Feed the cat", Schedule: &schedule, Completed: true,
+		Cycle: Cycle{ResetAt: &resetAt, CompletedAt: &completedAt}}
+	if err := mem.CreateTask(ctx, &task); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cat gets fed again, in the new cycle, while the pass is about to
+	// reset yesterday's completion.
+	by := int64(3)
+	store := &racingStore{TaskStore: mem, edit: func() {
+		if _, err := mem.UpdateTask(ctx, task.ID, anyVersion, map[string]any{
+			"completed": true, "completed_at": now, "completed_by": by}); err != nil {
+			t.Fatal(err)
+		}
+	}}
+	if err := schedulePass(ctx, store, now, cal); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := mem.GetTask(ctx, task.ID)
+	if !got.Completed {
+		t.Fatal("the pass unchecked a task completed while it ran")
+	}
+
+	// The next pass resets the cycle and keeps the new completion.
+	if err := schedulePass(ctx, store, now, cal); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = mem.GetTask(ctx, task.ID)
+	if !got.Completed || got.ResetAt == nil || !got.ResetAt.After(lastReset) {
+		t.Errorf("after the next pass: completed %v, reset at %v", got.Completed, got.ResetAt)
+	}
+	done, err := mem.ListCompletions(ctx, CompletionQuery{ItemID: task.ID})
+	if err != nil || len(done) == 0 || !done[len(done)-1].Done {
+		t.Errorf("completions = %+v, %v; want the oldest ended cycle done", done, err)
+	}
+}
+
+// A subtask the pass that reset its task could not uncheck is unchecked by
+// the next one, although the task does not reset again.
+func TestSchedulePassUnchecksSubtasksLeftBehind(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemoryStore()
+	now := time.Now().UTC()
+	resetAt, before, after := now.Add(-2*time.Hour), now.Add(-26*time.Hour), now.Add(-time.Hour)
+	schedule := `{"mode":"default_monthly","defaultDays":30}`
+	task := Task{Title: "Water the plants", Schedule: &schedule, Cycle: Cycle{ResetAt: &resetAt}}
+	task.CreatedAt = resetAt
+	if err := mem.CreateTask(ctx, &task); err != nil {
+		t.Fatal(err)
+	}
+	subs := []Subtask{
+		{TaskID: task.ID, Title: "Ferns", Completed: true, Cycle: Cycle{CompletedAt: &before}},
+		{TaskID: task.ID, Title: "Cacti", Completed: true, Cycle: Cycle{CompletedAt: &after}},
+		{TaskID: task.ID, Title: "Orchids", Completed: true},
+	}
+	for i := range subs {
+		if err := mem.CreateSubtask(ctx, &subs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := schedulePass(ctx, mem, now, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := mem.ListSubtasks(ctx, task.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	completed := map[string]bool{}
+	for _, sub := range got {
+		completed[sub.Title] = sub.Completed
+	}
+	if completed["Ferns"] || !completed["Cacti"] || !completed["Orchids"] {
+		t.Errorf("completed after the pass = %v, want only Ferns unchecked", completed)
+	}
+	if got, _ := mem.GetTask(ctx, task.ID); !got.ResetAt.Equal(resetAt) {
+		t.Errorf("task reset again at %v", got.ResetAt)
+	}
+}
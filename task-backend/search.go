@@ -0,0 +1,433 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"html"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	// snippetRunes is roughly how much of a long field a highlight shows.
+	snippetRunes = 160
+)
+
+// SearchHit is one result of GET /search. Highlights maps the matched
+// fields to HTML-escaped text in which the matching words are wrapped in
+// <mark></mark>.
+type SearchHit struct {
+	Kind       EntityKind        `json:"kind"`
+	ID         int64             `json:"id"`
+	TaskID     int64             `json:"task_id"`
+	TaskTitle  string            `json:"task_title"`
+	Title      string            `json:"title"`
+	Score      float64           `json:"score"`
+	Highlights map[string]string `json:"highlights"`
+}
+
+type docKey struct {
+	kind EntityKind
+	id   int64
+}
+
+type searchField struct {
+	name   string
+	text   string
+	weight float64
+}
+
+type searchDoc struct {
+	key    docKey
+	taskID int64
+	title  string
+	fields []searchField
+}
+
+// searchIndex is an in-process inverted index over the text of live tasks,
+// subtasks and attachments. Writes through searchStore keep it current on
+// this instance; a periodic rebuild picks up writes made by other
+// instances.
+type searchIndex struct {
+	mu sync.RWMutex
+	// postings maps a term to the documents containing it and the term's
+	// weight in each: field weight times a saturated term frequency.
+	postings map[string]map[docKey]float64
+	docs     map[docKey]*searchDoc
+	byTask   map[int64][]docKey
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: map[string]map[docKey]float64{},
+		docs:     map[docKey]*searchDoc{},
+		byTask:   map[int64][]docKey{},
+	}
+}
+
+// token is a word of a text with its byte range.
+type token struct {
+	term       string
+	start, end int
+}
+
+// tokenize splits text into lower-cased runs of letters and digits.
+func tokenize(text string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range text {
+		word := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case word && start < 0:
+			start = i
+		case !word && start >= 0:
+			tokens = append(tokens, token{strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{strings.ToLower(text[start:]), start, len(text)})
+	}
+	return tokens
+}
+
+func taskDoc(t Task) *searchDoc {
+	fields := []searchField{{"title", t.Title, 3}}
+	if t.Description != nil {
+		fields = append(fields, searchField{"description", *t.Description, 1})
+	}
+	return &searchDoc{key: docKey{EntityTask, t.ID}, taskID: t.ID, title: t.Title, fields: fields}
+}
+
+func subtaskDoc(s Subtask) *searchDoc {
+	return &searchDoc{key: docKey{EntitySubtask, s.ID}, taskID: s.TaskID, title: s.Title,
+		fields: []searchField{{"title", s.Title, 2}}}
+}
+
+func attachmentDoc(a Attachment) *searchDoc {
+	return &searchDoc{key: docKey{EntityAttachment, a.ID}, taskID: a.TaskID, title: a.Name,
+		fields: []searchField{{"name", a.Name, 2}}}
+}
+
+// termWeights returns the weight of every term of doc.
+func (d *searchDoc) termWeights() map[string]float64 {
+	weights := map[string]float64{}
+	for _, f := range d.fields {
+		tf := map[string]int{}
+		for _, tok := range tokenize(f.text) {
+			tf[tok.term]++
+		}
+		for term, n := range tf {
+			weights[term] += f.weight * float64(n) / (float64(n) + 1.2)
+		}
+	}
+	return weights
+}
+
+func (idx *searchIndex) addLocked(d *searchDoc) {
+	idx.removeLocked(d.key)
+	idx.docs[d.key] = d
+	idx.byTask[d.taskID] = append(idx.byTask[d.taskID], d.key)
+	for term, w := range d.termWeights() {
+		if idx.postings[term] == nil {
+			idx.postings[term] = map[docKey]float64{}
+		}
+		idx.postings[term][d.key] = w
+	}
+}
+
+func (idx *searchIndex) removeLocked(key docKey) {
+	d, ok := idx.docs[key]
+	if !ok {
+		return
+	}
+	for term := range d.termWeights() {
+		delete(idx.postings[term], key)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	delete(idx.docs, key)
+	idx.byTask[d.taskID] = slices.DeleteFunc(idx.byTask[d.taskID], func(k docKey) bool { return k == key })
+	if len(idx.byTask[d.taskID]) == 0 {
+		delete(idx.byTask, d.taskID)
+	}
+}
+
+// replaceTask swaps every document of one task for docs (none if the task
+// is gone or trashed).
+func (idx *searchIndex) replaceTask(taskID int64, docs []*searchDoc) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, key := range slices.Clone(idx.byTask[taskID]) {
+		idx.removeLocked(key)
+	}
+	for _, d := range docs {
+		idx.addLocked(d)
+	}
+}
+
+// taskDocs loads the searchable documents of one task from the store.
+func taskDocs(ctx context.Context, store TaskStore, taskID int64) ([]*searchDoc, error) {
+	task, err := store.GetTask(ctx, taskID)
+	if errors.Is(err, ErrNotFound) || (err == nil && task.trashed()) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	subs, err := store.ListSubtasks(ctx, taskID)
+	if err != nil {
+		return nil, err
+	}
+	atts, err := store.ListAttachments(ctx, taskID)
+	if err != nil {
+		return nil, err
+	}
+	docs := []*searchDoc{taskDoc(task)}
+	for _, s := range subs {
+		docs = append(docs, subtaskDoc(s))
+	}
+	for _, a := range atts {
+		docs = append(docs, attachmentDoc(a))
+	}
+	return docs, nil
+}
+
+// refreshTask re-reads one task from the store into the index.
+func (idx *searchIndex) refreshTask(ctx context.Context, store TaskStore, taskID int64) error {
+	docs, err := taskDocs(ctx, store, taskID)
+	if err != nil {
+		return err
+	}
+	idx.replaceTask(taskID, docs)
+	return nil
+}
+
+// rebuild reloads the whole index from the store.
+func (idx *searchIndex) rebuild(ctx context.Context, store TaskStore) error {
+	tasks, err := store.ListTasks(ctx, TaskQuery{})
+	if err != nil {
+		return err
+	}
+	subs, err := store.ListSubtasks(ctx)
+	if err != nil {
+		return err
+	}
+	atts, err := store.ListAttachments(ctx)
+	if err != nil {
+		return err
+	}
+	fresh := newSearchIndex()
+	live := make(map[int64]bool, len(tasks))
+	for _, t := range tasks {
+		live[t.ID] = true
+		fresh.addLocked(taskDoc(t))
+	}
+	for _, s := range subs {
+		if live[s.TaskID] {
+			fresh.addLocked(subtaskDoc(s))
+		}
+	}
+	for _, a := range atts {
+		if live[a.TaskID] {
+			fresh.addLocked(attachmentDoc(a))
+		}
+	}
+	idx.mu.Lock()
+	idx.postings, idx.docs, idx.byTask = fresh.postings, fresh.docs, fresh.byTask
+	idx.mu.Unlock()
+	return nil
+}
+
+// runSearchRefresher rebuilds the index every interval until ctx is
+// cancelled.
+func runSearchRefresher(ctx context.Context, idx *searchIndex, store TaskStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := idx.rebuild(ctx, store); err != nil {
+			log.Println("search index rebuild error:", err)
+		}
+	}
+}
+
+// search returns the documents matching every word of query, best first.
+// The last word also matches as a prefix, so results follow as you type;
+// prefix matches score lower than whole words.
+func (idx *searchIndex) search(query string, limit int) []SearchHit {
+	var terms []string
+	for _, tok := range tokenize(query) {
+		if !slices.Contains(terms, tok.term) {
+			terms = append(terms, tok.term)
+		}
+	}
+	if len(terms) == 0 {
+		return []SearchHit{}
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	n := float64(len(idx.docs))
+	scores := map[docKey]float64{}
+	matched := map[string]bool{} // index terms to highlight
+	for i, qt := range terms {
+		prefix := i == len(terms)-1
+		termScores := map[docKey]float64{}
+		for term, posting := range idx.postings {
+			boost := 1.0
+			if term != qt {
+				if !prefix || !strings.HasPrefix(term, qt) {
+					continue
+				}
+				boost = 0.6
+			}
+			matched[term] = true
+			df := float64(len(posting))
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			for key, w := range posting {
+				termScores[key] = max(termScores[key], boost*idf*w)
+			}
+		}
+		// Every word has to match.
+		if i == 0 {
+			scores = termScores
+			continue
+		}
+		for key := range scores {
+			if s, ok := termScores[key]; ok {
+				scores[key] += s
+			} else {
+				delete(scores, key)
+			}
+		}
+	}
+
+	hits := make([]SearchHit, 0, len(scores))
+	for key, score := range scores {
+		d := idx.docs[key]
+		hit := SearchHit{
+			Kind:       key.kind,
+			ID:         key.id,
+			TaskID:     d.taskID,
+			Title:      d.title,
+			Score:      math.Round(score*1000) / 1000,
+			Highlights: map[string]string{},
+		}
+		if t, ok := idx.docs[docKey{EntityTask, d.taskID}]; ok {
+			hit.TaskTitle = t.title
+		}
+		for _, f := range d.fields {
+			if h, ok := highlight(f.text, matched); ok {
+				hit.Highlights[f.name] = h
+			}
+		}
+		hits = append(hits, hit)
+	}
+	slices.SortFunc(hits, func(a, b SearchHit) int {
+		if c := cmp.Compare(b.Score, a.Score); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.ID, a.ID)
+	})
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits
+}
+
+// highlight marks the words of text that are in terms. Long texts are cut
+// to a snippet around the first match. ok is false when nothing matched.
+func highlight(text string, terms map[string]bool) (string, bool) {
+	var marks []token
+	for _, tok := range tokenize(text) {
+		if terms[tok.term] {
+			marks = append(marks, tok)
+		}
+	}
+	if len(marks) == 0 {
+		return "", false
+	}
+
+	from, to := 0, len(text)
+	if utf8.RuneCountInString(text) > snippetRunes {
+		from = backRunes(text, marks[0].start, snippetRunes/4)
+		to = forwardRunes(text, from, snippetRunes)
+	}
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("…")
+	}
+	pos := from
+	for _, m := range marks {
+		if m.start < from || m.end > to {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[pos:m.start]))
+		b.WriteString("<mark>" + html.EscapeString(text[m.start:m.end]) + "</mark>")
+		pos = m.end
+	}
+	b.WriteString(html.EscapeString(text[pos:to]))
+	if to < len(text) {
+		b.WriteString("…")
+	}
+	return b.String(), true
+}
+
+// backRunes returns the byte offset n runes before i in s.
+func backRunes(s string, i, n int) int {
+	for ; n > 0 && i > 0; n-- {
+		_, size := utf8.DecodeLastRuneInString(s[:i])
+		i -= size
+	}
+	return i
+}
+
+// forwardRunes returns the byte offset n runes after i in s.
+func forwardRunes(s string, i, n int) int {
+	for ; n > 0 && i < len(s); n-- {
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+	}
+	return i
+}
+
+// registerSearchRoutes adds GET /search.
+func (s *server) registerSearchRoutes(r gin.IRouter) {
+	// GET /search?q=&limit=
+	r.GET("/search", s.allow(ActionRead), func(c *gin.Context) {
+		q := strings.TrimSpace(c.Query("q"))
+		if q == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "q is required"})
+			return
+		}
+		limit := defaultSearchLimit
+		if v := c.Query("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit: must be a positive number"})
+				return
+			}
+			limit = min(n, maxSearchLimit)
+		}
+		c.JSON(http.StatusOK, s.search.search(q, limit))
+	})
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned by a TaskStore when the requested document does
+// not exist. Handlers map it to a 404.
+var ErrNotFound = errors.New("not found")
+
+// ErrVersionConflict is returned by a conditional update when the stored
+// version is not the one the caller expected. Handlers map it to a 412.
+var ErrVersionConflict = errors.New("version conflict")
+
+// anyVersion makes an update unconditional.
+const anyVersion int64 = -1
+
+// ErrDuplicate is returned when a write would give a second document a
+// value that must be unique, such as a user name. Handlers map it to a 409.
+var ErrDuplicate = errors.New("already exists")
+
+// ErrParentTrashed is returned when restoring a subtask or attachment whose
+// task is itself in the trash (or gone).
+var ErrParentTrashed = errors.New("the task it belongs to is in the trash")
+
+// Sequence names used for the numeric ids exposed to the frontend. They match
+// the `_id`s of the documents in the Mongo "counters" collection.
+const (
+	seqTask            = "taskid"
+	seqSubtask         = "subtaskid"
+	seqAttachment      = "attachmentid"
+	seqUser            = "userid"
+	seqActivity        = "activityid"
+	seqNotification    = "notificationid"
+	seqWebhook         = "webhookid"
+	seqWebhookDelivery = "webhookdeliveryid"
+)
+
+// TaskStore is everything the HTTP handlers need from persistence. The Mongo
+// implementation is what production runs on; the in-memory one lets the API
+// run on a laptop (or in tests) without a database.
+type TaskStore interface {
+	TaskRepository
+	SubtaskRepository
+	AttachmentRepository
+	UserRepository
+	SessionRepository
+	TrashRepository
+	ActivityRepository
+	CompletionRepository
+	NotificationRepository
+	WebhookRepository
+	FileDeletionQueue
+	BlobRefRepository
+	NotificationQueue
+	WebhookQueue
+	LeaseRepository
+	Sequencer
+
+	Close(ctx context.Context) error
+}
+
+// Trashed tasks, subtasks and attachments are invisible to the repositories
+// below except where noted; TrashRepository deals with them.
+
+type TaskRepository interface {
+	// ListTasks returns the tasks selected by q in q's sort order.
+	ListTasks(ctx context.Context, q TaskQuery) ([]Task, error)
+	// RecentTasks returns the newest unarchived tasks.
+	RecentTasks(ctx context.Context, limit int) ([]Task, error)
+	// GetTask also returns trashed tasks; check Task.trashed().
+	GetTask(ctx context.Context, id int64) (Task, error)
+	// CreateTask assigns task.ID from the "taskid" sequence and stores it
+	// as version 1.
+	CreateTask(ctx context.Context, task *Task) error
+	// UpdateTask applies fields as a partial update (Mongo `$set` semantics),
+	// bumps the version and returns the stored result. It fails with
+	// ErrVersionConflict unless the stored version is version, or version is
+	// anyVersion. Tasks stored before versions existed are version 0.
+	UpdateTask(ctx context.Context, id, version int64, fields map[string]any) (Task, error)
+	// TrashTask moves a task, and with it its subtasks and attachments, to
+	// the trash, stamped with the user who did it.
+	TrashTask(ctx context.Context, id, by int64) error
+	// ClearTasks trashes every unarchived task.
+	ClearTasks(ctx context.Context, by int64) error
+	// OpenTasksAssignedTo returns the unarchived, incomplete tasks whose main
+	// assignee is userID.
+	OpenTasksAssignedTo(ctx context.Context, userID int64) ([]Task, error)
+	// OpenSubtasksAssignedTo returns the incomplete subtasks whose main
+	// assignee is userID.
+	OpenSubtasksAssignedTo(ctx context.Context, userID int64) ([]Subtask, error)
+	// ReassignOpenWork moves the main assignment of every open task and
+	// incomplete subtask from one user to another and reports how many
+	// tasks and subtasks changed.
+	ReassignOpenWork(ctx context.Context, from, to int64) (tasks, subtasks int64, err error)
+}
+
+type SubtaskRepository interface {
+	// ListSubtasks returns the subtasks of the given tasks, or every subtask
+	// when no task ids are passed.
+	ListSubtasks(ctx context.Context, taskIDs ...int64) ([]Subtask, error)
+	// CreateSubtask stores a subtask as version 1.
+	CreateSubtask(ctx context.Context, subtask *Subtask) error
+	// UpdateSubtask works like UpdateTask.
+	UpdateSubtask(ctx context.Context, taskID, id, version int64, fields map[string]any) (Subtask, error)
+	TrashSubtask(ctx context.Context, taskID, id, by int64) error
+}
+
+type AttachmentRepository interface {
+	// ListAttachments returns the attachments of the given tasks (or all of
+	// them when no task ids are passed), newest first.
+	ListAttachments(ctx context.Context, taskIDs ...int64) ([]Attachment, error)
+	GetAttachment(ctx context.Context, taskID, id int64) (Attachment, error)
+	// CreateAttachment assigns attachment.ID from the "attachmentid"
+	// sequence and stores it. If another attachment has the same UploadID
+	// it gives ErrDuplicate instead, with attachment.ID set to that one's.
+	CreateAttachment(ctx context.Context, attachment *Attachment) error
+	TrashAttachment(ctx context.Context, taskID, id, by int64) error
+}
+
+type UserRepository interface {
+	// ListUsers returns every user ordered by name.
+	ListUsers(ctx context.Context) ([]User, error)
+	GetUser(ctx context.Context, id int64) (User, error)
+	// FindUserByName looks a user up by name, ignoring case.
+	FindUserByName(ctx context.Context, name string) (User, error)
+	// CreateUser assigns user.ID from the "userid" sequence and stores it.
+	// It returns ErrDuplicate if the name is taken, ignoring case.
+	CreateUser(ctx context.Context, user *User) error
+	// UpdateUser applies fields as a partial update and returns the result;
+	// ErrDuplicate if it would rename the user to a taken name.
+	UpdateUser(ctx context.Context, id int64, fields map[string]any) (User, error)
+	SetUserPassword(ctx context.Context, id int64, hash string) error
+	SetNotificationPrefs(ctx context.Context, id int64, prefs NotificationPrefs) error
+	DeleteUser(ctx context.Context, id int64) error
+}
+
+type SessionRepository interface {
+	CreateSession(ctx context.Context, session Session) error
+	// GetSession returns ErrNotFound for unknown and expired sessions.
+	GetSession(ctx context.Context, id string) (Session, error)
+	DeleteSession(ctx context.Context, id string) error
+	// DeleteUserSessions revokes every session of a user except keepID.
+	DeleteUserSessions(ctx context.Context, userID int64, keepID string) error
+}
+
+type TrashRepository interface {
+	// ListTrash returns the trashed items, most recently trashed first.
+	ListTrash(ctx context.Context) ([]TrashItem, error)
+	// GetTrashItem returns ErrNotFound unless the item is in the trash.
+	GetTrashItem(ctx context.Context, kind TrashKind, id int64) (TrashItem, error)
+	// GetTrashedDocument returns a trashed item as stored: a *Task,
+	// *Subtask or *Attachment. ErrNotFound unless it is in the trash.
+	GetTrashedDocument(ctx context.Context, kind TrashKind, id int64) (any, error)
+	// RestoreTrashItem takes an item out of the trash. Subtasks and
+	// attachments of a trashed task give ErrParentTrashed.
+	RestoreTrashItem(ctx context.Context, kind TrashKind, id int64) error
+	// PurgeTrashItem deletes a trashed item for good in one consistent
+	// operation: a task goes with all its subtasks and attachments, and the
+	// stored files of purged attachments are queued for deletion.
+	PurgeTrashItem(ctx context.Context, kind TrashKind, id int64) error
+	// PurgeTrash purges everything trashed at or before cutoff and reports
+	// how many items went.
+	PurgeTrash(ctx context.Context, cutoff time.Time) (int64, error)
+}
+
+// ActivityQuery filters the activity log. Zero fields do not filter.
+type ActivityQuery struct {
+	TaskID  int64
+	ActorID int64
+	Entity  EntityKind
+	Action  string
+	Since   time.Time // inclusive
+	Until   time.Time // exclusive
+	// BeforeSeq pages backwards: only entries with a smaller Seq match.
+	BeforeSeq int64
+	Limit     int
+}
+
+type ActivityRepository interface {
+	// AppendActivity assigns a.Seq from the "activityid" sequence and
+	// stores the entry. Entries are never changed afterwards.
+	AppendActivity(ctx context.Context, a *Activity) error
+	// ListActivity returns matching entries, newest first.
+	ListActivity(ctx context.Context, q ActivityQuery) ([]Activity, error)
+	// TailActivity returns up to limit entries with a Seq above afterSeq,
+	// oldest first.
+	TailActivity(ctx context.Context, afterSeq int64, limit int) ([]Activity, error)
+}
+
+// CompletionQuery filters the completion history. Zero fields do not filter.
+type CompletionQuery struct {
+	Entity     EntityKind
+	ItemID     int64
+	TaskID     int64
+	AssigneeID *int64
+	// Since and Until bound CycleStart, inclusive and exclusive.
+	Since time.Time
+	Until time.Time
+}
+
+type CompletionRepository interface {
+	// RecordCompletions stores the outcome of ended cycles. A cycle that is
+	// already recorded for the same item is left as it is.
+	RecordCompletions(ctx context.Context, completions ...Completion) error
+	// ListCompletions returns matching records, latest cycle first.
+	ListCompletions(ctx context.Context, q CompletionQuery) ([]Completion, error)
+}
+
+// NotificationQuery selects from a user's inbox: the notifications that
+// went to the inbox channel.
+type NotificationQuery struct {
+	UserID int64
+	Unread bool
+	// BeforeID pages backwards: only entries with a smaller ID match.
+	BeforeID int64
+	Limit    int
+}
+
+type NotificationRepository interface {
+	// AddNotification assigns n.ID from the "notificationid" sequence and
+	// stores n. It reports false, storing nothing, when the user already has
+	// a notification with n's non-empty Key.
+	AddNotification(ctx context.Context, n *Notification) (bool, error)
+	// ListNotifications returns matching inbox entries, newest first.
+	ListNotifications(ctx context.Context, q NotificationQuery) ([]Notification, error)
+	CountUnreadNotifications(ctx context.Context, userID int64) (int64, error)
+	// MarkNotificationsRead marks the given unread inbox entries of a user
+	// read, or all of them when no ids are given, and reports how many
+	// changed.
+	MarkNotificationsRead(ctx context.Context, userID int64, at time.Time, ids ...int64) (int64, error)
+}
+
+type FileDeletionQueue interface {
+	// EnqueueFileDeletions queues stored files for removal. Queuing a path
+	// that is already queued is a no-op.
+	EnqueueFileDeletions(ctx context.Context, paths ...string) error
+	// ClaimFileDeletion leases the next due deletion to the caller for
+	// lease, so that other instances skip it meanwhile. It returns
+	// ErrNotFound when nothing is due.
+	ClaimFileDeletion(ctx context.Context, now time.Time, lease time.Duration) (FileDeletion, error)
+	CompleteFileDeletion(ctx context.Context, path string) error
+	// RetryFileDeletion records a failed attempt and when to try again.
+	RetryFileDeletion(ctx context.Context, path string, next time.Time, reason string) error
+}
+
+// BlobRefRepository counts the attachments sharing each stored file.
+// Purging file attachments releases their references in the same
+// operation.
+type BlobRefRepository interface {
+	// AcquireBlob takes a reference to the stored file with this content
+	// hash, or returns ErrNotFound if there is none or it is corrupt.
+	AcquireBlob(ctx context.Context, sha256 string) (BlobRef, error)
+	// AddBlob records a newly stored file with one reference. If a file
+	// with the same hash was recorded meanwhile, it takes a reference to
+	// that one instead and returns it; the caller's copy is then unused.
+	// A corrupt file with the same hash is replaced: its attachments move
+	// to the new file and it is queued for deletion.
+	AddBlob(ctx context.Context, ref BlobRef) (BlobRef, error)
+	// ReleaseBlobs drops one reference per hash given, queuing a file for
+	// deletion when its last reference goes.
+	ReleaseBlobs(ctx context.Context, hashes ...string) error
+	// MarkBlobCorrupt records that the stored file with this content hash
+	// no longer matches it; ErrNotFound if there is none. Marking it again
+	// keeps the first time.
+	MarkBlobCorrupt(ctx context.Context, sha256 string, at time.Time) error
+	// ListCorruptBlobs returns the stored files marked corrupt, first
+	// marked first.
+	ListCorruptBlobs(ctx context.Context) ([]BlobRef, error)
+}
+
+// NotificationQueue holds the email and webhook deliveries of notifications;
+// it works like the FileDeletionQueue.
+type NotificationQueue interface {
+	EnqueueNotificationDeliveries(ctx context.Context, deliveries ...NotificationDelivery) error
+	// ClaimNotificationDelivery leases the next due delivery to the caller,
+	// or returns ErrNotFound when nothing is due.
+	ClaimNotificationDelivery(ctx context.Context, now time.Time, lease time.Duration) (NotificationDelivery, error)
+	CompleteNotificationDelivery(ctx context.Context, id string) error
+	RetryNotificationDelivery(ctx context.Context, id string, next time.Time, reason string) error
+}
+
+type WebhookRepository interface {
+	// ListWebhooks returns every webhook in ID order.
+	ListWebhooks(ctx context.Context) ([]Webhook, error)
+	GetWebhook(ctx context.Context, id int64) (Webhook, error)
+	// CreateWebhook assigns w.ID from the "webhookid" sequence and stores it.
+	CreateWebhook(ctx context.Context, w *Webhook) error
+	// UpdateWebhook applies fields as a partial update and returns the
+	// result.
+	UpdateWebhook(ctx context.Context, id int64, fields map[string]any) (Webhook, error)
+	// DeleteWebhook removes a webhook together with its deliveries.
+	DeleteWebhook(ctx context.Context, id int64) error
+}
+
+// WebhookDeliveryQuery selects from a webhook's delivery log. Zero fields do
+// not filter.
+type WebhookDeliveryQuery struct {
+	WebhookID int64
+	State     string
+	// BeforeID pages backwards: only deliveries with a smaller ID match.
+	BeforeID int64
+	Limit    int
+}
+
+// WebhookQueue holds webhook deliveries. It works like the
+// FileDeletionQueue, except that finished deliveries are kept, as the
+// delivery log, until they are pruned.
+type WebhookQueue interface {
+	// EnqueueWebhookDeliveries assigns the deliveries' IDs from the
+	// "webhookdeliveryid" sequence and stores them as pending, due at
+	// NextAttemptAt.
+	EnqueueWebhookDeliveries(ctx context.Context, deliveries ...*WebhookDelivery) error
+	// ClaimWebhookDelivery leases the next due pending delivery to the
+	// caller, or returns ErrNotFound when nothing is due.
+	ClaimWebhookDelivery(ctx context.Context, now time.Time, lease time.Duration) (WebhookDelivery, error)
+	// CompleteWebhookDelivery marks a delivery delivered.
+	CompleteWebhookDelivery(ctx context.Context, id int64, at time.Time, status int) error
+	// RetryWebhookDelivery records a failed attempt and when to try again.
+	RetryWebhookDelivery(ctx context.Context, id int64, next time.Time, status int, reason string) error
+	// FailWebhookDelivery records a failed attempt and gives up.
+	FailWebhookDelivery(ctx context.Context, id int64, status int, reason string) error
+	GetWebhookDelivery(ctx context.Context, webhookID, id int64) (WebhookDelivery, error)
+	// ListWebhookDeliveries returns matching deliveries, newest first.
+	ListWebhookDeliveries(ctx context.Context, q WebhookDeliveryQuery) ([]WebhookDelivery, error)
+	// PruneWebhookDeliveries deletes the finished deliveries created before
+	// cutoff and reports how many went.
+	PruneWebhookDeliveries(ctx context.Context, cutoff time.Time) (int64, error)
+}
+
+type LeaseRepository interface {
+	// AcquireLease takes the named lease for holder, or extends it if holder
+	// already has it, until now+ttl. It reports false while another holder's
+	// lease is unexpired.
+	AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error)
+	// ReleaseLease gives up the lease if holder has it.
+	ReleaseLease(ctx context.Context, name, holder string) error
+}
+
+type Sequencer interface {
+	// NextSeq atomically increments and returns the named counter.
+	NextSeq(ctx context.Context, name string) (int64, error)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"reflect"
+	"slices"
+	"time"
+	"unicode/utf8"
+)
+
+// maxAuditValueRunes caps the length of a string recorded in a diff; inline
+// attachments carry whole files as data: URLs.
+const maxAuditValueRunes = 500
+
+// auditStore is a TaskStore that appends an Activity for every change to a
+// task, subtask or attachment that goes through it. The actor is the user
+// of the request the context belongs to. Entries are written after the
+// change; if that fails the change stands and the failure is logged.
+type auditStore struct {
+	TaskStore
+}
+
+func newAuditStore(store TaskStore) *auditStore {
+	return &auditStore{TaskStore: store}
+}
+
+// auditSkipFields are not recorded in diffs: ids never change, versions
+// change with everything else and the children of a task are audited on
+// their own.
+var auditSkipFields = []string{"id", "task_id", "version", "subtasks", "attachments"}
+
+// fieldsOf flattens a model to its JSON fields.
+func fieldsOf(v any) map[string]any {
+	fields := map[string]any{}
+	if v == nil || reflect.ValueOf(v).IsNil() {
+		return fields
+	}
+	raw, err := json.Marshal(v)
+	if err == nil {
+		err = json.Unmarshal(raw, &fields)
+	}
+	if err != nil {
+		log.Println("audit: flattening", reflect.TypeOf(v), "error:", err)
+	}
+	for _, f := range auditSkipFields {
+		delete(fields, f)
+	}
+	return fields
+}
+
+func clipValue(v any) any {
+	if s, ok := v.(string); ok && utf8.RuneCountInString(s) > maxAuditValueRunes {
+		return string([]rune(s)[:maxAuditValueRunes]) + "…"
+	}
+	return v
+}
+
+// diffFields lists the fields that differ between two versions of a model,
+// either of which may be nil, in field name order.
+func diffFields(before, after any) []FieldChange {
+	b, a := fieldsOf(before), fieldsOf(after)
+	var names []string
+	for name := range b {
+		names = append(names, name)
+	}
+	for name := range a {
+		if _, ok := b[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	var changes []FieldChange
+	for _, name := range names {
+		if !reflect.DeepEqual(b[name], a[name]) {
+			changes = append(changes, FieldChange{Field: name, Before: clipValue(b[name]), After: clipValue(a[name])})
+		}
+	}
+	return changes
+}
+
+func (s *auditStore) record(ctx context.Context, action string, entity EntityKind, id, taskID int64, changes []FieldChange) {
+	if action == ActivityUpdated && len(changes) == 0 {
+		return
+	}
+	a := Activity{
+		At:       time.Now().UTC(),
+		Action:   action,
+		Entity:   entity,
+		EntityID: id,
+		TaskID:   taskID,
+		Changes:  changes,
+	}
+	if user, ok := userFromContext(ctx); ok {
+		a.ActorID = user.ID
+	}
+	if err := s.TaskStore.AppendActivity(ctx, &a); err != nil {
+		log.Printf("audit: recording %s %s %d: %v", action, entity, id, err)
+	}
+}
+
+func (k TrashKind) entity() EntityKind {
+	switch k {
+	case TrashTasks:
+		return EntityTask
+	case TrashSubtasks:
+		return EntitySubtask
+	default:
+		return EntityAttachment
+	}
+}
+
+// trashChanges is the diff of an item going into the trash or, if
+// restored, coming back out of it.
+func trashChanges(item TrashItem, restored bool) []FieldChange {
+	stamp := &Trashed{DeletedAt: &item.DeletedAt, DeletedBy: item.DeletedBy}
+	if restored {
+		return diffFields(stamp, &Trashed{})
+	}
+	return diffFields(&Trashed{}, stamp)
+}
+
+// recordTrashed records an item that was just trashed, with the stamp the
+// store gave it.
+func (s *auditStore) recordTrashed(ctx context.Context, kind TrashKind, id, taskID int64) {
+	var changes []FieldChange
+	if item, err := s.TaskStore.GetTrashItem(ctx, kind, id); err == nil {
+		changes = trashChanges(item, false)
+	} else {
+		log.Printf("audit: reading trashed %s %d: %v", kind.entity(), id, err)
+	}
+	s.record(ctx, ActivityTrashed, kind.entity(), id, taskID, changes)
+}
+
+// findSubtask looks up a live subtask, for the before-image of an update;
+// nil if it cannot be found.
+func findSubtask(ctx context.Context, store TaskStore, taskID, id int64) *Subtask {
+	subs, err := store.ListSubtasks(ctx, taskID)
+	if err != nil {
+		return nil
+	}
+	for _, sub := range subs {
+		if sub.ID == id {
+			return &sub
+		}
+	}
+	return nil
+}
+
+func (s *auditStore) CreateTask(ctx context.Context, task *Task) error {
+	if err := s.TaskStore.CreateTask(ctx, task); err != nil {
+		return err
+	}
+	s.record(ctx, ActivityCreated, EntityTask, task.ID, task.ID, diffFields((*Task)(nil), task))
+	return nil
+}
+
+func (s *auditStore) UpdateTask(ctx context.Context, id, version int64, fields map[string]any) (Task, error) {
+	before, err := s.TaskStore.GetTask(ctx, id)
+	if err != nil {
+		return Task{}, err
+	}
+	after, err := s.TaskStore.UpdateTask(ctx, id, version, fields)
+	if err != nil {
+		return after, err
+	}
+	s.record(ctx, ActivityUpdated, EntityTask, id, id, diffFields(&before, &after))
+	return after, nil
+}
+
+func (s *auditStore) TrashTask(ctx context.Context, id, by int64) error {
+	if err := s.TaskStore.TrashTask(ctx, id, by); err != nil {
+		return err
+	}
+	s.recordTrashed(ctx, TrashTasks, id, id)
+	return nil
+}
+
+func (s *auditStore) ClearTasks(ctx context.Context, by int64) error {
+	archived := false
+	tasks, err := s.TaskStore.ListTasks(ctx, TaskQuery{Archived: &archived})
+	if err != nil {
+		return err
+	}
+	if err := s.TaskStore.ClearTasks(ctx, by); err != nil {
+		return err
+	}
+	trash, err := s.TaskStore.ListTrash(ctx)
+	if err != nil {
+		log.Println("audit: listing trash:", err)
+	}
+	stamps := map[int64]TrashItem{}
+	for _, item := range trash {
+		if item.Kind == TrashTasks {
+			stamps[item.ID] = item
+		}
+	}
+	for _, t := range tasks {
+		var changes []FieldChange
+		if item, ok := stamps[t.ID]; ok {
+			changes = trashChanges(item, false)
+		}
+		s.record(ctx, ActivityTrashed, EntityTask, t.ID, t.ID, changes)
+	}
+	return nil
+}
+
+func (s *auditStore) ReassignOpenWork(ctx context.Context, from, to int64) (int64, int64, error) {
+	tasks, err := s.TaskStore.OpenTasksAssignedTo(ctx, from)
+	if err != nil {
+		return 0, 0, err
+	}
+	subs, err := s.TaskStore.OpenSubtasksAssignedTo(ctx, from)
+	if err != nil {
+		return 0, 0, err
+	}
+	nTasks, nSubs, err := s.TaskStore.ReassignOpenWork(ctx, from, to)
+	if err != nil {
+		return nTasks, nSubs, err
+	}
+	change := []FieldChange{{Field: "main_assignee_id", Before: from, After: to}}
+	for _, t := range tasks {
+		s.record(ctx, ActivityUpdated, EntityTask, t.ID, t.ID, change)
+	}
+	for _, sub := range subs {
+		s.record(ctx, ActivityUpdated, EntitySubtask, sub.ID, sub.TaskID, change)
+	}
+	return nTasks, nSubs, nil
+}
+
+func (s *auditStore) CreateSubtask(ctx context.Context, subtask *Subtask) error {
+	if err := s.TaskStore.CreateSubtask(ctx, subtask); err != nil {
+		return err
+	}
+	s.record(ctx, ActivityCreated, EntitySubtask, subtask.ID, subtask.TaskID, diffFields((*Subtask)(nil), subtask))
+	return nil
+}
+
+func (s *auditStore) UpdateSubtask(ctx context.Context, taskID, id, version int64, fields map[string]any) (Subtask, error) {
+	before := findSubtask(ctx, s.TaskStore, taskID, id)
+	after, err := s.TaskStore.UpdateSubtask(ctx, taskID, id, version, fields)
+	if err != nil {
+		return after, err
+	}
+	s.record(ctx, ActivityUpdated, EntitySubtask, id, taskID, diffFields(before, &after))
+	return after, nil
+}
+
+func (s *auditStore) TrashSubtask(ctx context.Context, taskID, id, by int64) error {
+	if err := s.TaskStore.TrashSubtask(ctx, taskID, id, by); err != nil {
+		return err
+	}
+	s.recordTrashed(ctx, TrashSubtasks, id, taskID)
+	return nil
+}
+
+func (s *auditStore) CreateAttachment(ctx context.Context, attachment *Attachment) error {
+	if err := s.TaskStore.CreateAttachment(ctx, attachment); err != nil {
+		return err
+	}
+	s.record(ctx, ActivityCreated, EntityAttachment, attachment.ID, attachment.TaskID, diffFields((*Attachment)(nil), attachment))
+	return nil
+}
+
+func (s *auditStore) TrashAttachment(ctx context.Context, taskID, id, by int64) error {
+	if err := s.TaskStore.TrashAttachment(ctx, taskID, id, by); err != nil {
+		return err
+	}
+	s.recordTrashed(ctx, TrashAttachments, id, taskID)
+	return nil
+}
+
+func (s *auditStore) RestoreTrashItem(ctx context.Context, kind TrashKind, id int64) error {
+	item, err := s.TaskStore.GetTrashItem(ctx, kind, id)
+	if err != nil {
+		return err
+	}
+	if err := s.TaskStore.RestoreTrashItem(ctx, kind, id); err != nil {
+		return err
+	}
+	s.record(ctx, ActivityRestored, kind.entity(), id, item.TaskID, trashChanges(item, true))
+	return nil
+}
+
+// A purge is recorded with the whole item as it was, since nothing else
+// keeps it afterwards. The children purged with a task are not recorded.
+func (s *auditStore) PurgeTrashItem(ctx context.Context, kind TrashKind, id int64) error {
+	item, err := s.TaskStore.GetTrashItem(ctx, kind, id)
+	if err != nil {
+		return err
+	}
+	before, err := s.TaskStore.GetTrashedDocument(ctx, kind, id)
+	if err != nil {
+		return err
+	}
+	if err := s.TaskStore.PurgeTrashItem(ctx, kind, id); err != nil {
+		return err
+	}
+	s.record(ctx, ActivityPurged, kind.entity(), id, item.TaskID, diffFields(before, nil))
+	return nil
+}
+
+func (s *auditStore) PurgeTrash(ctx context.Context, cutoff time.Time) (int64, error) {
+	items, err := s.TaskStore.ListTrash(ctx)
+	if err != nil {
+		return 0, err
+	}
+	// The before-images of what goes, in the order of items.
+	var purged []TrashItem
+	var before []any
+	for _, item := range items {
+		if item.DeletedAt.After(cutoff) {
+			continue
+		}
+		doc, err := s.TaskStore.GetTrashedDocument(ctx, item.Kind, item.ID)
+		if err != nil {
+			log.Printf("audit: reading trashed %s %d: %v", item.Kind.entity(), item.ID, err)
+		}
+		purged = append(purged, item)
+		before = append(before, doc)
+	}
+	n, err := s.TaskStore.PurgeTrash(ctx, cutoff)
+	if err != nil {
+		return n, err
+	}
+	for i, item := range purged {
+		s.record(ctx, ActivityPurged, item.Kind.entity(), item.ID, item.TaskID, diffFields(before[i], nil))
+	}
+	return n, nil
+}
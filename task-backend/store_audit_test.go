@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// changed returns the change of field, failing the test if there is none.
+func changed(t *testing.T, a Activity, field string) FieldChange {
+	t.Helper()
+	for _, c := range a.Changes {
+		if c.Field == field {
+			return c
+		}
+	}
+	t.Fatalf("%s %s %d has no %s change: %+v", a.Action, a.Entity, a.EntityID, field, a.Changes)
+	return FieldChange{}
+}
+
+func TestAuditTrashRestorePurge(t *testing.T) {
+	mem := newMemoryStore()
+	store := newAuditStore(mem)
+	ctx := context.Background()
+	task := Task{Title: "Paint the shed"}
+	if err := store.CreateTask(ctx, &task); err != nil {
+		t.Fatal(err)
+	}
+	last := func(action string) Activity {
+		t.Helper()
+		entries, err := mem.ListActivity(ctx, ActivityQuery{TaskID: task.ID, Action: action, Limit: 1})
+		if err != nil || len(entries) == 0 {
+			t.Fatalf("no %s entry: %v", action, err)
+		}
+		return entries[0]
+	}
+
+	if err := store.TrashTask(ctx, task.ID, 4); err != nil {
+		t.Fatal(err)
+	}
+	trashed := last(ActivityTrashed)
+	if c := changed(t, trashed, "deleted_by"); c.Before != nil || c.After != float64(4) {
+		t.Errorf("trashed deleted_by change = %+v", c)
+	}
+	if c := changed(t, trashed, "deleted_at"); c.Before != nil || c.After == nil {
+		t.Errorf("trashed deleted_at change = %+v", c)
+	}
+
+	if err := store.RestoreTrashItem(ctx, TrashTasks, task.ID); err != nil {
+		t.Fatal(err)
+	}
+	restored := last(ActivityRestored)
+	if c := changed(t, restored, "deleted_by"); c.Before != float64(4) || c.After != nil {
+		t.Errorf("restored deleted_by change = %+v", c)
+	}
+
+	if err := store.TrashTask(ctx, task.ID, 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.PurgeTrash(ctx, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	purged := last(ActivityPurged)
+	if c := changed(t, purged, "title"); c.Before != "Paint the shed" || c.After != nil {
+		t.Errorf("purged title change = %+v", c)
+	}
+	changed(t, purged, "deleted_at")
+}
+
+// boardScanStore fails listings of every subtask on the board.
+type boardScanStore struct{ TaskStore }
+
+func (s boardScanStore) ListSubtasks(ctx context.Context, taskIDs ...int64) ([]Subtask, error) {
+	if len(taskIDs) == 0 {
+		return nil, errors.New("listed every subtask")
+	}
+	return s.TaskStore.ListSubtasks(ctx, taskIDs...)
+}
+
+func TestAuditReassignOpenWork(t *testing.T) {
+	mem := newMemoryStore()
+	store := newAuditStore(boardScanStore{mem})
+	ctx := context.Background()
+	from, other := 3, 4
+	task := Task{Title: "Paint the shed"}
+	if err := mem.CreateTask(ctx, &task); err != nil {
+		t.Fatal(err)
+	}
+	subs := []Subtask{
+		{TaskID: task.ID, Title: "Sand", MainAssigneeID: &from},
+		{TaskID: task.ID, Title: "Prime", MainAssigneeID: &from, Completed: true},
+		{TaskID: task.ID, Title: "Paint", MainAssigneeID: &other},
+	}
+	for i := range subs {
+		if err := mem.CreateSubtask(ctx, &subs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, nSubs, err := store.ReassignOpenWork(ctx, 3, 5); err != nil || nSubs != 1 {
+		t.Fatalf("ReassignOpenWork = %d subtasks, %v", nSubs, err)
+	}
+	entries, err := mem.ListActivity(ctx, ActivityQuery{TaskID: task.ID, Action: ActivityUpdated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].EntityID != subs[0].ID {
+		t.Fatalf("updates recorded = %+v, want one for subtask %d", entries, subs[0].ID)
+	}
+	if c := changed(t, entries[0], "main_assignee_id"); c.Before != int64(3) || c.After != int64(5) {
+		t.Errorf("main_assignee_id change = %+v", c)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"time"
+)
+
+// completionStore is a TaskStore that stamps tasks and subtasks with when and
+// by whom they were completed, for the completion history the scheduler
+// writes when their cycle ends. Unchecking an item clears the stamp.
+type completionStore struct {
+	TaskStore
+}
+
+func newCompletionStore(store TaskStore) *completionStore {
+	return &completionStore{TaskStore: store}
+}
+
+// stamp adds the completion stamp to an update that changes completed, and
+// returns the fields to apply.
+func stamp(ctx context.Context, fields map[string]any, wasCompleted bool) map[string]any {
+	done, ok := fields["completed"].(bool)
+	if !ok || done == wasCompleted {
+		return fields
+	}
+	fields = maps.Clone(fields)
+	fields["completed_at"], fields["completed_by"] = nil, nil
+	if done {
+		fields["completed_at"] = time.Now().UTC()
+		if user, ok := userFromContext(ctx); ok {
+			fields["completed_by"] = user.ID
+		}
+	}
+	return fields
+}
+
+func stampCycle(ctx context.Context, c *Cycle) {
+	now := time.Now().UTC()
+	c.CompletedAt, c.CompletedBy = &now, nil
+	if user, ok := userFromContext(ctx); ok {
+		c.CompletedBy = &user.ID
+	}
+}
+
+func (s *completionStore) CreateTask(ctx context.Context, task *Task) error {
+	if task.Completed {
+		stampCycle(ctx, &task.Cycle)
+	}
+	return s.TaskStore.CreateTask(ctx, task)
+}
+
+func (s *completionStore) UpdateTask(ctx context.Context, id, version int64, fields map[string]any) (Task, error) {
+	before, err := s.TaskStore.GetTask(ctx, id)
+	if err != nil {
+		return Task{}, err
+	}
+	return s.TaskStore.UpdateTask(ctx, id, version, stamp(ctx, fields, before.Completed))
+}
+
+func (s *completionStore) CreateSubtask(ctx context.Context, subtask *Subtask) error {
+	if subtask.Completed {
+		stampCycle(ctx, &subtask.Cycle)
+	}
+	return s.TaskStore.CreateSubtask(ctx, subtask)
+}
+
+func (s *completionStore) UpdateSubtask(ctx context.Context, taskID, id, version int64, fields map[string]any) (Subtask, error) {
+	if before := findSubtask(ctx, s.TaskStore, taskID, id); before != nil {
+		fields = stamp(ctx, fields, before.Completed)
+	}
+	return s.TaskStore.UpdateSubtask(ctx, taskID, id, version, fields)
+}
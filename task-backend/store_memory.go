@@ -0,0 +1,1189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore is a TaskStore that keeps everything in process memory. It is
+// meant for local development and tests; nothing survives a restart.
+type memoryStore struct {
+	mu          sync.RWMutex
+	tasks       map[int64]Task
+	subtasks    map[int64]Subtask
+	attachments map[int64]Attachment
+	users       map[int64]User
+	sessions    map[string]Session
+	deletions   map[string]FileDeletion
+	blobRefs    map[string]BlobRef
+	leases      map[string]Lease
+	activity    []Activity
+	completions []Completion
+	// notifications is in ID order.
+	notifications []Notification
+	deliveries    map[string]NotificationDelivery
+	webhooks      map[int64]Webhook
+	// hookDeliveries is in ID order.
+	hookDeliveries []WebhookDelivery
+	counters       map[string]int64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		tasks:       map[int64]Task{},
+		subtasks:    map[int64]Subtask{},
+		attachments: map[int64]Attachment{},
+		users:       map[int64]User{},
+		sessions:    map[string]Session{},
+		deletions:   map[string]FileDeletion{},
+		blobRefs:    map[string]BlobRef{},
+		leases:      map[string]Lease{},
+		deliveries:  map[string]NotificationDelivery{},
+		webhooks:    map[int64]Webhook{},
+		counters:    map[string]int64{},
+	}
+}
+
+func (s *memoryStore) Close(ctx context.Context) error { return nil }
+
+// applyFields mimics a Mongo `$set` on a struct by round-tripping it through
+// JSON. The bson and json field names are identical on every model, so the
+// keys the handlers receive line up with the struct tags.
+func applyFields(dst any, fields map[string]any) error {
+	raw, err := json.Marshal(dst)
+	if err != nil {
+		return err
+	}
+	doc := map[string]any{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return err
+	}
+	for k, v := range fields {
+		doc[k] = v
+	}
+	raw, err = json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, dst)
+}
+
+func idSet(ids []int64) map[int64]bool {
+	if len(ids) == 0 {
+		return nil
+	}
+	set := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
+
+func (s *memoryStore) nextSeqLocked(name string) int64 {
+	s.counters[name]++
+	return s.counters[name]
+}
+
+func (s *memoryStore) ListTasks(ctx context.Context, q TaskQuery) ([]Task, error) {
+	keys, err := q.Sort.keys()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tasks := []Task{}
+	for _, t := range s.tasks {
+		if q.matches(t) && (q.After == nil || compareKeys(keyOf(t), *q.After, keys) > 0) {
+			tasks = append(tasks, t)
+		}
+	}
+	sort.Slice(tasks, func(i, j int) bool { return compareKeys(keyOf(tasks[i]), keyOf(tasks[j]), keys) < 0 })
+	if q.Limit > 0 && len(tasks) > q.Limit {
+		tasks = tasks[:q.Limit]
+	}
+	return tasks, nil
+}
+
+func (s *memoryStore) RecentTasks(ctx context.Context, limit int) ([]Task, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tasks := []Task{}
+	for _, t := range s.tasks {
+		if !t.Archived && !t.trashed() {
+			tasks = append(tasks, t)
+		}
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].CreatedAt.After(tasks[j].CreatedAt) })
+	if limit > 0 && len(tasks) > limit {
+		tasks = tasks[:limit]
+	}
+	return tasks, nil
+}
+
+func (s *memoryStore) GetTask(ctx context.Context, id int64) (Task, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.tasks[id]
+	if !ok {
+		return Task{}, ErrNotFound
+	}
+	return t, nil
+}
+
+func (s *memoryStore) CreateTask(ctx context.Context, task *Task) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task.ID = s.nextSeqLocked(seqTask)
+	task.Version = 1
+	stored := *task
+	stored.Subtasks, stored.Attachments = nil, nil
+	s.tasks[task.ID] = stored
+	return nil
+}
+
+func (s *memoryStore) UpdateTask(ctx context.Context, id, version int64, fields map[string]any) (Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tasks[id]
+	if !ok || t.trashed() {
+		return Task{}, ErrNotFound
+	}
+	if version != anyVersion && t.Version != version {
+		return Task{}, ErrVersionConflict
+	}
+	if len(fields) == 0 {
+		return t, nil
+	}
+	if err := applyFields(&t, fields); err != nil {
+		return Task{}, err
+	}
+	t.ID = id
+	t.Version++
+	t.Subtasks, t.Attachments = nil, nil
+	s.tasks[id] = t
+	return t, nil
+}
+
+func newTrashStamp(by int64) Trashed {
+	now := time.Now().UTC()
+	return Trashed{DeletedAt: &now, DeletedBy: &by}
+}
+
+func (s *memoryStore) TrashTask(ctx context.Context, id, by int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tasks[id]
+	if !ok || t.trashed() {
+		return ErrNotFound
+	}
+	t.Trashed = newTrashStamp(by)
+	s.tasks[id] = t
+	return nil
+}
+
+func (s *memoryStore) ClearTasks(ctx context.Context, by int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stamp := newTrashStamp(by)
+	for id, t := range s.tasks {
+		if !t.Archived && !t.trashed() {
+			t.Trashed = stamp
+			s.tasks[id] = t
+		}
+	}
+	return nil
+}
+
+// deleteTasksLocked removes the given tasks with their subtasks and
+// attachments, and queues the attachments' stored files for deletion.
+func (s *memoryStore) deleteTasksLocked(ids map[int64]bool) {
+	for id, sub := range s.subtasks {
+		if ids[sub.TaskID] {
+			delete(s.subtasks, id)
+		}
+	}
+	for id, att := range s.attachments {
+		if ids[att.TaskID] {
+			s.enqueueFileDeletionLocked(att)
+			delete(s.attachments, id)
+		}
+	}
+	for id := range ids {
+		delete(s.tasks, id)
+	}
+}
+
+// enqueueFileDeletionLocked queues the stored file of a purged attachment
+// for deletion, or releases its reference if the file is shared. A file of
+// its own that is also a shared file is left to the references.
+func (s *memoryStore) enqueueFileDeletionLocked(att Attachment) {
+	if att.Type != "file" || att.URL == "" {
+		return
+	}
+	if att.SHA256 != "" {
+		s.releaseBlobLocked(att.SHA256)
+		return
+	}
+	for _, ref := range s.blobRefs {
+		if ref.Key == att.URL {
+			return
+		}
+	}
+	s.queueFileLocked(att.URL)
+}
+
+func (s *memoryStore) queueFileLocked(path string) {
+	if _, queued := s.deletions[path]; !queued {
+		now := time.Now().UTC()
+		s.deletions[path] = FileDeletion{Path: path, EnqueuedAt: now, NextAttemptAt: now}
+	}
+}
+
+func (s *memoryStore) OpenTasksAssignedTo(ctx context.Context, userID int64) ([]Task, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tasks := []Task{}
+	for _, t := range s.tasks {
+		if !t.Completed && !t.Archived && !t.trashed() && assignedTo(t.MainAssigneeID, userID) {
+			tasks = append(tasks, t)
+		}
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].ID < tasks[j].ID })
+	return tasks, nil
+}
+
+func (s *memoryStore) OpenSubtasksAssignedTo(ctx context.Context, userID int64) ([]Subtask, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	subtasks := []Subtask{}
+	for _, sub := range s.subtasks {
+		if !sub.Completed && !sub.trashed() && assignedTo(sub.MainAssigneeID, userID) {
+			subtasks = append(subtasks, sub)
+		}
+	}
+	sort.Slice(subtasks, func(i, j int) bool { return subtasks[i].ID < subtasks[j].ID })
+	return subtasks, nil
+}
+
+func (s *memoryStore) ReassignOpenWork(ctx context.Context, from, to int64) (int64, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	newID := int(to)
+	var nTasks, nSubtasks int64
+	for id, t := range s.tasks {
+		if !t.Completed && !t.Archived && !t.trashed() && assignedTo(t.MainAssigneeID, from) {
+			t.MainAssigneeID = &newID
+			t.Version++
+			s.tasks[id] = t
+			nTasks++
+		}
+	}
+	for id, sub := range s.subtasks {
+		if !sub.Completed && !sub.trashed() && assignedTo(sub.MainAssigneeID, from) {
+			sub.MainAssigneeID = &newID
+			sub.Version++
+			s.subtasks[id] = sub
+			nSubtasks++
+		}
+	}
+	return nTasks, nSubtasks, nil
+}
+
+func (s *memoryStore) ListSubtasks(ctx context.Context, taskIDs ...int64) ([]Subtask, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	want := idSet(taskIDs)
+	subtasks := []Subtask{}
+	for _, sub := range s.subtasks {
+		if (want == nil || want[sub.TaskID]) && !sub.trashed() {
+			subtasks = append(subtasks, sub)
+		}
+	}
+	sort.Slice(subtasks, func(i, j int) bool { return subtasks[i].ID < subtasks[j].ID })
+	return subtasks, nil
+}
+
+func (s *memoryStore) CreateSubtask(ctx context.Context, subtask *Subtask) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subtask.ID = s.nextSeqLocked(seqSubtask)
+	subtask.Version = 1
+	s.subtasks[subtask.ID] = *subtask
+	return nil
+}
+
+func (s *memoryStore) UpdateSubtask(ctx context.Context, taskID, id, version int64, fields map[string]any) (Subtask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subtasks[id]
+	if !ok || sub.TaskID != taskID || sub.trashed() {
+		return Subtask{}, ErrNotFound
+	}
+	if version != anyVersion && sub.Version != version {
+		return Subtask{}, ErrVersionConflict
+	}
+	if len(fields) == 0 {
+		return sub, nil
+	}
+	if err := applyFields(&sub, fields); err != nil {
+		return Subtask{}, err
+	}
+	sub.ID, sub.TaskID = id, taskID
+	sub.Version++
+	s.subtasks[id] = sub
+	return sub, nil
+}
+
+func (s *memoryStore) TrashSubtask(ctx context.Context, taskID, id, by int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subtasks[id]
+	if !ok || sub.TaskID != taskID || sub.trashed() {
+		return ErrNotFound
+	}
+	sub.Trashed = newTrashStamp(by)
+	s.subtasks[id] = sub
+	return nil
+}
+
+func (s *memoryStore) ListAttachments(ctx context.Context, taskIDs ...int64) ([]Attachment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	want := idSet(taskIDs)
+	attachments := []Attachment{}
+	for _, att := range s.attachments {
+		if (want == nil || want[att.TaskID]) && !att.trashed() {
+			attachments = append(attachments, att)
+		}
+	}
+	sort.Slice(attachments, func(i, j int) bool { return attachments[i].CreatedAt.After(attachments[j].CreatedAt) })
+	return attachments, nil
+}
+
+func (s *memoryStore) GetAttachment(ctx context.Context, taskID, id int64) (Attachment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	att, ok := s.attachments[id]
+	if !ok || att.TaskID != taskID || att.trashed() {
+		return Attachment{}, ErrNotFound
+	}
+	return att, nil
+}
+
+func (s *memoryStore) CreateAttachment(ctx context.Context, attachment *Attachment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if attachment.UploadID != "" {
+		for _, att := range s.attachments {
+			if att.UploadID == attachment.UploadID {
+				attachment.ID = att.ID
+				return ErrDuplicate
+			}
+		}
+	}
+	attachment.ID = s.nextSeqLocked(seqAttachment)
+	s.attachments[attachment.ID] = *attachment
+	return nil
+}
+
+func (s *memoryStore) TrashAttachment(ctx context.Context, taskID, id, by int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	att, ok := s.attachments[id]
+	if !ok || att.TaskID != taskID || att.trashed() {
+		return ErrNotFound
+	}
+	att.Trashed = newTrashStamp(by)
+	s.attachments[id] = att
+	return nil
+}
+
+func (s *memoryStore) ListTrash(ctx context.Context) ([]TrashItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	items := []TrashItem{}
+	for _, t := range s.tasks {
+		if t.trashed() {
+			items = append(items, t.trashItem())
+		}
+	}
+	for _, sub := range s.subtasks {
+		if sub.trashed() {
+			items = append(items, sub.trashItem())
+		}
+	}
+	for _, att := range s.attachments {
+		if att.trashed() {
+			items = append(items, att.trashItem())
+		}
+	}
+	sortTrash(items)
+	return items, nil
+}
+
+func (s *memoryStore) GetTrashItem(ctx context.Context, kind TrashKind, id int64) (TrashItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.trashItemLocked(kind, id)
+}
+
+func (s *memoryStore) trashItemLocked(kind TrashKind, id int64) (TrashItem, error) {
+	switch kind {
+	case TrashTasks:
+		if t, ok := s.tasks[id]; ok && t.trashed() {
+			return t.trashItem(), nil
+		}
+	case TrashSubtasks:
+		if sub, ok := s.subtasks[id]; ok && sub.trashed() {
+			return sub.trashItem(), nil
+		}
+	case TrashAttachments:
+		if att, ok := s.attachments[id]; ok && att.trashed() {
+			return att.trashItem(), nil
+		}
+	}
+	return TrashItem{}, ErrNotFound
+}
+
+func (s *memoryStore) GetTrashedDocument(ctx context.Context, kind TrashKind, id int64) (any, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	switch kind {
+	case TrashTasks:
+		if t, ok := s.tasks[id]; ok && t.trashed() {
+			doc := t
+			return &doc, nil
+		}
+	case TrashSubtasks:
+		if sub, ok := s.subtasks[id]; ok && sub.trashed() {
+			doc := sub
+			return &doc, nil
+		}
+	case TrashAttachments:
+		if att, ok := s.attachments[id]; ok && att.trashed() {
+			doc := att
+			return &doc, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryStore) RestoreTrashItem(ctx context.Context, kind TrashKind, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, err := s.trashItemLocked(kind, id)
+	if err != nil {
+		return err
+	}
+	if kind != TrashTasks {
+		if t, ok := s.tasks[item.TaskID]; !ok || t.trashed() {
+			return ErrParentTrashed
+		}
+	}
+	switch kind {
+	case TrashTasks:
+		t := s.tasks[id]
+		t.Trashed = Trashed{}
+		s.tasks[id] = t
+	case TrashSubtasks:
+		sub := s.subtasks[id]
+		sub.Trashed = Trashed{}
+		s.subtasks[id] = sub
+	case TrashAttachments:
+		att := s.attachments[id]
+		att.Trashed = Trashed{}
+		s.attachments[id] = att
+	}
+	return nil
+}
+
+func (s *memoryStore) PurgeTrashItem(ctx context.Context, kind TrashKind, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.trashItemLocked(kind, id); err != nil {
+		return err
+	}
+	switch kind {
+	case TrashTasks:
+		s.deleteTasksLocked(map[int64]bool{id: true})
+	case TrashSubtasks:
+		delete(s.subtasks, id)
+	case TrashAttachments:
+		s.enqueueFileDeletionLocked(s.attachments[id])
+		delete(s.attachments, id)
+	}
+	return nil
+}
+
+func (s *memoryStore) PurgeTrash(ctx context.Context, cutoff time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	due := func(t Trashed) bool { return t.trashed() && !t.DeletedAt.After(cutoff) }
+	ids := map[int64]bool{}
+	for id, t := range s.tasks {
+		if due(t.Trashed) {
+			ids[id] = true
+		}
+	}
+	s.deleteTasksLocked(ids)
+	n := int64(len(ids))
+	for id, sub := range s.subtasks {
+		if due(sub.Trashed) {
+			delete(s.subtasks, id)
+			n++
+		}
+	}
+	for id, att := range s.attachments {
+		if due(att.Trashed) {
+			s.enqueueFileDeletionLocked(att)
+			delete(s.attachments, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) ListUsers(ctx context.Context) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users, nil
+}
+
+func (s *memoryStore) GetUser(ctx context.Context, id int64) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[id]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return u, nil
+}
+
+func (s *memoryStore) FindUserByName(ctx context.Context, name string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, u := range s.users {
+		if strings.EqualFold(u.Name, name) {
+			return u, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (s *memoryStore) CreateUser(ctx context.Context, user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nameTakenLocked(user.Name, 0) {
+		return ErrDuplicate
+	}
+	user.ID = s.nextSeqLocked(seqUser)
+	s.users[user.ID] = *user
+	return nil
+}
+
+func (s *memoryStore) UpdateUser(ctx context.Context, id int64, fields map[string]any) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	// The hash is not part of the JSON form applyFields works on.
+	hash := u.PasswordHash
+	if err := applyFields(&u, fields); err != nil {
+		return User{}, err
+	}
+	u.ID, u.PasswordHash = id, hash
+	if s.nameTakenLocked(u.Name, id) {
+		return User{}, ErrDuplicate
+	}
+	s.users[id] = u
+	return u, nil
+}
+
+// nameTakenLocked reports whether a user other than self has name.
+func (s *memoryStore) nameTakenLocked(name string, self int64) bool {
+	for _, u := range s.users {
+		if u.ID != self && strings.EqualFold(u.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryStore) SetUserPassword(ctx context.Context, id int64, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	u.PasswordHash = hash
+	s.users[id] = u
+	return nil
+}
+
+func (s *memoryStore) SetNotificationPrefs(ctx context.Context, id int64, prefs NotificationPrefs) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	u.NotificationPrefs = prefs
+	s.users[id] = u
+	return nil
+}
+
+func (s *memoryStore) DeleteUser(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, id)
+	return nil
+}
+
+func (s *memoryStore) CreateSession(ctx context.Context, session Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.ID] = session
+	return nil
+}
+
+func (s *memoryStore) GetSession(ctx context.Context, id string) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return Session{}, ErrNotFound
+	}
+	if !sess.ExpiresAt.After(time.Now()) {
+		delete(s.sessions, id)
+		return Session{}, ErrNotFound
+	}
+	return sess, nil
+}
+
+func (s *memoryStore) DeleteSession(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *memoryStore) DeleteUserSessions(ctx context.Context, userID int64, keepID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sess := range s.sessions {
+		if sess.UserID == userID && id != keepID {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) AppendActivity(ctx context.Context, a *Activity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a.Seq = s.nextSeqLocked(seqActivity)
+	s.activity = append(s.activity, *a)
+	return nil
+}
+
+func (s *memoryStore) ListActivity(ctx context.Context, q ActivityQuery) ([]Activity, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries := []Activity{}
+	for i := len(s.activity) - 1; i >= 0 && (q.Limit <= 0 || len(entries) < q.Limit); i-- {
+		a := s.activity[i]
+		if (q.TaskID != 0 && a.TaskID != q.TaskID) ||
+			(q.ActorID != 0 && a.ActorID != q.ActorID) ||
+			(q.Entity != "" && a.Entity != q.Entity) ||
+			(q.Action != "" && a.Action != q.Action) ||
+			(!q.Since.IsZero() && a.At.Before(q.Since)) ||
+			(!q.Until.IsZero() && !a.At.Before(q.Until)) ||
+			(q.BeforeSeq != 0 && a.Seq >= q.BeforeSeq) {
+			continue
+		}
+		entries = append(entries, a)
+	}
+	return entries, nil
+}
+
+func (s *memoryStore) TailActivity(ctx context.Context, afterSeq int64, limit int) ([]Activity, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i, _ := slices.BinarySearchFunc(s.activity, afterSeq+1, func(a Activity, seq int64) int { return int(a.Seq - seq) })
+	entries := slices.Clone(s.activity[i:min(i+limit, len(s.activity))])
+	if entries == nil {
+		entries = []Activity{}
+	}
+	return entries, nil
+}
+
+func (s *memoryStore) RecordCompletions(ctx context.Context, completions ...Completion) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+next:
+	for _, c := range completions {
+		for _, r := range s.completions {
+			if r.Entity == c.Entity && r.ItemID == c.ItemID && r.CycleStart.Equal(c.CycleStart) {
+				continue next
+			}
+		}
+		s.completions = append(s.completions, c)
+	}
+	return nil
+}
+
+func (s *memoryStore) ListCompletions(ctx context.Context, q CompletionQuery) ([]Completion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	records := []Completion{}
+	for _, c := range s.completions {
+		if (q.Entity != "" && c.Entity != q.Entity) ||
+			(q.ItemID != 0 && c.ItemID != q.ItemID) ||
+			(q.TaskID != 0 && c.TaskID != q.TaskID) ||
+			(q.AssigneeID != nil && !assignedTo(c.AssigneeID, *q.AssigneeID)) ||
+			(!q.Since.IsZero() && c.CycleStart.Before(q.Since)) ||
+			(!q.Until.IsZero() && !c.CycleStart.Before(q.Until)) {
+			continue
+		}
+		records = append(records, c)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].CycleStart.After(records[j].CycleStart) })
+	return records, nil
+}
+
+func (s *memoryStore) AddNotification(ctx context.Context, n *Notification) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n.Key != "" {
+		for _, existing := range s.notifications {
+			if existing.UserID == n.UserID && existing.Key == n.Key {
+				return false, nil
+			}
+		}
+	}
+	s.counters[seqNotification]++
+	n.ID = s.counters[seqNotification]
+	s.notifications = append(s.notifications, *n)
+	return true, nil
+}
+
+func (s *memoryStore) ListNotifications(ctx context.Context, q NotificationQuery) ([]Notification, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	notes := []Notification{}
+	for i := len(s.notifications) - 1; i >= 0 && (q.Limit <= 0 || len(notes) < q.Limit); i-- {
+		n := s.notifications[i]
+		if n.UserID != q.UserID || !slices.Contains(n.Channels, ChannelInbox) ||
+			(q.Unread && n.ReadAt != nil) ||
+			(q.BeforeID != 0 && n.ID >= q.BeforeID) {
+			continue
+		}
+		notes = append(notes, n)
+	}
+	return notes, nil
+}
+
+func (s *memoryStore) CountUnreadNotifications(ctx context.Context, userID int64) (int64, error) {
+	notes, err := s.ListNotifications(ctx, NotificationQuery{UserID: userID, Unread: true})
+	return int64(len(notes)), err
+}
+
+func (s *memoryStore) MarkNotificationsRead(ctx context.Context, userID int64, at time.Time, ids ...int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for i, note := range s.notifications {
+		if note.UserID == userID && note.ReadAt == nil && slices.Contains(note.Channels, ChannelInbox) &&
+			(len(ids) == 0 || slices.Contains(ids, note.ID)) {
+			s.notifications[i].ReadAt = &at
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) EnqueueFileDeletions(ctx context.Context, paths ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, path := range paths {
+		s.queueFileLocked(path)
+	}
+	return nil
+}
+
+func (s *memoryStore) ClaimFileDeletion(ctx context.Context, now time.Time, lease time.Duration) (FileDeletion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var next *FileDeletion
+	for _, fd := range s.deletions {
+		if !fd.NextAttemptAt.After(now) && (next == nil || fd.NextAttemptAt.Before(next.NextAttemptAt)) {
+			fd := fd
+			next = &fd
+		}
+	}
+	if next == nil {
+		return FileDeletion{}, ErrNotFound
+	}
+	next.NextAttemptAt = now.Add(lease)
+	next.Attempts++
+	s.deletions[next.Path] = *next
+	return *next, nil
+}
+
+func (s *memoryStore) CompleteFileDeletion(ctx context.Context, path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.deletions, path)
+	return nil
+}
+
+func (s *memoryStore) RetryFileDeletion(ctx context.Context, path string, next time.Time, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if fd, ok := s.deletions[path]; ok {
+		fd.NextAttemptAt, fd.LastError = next, reason
+		s.deletions[path] = fd
+	}
+	return nil
+}
+
+func (s *memoryStore) AcquireBlob(ctx context.Context, sha256 string) (BlobRef, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ref, ok := s.blobRefs[sha256]
+	if !ok || ref.CorruptAt != nil {
+		return BlobRef{}, ErrNotFound
+	}
+	ref.Refs++
+	s.blobRefs[sha256] = ref
+	return ref, nil
+}
+
+func (s *memoryStore) AddBlob(ctx context.Context, ref BlobRef) (BlobRef, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.blobRefs[ref.SHA256]
+	if ok && existing.CorruptAt == nil {
+		existing.Refs++
+		s.blobRefs[ref.SHA256] = existing
+		return existing, nil
+	}
+	ref.Refs = 1
+	if ok {
+		// ref replaces the corrupt file, which takes its attachments.
+		ref.Refs += existing.Refs
+		for id, att := range s.attachments {
+			if att.SHA256 == ref.SHA256 && att.URL == existing.Key {
+				att.URL = ref.Key
+				s.attachments[id] = att
+			}
+		}
+	}
+	s.blobRefs[ref.SHA256] = ref
+	if ok {
+		s.queueFileLocked(existing.Key)
+	}
+	return ref, nil
+}
+
+func (s *memoryStore) ReleaseBlobs(ctx context.Context, hashes ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, h := range hashes {
+		s.releaseBlobLocked(h)
+	}
+	return nil
+}
+
+func (s *memoryStore) releaseBlobLocked(sha256 string) {
+	ref, ok := s.blobRefs[sha256]
+	if !ok {
+		return
+	}
+	if ref.Refs--; ref.Refs > 0 {
+		s.blobRefs[sha256] = ref
+		return
+	}
+	delete(s.blobRefs, sha256)
+	s.queueFileLocked(ref.Key)
+}
+
+func (s *memoryStore) MarkBlobCorrupt(ctx context.Context, sha256 string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ref, ok := s.blobRefs[sha256]
+	if !ok {
+		return ErrNotFound
+	}
+	if ref.CorruptAt == nil {
+		ref.CorruptAt = &at
+		s.blobRefs[sha256] = ref
+	}
+	return nil
+}
+
+func (s *memoryStore) ListCorruptBlobs(ctx context.Context) ([]BlobRef, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	refs := []BlobRef{}
+	for _, ref := range s.blobRefs {
+		if ref.CorruptAt != nil {
+			refs = append(refs, ref)
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].CorruptAt.Before(*refs[j].CorruptAt) })
+	return refs, nil
+}
+
+func (s *memoryStore) EnqueueNotificationDeliveries(ctx context.Context, deliveries ...NotificationDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range deliveries {
+		if _, queued := s.deliveries[d.ID]; !queued {
+			s.deliveries[d.ID] = d
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) ClaimNotificationDelivery(ctx context.Context, now time.Time, lease time.Duration) (NotificationDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var next *NotificationDelivery
+	for _, d := range s.deliveries {
+		if !d.NextAttemptAt.After(now) && (next == nil || d.NextAttemptAt.Before(next.NextAttemptAt)) {
+			d := d
+			next = &d
+		}
+	}
+	if next == nil {
+		return NotificationDelivery{}, ErrNotFound
+	}
+	next.NextAttemptAt = now.Add(lease)
+	next.Attempts++
+	s.deliveries[next.ID] = *next
+	return *next, nil
+}
+
+func (s *memoryStore) CompleteNotificationDelivery(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.deliveries, id)
+	return nil
+}
+
+func (s *memoryStore) RetryNotificationDelivery(ctx context.Context, id string, next time.Time, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d, ok := s.deliveries[id]; ok {
+		d.NextAttemptAt, d.LastError = next, reason
+		s.deliveries[id] = d
+	}
+	return nil
+}
+
+func (s *memoryStore) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hooks := []Webhook{}
+	for _, w := range s.webhooks {
+		hooks = append(hooks, w)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].ID < hooks[j].ID })
+	return hooks, nil
+}
+
+func (s *memoryStore) GetWebhook(ctx context.Context, id int64) (Webhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	w, ok := s.webhooks[id]
+	if !ok {
+		return Webhook{}, ErrNotFound
+	}
+	return w, nil
+}
+
+func (s *memoryStore) CreateWebhook(ctx context.Context, w *Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.ID = s.nextSeqLocked(seqWebhook)
+	s.webhooks[w.ID] = *w
+	return nil
+}
+
+func (s *memoryStore) UpdateWebhook(ctx context.Context, id int64, fields map[string]any) (Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w, ok := s.webhooks[id]
+	if !ok {
+		return Webhook{}, ErrNotFound
+	}
+	// The secret is not part of the JSON form applyFields works on.
+	secret := w.Secret
+	if v, ok := fields["secret"].(string); ok {
+		secret = v
+	}
+	if err := applyFields(&w, fields); err != nil {
+		return Webhook{}, err
+	}
+	w.Secret = secret
+	s.webhooks[id] = w
+	return w, nil
+}
+
+func (s *memoryStore) DeleteWebhook(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.webhooks[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.webhooks, id)
+	s.hookDeliveries = slices.DeleteFunc(s.hookDeliveries, func(d WebhookDelivery) bool { return d.WebhookID == id })
+	return nil
+}
+
+func (s *memoryStore) EnqueueWebhookDeliveries(ctx context.Context, deliveries ...*WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range deliveries {
+		d.ID = s.nextSeqLocked(seqWebhookDelivery)
+		d.State = DeliveryPending
+		if d.NextAttemptAt == nil {
+			d.NextAttemptAt = &d.CreatedAt
+		}
+		s.hookDeliveries = append(s.hookDeliveries, *d)
+	}
+	return nil
+}
+
+func (s *memoryStore) ClaimWebhookDelivery(ctx context.Context, now time.Time, lease time.Duration) (WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := -1
+	for i, d := range s.hookDeliveries {
+		if d.State == DeliveryPending && !d.NextAttemptAt.After(now) &&
+			(next < 0 || d.NextAttemptAt.Before(*s.hookDeliveries[next].NextAttemptAt)) {
+			next = i
+		}
+	}
+	if next < 0 {
+		return WebhookDelivery{}, ErrNotFound
+	}
+	d := &s.hookDeliveries[next]
+	leased := now.Add(lease)
+	d.NextAttemptAt = &leased
+	d.Attempts++
+	return *d, nil
+}
+
+// updateHookDeliveryLocked applies fn to the delivery with the given ID.
+func (s *memoryStore) updateHookDeliveryLocked(id int64, fn func(d *WebhookDelivery)) {
+	if i, ok := slices.BinarySearchFunc(s.hookDeliveries, id, func(d WebhookDelivery, id int64) int {
+		return int(d.ID - id)
+	}); ok {
+		fn(&s.hookDeliveries[i])
+	}
+}
+
+func (s *memoryStore) CompleteWebhookDelivery(ctx context.Context, id int64, at time.Time, status int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updateHookDeliveryLocked(id, func(d *WebhookDelivery) {
+		d.State, d.NextAttemptAt, d.DeliveredAt, d.StatusCode, d.LastError = DeliveryDelivered, nil, &at, status, ""
+	})
+	return nil
+}
+
+func (s *memoryStore) RetryWebhookDelivery(ctx context.Context, id int64, next time.Time, status int, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updateHookDeliveryLocked(id, func(d *WebhookDelivery) {
+		d.NextAttemptAt, d.StatusCode, d.LastError = &next, status, reason
+	})
+	return nil
+}
+
+func (s *memoryStore) FailWebhookDelivery(ctx context.Context, id int64, status int, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updateHookDeliveryLocked(id, func(d *WebhookDelivery) {
+		d.State, d.NextAttemptAt, d.StatusCode, d.LastError = DeliveryFailed, nil, status, reason
+	})
+	return nil
+}
+
+func (s *memoryStore) GetWebhookDelivery(ctx context.Context, webhookID, id int64) (WebhookDelivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, d := range s.hookDeliveries {
+		if d.ID == id && d.WebhookID == webhookID {
+			return d, nil
+		}
+	}
+	return WebhookDelivery{}, ErrNotFound
+}
+
+func (s *memoryStore) ListWebhookDeliveries(ctx context.Context, q WebhookDeliveryQuery) ([]WebhookDelivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	deliveries := []WebhookDelivery{}
+	for i := len(s.hookDeliveries) - 1; i >= 0 && (q.Limit <= 0 || len(deliveries) < q.Limit); i-- {
+		d := s.hookDeliveries[i]
+		if (q.WebhookID != 0 && d.WebhookID != q.WebhookID) ||
+			(q.State != "" && d.State != q.State) ||
+			(q.BeforeID != 0 && d.ID >= q.BeforeID) {
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+func (s *memoryStore) PruneWebhookDeliveries(ctx context.Context, cutoff time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := len(s.hookDeliveries)
+	s.hookDeliveries = slices.DeleteFunc(s.hookDeliveries, func(d WebhookDelivery) bool {
+		return d.State != DeliveryPending && d.CreatedAt.Before(cutoff)
+	})
+	return int64(before - len(s.hookDeliveries)), nil
+}
+
+func (s *memoryStore) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	if l, ok := s.leases[name]; ok && l.Holder != holder && l.ExpiresAt.After(now) {
+		return false, nil
+	}
+	s.leases[name] = Lease{Name: name, Holder: holder, ExpiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (s *memoryStore) ReleaseLease(ctx context.Context, name, holder string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.leases[name].Holder == holder {
+		delete(s.leases, name)
+	}
+	return nil
+}
+
+func (s *memoryStore) NextSeq(ctx context.Context, name string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nextSeqLocked(name), nil
+}
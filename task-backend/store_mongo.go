@@ -0,0 +1,1409 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoStore is the TaskStore backed by the task_manager_db database.
+type mongoStore struct {
+	client *mongo.Client
+	db     *mongo.Database
+}
+
+func newMongoStore(client *mongo.Client, db *mongo.Database) *mongoStore {
+	return &mongoStore{client: client, db: db}
+}
+
+func (s *mongoStore) tasks() *mongo.Collection       { return s.db.Collection("tasks") }
+func (s *mongoStore) subtasks() *mongo.Collection    { return s.db.Collection("subtasks") }
+func (s *mongoStore) attachments() *mongo.Collection { return s.db.Collection("attachments") }
+func (s *mongoStore) users() *mongo.Collection       { return s.db.Collection("users") }
+func (s *mongoStore) counters() *mongo.Collection    { return s.db.Collection("counters") }
+func (s *mongoStore) sessions() *mongo.Collection    { return s.db.Collection("sessions") }
+func (s *mongoStore) activity() *mongo.Collection    { return s.db.Collection("activity") }
+func (s *mongoStore) leases() *mongo.Collection      { return s.db.Collection("leases") }
+func (s *mongoStore) completions() *mongo.Collection {
+	return s.db.Collection("completions")
+}
+func (s *mongoStore) fileDeletions() *mongo.Collection {
+	return s.db.Collection("file_deletions")
+}
+func (s *mongoStore) blobRefs() *mongo.Collection { return s.db.Collection("blob_refs") }
+func (s *mongoStore) notifications() *mongo.Collection {
+	return s.db.Collection("notifications")
+}
+func (s *mongoStore) notificationDeliveries() *mongo.Collection {
+	return s.db.Collection("notification_deliveries")
+}
+func (s *mongoStore) webhooks() *mongo.Collection { return s.db.Collection("webhooks") }
+func (s *mongoStore) webhookDeliveries() *mongo.Collection {
+	return s.db.Collection("webhook_deliveries")
+}
+
+func (s *mongoStore) Close(ctx context.Context) error {
+	return s.client.Disconnect(ctx)
+}
+
+// ensureIndexes creates the indexes the store relies on. It is safe to call
+// on every start; existing indexes are left alone.
+func (s *mongoStore) ensureIndexes(ctx context.Context) error {
+	// Only trashed documents have deleted_at; the purge job range-scans it.
+	trashIndex := mongo.IndexModel{Keys: bson.D{{Key: "deleted_at", Value: 1}}, Options: options.Index().SetSparse(true)}
+	indexes := map[*mongo.Collection][]mongo.IndexModel{
+		s.sessions(): {
+			{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+			// Expired sessions are removed by Mongo's TTL monitor.
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		s.activity(): {
+			{Keys: bson.D{{Key: "seq", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "task_id", Value: 1}, {Key: "seq", Value: -1}}},
+			{Keys: bson.D{{Key: "actor_id", Value: 1}, {Key: "seq", Value: -1}}},
+		},
+		s.completions(): {
+			{Keys: bson.D{{Key: "entity", Value: 1}, {Key: "item_id", Value: 1}, {Key: "cycle_start", Value: -1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "assignee_id", Value: 1}, {Key: "cycle_start", Value: -1}}},
+		},
+		s.notifications(): {
+			{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "id", Value: -1}}},
+			// Only keyed notifications are once-only.
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "key", Value: 1}}, Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"key": bson.M{"$type": "string"}})},
+		},
+		s.notificationDeliveries(): {
+			{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "next_attempt_at", Value: 1}}},
+		},
+		s.webhooks(): {
+			{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		s.webhookDeliveries(): {
+			{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "webhook_id", Value: 1}, {Key: "id", Value: -1}}},
+			// Only pending deliveries have next_attempt_at.
+			{Keys: bson.D{{Key: "next_attempt_at", Value: 1}}, Options: options.Index().SetSparse(true)},
+		},
+		s.fileDeletions(): {
+			{Keys: bson.D{{Key: "path", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "next_attempt_at", Value: 1}}},
+		},
+		s.users(): {
+			// Names are unique ignoring case, as FindUserByName looks them up.
+			{Keys: bson.D{{Key: "name", Value: 1}}, Options: options.Index().SetUnique(true).
+				SetCollation(userNameCollation)},
+		},
+		s.blobRefs(): {
+			{Keys: bson.D{{Key: "sha256", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		s.tasks(): {
+			{Keys: bson.D{{Key: "pinned", Value: -1}, {Key: "created_at", Value: -1}, {Key: "id", Value: -1}}},
+			{Keys: bson.D{{Key: "main_assignee_id", Value: 1}}},
+			trashIndex,
+		},
+		s.subtasks(): {
+			{Keys: bson.D{{Key: "task_id", Value: 1}}},
+			trashIndex,
+		},
+		s.attachments(): {
+			{Keys: bson.D{{Key: "task_id", Value: 1}}},
+			// Only attachments of resumable uploads have one.
+			{Keys: bson.D{{Key: "upload_id", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+			trashIndex,
+		},
+	}
+	// Databases from before names were unique may hold users the index
+	// would refuse; say which rather than fail on the first.
+	if err := s.checkUserNames(ctx); err != nil {
+		return err
+	}
+	for coll, models := range indexes {
+		if _, err := coll.Indexes().CreateMany(ctx, models); err != nil {
+			return fmt.Errorf("creating indexes on %s: %w", coll.Name(), err)
+		}
+	}
+	return nil
+}
+
+var userNameCollation = &options.Collation{Locale: "en", Strength: 2}
+
+// checkUserNames fails if users share a name, ignoring case, listing each
+// such name with the ids of its users. All but one of them need renaming in
+// the users collection before the server can start.
+func (s *mongoStore) checkUserNames(ctx context.Context) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": "$name", "ids": bson.M{"$push": "$id"}}}},
+		{{Key: "$match", Value: bson.M{"ids.1": bson.M{"$exists": true}}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+	cur, err := s.users().Aggregate(ctx, pipeline, options.Aggregate().SetCollation(userNameCollation))
+	if err != nil {
+		return fmt.Errorf("checking user names: %w", err)
+	}
+	var dups []struct {
+		Name string  `bson:"_id"`
+		IDs  []int64 `bson:"ids"`
+	}
+	if err := cur.All(ctx, &dups); err != nil {
+		return fmt.Errorf("checking user names: %w", err)
+	}
+	if len(dups) == 0 {
+		return nil
+	}
+	list := make([]string, len(dups))
+	for i, d := range dups {
+		list[i] = fmt.Sprintf("%q (ids %s)", d.Name, strings.Trim(fmt.Sprint(d.IDs), "[]"))
+	}
+	return fmt.Errorf("user names must be unique ignoring case; rename all but one user of each in the users collection: %s",
+		strings.Join(list, ", "))
+}
+
+// taskIDFilter matches documents belonging to any of ids, or everything when
+// ids is empty.
+func taskIDFilter(ids []int64) bson.M {
+	if len(ids) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"task_id": bson.M{"$in": ids}}
+}
+
+// live restricts filter to documents that are not in the trash. deleted_at
+// is omitted on live documents, and a null match covers missing fields.
+func live(filter bson.M) bson.M {
+	filter["deleted_at"] = nil
+	return filter
+}
+
+// inTrash restricts filter to trashed documents.
+func inTrash(filter bson.M) bson.M {
+	filter["deleted_at"] = bson.M{"$ne": nil}
+	return filter
+}
+
+func trashStamp(by int64) bson.M {
+	return bson.M{"$set": bson.M{"deleted_at": time.Now().UTC(), "deleted_by": by}}
+}
+
+// withTransaction runs fn in a multi-document transaction. Standalone
+// servers (a plain local mongod) do not support transactions; there fn runs
+// without one and the orphan sweeper (cmd/sweep-orphans) cleans up after a
+// partial failure.
+func (s *mongoStore) withTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	sess, err := s.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer sess.EndSession(ctx)
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (any, error) {
+		return nil, fn(sc)
+	})
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == 20 { // IllegalOperation: not a replica set
+		return fn(ctx)
+	}
+	return err
+}
+
+func notFound(err error) error {
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// taskFilter translates the filters of q into a Mongo query.
+func taskFilter(q TaskQuery) bson.M {
+	filter := live(bson.M{})
+	if len(q.Types) > 0 {
+		filter["type"] = bson.M{"$in": q.Types}
+	}
+	if len(q.Priorities) > 0 {
+		filter["priority"] = bson.M{"$in": q.Priorities}
+	}
+	for field, v := range map[string]*bool{"completed": q.Completed, "archived": q.Archived, "pinned": q.Pinned} {
+		if v != nil {
+			filter[field] = *v
+		}
+	}
+	created := bson.M{}
+	if !q.CreatedFrom.IsZero() {
+		created["$gte"] = q.CreatedFrom
+	}
+	if !q.CreatedTo.IsZero() {
+		created["$lt"] = q.CreatedTo
+	}
+	if len(created) > 0 {
+		filter["created_at"] = created
+	}
+	if q.Assignee != nil {
+		main := bson.M{"main_assignee_id": *q.Assignee}
+		supporting := bson.M{"supporting_assignees": primitive.Regex{Pattern: supportingPattern(*q.Assignee)}}
+		either := bson.A{main, supporting}
+		switch q.AssigneeRole {
+		case AssigneeMain:
+			either = bson.A{main}
+		case AssigneeSupporting:
+			either = bson.A{supporting}
+		}
+		filter["$or"] = either
+	}
+	return filter
+}
+
+// keysetFilter matches the documents that sort after the key `after`: for
+// keys k1..kn, those greater on k1, or equal on k1 and greater on k2, etc.
+func keysetFilter(keys []sortKey, after taskKey) bson.M {
+	or := bson.A{}
+	for i, k := range keys {
+		clause := bson.M{}
+		for _, prev := range keys[:i] {
+			clause[prev.field] = after.value(prev.field)
+		}
+		op := "$gt"
+		if k.desc {
+			op = "$lt"
+		}
+		clause[k.field] = bson.M{op: after.value(k.field)}
+		or = append(or, clause)
+	}
+	return bson.M{"$or": or}
+}
+
+func (s *mongoStore) ListTasks(ctx context.Context, q TaskQuery) ([]Task, error) {
+	keys, err := q.Sort.keys()
+	if err != nil {
+		return nil, err
+	}
+	ranks := bson.A{}
+	for name, rank := range priorityRanks {
+		ranks = append(ranks, bson.M{"case": bson.M{"$eq": bson.A{"$priority", name}}, "then": rank})
+	}
+	order := bson.D{}
+	for _, k := range keys {
+		dir := 1
+		if k.desc {
+			dir = -1
+		}
+		order = append(order, bson.E{Key: k.field, Value: dir})
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: taskFilter(q)}},
+		{{Key: "$addFields", Value: bson.M{"priority_rank": bson.M{"$switch": bson.M{"branches": ranks, "default": 0}}}}},
+	}
+	if q.After != nil {
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: keysetFilter(keys, *q.After)}})
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$sort", Value: order}})
+	if q.Limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: q.Limit}})
+	}
+	cur, err := s.tasks().Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	tasks := []Task{}
+	if err := cur.All(ctx, &tasks); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+func (s *mongoStore) RecentTasks(ctx context.Context, limit int) ([]Task, error) {
+	filter := live(bson.M{"archived": false}) // Only filter out archived tasks, show both completed and incomplete
+	op := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(int64(limit))
+	cur, err := s.tasks().Find(ctx, filter, op)
+	if err != nil {
+		return nil, err
+	}
+	tasks := []Task{}
+	if err := cur.All(ctx, &tasks); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+func (s *mongoStore) GetTask(ctx context.Context, id int64) (Task, error) {
+	var task Task
+	err := s.tasks().FindOne(ctx, bson.M{"id": id}).Decode(&task)
+	return task, notFound(err)
+}
+
+func (s *mongoStore) CreateTask(ctx context.Context, task *Task) error {
+	seq, err := s.NextSeq(ctx, seqTask)
+	if err != nil {
+		return err
+	}
+	task.ID, task.Version = seq, 1
+	_, err = s.tasks().InsertOne(ctx, task)
+	return err
+}
+
+func (s *mongoStore) UpdateTask(ctx context.Context, id, version int64, fields map[string]any) (Task, error) {
+	var task Task
+	filter := live(bson.M{"id": id})
+	if len(fields) == 0 {
+		err := s.tasks().FindOne(ctx, withVersion(filter, version)).Decode(&task)
+		return task, s.versionMiss(ctx, s.tasks(), filter, err)
+	}
+	err := s.tasks().FindOneAndUpdate(ctx, withVersion(filter, version), versionedSet(fields),
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&task)
+	return task, s.versionMiss(ctx, s.tasks(), filter, err)
+}
+
+// withVersion adds the version check of a conditional update to a copy of
+// filter. Documents stored before versions existed have none and count as
+// version 0.
+func withVersion(filter bson.M, version int64) bson.M {
+	out := bson.M{}
+	for k, v := range filter {
+		out[k] = v
+	}
+	switch version {
+	case anyVersion:
+	case 0:
+		out["version"] = bson.M{"$in": bson.A{0, nil}}
+	default:
+		out["version"] = version
+	}
+	return out
+}
+
+func versionedSet(fields map[string]any) bson.M {
+	return bson.M{"$set": fields, "$inc": bson.M{"version": 1}}
+}
+
+// versionMiss tells apart why a conditional update matched nothing: the
+// document is gone (ErrNotFound) or has another version
+// (ErrVersionConflict).
+func (s *mongoStore) versionMiss(ctx context.Context, coll *mongo.Collection, filter bson.M, err error) error {
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+	n, err := coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrVersionConflict
+	}
+	return ErrNotFound
+}
+
+func (s *mongoStore) TrashTask(ctx context.Context, id, by int64) error {
+	res, err := s.tasks().UpdateOne(ctx, live(bson.M{"id": id}), trashStamp(by))
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoStore) ClearTasks(ctx context.Context, by int64) error {
+	_, err := s.tasks().UpdateMany(ctx, live(bson.M{"archived": false}), trashStamp(by))
+	return err
+}
+
+// deleteTasks removes the tasks matching filter with their subtasks and
+// attachments, and releases the attachments' stored files. It reports how
+// many tasks went.
+func (s *mongoStore) deleteTasks(ctx context.Context, filter bson.M) (int64, error) {
+	var n int64
+	err := s.withTransaction(ctx, func(ctx context.Context) error {
+		rawIDs, err := s.tasks().Distinct(ctx, "id", filter)
+		if err != nil {
+			return err
+		}
+		n = int64(len(rawIDs))
+		if n == 0 {
+			return nil
+		}
+		children := bson.M{"task_id": bson.M{"$in": rawIDs}}
+		if err := s.releaseFiles(ctx, children); err != nil {
+			return err
+		}
+		if _, err := s.attachments().DeleteMany(ctx, children); err != nil {
+			return err
+		}
+		if _, err := s.subtasks().DeleteMany(ctx, children); err != nil {
+			return err
+		}
+		_, err = s.tasks().DeleteMany(ctx, bson.M{"id": bson.M{"$in": rawIDs}})
+		return err
+	})
+	return n, err
+}
+
+// deleteAttachments removes the attachments matching filter and releases
+// their stored files. It reports how many went.
+func (s *mongoStore) deleteAttachments(ctx context.Context, filter bson.M) (int64, error) {
+	var n int64
+	err := s.withTransaction(ctx, func(ctx context.Context) error {
+		if err := s.releaseFiles(ctx, filter); err != nil {
+			return err
+		}
+		res, err := s.attachments().DeleteMany(ctx, filter)
+		if err != nil {
+			return err
+		}
+		n = res.DeletedCount
+		return nil
+	})
+	return n, err
+}
+
+// releaseFiles lets go of the stored files of the file attachments matching
+// filter: files of their own are queued for deletion, shared ones lose a
+// reference. A file of its own that is also a shared file is left to the
+// references.
+func (s *mongoStore) releaseFiles(ctx context.Context, filter bson.M) error {
+	f := bson.M{"type": "file", "url": bson.M{"$ne": ""}}
+	for k, v := range filter {
+		f[k] = v
+	}
+	cur, err := s.attachments().Find(ctx, f, options.Find().SetProjection(bson.M{"url": 1, "sha256": 1}))
+	if err != nil {
+		return err
+	}
+	var atts []Attachment
+	if err := cur.All(ctx, &atts); err != nil {
+		return err
+	}
+	var paths, hashes []string
+	for _, att := range atts {
+		if att.SHA256 != "" {
+			hashes = append(hashes, att.SHA256)
+		} else {
+			paths = append(paths, att.URL)
+		}
+	}
+	if len(paths) > 0 {
+		shared, err := s.blobRefs().Distinct(ctx, "key", bson.M{"key": bson.M{"$in": paths}})
+		if err != nil {
+			return err
+		}
+		paths = slices.DeleteFunc(paths, func(p string) bool { return slices.Contains(shared, any(p)) })
+	}
+	if err := s.EnqueueFileDeletions(ctx, paths...); err != nil {
+		return err
+	}
+	return s.releaseBlobs(ctx, hashes)
+}
+
+func (s *mongoStore) OpenTasksAssignedTo(ctx context.Context, userID int64) ([]Task, error) {
+	cur, err := s.tasks().Find(ctx, live(bson.M{"main_assignee_id": userID, "completed": false, "archived": false}))
+	if err != nil {
+		return nil, err
+	}
+	tasks := []Task{}
+	if err := cur.All(ctx, &tasks); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+func (s *mongoStore) OpenSubtasksAssignedTo(ctx context.Context, userID int64) ([]Subtask, error) {
+	cur, err := s.subtasks().Find(ctx, live(bson.M{"main_assignee_id": userID, "completed": false}),
+		options.Find().SetSort(bson.D{{Key: "id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	subtasks := []Subtask{}
+	if err := cur.All(ctx, &subtasks); err != nil {
+		return nil, err
+	}
+	return subtasks, nil
+}
+
+func (s *mongoStore) ReassignOpenWork(ctx context.Context, from, to int64) (int64, int64, error) {
+	set := versionedSet(bson.M{"main_assignee_id": to})
+	taskRes, err := s.tasks().UpdateMany(ctx, live(bson.M{"main_assignee_id": from, "completed": false, "archived": false}), set)
+	if err != nil {
+		return 0, 0, err
+	}
+	subRes, err := s.subtasks().UpdateMany(ctx, live(bson.M{"main_assignee_id": from, "completed": false}), set)
+	if err != nil {
+		return taskRes.ModifiedCount, 0, err
+	}
+	return taskRes.ModifiedCount, subRes.ModifiedCount, nil
+}
+
+func (s *mongoStore) ListSubtasks(ctx context.Context, taskIDs ...int64) ([]Subtask, error) {
+	cur, err := s.subtasks().Find(ctx, live(taskIDFilter(taskIDs)))
+	if err != nil {
+		return nil, err
+	}
+	subtasks := []Subtask{}
+	if err := cur.All(ctx, &subtasks); err != nil {
+		return nil, err
+	}
+	return subtasks, nil
+}
+
+func (s *mongoStore) CreateSubtask(ctx context.Context, subtask *Subtask) error {
+	seq, err := s.NextSeq(ctx, seqSubtask)
+	if err != nil {
+		return err
+	}
+	subtask.ID, subtask.Version = seq, 1
+	_, err = s.subtasks().InsertOne(ctx, subtask)
+	return err
+}
+
+func (s *mongoStore) UpdateSubtask(ctx context.Context, taskID, id, version int64, fields map[string]any) (Subtask, error) {
+	var updated Subtask
+	filter := live(bson.M{"id": id, "task_id": taskID})
+	if len(fields) == 0 {
+		err := s.subtasks().FindOne(ctx, withVersion(filter, version)).Decode(&updated)
+		return updated, s.versionMiss(ctx, s.subtasks(), filter, err)
+	}
+	err := s.subtasks().FindOneAndUpdate(ctx, withVersion(filter, version), versionedSet(fields),
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updated)
+	return updated, s.versionMiss(ctx, s.subtasks(), filter, err)
+}
+
+func (s *mongoStore) TrashSubtask(ctx context.Context, taskID, id, by int64) error {
+	res, err := s.subtasks().UpdateOne(ctx, live(bson.M{"id": id, "task_id": taskID}), trashStamp(by))
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoStore) ListAttachments(ctx context.Context, taskIDs ...int64) ([]Attachment, error) {
+	cur, err := s.attachments().Find(ctx, live(taskIDFilter(taskIDs)), options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	attachments := []Attachment{}
+	if err := cur.All(ctx, &attachments); err != nil {
+		return nil, err
+	}
+	return attachments, nil
+}
+
+func (s *mongoStore) GetAttachment(ctx context.Context, taskID, id int64) (Attachment, error) {
+	var att Attachment
+	err := s.attachments().FindOne(ctx, live(bson.M{"id": id, "task_id": taskID})).Decode(&att)
+	return att, notFound(err)
+}
+
+func (s *mongoStore) CreateAttachment(ctx context.Context, attachment *Attachment) error {
+	seq, err := s.NextSeq(ctx, seqAttachment)
+	if err != nil {
+		return err
+	}
+	attachment.ID = seq
+	_, err = s.attachments().InsertOne(ctx, attachment)
+	if mongo.IsDuplicateKeyError(err) {
+		var existing Attachment
+		if err := s.attachments().FindOne(ctx, bson.M{"upload_id": attachment.UploadID}).Decode(&existing); err != nil {
+			return err
+		}
+		attachment.ID = existing.ID
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (s *mongoStore) TrashAttachment(ctx context.Context, taskID, id, by int64) error {
+	res, err := s.attachments().UpdateOne(ctx, live(bson.M{"id": id, "task_id": taskID}), trashStamp(by))
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoStore) trashCollection(kind TrashKind) *mongo.Collection {
+	switch kind {
+	case TrashTasks:
+		return s.tasks()
+	case TrashSubtasks:
+		return s.subtasks()
+	default:
+		return s.attachments()
+	}
+}
+
+// findTrash decodes the trashed documents of coll matching filter as T.
+func findTrash[T interface{ trashItem() TrashItem }](ctx context.Context, coll *mongo.Collection, filter bson.M) ([]TrashItem, error) {
+	cur, err := coll.Find(ctx, inTrash(filter))
+	if err != nil {
+		return nil, err
+	}
+	var docs []T
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	items := make([]TrashItem, len(docs))
+	for i, d := range docs {
+		items[i] = d.trashItem()
+	}
+	return items, nil
+}
+
+func (s *mongoStore) findTrash(ctx context.Context, kind TrashKind, filter bson.M) ([]TrashItem, error) {
+	switch kind {
+	case TrashTasks:
+		return findTrash[Task](ctx, s.tasks(), filter)
+	case TrashSubtasks:
+		return findTrash[Subtask](ctx, s.subtasks(), filter)
+	default:
+		return findTrash[Attachment](ctx, s.attachments(), filter)
+	}
+}
+
+func (s *mongoStore) ListTrash(ctx context.Context) ([]TrashItem, error) {
+	items := []TrashItem{}
+	for _, kind := range []TrashKind{TrashTasks, TrashSubtasks, TrashAttachments} {
+		found, err := s.findTrash(ctx, kind, bson.M{})
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, found...)
+	}
+	sortTrash(items)
+	return items, nil
+}
+
+func (s *mongoStore) GetTrashItem(ctx context.Context, kind TrashKind, id int64) (TrashItem, error) {
+	found, err := s.findTrash(ctx, kind, bson.M{"id": id})
+	if err != nil {
+		return TrashItem{}, err
+	}
+	if len(found) == 0 {
+		return TrashItem{}, ErrNotFound
+	}
+	return found[0], nil
+}
+
+func (s *mongoStore) GetTrashedDocument(ctx context.Context, kind TrashKind, id int64) (any, error) {
+	var doc any
+	switch kind {
+	case TrashTasks:
+		doc = &Task{}
+	case TrashSubtasks:
+		doc = &Subtask{}
+	default:
+		doc = &Attachment{}
+	}
+	if err := s.trashCollection(kind).FindOne(ctx, inTrash(bson.M{"id": id})).Decode(doc); err != nil {
+		return nil, notFound(err)
+	}
+	return doc, nil
+}
+
+func (s *mongoStore) RestoreTrashItem(ctx context.Context, kind TrashKind, id int64) error {
+	if kind != TrashTasks {
+		item, err := s.GetTrashItem(ctx, kind, id)
+		if err != nil {
+			return err
+		}
+		task, err := s.GetTask(ctx, item.TaskID)
+		if errors.Is(err, ErrNotFound) || (err == nil && task.trashed()) {
+			return ErrParentTrashed
+		}
+		if err != nil {
+			return err
+		}
+	}
+	res, err := s.trashCollection(kind).UpdateOne(ctx, inTrash(bson.M{"id": id}),
+		bson.M{"$unset": bson.M{"deleted_at": "", "deleted_by": ""}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoStore) PurgeTrashItem(ctx context.Context, kind TrashKind, id int64) error {
+	filter := inTrash(bson.M{"id": id})
+	var n int64
+	var err error
+	switch kind {
+	case TrashTasks:
+		n, err = s.deleteTasks(ctx, filter)
+	case TrashSubtasks:
+		var res *mongo.DeleteResult
+		if res, err = s.subtasks().DeleteOne(ctx, filter); err == nil {
+			n = res.DeletedCount
+		}
+	default:
+		n, err = s.deleteAttachments(ctx, filter)
+	}
+	if err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *mongoStore) PurgeTrash(ctx context.Context, cutoff time.Time) (int64, error) {
+	due := func() bson.M { return bson.M{"deleted_at": bson.M{"$lte": cutoff}} }
+	tasks, err := s.deleteTasks(ctx, due())
+	if err != nil {
+		return 0, err
+	}
+	subs, err := s.subtasks().DeleteMany(ctx, due())
+	if err != nil {
+		return tasks, err
+	}
+	atts, err := s.deleteAttachments(ctx, due())
+	return tasks + subs.DeletedCount + atts, err
+}
+
+func (s *mongoStore) ListUsers(ctx context.Context) ([]User, error) {
+	cur, err := s.users().Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	users := []User{}
+	if err := cur.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *mongoStore) GetUser(ctx context.Context, id int64) (User, error) {
+	var u User
+	err := s.users().FindOne(ctx, bson.M{"id": id}).Decode(&u)
+	return u, notFound(err)
+}
+
+func (s *mongoStore) FindUserByName(ctx context.Context, name string) (User, error) {
+	var u User
+	filter := bson.M{"name": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(name) + "$", Options: "i"}}
+	err := s.users().FindOne(ctx, filter).Decode(&u)
+	return u, notFound(err)
+}
+
+func (s *mongoStore) CreateUser(ctx context.Context, user *User) error {
+	seq, err := s.NextSeq(ctx, seqUser)
+	if err != nil {
+		return err
+	}
+	user.ID = seq
+	_, err = s.users().InsertOne(ctx, user)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (s *mongoStore) UpdateUser(ctx context.Context, id int64, fields map[string]any) (User, error) {
+	if len(fields) > 0 {
+		_, err := s.users().UpdateOne(ctx, bson.M{"id": id}, bson.M{"$set": fields})
+		if mongo.IsDuplicateKeyError(err) {
+			return User{}, ErrDuplicate
+		}
+		if err != nil {
+			return User{}, err
+		}
+	}
+	return s.GetUser(ctx, id)
+}
+
+func (s *mongoStore) SetUserPassword(ctx context.Context, id int64, hash string) error {
+	res, err := s.users().UpdateOne(ctx, bson.M{"id": id}, bson.M{"$set": bson.M{"password_hash": hash}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoStore) SetNotificationPrefs(ctx context.Context, id int64, prefs NotificationPrefs) error {
+	res, err := s.users().UpdateOne(ctx, bson.M{"id": id}, bson.M{"$set": bson.M{"notification_prefs": prefs}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoStore) DeleteUser(ctx context.Context, id int64) error {
+	_, err := s.users().DeleteOne(ctx, bson.M{"id": id})
+	return err
+}
+
+func (s *mongoStore) CreateSession(ctx context.Context, session Session) error {
+	_, err := s.sessions().InsertOne(ctx, session)
+	return err
+}
+
+func (s *mongoStore) GetSession(ctx context.Context, id string) (Session, error) {
+	var sess Session
+	// The TTL monitor only runs once a minute, so filter on expiry too.
+	err := s.sessions().FindOne(ctx, bson.M{"id": id, "expires_at": bson.M{"$gt": time.Now()}}).Decode(&sess)
+	return sess, notFound(err)
+}
+
+func (s *mongoStore) DeleteSession(ctx context.Context, id string) error {
+	_, err := s.sessions().DeleteOne(ctx, bson.M{"id": id})
+	return err
+}
+
+func (s *mongoStore) DeleteUserSessions(ctx context.Context, userID int64, keepID string) error {
+	_, err := s.sessions().DeleteMany(ctx, bson.M{"user_id": userID, "id": bson.M{"$ne": keepID}})
+	return err
+}
+
+func (s *mongoStore) AppendActivity(ctx context.Context, a *Activity) error {
+	seq, err := s.NextSeq(ctx, seqActivity)
+	if err != nil {
+		return err
+	}
+	a.Seq = seq
+	_, err = s.activity().InsertOne(ctx, a)
+	return err
+}
+
+func (s *mongoStore) ListActivity(ctx context.Context, q ActivityQuery) ([]Activity, error) {
+	filter := bson.M{}
+	if q.TaskID != 0 {
+		filter["task_id"] = q.TaskID
+	}
+	if q.ActorID != 0 {
+		filter["actor_id"] = q.ActorID
+	}
+	if q.Entity != "" {
+		filter["entity"] = q.Entity
+	}
+	if q.Action != "" {
+		filter["action"] = q.Action
+	}
+	at := bson.M{}
+	if !q.Since.IsZero() {
+		at["$gte"] = q.Since
+	}
+	if !q.Until.IsZero() {
+		at["$lt"] = q.Until
+	}
+	if len(at) > 0 {
+		filter["at"] = at
+	}
+	if q.BeforeSeq != 0 {
+		filter["seq"] = bson.M{"$lt": q.BeforeSeq}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: -1}})
+	if q.Limit > 0 {
+		opts.SetLimit(int64(q.Limit))
+	}
+	cur, err := s.activity().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	entries := []Activity{}
+	if err := cur.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (s *mongoStore) TailActivity(ctx context.Context, afterSeq int64, limit int) ([]Activity, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}).SetLimit(int64(limit))
+	cur, err := s.activity().Find(ctx, bson.M{"seq": bson.M{"$gt": afterSeq}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	entries := []Activity{}
+	if err := cur.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (s *mongoStore) RecordCompletions(ctx context.Context, completions ...Completion) error {
+	for _, c := range completions {
+		key := bson.M{"entity": c.Entity, "item_id": c.ItemID, "cycle_start": c.CycleStart}
+		if _, err := s.completions().UpdateOne(ctx, key, bson.M{"$setOnInsert": c}, options.Update().SetUpsert(true)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *mongoStore) ListCompletions(ctx context.Context, q CompletionQuery) ([]Completion, error) {
+	filter := bson.M{}
+	if q.Entity != "" {
+		filter["entity"] = q.Entity
+	}
+	if q.ItemID != 0 {
+		filter["item_id"] = q.ItemID
+	}
+	if q.TaskID != 0 {
+		filter["task_id"] = q.TaskID
+	}
+	if q.AssigneeID != nil {
+		filter["assignee_id"] = *q.AssigneeID
+	}
+	start := bson.M{}
+	if !q.Since.IsZero() {
+		start["$gte"] = q.Since
+	}
+	if !q.Until.IsZero() {
+		start["$lt"] = q.Until
+	}
+	if len(start) > 0 {
+		filter["cycle_start"] = start
+	}
+	cur, err := s.completions().Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "cycle_start", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	records := []Completion{}
+	if err := cur.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (s *mongoStore) EnqueueFileDeletions(ctx context.Context, paths ...string) error {
+	now := time.Now().UTC()
+	for _, path := range paths {
+		doc := bson.M{"$setOnInsert": FileDeletion{Path: path, EnqueuedAt: now, NextAttemptAt: now}}
+		if _, err := s.fileDeletions().UpdateOne(ctx, bson.M{"path": path}, doc, options.Update().SetUpsert(true)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *mongoStore) ClaimFileDeletion(ctx context.Context, now time.Time, lease time.Duration) (FileDeletion, error) {
+	var fd FileDeletion
+	err := s.fileDeletions().FindOneAndUpdate(ctx,
+		bson.M{"next_attempt_at": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"next_attempt_at": now.Add(lease)}, "$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}).SetReturnDocument(options.After),
+	).Decode(&fd)
+	return fd, notFound(err)
+}
+
+func (s *mongoStore) CompleteFileDeletion(ctx context.Context, path string) error {
+	_, err := s.fileDeletions().DeleteOne(ctx, bson.M{"path": path})
+	return err
+}
+
+func (s *mongoStore) RetryFileDeletion(ctx context.Context, path string, next time.Time, reason string) error {
+	_, err := s.fileDeletions().UpdateOne(ctx, bson.M{"path": path},
+		bson.M{"$set": bson.M{"next_attempt_at": next, "last_error": reason}})
+	return err
+}
+
+func (s *mongoStore) AcquireBlob(ctx context.Context, sha256 string) (BlobRef, error) {
+	// A file whose count has dropped to zero is on its way out, and a
+	// corrupt one is replaced by the next upload.
+	var ref BlobRef
+	err := s.blobRefs().FindOneAndUpdate(ctx,
+		bson.M{"sha256": sha256, "refs": bson.M{"$gt": 0}, "corrupt_at": bson.M{"$exists": false}},
+		bson.M{"$inc": bson.M{"refs": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&ref)
+	return ref, notFound(err)
+}
+
+func (s *mongoStore) AddBlob(ctx context.Context, ref BlobRef) (BlobRef, error) {
+	ref.Refs = 1
+	for attempt := 1; attempt <= 3; attempt++ {
+		_, err := s.blobRefs().InsertOne(ctx, ref)
+		if !mongo.IsDuplicateKeyError(err) {
+			return ref, err
+		}
+		existing, err := s.AcquireBlob(ctx, ref.SHA256)
+		if !errors.Is(err, ErrNotFound) {
+			return existing, err
+		}
+		replaced, err := s.replaceCorruptBlob(ctx, ref)
+		if !errors.Is(err, ErrNotFound) {
+			return replaced, err
+		}
+		// The other one is being released; it is gone in a moment.
+		time.Sleep(time.Duration(attempt) * 50 * time.Millisecond)
+	}
+	return BlobRef{}, fmt.Errorf("stored file %s is being released", ref.SHA256)
+}
+
+// replaceCorruptBlob puts ref's file in place of the corrupt one with the
+// same hash, moves the attachments of the corrupt one over and queues it for
+// deletion. ErrNotFound if there is no corrupt one.
+func (s *mongoStore) replaceCorruptBlob(ctx context.Context, ref BlobRef) (BlobRef, error) {
+	err := s.withTransaction(ctx, func(ctx context.Context) error {
+		var old BlobRef
+		err := s.blobRefs().FindOneAndUpdate(ctx,
+			bson.M{"sha256": ref.SHA256, "corrupt_at": bson.M{"$exists": true}},
+			bson.M{
+				"$set":   bson.M{"key": ref.Key, "size": ref.Size, "created_at": ref.CreatedAt},
+				"$unset": bson.M{"corrupt_at": ""},
+				"$inc":   bson.M{"refs": 1},
+			}).Decode(&old)
+		if err != nil {
+			return notFound(err)
+		}
+		ref.Refs = old.Refs + 1
+		if _, err := s.attachments().UpdateMany(ctx, bson.M{"sha256": ref.SHA256, "url": old.Key},
+			bson.M{"$set": bson.M{"url": ref.Key}}); err != nil {
+			return err
+		}
+		return s.EnqueueFileDeletions(ctx, old.Key)
+	})
+	if err != nil {
+		return BlobRef{}, err
+	}
+	return ref, nil
+}
+
+func (s *mongoStore) MarkBlobCorrupt(ctx context.Context, sha256 string, at time.Time) error {
+	res, err := s.blobRefs().UpdateOne(ctx, bson.M{"sha256": sha256},
+		[]bson.M{{"$set": bson.M{"corrupt_at": bson.M{"$ifNull": bson.A{"$corrupt_at", at}}}}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoStore) ListCorruptBlobs(ctx context.Context) ([]BlobRef, error) {
+	cur, err := s.blobRefs().Find(ctx, bson.M{"corrupt_at": bson.M{"$exists": true}},
+		options.Find().SetSort(bson.D{{Key: "corrupt_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	refs := []BlobRef{}
+	if err := cur.All(ctx, &refs); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+func (s *mongoStore) ReleaseBlobs(ctx context.Context, hashes ...string) error {
+	return s.withTransaction(ctx, func(ctx context.Context) error {
+		return s.releaseBlobs(ctx, hashes)
+	})
+}
+
+func (s *mongoStore) releaseBlobs(ctx context.Context, hashes []string) error {
+	counts := map[string]int64{}
+	for _, h := range hashes {
+		counts[h]++
+	}
+	for h, n := range counts {
+		var ref BlobRef
+		err := s.blobRefs().FindOneAndUpdate(ctx, bson.M{"sha256": h}, bson.M{"$inc": bson.M{"refs": -n}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&ref)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if ref.Refs > 0 {
+			continue
+		}
+		res, err := s.blobRefs().DeleteOne(ctx, bson.M{"sha256": h, "refs": bson.M{"$lte": 0}})
+		if err != nil {
+			return err
+		}
+		if res.DeletedCount == 1 {
+			if err := s.EnqueueFileDeletions(ctx, ref.Key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *mongoStore) AddNotification(ctx context.Context, n *Notification) (bool, error) {
+	id, err := s.NextSeq(ctx, seqNotification)
+	if err != nil {
+		return false, err
+	}
+	n.ID = id
+	_, err = s.notifications().InsertOne(ctx, n)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// inboxFilter matches the inbox entries selected by q.
+func inboxFilter(q NotificationQuery) bson.M {
+	filter := bson.M{"user_id": q.UserID, "channels": ChannelInbox}
+	if q.Unread {
+		filter["read_at"] = nil
+	}
+	if q.BeforeID != 0 {
+		filter["id"] = bson.M{"$lt": q.BeforeID}
+	}
+	return filter
+}
+
+func (s *mongoStore) ListNotifications(ctx context.Context, q NotificationQuery) ([]Notification, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "id", Value: -1}})
+	if q.Limit > 0 {
+		opts.SetLimit(int64(q.Limit))
+	}
+	cur, err := s.notifications().Find(ctx, inboxFilter(q), opts)
+	if err != nil {
+		return nil, err
+	}
+	notes := []Notification{}
+	if err := cur.All(ctx, &notes); err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+func (s *mongoStore) CountUnreadNotifications(ctx context.Context, userID int64) (int64, error) {
+	return s.notifications().CountDocuments(ctx, inboxFilter(NotificationQuery{UserID: userID, Unread: true}))
+}
+
+func (s *mongoStore) MarkNotificationsRead(ctx context.Context, userID int64, at time.Time, ids ...int64) (int64, error) {
+	filter := inboxFilter(NotificationQuery{UserID: userID, Unread: true})
+	if len(ids) > 0 {
+		filter["id"] = bson.M{"$in": ids}
+	}
+	res, err := s.notifications().UpdateMany(ctx, filter, bson.M{"$set": bson.M{"read_at": at}})
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+func (s *mongoStore) EnqueueNotificationDeliveries(ctx context.Context, deliveries ...NotificationDelivery) error {
+	for _, d := range deliveries {
+		doc := bson.M{"$setOnInsert": d}
+		if _, err := s.notificationDeliveries().UpdateOne(ctx, bson.M{"id": d.ID}, doc, options.Update().SetUpsert(true)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *mongoStore) ClaimNotificationDelivery(ctx context.Context, now time.Time, lease time.Duration) (NotificationDelivery, error) {
+	var d NotificationDelivery
+	err := s.notificationDeliveries().FindOneAndUpdate(ctx,
+		bson.M{"next_attempt_at": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"next_attempt_at": now.Add(lease)}, "$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}).SetReturnDocument(options.After),
+	).Decode(&d)
+	return d, notFound(err)
+}
+
+func (s *mongoStore) CompleteNotificationDelivery(ctx context.Context, id string) error {
+	_, err := s.notificationDeliveries().DeleteOne(ctx, bson.M{"id": id})
+	return err
+}
+
+func (s *mongoStore) RetryNotificationDelivery(ctx context.Context, id string, next time.Time, reason string) error {
+	_, err := s.notificationDeliveries().UpdateOne(ctx, bson.M{"id": id},
+		bson.M{"$set": bson.M{"next_attempt_at": next, "last_error": reason}})
+	return err
+}
+
+func (s *mongoStore) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	cur, err := s.webhooks().Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	hooks := []Webhook{}
+	if err := cur.All(ctx, &hooks); err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+func (s *mongoStore) GetWebhook(ctx context.Context, id int64) (Webhook, error) {
+	var w Webhook
+	err := s.webhooks().FindOne(ctx, bson.M{"id": id}).Decode(&w)
+	return w, notFound(err)
+}
+
+func (s *mongoStore) CreateWebhook(ctx context.Context, w *Webhook) error {
+	id, err := s.NextSeq(ctx, seqWebhook)
+	if err != nil {
+		return err
+	}
+	w.ID = id
+	_, err = s.webhooks().InsertOne(ctx, w)
+	return err
+}
+
+func (s *mongoStore) UpdateWebhook(ctx context.Context, id int64, fields map[string]any) (Webhook, error) {
+	if len(fields) > 0 {
+		res, err := s.webhooks().UpdateOne(ctx, bson.M{"id": id}, bson.M{"$set": fields})
+		if err != nil {
+			return Webhook{}, err
+		}
+		if res.MatchedCount == 0 {
+			return Webhook{}, ErrNotFound
+		}
+	}
+	return s.GetWebhook(ctx, id)
+}
+
+func (s *mongoStore) DeleteWebhook(ctx context.Context, id int64) error {
+	res, err := s.webhooks().DeleteOne(ctx, bson.M{"id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	_, err = s.webhookDeliveries().DeleteMany(ctx, bson.M{"webhook_id": id})
+	return err
+}
+
+func (s *mongoStore) EnqueueWebhookDeliveries(ctx context.Context, deliveries ...*WebhookDelivery) error {
+	docs := make([]any, len(deliveries))
+	for i, d := range deliveries {
+		id, err := s.NextSeq(ctx, seqWebhookDelivery)
+		if err != nil {
+			return err
+		}
+		d.ID, d.State = id, DeliveryPending
+		if d.NextAttemptAt == nil {
+			d.NextAttemptAt = &d.CreatedAt
+		}
+		docs[i] = d
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+	_, err := s.webhookDeliveries().InsertMany(ctx, docs)
+	return err
+}
+
+func (s *mongoStore) ClaimWebhookDelivery(ctx context.Context, now time.Time, lease time.Duration) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	err := s.webhookDeliveries().FindOneAndUpdate(ctx,
+		bson.M{"state": DeliveryPending, "next_attempt_at": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"next_attempt_at": now.Add(lease)}, "$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}).SetReturnDocument(options.After),
+	).Decode(&d)
+	return d, notFound(err)
+}
+
+func (s *mongoStore) CompleteWebhookDelivery(ctx context.Context, id int64, at time.Time, status int) error {
+	_, err := s.webhookDeliveries().UpdateOne(ctx, bson.M{"id": id}, bson.M{
+		"$set":   bson.M{"state": DeliveryDelivered, "delivered_at": at, "status_code": status},
+		"$unset": bson.M{"next_attempt_at": "", "last_error": ""},
+	})
+	return err
+}
+
+func (s *mongoStore) RetryWebhookDelivery(ctx context.Context, id int64, next time.Time, status int, reason string) error {
+	_, err := s.webhookDeliveries().UpdateOne(ctx, bson.M{"id": id},
+		bson.M{"$set": bson.M{"next_attempt_at": next, "status_code": status, "last_error": reason}})
+	return err
+}
+
+func (s *mongoStore) FailWebhookDelivery(ctx context.Context, id int64, status int, reason string) error {
+	_, err := s.webhookDeliveries().UpdateOne(ctx, bson.M{"id": id}, bson.M{
+		"$set":   bson.M{"state": DeliveryFailed, "status_code": status, "last_error": reason},
+		"$unset": bson.M{"next_attempt_at": ""},
+	})
+	return err
+}
+
+func (s *mongoStore) GetWebhookDelivery(ctx context.Context, webhookID, id int64) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	err := s.webhookDeliveries().FindOne(ctx, bson.M{"id": id, "webhook_id": webhookID}).Decode(&d)
+	return d, notFound(err)
+}
+
+func (s *mongoStore) ListWebhookDeliveries(ctx context.Context, q WebhookDeliveryQuery) ([]WebhookDelivery, error) {
+	filter := bson.M{}
+	if q.WebhookID != 0 {
+		filter["webhook_id"] = q.WebhookID
+	}
+	if q.State != "" {
+		filter["state"] = q.State
+	}
+	if q.BeforeID != 0 {
+		filter["id"] = bson.M{"$lt": q.BeforeID}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "id", Value: -1}})
+	if q.Limit > 0 {
+		opts.SetLimit(int64(q.Limit))
+	}
+	cur, err := s.webhookDeliveries().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	deliveries := []WebhookDelivery{}
+	if err := cur.All(ctx, &deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (s *mongoStore) PruneWebhookDeliveries(ctx context.Context, cutoff time.Time) (int64, error) {
+	res, err := s.webhookDeliveries().DeleteMany(ctx,
+		bson.M{"state": bson.M{"$ne": DeliveryPending}, "created_at": bson.M{"$lt": cutoff}})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+func (s *mongoStore) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	// When another holder's lease is live the filter misses and the upsert
+	// collides with its _id.
+	filter := bson.M{"_id": name, "$or": bson.A{bson.M{"holder": holder}, bson.M{"expires_at": bson.M{"$lte": now}}}}
+	update := bson.M{"$set": bson.M{"holder": holder, "expires_at": now.Add(ttl)}}
+	_, err := s.leases().UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *mongoStore) ReleaseLease(ctx context.Context, name, holder string) error {
+	_, err := s.leases().DeleteOne(ctx, bson.M{"_id": name, "holder": holder})
+	return err
+}
+
+func (s *mongoStore) NextSeq(ctx context.Context, name string) (int64, error) {
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var out bson.M
+	err := s.counters().FindOneAndUpdate(ctx, bson.M{"_id": name}, bson.M{"$inc": bson.M{"seq": 1}}, opts).Decode(&out)
+	if err != nil {
+		return 0, err
+	}
+	switch v := out["seq"].(type) {
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case float64:
+		return int64(v), nil
+	default:
+		return 0, nil
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+// notifyStore is a TaskStore that tells users about the changes to tasks,
+// subtasks and attachments that concern them: becoming the main or a
+// supporting assignee, being @mentioned, new attachments on their tasks, and
+// their tasks being completed, reopened, archived, deleted or restored.
+// Nobody is told about their own changes.
+type notifyStore struct {
+	TaskStore
+	notify *notifier
+}
+
+func newNotifyStore(store TaskStore, n *notifier) *notifyStore {
+	return &notifyStore{TaskStore: store, notify: n}
+}
+
+// assignee returns the user id of a main_assignee_id, 0 for none.
+func assignee(mainAssigneeID *int) int64 {
+	if mainAssigneeID == nil {
+		return 0
+	}
+	return int64(*mainAssigneeID)
+}
+
+// itemEvents sends the events of one change to a task or subtask. taskTeam
+// is, for subtasks, the main and supporting assignees of the task, who hear
+// about state changes too.
+func (s *notifyStore) itemEvents(ctx context.Context, ev event, label string, before, after notifyItem, taskTeam []int64) {
+	actor, name := actorName(ctx)
+	ev.actor = actor
+	send := func(kind NotificationEvent, text string, users ...int64) {
+		ev.kind, ev.text = kind, text
+		s.notify.notify(ctx, ev, users...)
+	}
+	mainID := assignee(after.assignee)
+	if mainID != 0 && mainID != assignee(before.assignee) {
+		send(EventAssigned, fmt.Sprintf("%s assigned you to %s", name, label), mainID)
+	}
+	var added []int64
+	for _, id := range after.supporting {
+		if id != mainID && !slices.Contains(before.supporting, id) {
+			added = append(added, id)
+		}
+	}
+	if len(added) > 0 {
+		send(EventAssigned, fmt.Sprintf("%s added you as a supporting assignee on %s", name, label), added...)
+	}
+	if ids := s.notify.newMentions(ctx, before.texts, after.texts); len(ids) > 0 {
+		send(EventMentioned, fmt.Sprintf("%s mentioned you in %s", name, label), ids...)
+	}
+
+	team := append(after.team(), taskTeam...)
+	switch {
+	case after.completed && !before.completed:
+		send(EventCompleted, fmt.Sprintf("%s completed %s", name, label), team...)
+	case before.completed && !after.completed && actor != 0:
+		// Resets by the scheduler are routine, not news.
+		send(EventStateChanged, fmt.Sprintf("%s reopened %s", name, label), team...)
+	}
+	switch {
+	case after.archived && !before.archived:
+		send(EventStateChanged, fmt.Sprintf("%s archived %s", name, label), team...)
+	case before.archived && !after.archived:
+		send(EventStateChanged, fmt.Sprintf("%s unarchived %s", name, label), team...)
+	}
+}
+
+// stateEvent tells the team of a task or subtask that it was deleted or
+// restored.
+func (s *notifyStore) stateEvent(ctx context.Context, ev event, verb, label string, team ...int64) {
+	actor, name := actorName(ctx)
+	ev.kind, ev.actor, ev.text = EventStateChanged, actor, fmt.Sprintf("%s %s %s", name, verb, label)
+	s.notify.notify(ctx, ev, team...)
+}
+
+// notifyItem is what itemEvents looks at in a task or subtask.
+type notifyItem struct {
+	assignee   *int
+	supporting []int64
+	texts      []string
+	completed  bool
+	archived   bool
+}
+
+// team lists the main and supporting assignees.
+func (it notifyItem) team() []int64 {
+	return append([]int64{assignee(it.assignee)}, it.supporting...)
+}
+
+func (t Task) notifyItem() notifyItem {
+	texts := []string{t.Title}
+	if t.Description != nil {
+		texts = append(texts, *t.Description)
+	}
+	return notifyItem{assignee: t.MainAssigneeID, supporting: supportingIDs(t.SupportingAssignees), texts: texts,
+		completed: t.Completed, archived: t.Archived}
+}
+
+func (sub Subtask) notifyItem() notifyItem {
+	return notifyItem{assignee: sub.MainAssigneeID, supporting: supportingIDs(sub.SupportingAssignees),
+		texts: []string{sub.Title}, completed: sub.Completed}
+}
+
+// created is the before-image of a new item: nobody was assigned or
+// mentioned, and nobody completed or archived it.
+func (it notifyItem) created() notifyItem {
+	return notifyItem{completed: it.completed, archived: it.archived}
+}
+
+func (s *notifyStore) taskEvents(ctx context.Context, before notifyItem, after Task) {
+	ev := event{entity: EntityTask, id: after.ID, taskID: after.ID}
+	s.itemEvents(ctx, ev, itemLabel(EntityTask, after.Title, ""), before, after.notifyItem(), nil)
+}
+
+func (s *notifyStore) subtaskEvents(ctx context.Context, before notifyItem, after Subtask) {
+	task, err := s.TaskStore.GetTask(ctx, after.TaskID)
+	if err != nil {
+		return
+	}
+	ev := event{entity: EntitySubtask, id: after.ID, taskID: after.TaskID}
+	s.itemEvents(ctx, ev, itemLabel(EntitySubtask, after.Title, task.Title), before, after.notifyItem(), task.notifyItem().team())
+}
+
+func (s *notifyStore) CreateTask(ctx context.Context, task *Task) error {
+	if err := s.TaskStore.CreateTask(ctx, task); err != nil {
+		return err
+	}
+	s.taskEvents(ctx, task.notifyItem().created(), *task)
+	return nil
+}
+
+func (s *notifyStore) UpdateTask(ctx context.Context, id, version int64, fields map[string]any) (Task, error) {
+	before, err := s.TaskStore.GetTask(ctx, id)
+	if err != nil {
+		return Task{}, err
+	}
+	after, err := s.TaskStore.UpdateTask(ctx, id, version, fields)
+	if err != nil {
+		return after, err
+	}
+	s.taskEvents(ctx, before.notifyItem(), after)
+	return after, nil
+}
+
+func (s *notifyStore) TrashTask(ctx context.Context, id, by int64) error {
+	task, err := s.TaskStore.GetTask(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := s.TaskStore.TrashTask(ctx, id, by); err != nil {
+		return err
+	}
+	s.stateEvent(ctx, event{entity: EntityTask, id: id, taskID: id}, "deleted", itemLabel(EntityTask, task.Title, ""), task.notifyItem().team()...)
+	return nil
+}
+
+func (s *notifyStore) ClearTasks(ctx context.Context, by int64) error {
+	archived := false
+	tasks, err := s.TaskStore.ListTasks(ctx, TaskQuery{Archived: &archived})
+	if err != nil {
+		return err
+	}
+	if err := s.TaskStore.ClearTasks(ctx, by); err != nil {
+		return err
+	}
+	for _, t := range tasks {
+		s.stateEvent(ctx, event{entity: EntityTask, id: t.ID, taskID: t.ID}, "deleted", itemLabel(EntityTask, t.Title, ""), t.notifyItem().team()...)
+	}
+	return nil
+}
+
+func (s *notifyStore) CreateSubtask(ctx context.Context, subtask *Subtask) error {
+	if err := s.TaskStore.CreateSubtask(ctx, subtask); err != nil {
+		return err
+	}
+	s.subtaskEvents(ctx, subtask.notifyItem().created(), *subtask)
+	return nil
+}
+
+func (s *notifyStore) UpdateSubtask(ctx context.Context, taskID, id, version int64, fields map[string]any) (Subtask, error) {
+	var before notifyItem
+	if sub := findSubtask(ctx, s.TaskStore, taskID, id); sub != nil {
+		before = sub.notifyItem()
+	}
+	after, err := s.TaskStore.UpdateSubtask(ctx, taskID, id, version, fields)
+	if err != nil {
+		return after, err
+	}
+	s.subtaskEvents(ctx, before, after)
+	return after, nil
+}
+
+func (s *notifyStore) TrashSubtask(ctx context.Context, taskID, id, by int64) error {
+	sub := findSubtask(ctx, s.TaskStore, taskID, id)
+	if err := s.TaskStore.TrashSubtask(ctx, taskID, id, by); err != nil {
+		return err
+	}
+	if task, err := s.TaskStore.GetTask(ctx, taskID); err == nil && sub != nil {
+		team := append(sub.notifyItem().team(), task.notifyItem().team()...)
+		s.stateEvent(ctx, event{entity: EntitySubtask, id: id, taskID: taskID}, "deleted", itemLabel(EntitySubtask, sub.Title, task.Title), team...)
+	}
+	return nil
+}
+
+func (s *notifyStore) RestoreTrashItem(ctx context.Context, kind TrashKind, id int64) error {
+	item, err := s.TaskStore.GetTrashItem(ctx, kind, id)
+	if err != nil {
+		return err
+	}
+	if err := s.TaskStore.RestoreTrashItem(ctx, kind, id); err != nil {
+		return err
+	}
+	task, err := s.TaskStore.GetTask(ctx, item.TaskID)
+	if err != nil {
+		return nil
+	}
+	switch kind {
+	case TrashTasks:
+		s.stateEvent(ctx, event{entity: EntityTask, id: id, taskID: id}, "restored", itemLabel(EntityTask, task.Title, ""), task.notifyItem().team()...)
+	case TrashSubtasks:
+		if sub := findSubtask(ctx, s.TaskStore, task.ID, id); sub != nil {
+			team := append(sub.notifyItem().team(), task.notifyItem().team()...)
+			s.stateEvent(ctx, event{entity: EntitySubtask, id: id, taskID: task.ID}, "restored", itemLabel(EntitySubtask, sub.Title, task.Title), team...)
+		}
+	}
+	return nil
+}
+
+func (s *notifyStore) ReassignOpenWork(ctx context.Context, from, to int64) (int64, int64, error) {
+	tasks, err := s.TaskStore.OpenTasksAssignedTo(ctx, from)
+	if err != nil {
+		return 0, 0, err
+	}
+	subs, err := s.TaskStore.ListSubtasks(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	nTasks, nSubs, err := s.TaskStore.ReassignOpenWork(ctx, from, to)
+	if err != nil {
+		return nTasks, nSubs, err
+	}
+	actor, name := actorName(ctx)
+	titles := map[int64]string{}
+	for _, t := range tasks {
+		titles[t.ID] = t.Title
+		s.notify.notify(ctx, event{kind: EventAssigned, entity: EntityTask, id: t.ID, taskID: t.ID, actor: actor,
+			text: fmt.Sprintf("%s assigned you to %s", name, itemLabel(EntityTask, t.Title, ""))}, to)
+	}
+	for _, sub := range subs {
+		if sub.Completed || !assignedTo(sub.MainAssigneeID, from) {
+			continue
+		}
+		taskTitle, ok := titles[sub.TaskID]
+		if !ok {
+			if task, err := s.TaskStore.GetTask(ctx, sub.TaskID); err == nil {
+				taskTitle = task.Title
+			}
+		}
+		s.notify.notify(ctx, event{kind: EventAssigned, entity: EntitySubtask, id: sub.ID, taskID: sub.TaskID, actor: actor,
+			text: fmt.Sprintf("%s assigned you to %s", name, itemLabel(EntitySubtask, sub.Title, taskTitle))}, to)
+	}
+	return nTasks, nSubs, nil
+}
+
+func (s *notifyStore) CreateAttachment(ctx context.Context, attachment *Attachment) error {
+	if err := s.TaskStore.CreateAttachment(ctx, attachment); err != nil {
+		return err
+	}
+	task, err := s.TaskStore.GetTask(ctx, attachment.TaskID)
+	if err != nil {
+		return nil
+	}
+	actor, name := actorName(ctx)
+	s.notify.notify(ctx, event{kind: EventAttachmentAdded, entity: EntityAttachment, id: attachment.ID, taskID: task.ID, actor: actor,
+		text: fmt.Sprintf("%s attached %q to %s", name, attachment.Name, itemLabel(EntityTask, task.Title, ""))},
+		task.notifyItem().team()...)
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+// searchStore is a TaskStore that keeps a searchIndex in step with the
+// writes going through it. Index failures are logged, not returned: the
+// write itself succeeded and the next rebuild repairs the index.
+type searchStore struct {
+	TaskStore
+	index *searchIndex
+}
+
+func newSearchStore(store TaskStore, index *searchIndex) *searchStore {
+	return &searchStore{TaskStore: store, index: index}
+}
+
+func (s *searchStore) refresh(ctx context.Context, taskID int64) {
+	if err := s.index.refreshTask(ctx, s.TaskStore, taskID); err != nil {
+		log.Printf("search index: refreshing task %d: %v", taskID, err)
+	}
+}
+
+func (s *searchStore) rebuild(ctx context.Context) {
+	if err := s.index.rebuild(ctx, s.TaskStore); err != nil {
+		log.Println("search index rebuild error:", err)
+	}
+}
+
+func (s *searchStore) CreateTask(ctx context.Context, task *Task) error {
+	if err := s.TaskStore.CreateTask(ctx, task); err != nil {
+		return err
+	}
+	s.refresh(ctx, task.ID)
+	return nil
+}
+
+func (s *searchStore) UpdateTask(ctx context.Context, id, version int64, fields map[string]any) (Task, error) {
+	task, err := s.TaskStore.UpdateTask(ctx, id, version, fields)
+	if err == nil {
+		s.refresh(ctx, id)
+	}
+	return task, err
+}
+
+func (s *searchStore) TrashTask(ctx context.Context, id, by int64) error {
+	if err := s.TaskStore.TrashTask(ctx, id, by); err != nil {
+		return err
+	}
+	s.refresh(ctx, id)
+	return nil
+}
+
+func (s *searchStore) ClearTasks(ctx context.Context, by int64) error {
+	if err := s.TaskStore.ClearTasks(ctx, by); err != nil {
+		return err
+	}
+	s.rebuild(ctx)
+	return nil
+}
+
+func (s *searchStore) CreateSubtask(ctx context.Context, subtask *Subtask) error {
+	if err := s.TaskStore.CreateSubtask(ctx, subtask); err != nil {
+		return err
+	}
+	s.refresh(ctx, subtask.TaskID)
+	return nil
+}
+
+func (s *searchStore) UpdateSubtask(ctx context.Context, taskID, id, version int64, fields map[string]any) (Subtask, error) {
+	sub, err := s.TaskStore.UpdateSubtask(ctx, taskID, id, version, fields)
+	if err == nil {
+		s.refresh(ctx, taskID)
+	}
+	return sub, err
+}
+
+func (s *searchStore) TrashSubtask(ctx context.Context, taskID, id, by int64) error {
+	if err := s.TaskStore.TrashSubtask(ctx, taskID, id, by); err != nil {
+		return err
+	}
+	s.refresh(ctx, taskID)
+	return nil
+}
+
+func (s *searchStore) CreateAttachment(ctx context.Context, attachment *Attachment) error {
+	if err := s.TaskStore.CreateAttachment(ctx, attachment); err != nil {
+		return err
+	}
+	s.refresh(ctx, attachment.TaskID)
+	return nil
+}
+
+func (s *searchStore) TrashAttachment(ctx context.Context, taskID, id, by int64) error {
+	if err := s.TaskStore.TrashAttachment(ctx, taskID, id, by); err != nil {
+		return err
+	}
+	s.refresh(ctx, taskID)
+	return nil
+}
+
+// Purging only touches trashed items, which are not indexed, so only
+// restoring needs handling among the trash operations.
+func (s *searchStore) RestoreTrashItem(ctx context.Context, kind TrashKind, id int64) error {
+	item, err := s.TaskStore.GetTrashItem(ctx, kind, id)
+	if err != nil {
+		return err
+	}
+	if err := s.TaskStore.RestoreTrashItem(ctx, kind, id); err != nil {
+		return err
+	}
+	s.refresh(ctx, item.TaskID)
+	return nil
+}
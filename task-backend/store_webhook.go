@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// webhookStore is a TaskStore that publishes changes to tasks, subtasks and
+// attachments to the webhook subscriptions. Purges are not published; the
+// item was already reported deleted when it went to the trash.
+type webhookStore struct {
+	TaskStore
+	hooks *webhooks
+}
+
+func newWebhookStore(store TaskStore, hooks *webhooks) *webhookStore {
+	return &webhookStore{TaskStore: store, hooks: hooks}
+}
+
+func (s *webhookStore) publish(ctx context.Context, entity EntityKind, verb string, id, taskID int64, data any, changes []FieldChange) {
+	s.hooks.publish(ctx, webhookEvent{Event: fmt.Sprintf("%s.%s", entity, verb), Entity: entity, EntityID: id,
+		TaskID: taskID, Data: data, Changes: changes})
+}
+
+// updateVerb names the event of an update: completing or reopening wins
+// over archiving or unarchiving, which wins over any other change.
+func updateVerb(changes []FieldChange) string {
+	verb := "updated"
+	for _, ch := range changes {
+		switch {
+		case ch.Field == "completed" && ch.After == true:
+			return "completed"
+		case ch.Field == "completed":
+			return "reopened"
+		case ch.Field == "archived" && ch.After == true:
+			verb = "archived"
+		case ch.Field == "archived":
+			verb = "unarchived"
+		}
+	}
+	return verb
+}
+
+// hookAttachment leaves inline (base64) URLs out of payloads, as
+// lightweight task lists do.
+func hookAttachment(att Attachment) Attachment {
+	if len(att.URL) > 1000 {
+		att.URL = ""
+	}
+	return att
+}
+
+func (s *webhookStore) CreateTask(ctx context.Context, task *Task) error {
+	if err := s.TaskStore.CreateTask(ctx, task); err != nil {
+		return err
+	}
+	s.publish(ctx, EntityTask, "created", task.ID, task.ID, task, nil)
+	return nil
+}
+
+func (s *webhookStore) UpdateTask(ctx context.Context, id, version int64, fields map[string]any) (Task, error) {
+	before, err := s.TaskStore.GetTask(ctx, id)
+	if err != nil {
+		return Task{}, err
+	}
+	after, err := s.TaskStore.UpdateTask(ctx, id, version, fields)
+	if err != nil {
+		return after, err
+	}
+	if changes := diffFields(&before, &after); len(changes) > 0 {
+		s.publish(ctx, EntityTask, updateVerb(changes), id, id, after, changes)
+	}
+	return after, nil
+}
+
+func (s *webhookStore) TrashTask(ctx context.Context, id, by int64) error {
+	task, err := s.TaskStore.GetTask(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := s.TaskStore.TrashTask(ctx, id, by); err != nil {
+		return err
+	}
+	s.publish(ctx, EntityTask, "deleted", id, id, task, nil)
+	return nil
+}
+
+func (s *webhookStore) ClearTasks(ctx context.Context, by int64) error {
+	archived := false
+	tasks, err := s.TaskStore.ListTasks(ctx, TaskQuery{Archived: &archived})
+	if err != nil {
+		return err
+	}
+	if err := s.TaskStore.ClearTasks(ctx, by); err != nil {
+		return err
+	}
+	for _, t := range tasks {
+		s.publish(ctx, EntityTask, "deleted", t.ID, t.ID, t, nil)
+	}
+	return nil
+}
+
+func (s *webhookStore) ReassignOpenWork(ctx context.Context, from, to int64) (int64, int64, error) {
+	tasks, err := s.TaskStore.OpenTasksAssignedTo(ctx, from)
+	if err != nil {
+		return 0, 0, err
+	}
+	subs, err := s.TaskStore.ListSubtasks(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	nTasks, nSubs, err := s.TaskStore.ReassignOpenWork(ctx, from, to)
+	if err != nil {
+		return nTasks, nSubs, err
+	}
+	change := []FieldChange{{Field: "main_assignee_id", Before: from, After: to}}
+	assignee := int(to)
+	for _, t := range tasks {
+		t.MainAssigneeID = &assignee
+		t.Version++
+		s.publish(ctx, EntityTask, "updated", t.ID, t.ID, t, change)
+	}
+	for _, sub := range subs {
+		if !sub.Completed && assignedTo(sub.MainAssigneeID, from) {
+			sub.MainAssigneeID = &assignee
+			sub.Version++
+			s.publish(ctx, EntitySubtask, "updated", sub.ID, sub.TaskID, sub, change)
+		}
+	}
+	return nTasks, nSubs, nil
+}
+
+func (s *webhookStore) CreateSubtask(ctx context.Context, subtask *Subtask) error {
+	if err := s.TaskStore.CreateSubtask(ctx, subtask); err != nil {
+		return err
+	}
+	s.publish(ctx, EntitySubtask, "created", subtask.ID, subtask.TaskID, subtask, nil)
+	return nil
+}
+
+func (s *webhookStore) UpdateSubtask(ctx context.Context, taskID, id, version int64, fields map[string]any) (Subtask, error) {
+	before := findSubtask(ctx, s.TaskStore, taskID, id)
+	after, err := s.TaskStore.UpdateSubtask(ctx, taskID, id, version, fields)
+	if err != nil {
+		return after, err
+	}
+	if changes := diffFields(before, &after); len(changes) > 0 {
+		s.publish(ctx, EntitySubtask, updateVerb(changes), id, taskID, after, changes)
+	}
+	return after, nil
+}
+
+func (s *webhookStore) TrashSubtask(ctx context.Context, taskID, id, by int64) error {
+	sub := findSubtask(ctx, s.TaskStore, taskID, id)
+	if err := s.TaskStore.TrashSubtask(ctx, taskID, id, by); err != nil {
+		return err
+	}
+	if sub != nil {
+		s.publish(ctx, EntitySubtask, "deleted", id, taskID, sub, nil)
+	}
+	return nil
+}
+
+func (s *webhookStore) CreateAttachment(ctx context.Context, attachment *Attachment) error {
+	if err := s.TaskStore.CreateAttachment(ctx, attachment); err != nil {
+		return err
+	}
+	s.publish(ctx, EntityAttachment, "created", attachment.ID, attachment.TaskID, hookAttachment(*attachment), nil)
+	return nil
+}
+
+func (s *webhookStore) TrashAttachment(ctx context.Context, taskID, id, by int64) error {
+	att, err := s.TaskStore.GetAttachment(ctx, taskID, id)
+	if err != nil {
+		return err
+	}
+	if err := s.TaskStore.TrashAttachment(ctx, taskID, id, by); err != nil {
+		return err
+	}
+	s.publish(ctx, EntityAttachment, "deleted", id, taskID, hookAttachment(att), nil)
+	return nil
+}
+
+func (s *webhookStore) RestoreTrashItem(ctx context.Context, kind TrashKind, id int64) error {
+	item, err := s.TaskStore.GetTrashItem(ctx, kind, id)
+	if err != nil {
+		return err
+	}
+	if err := s.TaskStore.RestoreTrashItem(ctx, kind, id); err != nil {
+		return err
+	}
+	var data any
+	switch kind {
+	case TrashTasks:
+		if task, err := s.TaskStore.GetTask(ctx, id); err == nil {
+			data = task
+		}
+	case TrashSubtasks:
+		if sub := findSubtask(ctx, s.TaskStore, item.TaskID, id); sub != nil {
+			data = sub
+		}
+	default:
+		if att, err := s.TaskStore.GetAttachment(ctx, item.TaskID, id); err == nil {
+			data = hookAttachment(att)
+		}
+	}
+	if data != nil {
+		s.publish(ctx, kind.entity(), "restored", id, item.TaskID, data, nil)
+	}
+	return nil
+}
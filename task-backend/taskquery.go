@@ -0,0 +1,352 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxTaskPageSize = 500
+
+// TaskQuery selects, orders and pages the tasks returned by ListTasks. The
+// zero value lists every task in the board's default order.
+type TaskQuery struct {
+	Types      []string
+	Priorities []string
+	Completed  *bool
+	Archived   *bool
+	Pinned     *bool
+	// Assignee matches tasks the user is assigned to, as main assignee,
+	// supporting assignee or either, depending on AssigneeRole.
+	Assignee     *int64
+	AssigneeRole AssigneeRole
+	// CreatedFrom is inclusive and CreatedTo exclusive; zero means unbounded.
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	Sort        TaskSort
+	// Limit caps the number of tasks returned; zero means no limit.
+	Limit int
+	// After continues a listing after the task a cursor was made from.
+	After *taskKey
+}
+
+type AssigneeRole string
+
+const (
+	AssigneeAny        AssigneeRole = ""
+	AssigneeMain       AssigneeRole = "main"
+	AssigneeSupporting AssigneeRole = "supporting"
+)
+
+// TaskSort is the value of the ?sort= parameter. A leading "-" sorts
+// descending. The default puts pinned tasks first, newest first.
+type TaskSort string
+
+const (
+	SortDefault TaskSort = ""
+	SortCreated TaskSort = "created_at"
+	SortTitle   TaskSort = "title"
+	// SortPriority orders Low < Medium < High, with unset priorities lowest.
+	SortPriority TaskSort = "priority"
+)
+
+// sortKey is one field of a sort order, using the field names of the Mongo
+// documents. priority_rank is derived from priority, see priorityRank.
+type sortKey struct {
+	field string
+	desc  bool
+}
+
+// keys returns the sort order, always ending in id so that every task has a
+// unique position for cursors.
+func (s TaskSort) keys() ([]sortKey, error) {
+	field, desc := strings.CutPrefix(string(s), "-")
+	switch TaskSort(field) {
+	case SortDefault:
+		if desc {
+			break
+		}
+		return []sortKey{{"pinned", true}, {"created_at", true}, {"id", true}}, nil
+	case SortCreated:
+		return []sortKey{{"created_at", desc}, {"id", desc}}, nil
+	case SortTitle:
+		return []sortKey{{"title", desc}, {"id", desc}}, nil
+	case SortPriority:
+		return []sortKey{{"priority_rank", desc}, {"created_at", true}, {"id", true}}, nil
+	}
+	return nil, fmt.Errorf("sort: unknown order %q (want created_at, title or priority, optionally prefixed with -)", s)
+}
+
+var priorityRanks = map[string]int{"Low": 1, "Medium": 2, "High": 3}
+
+func priorityRank(p *string) int {
+	if p == nil {
+		return 0
+	}
+	return priorityRanks[*p]
+}
+
+// taskKey holds the values a task is sorted by. A page cursor is the key of
+// the last task on the page.
+type taskKey struct {
+	Pinned    bool      `json:"p,omitempty"`
+	CreatedAt time.Time `json:"c"`
+	Title     string    `json:"t,omitempty"`
+	Priority  int       `json:"r,omitempty"`
+	ID        int64     `json:"i"`
+}
+
+func keyOf(t Task) taskKey {
+	return taskKey{Pinned: t.Pinned, CreatedAt: t.CreatedAt, Title: t.Title, Priority: priorityRank(t.Priority), ID: t.ID}
+}
+
+func (k taskKey) value(field string) any {
+	switch field {
+	case "pinned":
+		return k.Pinned
+	case "created_at":
+		return k.CreatedAt
+	case "title":
+		return k.Title
+	case "priority_rank":
+		return k.Priority
+	default:
+		return k.ID
+	}
+}
+
+// compareKeys orders a before b (negative), after b (positive) or at the
+// same position (zero) under keys.
+func compareKeys(a, b taskKey, keys []sortKey) int {
+	for _, k := range keys {
+		var c int
+		switch k.field {
+		case "pinned":
+			c = compareBool(a.Pinned, b.Pinned)
+		case "created_at":
+			c = a.CreatedAt.Compare(b.CreatedAt)
+		case "title":
+			c = strings.Compare(a.Title, b.Title)
+		case "priority_rank":
+			c = cmp.Compare(a.Priority, b.Priority)
+		default:
+			c = cmp.Compare(a.ID, b.ID)
+		}
+		if k.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	default:
+		return -1
+	}
+}
+
+// cursor is the opaque ?cursor= token. It records the sort it was made for
+// so that it cannot be replayed against a different order.
+type cursor struct {
+	Sort TaskSort `json:"s,omitempty"`
+	taskKey
+}
+
+func encodeCursor(sort TaskSort, last Task) string {
+	raw, _ := json.Marshal(cursor{Sort: sort, taskKey: keyOf(last)})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(token string, sort TaskSort) (*taskKey, error) {
+	errBad := errors.New("cursor: invalid or from a different sort order")
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errBad
+	}
+	var c cursor
+	if err := json.Unmarshal(raw, &c); err != nil || c.Sort != sort {
+		return nil, errBad
+	}
+	return &c.taskKey, nil
+}
+
+// supportingPattern matches a supporting_assignees JSON string such as
+// "[1,2]" that contains userID as a whole number. listsUser is the same
+// test in Go.
+func supportingPattern(userID int64) string {
+	return `(^|[^0-9])` + strconv.FormatInt(userID, 10) + `([^0-9]|$)`
+}
+
+func listsUser(supporting *string, userID int64) bool {
+	return slices.Contains(supportingIDs(supporting), userID)
+}
+
+// supportingIDs returns the user ids in a supporting_assignees JSON string.
+func supportingIDs(supporting *string) []int64 {
+	if supporting == nil {
+		return nil
+	}
+	notDigit := func(r rune) bool { return r < '0' || r > '9' }
+	var ids []int64
+	for _, f := range strings.FieldsFunc(*supporting, notDigit) {
+		if id, err := strconv.ParseInt(f, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// matches reports whether t passes the filters of q (not the cursor).
+func (q TaskQuery) matches(t Task) bool {
+	if t.trashed() {
+		return false
+	}
+	if len(q.Types) > 0 && (t.Type == nil || !slices.Contains(q.Types, *t.Type)) {
+		return false
+	}
+	if len(q.Priorities) > 0 && (t.Priority == nil || !slices.Contains(q.Priorities, *t.Priority)) {
+		return false
+	}
+	if (q.Completed != nil && t.Completed != *q.Completed) ||
+		(q.Archived != nil && t.Archived != *q.Archived) ||
+		(q.Pinned != nil && t.Pinned != *q.Pinned) {
+		return false
+	}
+	if !q.CreatedFrom.IsZero() && t.CreatedAt.Before(q.CreatedFrom) {
+		return false
+	}
+	if !q.CreatedTo.IsZero() && !t.CreatedAt.Before(q.CreatedTo) {
+		return false
+	}
+	if q.Assignee != nil {
+		main := assignedTo(t.MainAssigneeID, *q.Assignee)
+		supporting := listsUser(t.SupportingAssignees, *q.Assignee)
+		switch q.AssigneeRole {
+		case AssigneeMain:
+			return main
+		case AssigneeSupporting:
+			return supporting
+		default:
+			return main || supporting
+		}
+	}
+	return true
+}
+
+// timeParam reads an optional query parameter given as an RFC 3339
+// timestamp or a YYYY-MM-DD date (midnight UTC).
+func timeParam(c *gin.Context, name string) (time.Time, error) {
+	v := c.Query(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%s: must be an RFC 3339 timestamp or YYYY-MM-DD", name)
+}
+
+// parseTaskQuery reads the GET /tasks query parameters:
+//
+//	type, priority         comma-separated values to match
+//	completed, archived,
+//	pinned                 true or false
+//	assignee               user id; assignee_role=main|supporting narrows it
+//	created_after          inclusive, RFC 3339 or YYYY-MM-DD
+//	created_before         exclusive, RFC 3339 or YYYY-MM-DD
+//	sort                   created_at, title or priority, "-" for descending
+//	limit, cursor          page size and the X-Next-Cursor of the last page
+func parseTaskQuery(c *gin.Context) (TaskQuery, error) {
+	var q TaskQuery
+	var errs []error
+	list := func(name string) []string {
+		var out []string
+		for _, v := range strings.Split(c.Query(name), ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				out = append(out, v)
+			}
+		}
+		return out
+	}
+	boolean := func(name string) *bool {
+		v, ok := c.GetQuery(name)
+		if !ok || v == "" {
+			return nil
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: must be true or false", name))
+			return nil
+		}
+		return &b
+	}
+	date := func(name string) time.Time {
+		t, err := timeParam(c, name)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return t
+	}
+
+	q.Types = list("type")
+	q.Priorities = list("priority")
+	q.Completed = boolean("completed")
+	q.Archived = boolean("archived")
+	q.Pinned = boolean("pinned")
+	q.CreatedFrom = date("created_after")
+	q.CreatedTo = date("created_before")
+
+	if v := c.Query("assignee"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			errs = append(errs, errors.New("assignee: must be a user id"))
+		}
+		q.Assignee = &id
+	}
+	switch role := AssigneeRole(c.Query("assignee_role")); role {
+	case AssigneeAny, AssigneeMain, AssigneeSupporting, "any":
+		if role != "any" {
+			q.AssigneeRole = role
+		}
+	default:
+		errs = append(errs, errors.New("assignee_role: must be main, supporting or any"))
+	}
+
+	q.Sort = TaskSort(c.Query("sort"))
+	if _, err := q.Sort.keys(); err != nil {
+		errs = append(errs, err)
+	}
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			errs = append(errs, errors.New("limit: must be a positive number"))
+		}
+		q.Limit = min(n, maxTaskPageSize)
+	}
+	if v := c.Query("cursor"); v != "" {
+		after, err := decodeCursor(v, q.Sort)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		q.After = after
+	}
+	return q, errors.Join(errs...)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTaskPages(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.addUser("ada", RoleMember)
+	base := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	// Two pairs share a creation time, so the pages meet inside a tie.
+	for i, f := range []map[string]any{
+		{"title": "b", "priority": "High", "created_at": base},
+		{"title": "a", "priority": "Low", "created_at": base},
+		{"title": "d", "created_at": base.Add(time.Hour), "pinned": true},
+		{"title": "c", "priority": "High", "created_at": base.Add(2 * time.Hour)},
+		{"title": "e", "priority": "Medium", "created_at": base.Add(2 * time.Hour)},
+	} {
+		if task := ts.createTask(token, f); task.ID != int64(i+1) {
+			t.Fatalf("task %q got id %d", f["title"], task.ID)
+		}
+	}
+
+	tests := []struct {
+		sort string
+		want []int64
+	}{
+		{"", []int64{3, 5, 4, 2, 1}},
+		{"created_at", []int64{1, 2, 3, 4, 5}},
+		{"-created_at", []int64{5, 4, 3, 2, 1}},
+		{"title", []int64{2, 1, 4, 3, 5}},
+		{"-title", []int64{5, 3, 4, 1, 2}},
+		// Ties in priority go newest first.
+		{"priority", []int64{3, 2, 5, 4, 1}},
+		{"-priority", []int64{4, 1, 5, 2, 3}},
+	}
+	for _, tt := range tests {
+		var got []int64
+		cursor := ""
+		for page := 0; page < 5; page++ {
+			path := "/tasks?limit=2&sort=" + tt.sort
+			if cursor != "" {
+				path += "&cursor=" + cursor
+			}
+			w := ts.do("GET", path, token, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET %s: %d %s", path, w.Code, w.Body)
+			}
+			var tasks []Task
+			decode(t, w, &tasks)
+			for _, task := range tasks {
+				got = append(got, task.ID)
+			}
+			if cursor = w.Header().Get("X-Next-Cursor"); cursor == "" {
+				break
+			}
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("sort %q: pages give %v, want %v", tt.sort, got, tt.want)
+		}
+	}
+}
+
+func TestTaskQueryParams(t *testing.T) {
+	ts := newTestServer(t)
+	ada, token := ts.addUser("ada", RoleMember)
+	other := strconv.FormatInt(ada.ID+1, 10)
+	mine := int(ada.ID)
+	base := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	ts.createTask(token, map[string]any{"title": "Mine", "type": "daily", "main_assignee_id": mine, "created_at": base})
+	ts.createTask(token, map[string]any{"title": "Helping", "type": "weekly", "completed": true,
+		"supporting_assignees": "[" + other + "," + strconv.Itoa(mine) + "]", "created_at": base.AddDate(0, 0, 1)})
+	ts.createTask(token, map[string]any{"title": "Someone's", "type": "daily", "supporting_assignees": "[1" + other + "]",
+		"archived": true, "created_at": base.AddDate(0, 0, 2)})
+
+	titles := func(query string) []string {
+		t.Helper()
+		w := ts.do("GET", "/tasks?sort=created_at&"+query, token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /tasks?%s: %d %s", query, w.Code, w.Body)
+		}
+		var tasks []Task
+		decode(t, w, &tasks)
+		var out []string
+		for _, task := range tasks {
+			out = append(out, task.Title)
+		}
+		return out
+	}
+	id := strconv.FormatInt(ada.ID, 10)
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"type=daily", []string{"Mine", "Someone's"}},
+		{"type=daily,weekly&completed=false", []string{"Mine", "Someone's"}},
+		{"archived=true", []string{"Someone's"}},
+		{"assignee=" + id, []string{"Mine", "Helping"}},
+		{"assignee=" + id + "&assignee_role=main", []string{"Mine"}},
+		{"assignee=" + id + "&assignee_role=supporting", []string{"Helping"}},
+		{"created_after=2026-03-03", []string{"Helping", "Someone's"}},
+		{"created_after=2026-03-03&created_before=2026-03-04", []string{"Helping"}},
+	}
+	for _, tt := range tests {
+		if got := titles(tt.query); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.query, got, tt.want)
+		}
+	}
+
+	// A cursor only fits the sort it was made for.
+	w := ts.do("GET", "/tasks?sort=title&limit=1", token, nil)
+	cursor := w.Header().Get("X-Next-Cursor")
+	for _, query := range []string{
+		"sort=colour", "limit=0", "limit=x", "completed=maybe", "assignee=ada",
+		"assignee_role=lead", "created_after=yesterday", "cursor=" + cursor, "cursor=not-a-cursor",
+	} {
+		if w := ts.do("GET", "/tasks?"+query, token, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("GET /tasks?%s = %d, want 400", query, w.Code)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// restoreActions is what a user needs on the owning task to restore an item
+// of each kind: whatever let them delete it in the first place.
+var restoreActions = map[TrashKind]Action{
+	TrashTasks:       ActionTaskDelete,
+	TrashSubtasks:    ActionSubtaskWrite,
+	TrashAttachments: ActionAttachmentDelete,
+}
+
+func sortTrash(items []TrashItem) {
+	sort.Slice(items, func(i, j int) bool { return items[i].DeletedAt.After(items[j].DeletedAt) })
+}
+
+// trashParams parses the :kind and :itemId route parameters, writing a 400
+// and returning ok=false when they are invalid.
+func trashParams(c *gin.Context) (kind TrashKind, id int64, ok bool) {
+	kind = TrashKind(c.Param("kind"))
+	if !kind.valid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "kind must be tasks, subtasks or attachments"})
+		return "", 0, false
+	}
+	id, err := strconv.ParseInt(c.Param("itemId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return "", 0, false
+	}
+	return kind, id, true
+}
+
+// registerTrashRoutes wires the trash bin. Deleting a task, subtask or
+// attachment only moves it here; it is purged for good by an admin or by
+// the retention job.
+func (s *server) registerTrashRoutes(r gin.IRouter) {
+	store := s.store
+
+	// GET /trash
+	r.GET("/trash", s.allow(ActionRead), func(c *gin.Context) {
+		items, err := store.ListTrash(c.Request.Context())
+		if err != nil {
+			log.Println("/trash error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, items)
+	})
+
+	// POST /trash/:kind/:itemId/restore
+	r.POST("/trash/:kind/:itemId/restore", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		kind, id, ok := trashParams(c)
+		if !ok {
+			return
+		}
+		item, err := store.GetTrashItem(ctx, kind, id)
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Item not found in trash"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		var owner *Task
+		if task, err := store.GetTask(ctx, item.TaskID); err == nil {
+			owner = &task
+		}
+		if err := authorize(currentUser(c), restoreActions[kind], owner); err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		err = store.RestoreTrashItem(ctx, kind, id)
+		if errors.Is(err, ErrParentTrashed) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error() + "; restore the task first", "task_id": item.TaskID})
+			return
+		}
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Item not found in trash"})
+			return
+		}
+		if err != nil {
+			log.Println("RestoreTrashItem error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "restored", "kind": kind, "id": id})
+	})
+
+	// DELETE /trash/:kind/:itemId
+	r.DELETE("/trash/:kind/:itemId", s.allow(ActionTrashPurge), func(c *gin.Context) {
+		kind, id, ok := trashParams(c)
+		if !ok {
+			return
+		}
+		err := store.PurgeTrashItem(c.Request.Context(), kind, id)
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Item not found in trash"})
+			return
+		}
+		if err != nil {
+			log.Println("PurgeTrashItem error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "purged"})
+	})
+
+	// DELETE /trash
+	// Empties the whole trash bin.
+	r.DELETE("/trash", s.allow(ActionTrashPurge), func(c *gin.Context) {
+		n, err := store.PurgeTrash(c.Request.Context(), time.Now().UTC())
+		if err != nil {
+			log.Println("PurgeTrash error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "purged", "purged": n})
+	})
+}
+
+// runTrashPurger purges items that have been in the trash for longer than
+// retention, checking every interval until ctx is cancelled. Purging is
+// idempotent, so every instance can run one.
+func runTrashPurger(ctx context.Context, store TaskStore, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := store.PurgeTrash(ctx, time.Now().UTC().Add(-retention))
+		if err != nil {
+			log.Println("trash purge error:", err)
+		} else if n > 0 {
+			log.Printf("trash purge: purged %d items older than %s", n, retention)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
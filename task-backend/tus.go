@@ -0,0 +1,609 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Resumable uploads follow the tus protocol (https://tus.io), version 1.0.0
+// with the creation, creation-with-upload, termination and expiration
+// extensions, so stock clients such as tus-js-client and Uppy work.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,creation-with-upload,termination,expiration"
+	tusChunkType  = "application/offset+octet-stream"
+)
+
+var validTusID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// tusUpload is what is kept about a resumable upload next to its data. How
+// much has been received is the size of the data file, so an upload picks
+// up where it was after a restart.
+type tusUpload struct {
+	ID     string `json:"id"`
+	TaskID int64  `json:"task_id"`
+	UserID int64  `json:"user_id"`
+	Length int64  `json:"length"`
+	// Metadata is the Upload-Metadata header as the client sent it.
+	Metadata  string    `json:"metadata,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// AttachmentID is set once the upload is complete; the data file is
+	// gone by then.
+	AttachmentID int64 `json:"attachment_id,omitempty"`
+
+	offset  int64
+	expires time.Time
+}
+
+// resumableUploads keeps unfinished uploads in a directory: <id>.bin has
+// the bytes received so far and <id>.json the tusUpload. An upload expires
+// once neither has changed for ttl; completed ones are kept as long, so a
+// client that missed the last response can still learn the attachment.
+//
+// Instances may share the directory: a request to an upload holds a lock
+// on <id>.lock. Where the system has no file locks (Windows), the locks
+// only keep out requests to the same instance.
+type resumableUploads struct {
+	dir string
+	ttl time.Duration
+
+	mu   sync.Mutex
+	busy map[string]*os.File // locks of uploads with a request in progress
+}
+
+// errLocked is returned for an upload another request is working on.
+var errLocked = errors.New("another request is writing to this upload")
+
+func newResumableUploads(cfg UploadConfig) (*resumableUploads, error) {
+	if err := os.MkdirAll(cfg.ResumableDir, 0o750); err != nil {
+		return nil, err
+	}
+	return &resumableUploads{dir: cfg.ResumableDir, ttl: time.Duration(cfg.ResumableTTL), busy: map[string]*os.File{}}, nil
+}
+
+func (t *resumableUploads) dataPath(id string) string { return filepath.Join(t.dir, id+".bin") }
+func (t *resumableUploads) infoPath(id string) string { return filepath.Join(t.dir, id+".json") }
+func (t *resumableUploads) lockPath(id string) string { return filepath.Join(t.dir, id+".lock") }
+
+// create starts an empty upload.
+func (t *resumableUploads) create(u *tusUpload) error {
+	var b [16]byte
+	rand.Read(b[:])
+	u.ID = hex.EncodeToString(b[:])
+	f, err := os.OpenFile(t.dataPath(u.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if err := t.save(u); err != nil {
+		os.Remove(t.dataPath(u.ID))
+		return err
+	}
+	u.expires = time.Now().Add(t.ttl)
+	return nil
+}
+
+// save writes the info file through a rename, so it is never seen
+// half-written.
+func (t *resumableUploads) save(u *tusUpload) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(t.dir, ".info-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), t.infoPath(u.ID))
+	}
+	return err
+}
+
+// load reads an upload and how far it has got; ErrNotFound if there is no
+// such upload or it has expired.
+func (t *resumableUploads) load(id string) (*tusUpload, error) {
+	if !validTusID.MatchString(id) {
+		return nil, ErrNotFound
+	}
+	b, err := os.ReadFile(t.infoPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var u tusUpload
+	if err := json.Unmarshal(b, &u); err != nil {
+		return nil, fmt.Errorf("resumable upload %s: %w", id, err)
+	}
+	info, err := os.Stat(t.infoPath(id))
+	if err != nil {
+		return nil, err
+	}
+	modified := info.ModTime()
+	if u.AttachmentID != 0 {
+		u.offset = u.Length
+	} else {
+		data, err := os.Stat(t.dataPath(id))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		u.offset = data.Size()
+		if data.ModTime().After(modified) {
+			modified = data.ModTime()
+		}
+	}
+	u.expires = modified.Add(t.ttl)
+	if time.Now().After(u.expires) {
+		return nil, ErrNotFound
+	}
+	return &u, nil
+}
+
+// remove deletes an upload's files. The caller holds its lock.
+func (t *resumableUploads) remove(id string) error {
+	for _, path := range []string{t.dataPath(id), t.infoPath(id), t.lockPath(id)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// lock marks an upload as having a request in progress; errLocked if one
+// already has, on this instance or another.
+func (t *resumableUploads) lock(id string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.busy[id] != nil {
+		return errLocked
+	}
+	f, err := lockFile(t.lockPath(id))
+	if err != nil {
+		return err
+	}
+	t.busy[id] = f
+	return nil
+}
+
+func (t *resumableUploads) unlock(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if f := t.busy[id]; f != nil {
+		f.Close()
+	}
+	delete(t.busy, id)
+}
+
+// sweep removes the files of expired uploads, and anything else left in
+// the directory for longer than the TTL.
+func (t *resumableUploads) sweep() (int, error) {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return 0, err
+	}
+	latest := map[string]time.Time{}
+	files := map[string][]string{}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		key := e.Name()
+		for _, ext := range []string{".bin", ".json", ".lock"} {
+			key = strings.TrimSuffix(key, ext)
+		}
+		if info.ModTime().After(latest[key]) {
+			latest[key] = info.ModTime()
+		}
+		files[key] = append(files[key], e.Name())
+	}
+	removed := 0
+	for key, modified := range latest {
+		if time.Since(modified) <= t.ttl || t.lock(key) != nil {
+			continue
+		}
+		for _, name := range append(files[key], key+".lock") {
+			if err := os.Remove(filepath.Join(t.dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				log.Println("resumable upload sweep error:", err)
+			}
+		}
+		t.unlock(key)
+		removed++
+	}
+	return removed, nil
+}
+
+// runResumableSweeper removes expired resumable uploads every interval
+// until ctx is done.
+func runResumableSweeper(ctx context.Context, t *resumableUploads, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := t.sweep()
+		if err != nil {
+			log.Println("resumable upload sweep error:", err)
+		} else if n > 0 {
+			log.Printf("resumable upload sweep: removed %d expired uploads", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// parseTusMetadata parses an Upload-Metadata header: comma-separated keys,
+// each followed by a space and its base64 value unless it has none.
+func parseTusMetadata(h string) (map[string]string, error) {
+	meta := map[string]string{}
+	if strings.TrimSpace(h) == "" {
+		return meta, nil
+	}
+	for _, pair := range strings.Split(h, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" || strings.ContainsAny(key, " ") {
+			return nil, errors.New("invalid Upload-Metadata header")
+		}
+		if _, dup := meta[key]; dup {
+			return nil, fmt.Errorf("duplicate Upload-Metadata key %q", key)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %q", key)
+		}
+		meta[key] = string(decoded)
+	}
+	return meta, nil
+}
+
+// tusResumable checks that a request speaks our tus version, and marks
+// every response as tus.
+func tusResumable(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"error": "Unsupported tus version"})
+	}
+}
+
+// uploadHeaders sets how far an upload has got and when it expires.
+func uploadHeaders(c *gin.Context, u *tusUpload) {
+	c.Header("Upload-Offset", strconv.FormatInt(u.offset, 10))
+	c.Header("Upload-Expires", u.expires.UTC().Format(http.TimeFormat))
+	if u.AttachmentID != 0 {
+		c.Header("X-Attachment-ID", strconv.FormatInt(u.AttachmentID, 10))
+	}
+}
+
+// registerResumableRoutes adds the tus endpoints for resumable attachment
+// uploads. The discovery request goes without a token, as tus clients send
+// it without one.
+func (s *server) registerResumableRoutes(public, r gin.IRouter) {
+	// OPTIONS /tasks/:id/uploads
+	public.OPTIONS("/tasks/:id/uploads", func(c *gin.Context) {
+		c.Header("Tus-Resumable", tusVersion)
+		c.Header("Tus-Version", tusVersion)
+		c.Header("Tus-Extension", tusExtensions)
+		c.Header("Tus-Max-Size", strconv.Itoa(maxUploadSize))
+		c.Status(http.StatusNoContent)
+	})
+
+	// POST /tasks/:id/uploads
+	// Starts a resumable upload of Upload-Length bytes, and takes its first
+	// chunk if there is one. The file is named by the "filename" (or
+	// "name") metadata and typed by "filetype" (or "mime_type").
+	r.POST("/tasks/:id/uploads", tusResumable, s.allowTask(ActionAttachmentCreate), func(c *gin.Context) {
+		taskID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		if c.GetHeader("Upload-Defer-Length") != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Defer-Length is not supported"})
+			return
+		}
+		length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Length header"})
+			return
+		}
+		if length > maxUploadSize {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": errUploadTooLarge.Error()})
+			return
+		}
+		metadata := c.GetHeader("Upload-Metadata")
+		if _, err := parseTusMetadata(metadata); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		u := &tusUpload{TaskID: taskID, UserID: currentUser(c).ID, Length: length, Metadata: metadata,
+			CreatedAt: time.Now().UTC()}
+		if err := s.resumable.create(u); err != nil {
+			log.Println("resumable upload create error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Header("Location", fmt.Sprintf("/tasks/%d/uploads/%s", taskID, u.ID))
+
+		// An empty file is complete as soon as it is created.
+		status := http.StatusCreated
+		if c.ContentType() == tusChunkType || length == 0 {
+			if !s.lockUpload(c, u.ID) {
+				return
+			}
+			defer s.resumable.unlock(u.ID)
+			if status = s.receiveChunk(c, u); status >= 400 {
+				return
+			}
+		}
+		uploadHeaders(c, u)
+		if status == http.StatusNoContent {
+			status = http.StatusCreated
+		}
+		c.Status(status)
+	})
+
+	// HEAD /tasks/:id/uploads/:uploadId
+	// How much of the upload the server has, so the client can resume from
+	// there.
+	r.HEAD("/tasks/:id/uploads/:uploadId", tusResumable, s.allowTask(ActionAttachmentCreate), func(c *gin.Context) {
+		u, ok := s.resumableUpload(c)
+		if !ok {
+			return
+		}
+		uploadHeaders(c, u)
+		c.Header("Upload-Length", strconv.FormatInt(u.Length, 10))
+		if u.Metadata != "" {
+			c.Header("Upload-Metadata", u.Metadata)
+		}
+		c.Header("Cache-Control", "no-store")
+		c.Status(http.StatusOK)
+	})
+
+	// PATCH /tasks/:id/uploads/:uploadId
+	// Appends a chunk at Upload-Offset. The attachment is created once the
+	// last byte is in; its ID comes back in X-Attachment-ID.
+	r.PATCH("/tasks/:id/uploads/:uploadId", tusResumable, s.allowTask(ActionAttachmentCreate), func(c *gin.Context) {
+		u, ok := s.resumableUpload(c)
+		if !ok {
+			return
+		}
+		if c.ContentType() != tusChunkType {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be " + tusChunkType})
+			return
+		}
+		offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Offset header"})
+			return
+		}
+		if !s.lockUpload(c, u.ID) {
+			return
+		}
+		defer s.resumable.unlock(u.ID)
+		// Reload under the lock: a request that just finished may have
+		// moved the offset.
+		if u, err = s.resumable.load(u.ID); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+			return
+		}
+		if offset != u.offset {
+			c.Header("Upload-Offset", strconv.FormatInt(u.offset, 10))
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Upload-Offset is %d, not %d", u.offset, offset)})
+			return
+		}
+		if status := s.receiveChunk(c, u); status < 400 {
+			uploadHeaders(c, u)
+			c.Status(status)
+		}
+	})
+
+	// DELETE /tasks/:id/uploads/:uploadId
+	// Abandons an upload. The attachment of a completed one is kept.
+	r.DELETE("/tasks/:id/uploads/:uploadId", tusResumable, s.allowTask(ActionAttachmentCreate), func(c *gin.Context) {
+		u, ok := s.resumableUpload(c)
+		if !ok {
+			return
+		}
+		if !s.lockUpload(c, u.ID) {
+			return
+		}
+		defer s.resumable.unlock(u.ID)
+		if err := s.resumable.remove(u.ID); err != nil {
+			log.Println("resumable upload delete error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+}
+
+// resumableUpload loads the :uploadId upload, answering 404 unless it
+// belongs to the :id task and the current user.
+func (s *server) resumableUpload(c *gin.Context) (*tusUpload, bool) {
+	u, err := s.resumable.load(c.Param("uploadId"))
+	if err == nil && (strconv.FormatInt(u.TaskID, 10) != c.Param("id") || u.UserID != currentUser(c).ID) {
+		err = ErrNotFound
+	}
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return nil, false
+	}
+	if err != nil {
+		log.Println("resumable upload load error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return u, true
+}
+
+// lockUpload locks an upload for the request, answering 423 if another
+// request has it.
+func (s *server) lockUpload(c *gin.Context, id string) bool {
+	err := s.resumable.lock(id)
+	if errors.Is(err, errLocked) {
+		c.JSON(http.StatusLocked, gin.H{"error": "Another request is writing to this upload"})
+		return false
+	}
+	if err != nil {
+		log.Println("resumable upload lock error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// receiveChunk appends the request body to an upload the caller has locked
+// and, when that completes it, creates the attachment. It returns the
+// status to answer with, or one of 400 and up once it has answered with an
+// error. What was received before the client went away is kept.
+func (s *server) receiveChunk(c *gin.Context, u *tusUpload) int {
+	rest := u.Length - u.offset
+	if c.Request.ContentLength > rest {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "The chunk goes past Upload-Length"})
+		return http.StatusRequestEntityTooLarge
+	}
+	if rest > 0 {
+		if !s.uploads.acquire() {
+			c.Header("Retry-After", "5")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many uploads in progress, try again shortly"})
+			return http.StatusServiceUnavailable
+		}
+		defer s.uploads.release()
+		f, err := os.OpenFile(s.resumable.dataPath(u.ID), os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			log.Println("resumable upload open error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return http.StatusInternalServerError
+		}
+		n, err := io.Copy(f, io.LimitReader(c.Request.Body, rest))
+		if serr := f.Sync(); err == nil {
+			err = serr
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		u.offset += n
+		u.expires = time.Now().Add(s.resumable.ttl)
+		if err != nil {
+			log.Println("resumable upload write error:", err)
+			c.Header("Upload-Offset", strconv.FormatInt(u.offset, 10))
+			status := uploadStatus(err)
+			c.JSON(status, gin.H{"error": "Upload failed: " + err.Error()})
+			return status
+		}
+		if u.offset == u.Length {
+			var extra [1]byte
+			if m, _ := c.Request.Body.Read(extra[:]); m > 0 {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "The chunk goes past Upload-Length"})
+				return http.StatusRequestEntityTooLarge
+			}
+		}
+	}
+	if u.offset == u.Length && u.AttachmentID == 0 {
+		err := s.finishResumable(c.Request.Context(), u)
+		if errors.Is(err, ErrParentTrashed) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+			return http.StatusNotFound
+		}
+		if err != nil {
+			log.Println("resumable upload finish error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to store file: %s", err.Error())})
+			return http.StatusInternalServerError
+		}
+	}
+	return http.StatusNoContent
+}
+
+// finishResumable stores a complete upload and creates its attachment. If
+// it fails the data stays, and a PATCH with an empty body at the end tries
+// again. The task may have been trashed since the last chunk; then it
+// gives ErrParentTrashed and keeps the data for after a restore.
+func (s *server) finishResumable(ctx context.Context, u *tusUpload) error {
+	task, err := s.store.GetTask(ctx, u.TaskID)
+	if errors.Is(err, ErrNotFound) || (err == nil && task.trashed()) {
+		return ErrParentTrashed
+	}
+	if err != nil {
+		return err
+	}
+	meta, _ := parseTusMetadata(u.Metadata) // checked on creation
+	name := meta["filename"]
+	if name == "" {
+		name = meta["name"]
+	}
+	if name == "" {
+		name = "file"
+	}
+	mimeType := meta["filetype"]
+	if mimeType == "" {
+		mimeType = meta["mime_type"]
+	}
+
+	f, err := os.Open(s.resumable.dataPath(u.ID))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// The chunks may have come over several restarts, so the file is
+	// hashed here rather than as it arrived.
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	key, err := putShared(ctx, s.store, s.blobs, name, f, u.Length, sum, nil)
+	if err != nil {
+		return err
+	}
+	// A finish that stopped short of saving u below is retried with the
+	// attachment already there; CreateAttachment then hands back that one
+	// rather than making a second.
+	attachment := Attachment{TaskID: u.TaskID, Type: "file", Name: name, URL: key, Size: u.Length,
+		MimeType: &mimeType, SHA256: sum, UploadID: u.ID, CreatedAt: time.Now().UTC()}
+	err = s.store.CreateAttachment(ctx, &attachment)
+	if err != nil {
+		// The attachment made before holds its own reference.
+		if rerr := s.store.ReleaseBlobs(ctx, sum); rerr != nil {
+			log.Println("ReleaseBlobs error:", rerr)
+		}
+		if !errors.Is(err, ErrDuplicate) {
+			return err
+		}
+	}
+	u.AttachmentID, u.expires = attachment.ID, time.Now().Add(s.resumable.ttl)
+	if err := s.resumable.save(u); err != nil {
+		// The data stays so that the upload still loads as complete; a
+		// retry finds the attachment through its upload ID.
+		log.Println("resumable upload save error:", err)
+		return nil
+	}
+	os.Remove(s.resumable.dataPath(u.ID))
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestResumableUpload(t *testing.T) {
+	ts := newTestServer(t)
+	_, admin := ts.addUser("root", RoleAdmin)
+	task := ts.createTask(admin, map[string]any{"title": "Plans"})
+	w := ts.do("POST", taskPath(task.ID, "uploads"), admin, nil,
+		"Tus-Resumable", tusVersion, "Upload-Length", "10", "Upload-Metadata", "filename cGxhbi50eHQ=")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST uploads: %d %s", w.Code, w.Body)
+	}
+	location := w.Header().Get("Location")
+	patch := func(offset int, chunk string) *httptest.ResponseRecorder {
+		return ts.do("PATCH", location, admin, strings.NewReader(chunk), "Tus-Resumable", tusVersion,
+			"Content-Type", tusChunkType, "Upload-Offset", strconv.Itoa(offset))
+	}
+
+	if w := patch(0, "first "); w.Code != http.StatusNoContent {
+		t.Fatalf("PATCH at 0: %d %s", w.Code, w.Body)
+	}
+	if w := patch(6, "and more"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PATCH past Upload-Length = %d, want 413", w.Code)
+	}
+	w = patch(6, "last")
+	if w.Code != http.StatusNoContent || w.Header().Get("X-Attachment-ID") == "" {
+		t.Fatalf("PATCH at 6: %d %s %v", w.Code, w.Body, w.Header())
+	}
+	var atts []Attachment
+	decode(t, ts.do("GET", taskPath(task.ID, "attachments"), admin, nil), &atts)
+	if len(atts) != 1 || atts[0].Name != "plan.txt" || atts[0].SHA256 != sha256Hex("first last") {
+		t.Errorf("attachments = %+v", atts)
+	}
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// A finish that created the attachment but died before saving the upload
+// is retried with the upload as it was before.
+func TestFinishResumableTwice(t *testing.T) {
+	ts := newTestServer(t)
+	_, admin := ts.addUser("root", RoleAdmin)
+	task := ts.createTask(admin, map[string]any{"title": "Plans"})
+	ctx := context.Background()
+	u := &tusUpload{TaskID: task.ID, Length: 5, Metadata: "filename YS50eHQ="}
+	if err := ts.resumable.create(u); err != nil {
+		t.Fatal(err)
+	}
+	u.offset = u.Length
+	before := *u
+
+	var ids []int64
+	for _, u := range []*tusUpload{u, &before} {
+		if err := os.WriteFile(ts.resumable.dataPath(u.ID), []byte("hello"), 0o640); err != nil {
+			t.Fatal(err)
+		}
+		if err := ts.finishResumable(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, u.AttachmentID)
+	}
+	if ids[0] == 0 || ids[0] != ids[1] {
+		t.Errorf("attachment IDs = %v, want the same one twice", ids)
+	}
+	atts, err := ts.store.ListAttachments(ctx, task.ID)
+	if err != nil || len(atts) != 1 {
+		t.Fatalf("attachments = %+v, %v", atts, err)
+	}
+	if ref := ts.mem.blobRefs[atts[0].SHA256]; ref.Refs != 1 {
+		t.Errorf("blob ref = %+v, want one reference", ref)
+	}
+}
+
+// Instances sharing the upload directory keep off each other's uploads.
+func TestResumableLockAcrossInstances(t *testing.T) {
+	cfg := defaultConfig().Uploads
+	cfg.ResumableDir = t.TempDir()
+	a, err := newResumableUploads(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newResumableUploads(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.lock("up"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.lock("up"); !errors.Is(err, errLocked) {
+		t.Errorf("locking twice in one instance = %v, want errLocked", err)
+	}
+	if err := b.lock("up"); !errors.Is(err, errLocked) {
+		t.Errorf("locking from another instance = %v, want errLocked", err)
+	}
+	a.unlock("up")
+	if err := b.lock("up"); err != nil {
+		t.Errorf("locking after unlock = %v", err)
+	}
+	b.unlock("up")
+}
+
+// The data of an upload whose finish could not be saved stays, so that the
+// upload can still be finished again.
+func TestFinishResumableUnsaved(t *testing.T) {
+	ts := newTestServer(t)
+	_, admin := ts.addUser("root", RoleAdmin)
+	task := ts.createTask(admin, map[string]any{"title": "Plans"})
+	ctx := context.Background()
+	u := &tusUpload{TaskID: task.ID, Length: 5, Metadata: "filename YS50eHQ="}
+	if err := ts.resumable.create(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(ts.resumable.dataPath(u.ID), []byte("hello"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	u.offset = u.Length
+	before := *u
+
+	// A directory in place of the info file fails the save.
+	info := ts.resumable.infoPath(u.ID)
+	if err := os.Remove(info); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(info, "x"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.finishResumable(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(ts.resumable.dataPath(u.ID)); err != nil {
+		t.Fatalf("data after a failed save: %v", err)
+	}
+
+	if err := os.RemoveAll(info); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.resumable.save(&before); err != nil {
+		t.Fatal(err)
+	}
+	again, err := ts.resumable.load(u.ID)
+	if err != nil || again.offset != again.Length || again.AttachmentID != 0 {
+		t.Fatalf("load = %+v, %v; want a complete, unfinished upload", again, err)
+	}
+	if err := ts.finishResumable(ctx, again); err != nil {
+		t.Fatal(err)
+	}
+	if again.AttachmentID != u.AttachmentID {
+		t.Errorf("finishing again made attachment %d, want %d", again.AttachmentID, u.AttachmentID)
+	}
+	if _, err := os.Stat(ts.resumable.dataPath(u.ID)); !os.IsNotExist(err) {
+		t.Errorf("data after a saved finish: %v", err)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxUploadSize is the hard limit on one attached file.
+	maxUploadSize = 250 << 20
+	// maxUploadField bounds each form field that comes with a file, and
+	// maxUploadFields and maxUploadFieldsSize all of them together.
+	maxUploadField      = 64 << 10
+	maxUploadFields     = 32
+	maxUploadFieldsSize = 256 << 10
+	// uploadProgressTTL is how long the progress of a finished upload can
+	// still be read.
+	uploadProgressTTL = 5 * time.Minute
+)
+
+// Upload states, in order.
+const (
+	UploadReceiving = "receiving" // the client is sending the file
+	UploadStoring   = "storing"   // it is being sent on to attachment storage
+	UploadDone      = "done"
+	UploadFailed    = "failed"
+)
+
+var (
+	errUploadTooLarge = errors.New("file too large (max 250 MB)")
+	errUploadNoFile   = errors.New("missing file field")
+	// errUploadFieldTooLarge is wrapped with the name of the field.
+	errUploadFieldTooLarge = errors.New("form field too large (max 64 KB)")
+	errUploadFormTooLarge  = errors.New("form fields too large (at most 32 fields of 256 KB in all)")
+	errUploadIDInUse       = errors.New("upload ID already in use")
+	validUploadID          = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+// UploadProgress is how far a file upload has got. Received counts request
+// bytes, out of Total when the client sent a Content-Length; Stored counts
+// file bytes sent to attachment storage, out of Size.
+type UploadProgress struct {
+	ID           string    `json:"id"`
+	TaskID       int64     `json:"task_id"`
+	State        string    `json:"state"`
+	Total        int64     `json:"total,omitempty"`
+	Received     int64     `json:"received"`
+	Size         int64     `json:"size,omitempty"`
+	Stored       int64     `json:"stored"`
+	AttachmentID int64     `json:"attachment_id,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	userID       int64
+}
+
+// uploads limits how many file uploads this instance takes at a time and
+// keeps their progress for GET /uploads/:uploadId. Progress is per
+// instance: clients behind a load balancer poll the one they upload to.
+type uploads struct {
+	spoolDir string
+	slots    chan struct{}
+
+	mu       sync.Mutex
+	progress map[string]*UploadProgress
+}
+
+func newUploads(cfg UploadConfig) *uploads {
+	return &uploads{spoolDir: cfg.SpoolDir, slots: make(chan struct{}, cfg.MaxConcurrent),
+		progress: map[string]*UploadProgress{}}
+}
+
+// acquire takes an upload slot without waiting; release gives it back.
+func (u *uploads) acquire() bool {
+	select {
+	case u.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (u *uploads) release() { <-u.slots }
+
+// begin starts tracking an upload. Without an id from the client it is not
+// tracked, but the returned progress still works.
+func (u *uploads) begin(id string, userID, taskID, total int64) (*UploadProgress, error) {
+	p := &UploadProgress{ID: id, TaskID: taskID, State: UploadReceiving, Total: max(total, 0),
+		UpdatedAt: time.Now().UTC(), userID: userID}
+	if id == "" {
+		return p, nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for key, old := range u.progress {
+		if old.finished() && time.Since(old.UpdatedAt) > uploadProgressTTL {
+			delete(u.progress, key)
+		}
+	}
+	if old, ok := u.progress[id]; ok && !old.finished() {
+		return nil, errUploadIDInUse
+	}
+	u.progress[id] = p
+	return p, nil
+}
+
+// update changes a tracked upload under the lock.
+func (u *uploads) update(p *UploadProgress, f func(p *UploadProgress)) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	f(p)
+	p.UpdatedAt = time.Now().UTC()
+}
+
+// get returns a copy of the progress of a user's upload.
+func (u *uploads) get(id string, userID int64) (UploadProgress, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	p, ok := u.progress[id]
+	if !ok || p.userID != userID {
+		return UploadProgress{}, false
+	}
+	return *p, true
+}
+
+func (p *UploadProgress) finished() bool { return p.State == UploadDone || p.State == UploadFailed }
+
+// spooledFile is an uploaded file received into a temp file, with its
+// SHA-256 and the form fields that came with it.
+type spooledFile struct {
+	*os.File
+	filename string
+	size     int64
+	sha256   string
+	fields   map[string]string
+}
+
+// Close closes and removes the temp file.
+func (f *spooledFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.File.Name())
+	return err
+}
+
+// spool reads a multipart upload part by part, copying the "file" part to
+// a temp file in dir; memory use stays at a copy buffer however big the
+// file. The other parts are read as form fields, before or after the file,
+// and fail the upload if there are too many or they are too big.
+// A write to the temp file fails with an *fs.PathError, to tell disk
+// trouble from a bad request.
+func spool(r *multipart.Reader, dir string) (*spooledFile, error) {
+	var file *spooledFile
+	fields := map[string]string{}
+	nFields, fieldsSize := 0, 0
+	fail := func(err error) (*spooledFile, error) {
+		if file != nil {
+			file.Close()
+		}
+		return nil, err
+	}
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+		name := part.FormName()
+		switch {
+		case name == "file" && file == nil:
+			tmp, err := os.CreateTemp(dir, "upload-*")
+			if err != nil {
+				return fail(err)
+			}
+			file = &spooledFile{File: tmp, filename: part.FileName(), fields: fields}
+			h := sha256.New()
+			n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(part, maxUploadSize+1))
+			file.size, file.sha256 = n, hex.EncodeToString(h.Sum(nil))
+			if err != nil {
+				return fail(err)
+			}
+			if n > maxUploadSize {
+				return fail(errUploadTooLarge)
+			}
+		case name != "":
+			b, err := io.ReadAll(io.LimitReader(part, maxUploadField+1))
+			if err != nil {
+				return fail(err)
+			}
+			if len(b) > maxUploadField {
+				return fail(fmt.Errorf("%s: %w", name, errUploadFieldTooLarge))
+			}
+			nFields, fieldsSize = nFields+1, fieldsSize+len(b)
+			if nFields > maxUploadFields || fieldsSize > maxUploadFieldsSize {
+				return fail(errUploadFormTooLarge)
+			}
+			fields[name] = string(b)
+		}
+		part.Close()
+	}
+	if file == nil {
+		return nil, errUploadNoFile
+	}
+	return file, nil
+}
+
+// uploadStatus is the response status for an error from spool.
+func uploadStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	var pathErr *fs.PathError
+	switch {
+	case errors.Is(err, errUploadTooLarge) || errors.Is(err, errUploadFieldTooLarge) ||
+		errors.Is(err, errUploadFormTooLarge) || errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.As(err, &pathErr):
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// registerUploadRoutes adds the upload progress endpoint.
+func (s *server) registerUploadRoutes(r gin.IRouter) {
+	// GET /uploads/:uploadId
+	// The progress of a file upload sent to POST /tasks/:id/attachments with
+	// this ID in X-Upload-ID, while it runs and for a few minutes after. Only
+	// the uploader can see it.
+	r.GET("/uploads/:uploadId", s.allow(ActionRead), func(c *gin.Context) {
+		p, ok := s.uploads.get(c.Param("uploadId"), currentUser(c).ID)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+			return
+		}
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, p)
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSpoolFields(t *testing.T) {
+	type field struct{ name, value string }
+	many := func(n, size int) []field {
+		var fs []field
+		for i := 0; i < n; i++ {
+			fs = append(fs, field{"f" + strconv.Itoa(i), strings.Repeat("x", size)})
+		}
+		return fs
+	}
+	tests := []struct {
+		name   string
+		fields []field
+		err    error
+	}{
+		{"a few fields", []field{{"name", "Plan"}, {"type", "file"}}, nil},
+		{"a field at the limit", []field{{"name", strings.Repeat("x", maxUploadField)}}, nil},
+		{"a field over the limit", []field{{"name", strings.Repeat("x", maxUploadField+1)}}, errUploadFieldTooLarge},
+		{"as many fields as allowed", many(maxUploadFields, 8), nil},
+		{"too many fields", many(maxUploadFields+1, 8), errUploadFormTooLarge},
+		{"too much in all", many(5, maxUploadField), errUploadFormTooLarge},
+	}
+	for _, tt := range tests {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", "plan.txt")
+		fw.Write([]byte("the plan"))
+		for _, f := range tt.fields {
+			mw.WriteField(f.name, f.value)
+		}
+		mw.Close()
+
+		f, err := spool(multipart.NewReader(&body, mw.Boundary()), t.TempDir())
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: spool = %v, want %v", tt.name, err, tt.err)
+		}
+		if err != nil {
+			if got := uploadStatus(err); got != http.StatusRequestEntityTooLarge {
+				t.Errorf("%s: uploadStatus = %d, want 413", tt.name, got)
+			}
+			continue
+		}
+		if f.sha256 != sha256Hex("the plan") || len(f.fields) != len(tt.fields) {
+			t.Errorf("%s: spooled %d fields, hash %s", tt.name, len(f.fields), f.sha256)
+		}
+		for _, fd := range tt.fields {
+			if f.fields[fd.name] != fd.value {
+				t.Errorf("%s: field %s has %d bytes, want %d", tt.name, fd.name, len(f.fields[fd.name]), len(fd.value))
+			}
+		}
+		f.Close()
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// userInput is the body of POST /users and PUT /users/:id. Nil fields are
+// left unchanged on update.
+type userInput struct {
+	Name      *string `json:"name"`
+	FullName  *string `json:"full_name"`
+	Initials  *string `json:"initials"`
+	Email     *string `json:"email"`
+	AvatarURL *string `json:"avatar_url"`
+	Role      *Role   `json:"role"`
+	Password  *string `json:"password"`
+	// Empty values fall back to the workspace calendar.
+	TimeZone    *string   `json:"time_zone"`
+	WorkingDays *[]string `json:"working_days"`
+	Holidays    *[]string `json:"holidays"`
+}
+
+// fields validates the input and returns it as a partial update. The
+// password is returned separately, already hashed.
+func (in userInput) fields() (map[string]any, string, error) {
+	fields := map[string]any{}
+	if in.Name != nil {
+		name := strings.TrimSpace(*in.Name)
+		if name == "" {
+			return nil, "", errors.New("name must not be empty")
+		}
+		fields["name"] = name
+	}
+	if in.FullName != nil {
+		fields["full_name"] = strings.TrimSpace(*in.FullName)
+	}
+	if in.Initials != nil {
+		initials := strings.ToUpper(strings.TrimSpace(*in.Initials))
+		if len([]rune(initials)) > 3 {
+			return nil, "", errors.New("initials must be at most 3 characters")
+		}
+		fields["initials"] = initials
+	}
+	if in.Email != nil {
+		email := strings.TrimSpace(*in.Email)
+		if email != "" {
+			addr, err := mail.ParseAddress(email)
+			if err != nil || addr.Address != email {
+				return nil, "", fmt.Errorf("invalid email address %q", email)
+			}
+		}
+		fields["email"] = email
+	}
+	if in.AvatarURL != nil {
+		avatar := strings.TrimSpace(*in.AvatarURL)
+		if avatar != "" {
+			u, err := url.Parse(avatar)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, "", errors.New("avatar_url must be an http(s) URL")
+			}
+		}
+		fields["avatar_url"] = avatar
+	}
+	if in.Role != nil {
+		if !in.Role.valid() {
+			return nil, "", fmt.Errorf("unknown role %q (want admin, lead, member or viewer)", *in.Role)
+		}
+		fields["role"] = *in.Role
+	}
+	var cal WorkCalendar
+	if in.TimeZone != nil {
+		cal.TimeZone = strings.TrimSpace(*in.TimeZone)
+		fields["time_zone"] = cal.TimeZone
+	}
+	if in.WorkingDays != nil {
+		cal.WorkingDays = *in.WorkingDays
+		fields["working_days"] = cal.WorkingDays
+	}
+	if in.Holidays != nil {
+		cal.Holidays = *in.Holidays
+		fields["holidays"] = cal.Holidays
+	}
+	if err := cal.validate(); err != nil {
+		return nil, "", err
+	}
+	var hash string
+	if in.Password != nil {
+		var err error
+		if hash, err = hashPassword(*in.Password); err != nil {
+			return nil, "", err
+		}
+	}
+	return fields, hash, nil
+}
+
+// initialsFrom derives initials the way the frontend did for its static user
+// list: first letters of the first two words, or the first two letters of a
+// single word.
+func initialsFrom(name string) string {
+	words := strings.FieldsFunc(name, func(r rune) bool { return !unicode.IsLetter(r) })
+	var out []rune
+	switch {
+	case len(words) >= 2:
+		out = []rune{[]rune(words[0])[0], []rune(words[len(words)-1])[0]}
+	case len(words) == 1:
+		out = []rune(words[0])
+		if len(out) > 2 {
+			out = out[:2]
+		}
+	}
+	return strings.ToUpper(string(out))
+}
+
+func parseUserID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("userId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return 0, false
+	}
+	return id, true
+}
+
+// registerUserRoutes wires the user management endpoints.
+func (s *server) registerUserRoutes(r gin.IRouter) {
+	store := s.store
+
+	// nameTaken reports whether another user already uses name.
+	nameTaken := func(c *gin.Context, name string, self int64) (bool, error) {
+		existing, err := store.FindUserByName(c.Request.Context(), name)
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return err == nil && existing.ID != self, err
+	}
+
+	// GET /users
+	r.GET("/users", s.allow(ActionRead), func(c *gin.Context) {
+		users, err := store.ListUsers(c.Request.Context())
+		if err != nil {
+			log.Println("/users error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, users)
+	})
+
+	// GET /users/:userId
+	r.GET("/users/:userId", s.allow(ActionRead), func(c *gin.Context) {
+		id, ok := parseUserID(c)
+		if !ok {
+			return
+		}
+		user, err := store.GetUser(c.Request.Context(), id)
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, user)
+	})
+
+	// POST /users
+	r.POST("/users", s.allow(ActionUserManage), func(c *gin.Context) {
+		ctx := c.Request.Context()
+		var in userInput
+		if err := c.BindJSON(&in); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if in.Name == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+			return
+		}
+		fields, hash, err := in.fields()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var user User
+		if err := applyFields(&user, fields); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if taken, err := nameTaken(c, user.Name, 0); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		} else if taken {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("a user named %q already exists", user.Name)})
+			return
+		}
+		if user.Role == "" {
+			user.Role = RoleMember
+		}
+		if user.Initials == "" {
+			user.Initials = initialsFrom(cmp.Or(user.FullName, user.Name))
+		}
+		user.PasswordHash = hash
+		err = store.CreateUser(ctx, &user)
+		if errors.Is(err, ErrDuplicate) {
+			// Created by someone else since the check above.
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("a user named %q already exists", user.Name)})
+			return
+		}
+		if err != nil {
+			log.Println("CreateUser error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, user)
+	})
+
+	// PUT /users/:userId
+	// Users may edit their own profile; roles, passwords and other users
+	// need users.manage.
+	r.PUT("/users/:userId", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		id, ok := parseUserID(c)
+		if !ok {
+			return
+		}
+		var in userInput
+		if err := c.BindJSON(&in); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := authorizeUserEdit(currentUser(c), id, in.Role != nil || in.Password != nil); err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		fields, hash, err := in.fields()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if name, ok := fields["name"].(string); ok {
+			if taken, err := nameTaken(c, name, id); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			} else if taken {
+				c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("a user named %q already exists", name)})
+				return
+			}
+		}
+		user, err := store.UpdateUser(ctx, id, fields)
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		if errors.Is(err, ErrDuplicate) {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("a user named %q already exists", fields["name"])})
+			return
+		}
+		if err != nil {
+			log.Println("UpdateUser error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// The password only changes once the rest of the update went
+		// through, so a refused update leaves the sessions alone.
+		if hash != "" {
+			if err := store.SetUserPassword(ctx, id, hash); err != nil {
+				log.Println("SetUserPassword error:", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			// A password reset signs the user out everywhere.
+			if err := store.DeleteUserSessions(ctx, id, ""); err != nil {
+				log.Println("DeleteUserSessions error:", err)
+			}
+		}
+		c.JSON(http.StatusOK, user)
+	})
+
+	// releaseOpenWork makes sure a user about to be deactivated or deleted is
+	// not left as main assignee of open tasks or subtasks. With
+	// ?reassign_to=<id> (or "reassign_to" in the JSON body) the work is moved
+	// to that user; otherwise the request fails with 409 and the blocking
+	// task and subtask ids.
+	releaseOpenWork := func(c *gin.Context, user User, reassignTo int64) bool {
+		ctx := c.Request.Context()
+		open, err := store.OpenTasksAssignedTo(ctx, user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return false
+		}
+		openSubs, err := store.OpenSubtasksAssignedTo(ctx, user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return false
+		}
+		if len(open) == 0 && len(openSubs) == 0 {
+			return true
+		}
+		if reassignTo == 0 {
+			taskIDs := make([]int64, len(open))
+			for i, t := range open {
+				taskIDs[i] = t.ID
+			}
+			subIDs := make([]int64, len(openSubs))
+			for i, sub := range openSubs {
+				subIDs[i] = sub.ID
+			}
+			c.JSON(http.StatusConflict, gin.H{
+				"error": fmt.Sprintf("%s is still main assignee of %d open task(s) and %d open subtask(s); pass reassign_to to hand them over",
+					user.Name, len(open), len(openSubs)),
+				"open_tasks":    taskIDs,
+				"open_subtasks": subIDs,
+			})
+			return false
+		}
+		if reassignTo == user.ID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "reassign_to must be a different user"})
+			return false
+		}
+		target, err := store.GetUser(ctx, reassignTo)
+		if errors.Is(err, ErrNotFound) || (err == nil && !target.active()) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "reassign_to must be an active user"})
+			return false
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return false
+		}
+		nTasks, nSubtasks, err := store.ReassignOpenWork(ctx, user.ID, target.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return false
+		}
+		log.Printf("reassigned %d task(s) and %d subtask(s) from user %d to %d", nTasks, nSubtasks, user.ID, target.ID)
+		return true
+	}
+
+	reassignTarget := func(c *gin.Context) (int64, bool) {
+		var body struct {
+			ReassignTo int64 `json:"reassign_to"`
+		}
+		if v := c.Query("reassign_to"); v != "" {
+			id, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid reassign_to"})
+				return 0, false
+			}
+			return id, true
+		}
+		if c.Request.ContentLength > 0 {
+			if err := c.BindJSON(&body); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return 0, false
+			}
+		}
+		return body.ReassignTo, true
+	}
+
+	// loadTarget fetches the user named in the route, refusing to act on the
+	// caller's own account.
+	loadTarget := func(c *gin.Context) (User, bool) {
+		id, ok := parseUserID(c)
+		if !ok {
+			return User{}, false
+		}
+		if id == currentUser(c).ID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "you cannot do this to your own account"})
+			return User{}, false
+		}
+		user, err := store.GetUser(c.Request.Context(), id)
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return User{}, false
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return User{}, false
+		}
+		return user, true
+	}
+
+	// POST /users/:userId/deactivate
+	r.POST("/users/:userId/deactivate", s.allow(ActionUserManage), func(c *gin.Context) {
+		ctx := c.Request.Context()
+		user, ok := loadTarget(c)
+		if !ok {
+			return
+		}
+		reassignTo, ok := reassignTarget(c)
+		if !ok || !releaseOpenWork(c, user, reassignTo) {
+			return
+		}
+		updated, err := store.UpdateUser(ctx, user.ID, map[string]any{"deactivated_at": time.Now().UTC()})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := store.DeleteUserSessions(ctx, user.ID, ""); err != nil {
+			log.Println("DeleteUserSessions error:", err)
+		}
+		c.JSON(http.StatusOK, updated)
+	})
+
+	// POST /users/:userId/reactivate
+	r.POST("/users/:userId/reactivate", s.allow(ActionUserManage), func(c *gin.Context) {
+		id, ok := parseUserID(c)
+		if !ok {
+			return
+		}
+		updated, err := store.UpdateUser(c.Request.Context(), id, map[string]any{"deactivated_at": nil})
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, updated)
+	})
+
+	// DELETE /users/:userId
+	r.DELETE("/users/:userId", s.allow(ActionUserManage), func(c *gin.Context) {
+		ctx := c.Request.Context()
+		user, ok := loadTarget(c)
+		if !ok {
+			return
+		}
+		reassignTo, ok := reassignTarget(c)
+		if !ok || !releaseOpenWork(c, user, reassignTo) {
+			return
+		}
+		if err := store.DeleteUser(ctx, user.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := store.DeleteUserSessions(ctx, user.ID, ""); err != nil {
+			log.Println("DeleteUserSessions error:", err)
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	})
+}
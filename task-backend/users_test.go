@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestDeactivateNeedsOpenSubtasksReassigned(t *testing.T) {
+	ts := newTestServer(t)
+	_, admin := ts.addUser("root", RoleAdmin)
+	leaving, _ := ts.addUser("bob", RoleMember)
+	heir, _ := ts.addUser("carol", RoleMember)
+
+	// Bob is main assignee of an open subtask only.
+	task := ts.createTask(admin, map[string]any{"title": "Release"})
+	w := ts.do("POST", taskPath(task.ID, "subtasks"), admin, map[string]any{"title": "Notes", "main_assignee_id": leaving.ID})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST subtask: %d %s", w.Code, w.Body)
+	}
+	var sub Subtask
+	decode(t, w, &sub)
+
+	path := "/users/" + strconv.FormatInt(leaving.ID, 10)
+	w = ts.do("POST", path+"/deactivate", admin, nil)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("deactivate with an open subtask = %d, want 409", w.Code)
+	}
+	var blocked struct {
+		OpenSubtasks []int64 `json:"open_subtasks"`
+	}
+	decode(t, w, &blocked)
+	if len(blocked.OpenSubtasks) != 1 || blocked.OpenSubtasks[0] != sub.ID {
+		t.Errorf("open_subtasks = %v, want [%d]", blocked.OpenSubtasks, sub.ID)
+	}
+
+	w = ts.do("POST", path+"/deactivate?reassign_to="+strconv.FormatInt(heir.ID, 10), admin, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("deactivate with reassign_to = %d %s", w.Code, w.Body)
+	}
+	open, err := ts.mem.OpenSubtasksAssignedTo(context.Background(), heir.ID)
+	if err != nil || len(open) != 1 || open[0].ID != sub.ID {
+		t.Errorf("subtasks of the new assignee = %+v, %v", open, err)
+	}
+}
+
+func TestUserNamesAreUnique(t *testing.T) {
+	ts := newTestServer(t)
+	_, admin := ts.addUser("root", RoleAdmin)
+
+	if w := ts.do("POST", "/users", admin, map[string]any{"name": "dana", "password": testPassword}); w.Code != http.StatusCreated {
+		t.Fatalf("POST /users: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do("POST", "/users", admin, map[string]any{"name": "Dana", "password": testPassword}); w.Code != http.StatusConflict {
+		t.Errorf("POST /users with a taken name = %d, want 409", w.Code)
+	}
+
+	// The store refuses duplicates too, for creates that race past the
+	// handler's check.
+	if err := ts.mem.CreateUser(context.Background(), &User{Name: "DANA"}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("CreateUser with a taken name = %v, want ErrDuplicate", err)
+	}
+	other := User{Name: "erin"}
+	if err := ts.mem.CreateUser(context.Background(), &other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.mem.UpdateUser(context.Background(), other.ID, map[string]any{"name": "dana"}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("UpdateUser to a taken name = %v, want ErrDuplicate", err)
+	}
+}
+
+// conflictingUserStore fails every user update as if another user had
+// taken the name meanwhile.
+type conflictingUserStore struct{ TaskStore }
+
+func (conflictingUserStore) UpdateUser(ctx context.Context, id int64, fields map[string]any) (User, error) {
+	return User{}, ErrDuplicate
+}
+
+func TestFailedUserUpdateKeepsPassword(t *testing.T) {
+	ts := newTestServer(t)
+	_, admin := ts.addUser("root", RoleAdmin)
+	dana, token := ts.addUser("dana", RoleMember)
+	ts.store = conflictingUserStore{ts.mem}
+	ts.handler = ts.router()
+
+	w := ts.do("PUT", "/users/"+strconv.FormatInt(dana.ID, 10), admin, map[string]any{"name": "dee", "password": "a-new-password"})
+	if w.Code != http.StatusConflict {
+		t.Fatalf("PUT /users = %d %s, want 409", w.Code, w.Body)
+	}
+	if w := ts.do("GET", "/me", token, nil); w.Code != http.StatusOK {
+		t.Errorf("GET /me after the failed update = %d, want the session kept", w.Code)
+	}
+	if _, _, _, err := ts.auth.login(context.Background(), "dana", testPassword); err != nil {
+		t.Errorf("login with the old password = %v", err)
+	}
+}
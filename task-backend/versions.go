@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// etag is the strong entity tag of a task or subtask version.
+func etag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// ifMatch returns the version a write is conditional on: the one in the
+// If-Match header, or anyVersion when there is none or it is "*". It
+// answers 400 and returns false for a header that is not a single strong
+// ETag as sent by the reads.
+func ifMatch(c *gin.Context) (int64, bool) {
+	h := strings.TrimSpace(c.GetHeader("If-Match"))
+	if h == "" || h == "*" {
+		return anyVersion, true
+	}
+	if unquoted, err := strconv.Unquote(h); err == nil && strings.HasPrefix(h, `"`) {
+		if v, err := strconv.ParseInt(unquoted, 10, 64); err == nil && v >= 0 {
+			return v, true
+		}
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid If-Match header"})
+	return 0, false
+}
+
+// versionConflict answers a write whose If-Match is stale with 412 and the
+// item as it is now, so the client can merge and retry with its ETag.
+func versionConflict(c *gin.Context, version int64, current any) {
+	c.Header("ETag", etag(version))
+	c.JSON(http.StatusPreconditionFailed, gin.H{"error": "The item was changed by someone else", "current": current})
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	webhookDeliveryLease = 5 * time.Minute
+	// webhookMaxAttempts is how often a delivery is tried before it is
+	// marked failed; with retryBackoff that spans about two hours.
+	webhookMaxAttempts = 8
+	// minWebhookSecret is the shortest secret accepted from the client.
+	minWebhookSecret = 16
+
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 200
+)
+
+// webhookEvents lists the events webhooks can subscribe to. Updates that
+// complete, reopen, archive or unarchive an item are sent as that event
+// rather than as "updated"; the changes in the payload tell the rest.
+var webhookEvents = []string{
+	"task.created", "task.updated", "task.completed", "task.reopened", "task.archived", "task.unarchived",
+	"task.deleted", "task.restored",
+	"subtask.created", "subtask.updated", "subtask.completed", "subtask.reopened", "subtask.deleted",
+	"subtask.restored",
+	"attachment.created", "attachment.deleted", "attachment.restored",
+}
+
+// validEventPattern reports whether p names a webhook event or is an
+// "<entity>.*" wildcard.
+func validEventPattern(p string) bool {
+	if entity, ok := strings.CutSuffix(p, ".*"); ok {
+		switch EntityKind(entity) {
+		case EntityTask, EntitySubtask, EntityAttachment:
+			return true
+		}
+		return false
+	}
+	return slices.Contains(webhookEvents, p)
+}
+
+// wants reports whether w is sent event.
+func (w Webhook) wants(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, p := range w.Events {
+		if p == event || (strings.HasSuffix(p, ".*") && strings.HasPrefix(event, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// webhooks sends change events to the webhook subscriptions. Events are
+// queued as deliveries and POSTed by a background worker, so a slow or
+// failing receiver never holds up the API. Each request is signed:
+//
+//	X-Webhook-Event:     task.completed
+//	X-Webhook-Delivery:  the delivery ID, the same on every attempt
+//	X-Webhook-Timestamp: Unix time of the attempt
+//	X-Webhook-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>">
+//
+// keyed with the webhook's secret.
+type webhooks struct {
+	store  TaskStore
+	client *http.Client
+	// wake nudges the delivery worker when deliveries were queued.
+	wake chan struct{}
+}
+
+func newWebhooks(store TaskStore, cfg WebhookConfig) *webhooks {
+	return &webhooks{
+		store:  store,
+		client: &http.Client{Timeout: time.Duration(cfg.Timeout)},
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// webhookEvent is the body of a delivery.
+type webhookEvent struct {
+	Event      string     `json:"event"`
+	OccurredAt time.Time  `json:"occurred_at"`
+	ActorID    int64      `json:"actor_id,omitempty"` // 0 for background jobs
+	Entity     EntityKind `json:"entity"`
+	EntityID   int64      `json:"entity_id"`
+	// TaskID is the task the entity is or belongs to.
+	TaskID int64 `json:"task_id"`
+	// Data is the task, subtask or attachment after the change, or as it
+	// was for deletions.
+	Data    any           `json:"data"`
+	Changes []FieldChange `json:"changes,omitempty"`
+}
+
+// publish queues ev for every active webhook that wants it. Failures are
+// logged, never returned: a change stands even if it could not be sent on.
+func (h *webhooks) publish(ctx context.Context, ev webhookEvent) {
+	hooks, err := h.store.ListWebhooks(ctx)
+	if err != nil {
+		log.Printf("webhooks: listing subscriptions for %s: %v", ev.Event, err)
+		return
+	}
+	hooks = slices.DeleteFunc(hooks, func(w Webhook) bool { return !w.Active || !w.wants(ev.Event) })
+	if len(hooks) == 0 {
+		return
+	}
+	ev.OccurredAt = time.Now().UTC()
+	if user, ok := userFromContext(ctx); ok {
+		ev.ActorID = user.ID
+	}
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("webhooks: encoding %s: %v", ev.Event, err)
+		return
+	}
+	deliveries := make([]*WebhookDelivery, len(hooks))
+	for i, w := range hooks {
+		deliveries[i] = &WebhookDelivery{WebhookID: w.ID, Event: ev.Event, Payload: payload, CreatedAt: ev.OccurredAt}
+	}
+	if err := h.store.EnqueueWebhookDeliveries(ctx, deliveries...); err != nil {
+		log.Printf("webhooks: queuing %s: %v", ev.Event, err)
+		return
+	}
+	h.nudge()
+}
+
+func (h *webhooks) nudge() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// signPayload returns the X-Webhook-Signature of body sent at timestamp.
+func signPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// send POSTs d to w and returns the response status, 0 if there was none.
+func (h *webhooks) send(ctx context.Context, w Webhook, d WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "task-backend")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(d.ID, 10))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signPayload(w.Secret, timestamp, d.Payload))
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	respBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook returned %d: %s", resp.StatusCode, strings.TrimSpace(string(respBytes)))
+	}
+	return resp.StatusCode, nil
+}
+
+// runWebhookWorker sends queued deliveries until ctx is cancelled. Like the
+// file deletion worker it claims them with a lease, so several instances can
+// share the queue.
+func runWebhookWorker(ctx context.Context, h *webhooks, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for h.deliverNext(ctx) {
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-h.wake:
+		}
+	}
+}
+
+// deliverNext sends one due delivery and reports whether there may be more.
+func (h *webhooks) deliverNext(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	d, err := h.store.ClaimWebhookDelivery(ctx, time.Now().UTC(), webhookDeliveryLease)
+	if errors.Is(err, ErrNotFound) {
+		return false
+	}
+	if err != nil {
+		log.Println("webhooks: claim error:", err)
+		return false
+	}
+	w, err := h.store.GetWebhook(ctx, d.WebhookID)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		// Deleted meanwhile; its deliveries went with it.
+		return true
+	case err != nil:
+		log.Println("webhooks: loading webhook error:", err)
+		return false
+	case !w.Active:
+		if err := h.store.FailWebhookDelivery(ctx, d.ID, 0, "webhook is paused"); err != nil {
+			log.Println("webhooks: fail error:", err)
+		}
+		return true
+	}
+	status, err := h.send(ctx, w, d)
+	switch {
+	case err == nil:
+		err = h.store.CompleteWebhookDelivery(ctx, d.ID, time.Now().UTC(), status)
+	case d.Attempts < webhookMaxAttempts:
+		next := time.Now().UTC().Add(retryBackoff(d.Attempts))
+		log.Printf("webhooks: delivery %d to webhook %d attempt %d failed: %v (retrying at %s)", d.ID, w.ID, d.Attempts, err, next.Format(time.RFC3339))
+		err = h.store.RetryWebhookDelivery(ctx, d.ID, next, status, err.Error())
+	default:
+		log.Printf("webhooks: giving up on delivery %d to webhook %d after %d attempts: %v", d.ID, w.ID, d.Attempts, err)
+		err = h.store.FailWebhookDelivery(ctx, d.ID, status, err.Error())
+	}
+	if err != nil {
+		log.Println("webhooks: recording delivery error:", err)
+	}
+	return true
+}
+
+// pruneDeliveries returns a scheduler job that trims the delivery logs to
+// retention.
+func (h *webhooks) pruneDeliveries(retention time.Duration) schedulerJob {
+	return func(ctx context.Context, now time.Time) error {
+		n, err := h.store.PruneWebhookDeliveries(ctx, now.Add(-retention))
+		if n > 0 {
+			log.Printf("webhooks: pruned %d old deliveries", n)
+		}
+		return err
+	}
+}
+
+// webhookInput is the body of POST /webhooks and PUT /webhooks/:id. Nil
+// fields are left unchanged on update.
+type webhookInput struct {
+	URL    *string   `json:"url"`
+	Secret *string   `json:"secret"`
+	Events *[]string `json:"events"`
+	Active *bool     `json:"active"`
+}
+
+// fields validates the input and returns it as a partial update.
+func (in webhookInput) fields() (map[string]any, error) {
+	fields := map[string]any{}
+	var errs []error
+	if in.URL != nil {
+		raw := strings.TrimSpace(*in.URL)
+		if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, errors.New("url: must be an absolute http(s) URL"))
+		}
+		fields["url"] = raw
+	}
+	if in.Secret != nil {
+		if len(*in.Secret) < minWebhookSecret {
+			errs = append(errs, fmt.Errorf("secret: must be at least %d characters", minWebhookSecret))
+		}
+		fields["secret"] = *in.Secret
+	}
+	if in.Events != nil {
+		events := []string{}
+		for _, e := range *in.Events {
+			if e = strings.TrimSpace(e); !validEventPattern(e) {
+				errs = append(errs, fmt.Errorf("events: unknown event %q", e))
+			} else if !slices.Contains(events, e) {
+				events = append(events, e)
+			}
+		}
+		fields["events"] = events
+	}
+	if in.Active != nil {
+		fields["active"] = *in.Active
+	}
+	return fields, errors.Join(errs...)
+}
+
+// newWebhookSecret makes a secret for webhooks created without one.
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func parseWebhookID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("webhookId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return 0, false
+	}
+	return id, true
+}
+
+// parseDeliveryQuery reads the filters of the delivery log:
+//
+//	state          pending, delivered or failed
+//	limit, cursor  page size and the X-Next-Cursor of the last page
+func parseDeliveryQuery(c *gin.Context, webhookID int64) (WebhookDeliveryQuery, error) {
+	q := WebhookDeliveryQuery{WebhookID: webhookID, Limit: defaultDeliveryLimit}
+	var errs []error
+	id := func(name string) int64 {
+		v := c.Query(name)
+		if v == "" {
+			return 0
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			errs = append(errs, fmt.Errorf("%s: must be a positive number", name))
+		}
+		return n
+	}
+	q.BeforeID = id("cursor")
+	if limit := id("limit"); limit > 0 {
+		q.Limit = min(int(limit), maxDeliveryLimit)
+	}
+	switch state := c.Query("state"); state {
+	case "", DeliveryPending, DeliveryDelivered, DeliveryFailed:
+		q.State = state
+	default:
+		errs = append(errs, errors.New("state: must be pending, delivered or failed"))
+	}
+	return q, errors.Join(errs...)
+}
+
+// registerWebhookRoutes adds the management of webhook subscriptions and
+// their delivery logs.
+func (s *server) registerWebhookRoutes(r gin.IRouter) {
+	store := s.store
+
+	// loadWebhook answers 404 for unknown webhooks.
+	loadWebhook := func(c *gin.Context) (Webhook, bool) {
+		id, ok := parseWebhookID(c)
+		if !ok {
+			return Webhook{}, false
+		}
+		w, err := store.GetWebhook(c.Request.Context(), id)
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+			return Webhook{}, false
+		}
+		if err != nil {
+			log.Println("GetWebhook error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return Webhook{}, false
+		}
+		return w, true
+	}
+
+	// GET /webhooks
+	r.GET("/webhooks", s.allow(ActionWebhookManage), func(c *gin.Context) {
+		hooks, err := store.ListWebhooks(c.Request.Context())
+		if err != nil {
+			log.Println("ListWebhooks error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, hooks)
+	})
+
+	// POST /webhooks
+	// A secret is generated when none is given. The response is the only
+	// place it is shown.
+	r.POST("/webhooks", s.allow(ActionWebhookManage), func(c *gin.Context) {
+		var in webhookInput
+		if err := c.BindJSON(&in); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if in.URL == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "url: required"})
+			return
+		}
+		fields, err := in.fields()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		w := Webhook{URL: fields["url"].(string), Events: []string{}, Active: true,
+			CreatedBy: currentUser(c).ID, CreatedAt: time.Now().UTC()}
+		if events, ok := fields["events"].([]string); ok {
+			w.Events = events
+		}
+		if in.Active != nil {
+			w.Active = *in.Active
+		}
+		if in.Secret != nil {
+			w.Secret = *in.Secret
+		} else if w.Secret, err = newWebhookSecret(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := store.CreateWebhook(c.Request.Context(), &w); err != nil {
+			log.Println("CreateWebhook error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, struct {
+			Webhook
+			Secret string `json:"secret"`
+		}{w, w.Secret})
+	})
+
+	// GET /webhooks/:webhookId
+	r.GET("/webhooks/:webhookId", s.allow(ActionWebhookManage), func(c *gin.Context) {
+		if w, ok := loadWebhook(c); ok {
+			c.JSON(http.StatusOK, w)
+		}
+	})
+
+	// PUT /webhooks/:webhookId
+	// "active": false pauses a webhook; deliveries still queued for it fail.
+	r.PUT("/webhooks/:webhookId", s.allow(ActionWebhookManage), func(c *gin.Context) {
+		id, ok := parseWebhookID(c)
+		if !ok {
+			return
+		}
+		var in webhookInput
+		if err := c.BindJSON(&in); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		fields, err := in.fields()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		w, err := store.UpdateWebhook(c.Request.Context(), id, fields)
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+			return
+		}
+		if err != nil {
+			log.Println("UpdateWebhook error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, w)
+	})
+
+	// DELETE /webhooks/:webhookId
+	// Removes the webhook and its delivery log.
+	r.DELETE("/webhooks/:webhookId", s.allow(ActionWebhookManage), func(c *gin.Context) {
+		id, ok := parseWebhookID(c)
+		if !ok {
+			return
+		}
+		err := store.DeleteWebhook(c.Request.Context(), id)
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+			return
+		}
+		if err != nil {
+			log.Println("DeleteWebhook error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	})
+
+	// GET /webhooks/:webhookId/deliveries?state=failed&limit=50&cursor=
+	// The delivery log, newest first. When more deliveries follow, the
+	// X-Next-Cursor response header holds the cursor for the next page.
+	r.GET("/webhooks/:webhookId/deliveries", s.allow(ActionWebhookManage), func(c *gin.Context) {
+		w, ok := loadWebhook(c)
+		if !ok {
+			return
+		}
+		q, err := parseDeliveryQuery(c, w.ID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// Fetch one extra delivery to learn whether there is a next page.
+		pageSize := q.Limit
+		q.Limit++
+		deliveries, err := store.ListWebhookDeliveries(c.Request.Context(), q)
+		if err != nil {
+			log.Println("ListWebhookDeliveries error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(deliveries) > pageSize {
+			deliveries = deliveries[:pageSize]
+			c.Header("X-Next-Cursor", strconv.FormatInt(deliveries[pageSize-1].ID, 10))
+		}
+		c.JSON(http.StatusOK, deliveries)
+	})
+
+	// POST /webhooks/:webhookId/deliveries/:deliveryId/redeliver
+	// Queues the payload of a past delivery again, as a new delivery.
+	r.POST("/webhooks/:webhookId/deliveries/:deliveryId/redeliver", s.allow(ActionWebhookManage), func(c *gin.Context) {
+		ctx := c.Request.Context()
+		w, ok := loadWebhook(c)
+		if !ok {
+			return
+		}
+		deliveryID, err := strconv.ParseInt(c.Param("deliveryId"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delivery ID"})
+			return
+		}
+		past, err := store.GetWebhookDelivery(ctx, w.ID, deliveryID)
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+			return
+		}
+		if err != nil {
+			log.Println("GetWebhookDelivery error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		d := &WebhookDelivery{WebhookID: w.ID, Event: past.Event, Payload: past.Payload, CreatedAt: time.Now().UTC()}
+		if err := store.EnqueueWebhookDeliveries(ctx, d); err != nil {
+			log.Println("EnqueueWebhookDeliveries error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		s.webhooks.nudge()
+		c.JSON(http.StatusAccepted, d)
+	})
+}
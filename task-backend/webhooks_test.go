@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSignPayload(t *testing.T) {
+	secret, body := "whsec-0123456789abcdef", []byte(`{"event":"task.created"}`)
+	const want = "sha256=4ce71f1241d0958e73507f7fb1611a29936b10b7181635306e55abe081fc9da1"
+	if got := signPayload(secret, "1767225600", body); got != want {
+		t.Errorf("signPayload = %s, want %s", got, want)
+	}
+	for name, got := range map[string]string{
+		"another secret":    signPayload(secret+"x", "1767225600", body),
+		"another timestamp": signPayload(secret, "1767225601", body),
+		"another body":      signPayload(secret, "1767225600", []byte(`{"event":"task.deleted"}`)),
+	} {
+		if got == want {
+			t.Errorf("%s gives the same signature", name)
+		}
+	}
+}
+
+func TestWebhookWants(t *testing.T) {
+	tests := []struct {
+		events []string
+		event  string
+		want   bool
+	}{
+		{nil, "task.created", true},
+		{[]string{"task.completed"}, "task.completed", true},
+		{[]string{"task.completed"}, "task.created", false},
+		{[]string{"task.*"}, "task.archived", true},
+		{[]string{"task.*"}, "subtask.created", false},
+		{[]string{"subtask.*", "attachment.created"}, "attachment.created", true},
+	}
+	for _, tt := range tests {
+		if got := (Webhook{Events: tt.events}).wants(tt.event); got != tt.want {
+			t.Errorf("%v wants %s = %v, want %v", tt.events, tt.event, got, tt.want)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1: 30 * time.Second, 2: time.Minute, 3: 2 * time.Minute, 7: 32 * time.Minute,
+		8: time.Hour, 20: time.Hour,
+	} {
+		if got := retryBackoff(attempts); got != want {
+			t.Errorf("retryBackoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+// receiver is a webhook endpoint that checks signatures the way a receiver
+// would and answers with the next status of its script, or the last one.
+type receiver struct {
+	t      *testing.T
+	secret string
+	mu     sync.Mutex
+	script []int
+	got    []http.Header
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	mac := hmac.New(sha256.New, []byte(r.secret))
+	mac.Write([]byte(req.Header.Get("X-Webhook-Timestamp") + "." + string(body)))
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); req.Header.Get("X-Webhook-Signature") != want {
+		r.t.Errorf("signature %q, want %q", req.Header.Get("X-Webhook-Signature"), want)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.got = append(r.got, req.Header.Clone())
+	status := r.script[min(len(r.got), len(r.script))-1]
+	w.WriteHeader(status)
+	io.WriteString(w, http.StatusText(status))
+}
+
+func newTestWebhook(t *testing.T, mem *memoryStore, script ...int) (*receiver, Webhook) {
+	rec := &receiver{t: t, secret: "whsec-0123456789abcdef", script: script}
+	srv := httptest.NewServer(rec)
+	t.Cleanup(srv.Close)
+	w := Webhook{URL: srv.URL, Secret: rec.secret, Events: []string{"task.*"}, Active: true}
+	if err := mem.CreateWebhook(context.Background(), &w); err != nil {
+		t.Fatal(err)
+	}
+	return rec, w
+}
+
+// makeDue makes the pending deliveries of w due now, as if their backoff had
+// passed.
+func makeDue(t *testing.T, mem *memoryStore, w Webhook) {
+	ctx := context.Background()
+	ds, err := mem.ListWebhookDeliveries(ctx, WebhookDeliveryQuery{WebhookID: w.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range ds {
+		if d.State == DeliveryPending {
+			if err := mem.RetryWebhookDelivery(ctx, d.ID, time.Now().Add(-time.Second), d.StatusCode, d.LastError); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func onlyDelivery(t *testing.T, mem *memoryStore, w Webhook) WebhookDelivery {
+	t.Helper()
+	ds, err := mem.ListWebhookDeliveries(context.Background(), WebhookDeliveryQuery{WebhookID: w.ID})
+	if err != nil || len(ds) != 1 {
+		t.Fatalf("deliveries = %+v, %v; want one", ds, err)
+	}
+	return ds[0]
+}
+
+func TestWebhookRetry(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemoryStore()
+	h := newWebhooks(mem, WebhookConfig{Timeout: duration(5 * time.Second)})
+	rec, w := newTestWebhook(t, mem, http.StatusServiceUnavailable, http.StatusOK)
+	_, other := newTestWebhook(t, mem, http.StatusOK)
+	if _, err := mem.UpdateWebhook(ctx, other.ID, map[string]any{"events": []string{"subtask.*"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.publish(ctx, webhookEvent{Event: "task.completed", Entity: EntityTask, EntityID: 1, TaskID: 1})
+	if !h.deliverNext(ctx) {
+		t.Fatal("nothing to deliver")
+	}
+	d := onlyDelivery(t, mem, w)
+	if d.State != DeliveryPending || d.Attempts != 1 || d.StatusCode != http.StatusServiceUnavailable ||
+		!strings.Contains(d.LastError, "503") {
+		t.Fatalf("after a failed attempt: %+v", d)
+	}
+	if wait := time.Until(*d.NextAttemptAt); wait < 25*time.Second || wait > 30*time.Second {
+		t.Errorf("next attempt in %v, want 30s", wait)
+	}
+	if h.deliverNext(ctx) {
+		t.Error("delivered again before the backoff passed")
+	}
+
+	makeDue(t, mem, w)
+	h.deliverNext(ctx)
+	if d := onlyDelivery(t, mem, w); d.State != DeliveryDelivered || d.Attempts != 2 || d.DeliveredAt == nil {
+		t.Errorf("after a second attempt: %+v", d)
+	}
+	if len(rec.got) != 2 {
+		t.Fatalf("receiver got %d requests, want 2", len(rec.got))
+	}
+	// Receivers tell retries apart from new deliveries by the delivery ID.
+	for _, header := range []string{"X-Webhook-Event", "X-Webhook-Delivery"} {
+		if a, b := rec.got[0].Get(header), rec.got[1].Get(header); a == "" || a != b {
+			t.Errorf("%s = %q, then %q", header, a, b)
+		}
+	}
+	if ds, _ := mem.ListWebhookDeliveries(ctx, WebhookDeliveryQuery{WebhookID: other.ID}); len(ds) != 0 {
+		t.Errorf("webhook for subtask events got %+v", ds)
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemoryStore()
+	h := newWebhooks(mem, WebhookConfig{Timeout: duration(5 * time.Second)})
+	rec, w := newTestWebhook(t, mem, http.StatusInternalServerError)
+
+	h.publish(ctx, webhookEvent{Event: "task.created", Entity: EntityTask, EntityID: 1, TaskID: 1})
+	for i := 0; i < webhookMaxAttempts; i++ {
+		makeDue(t, mem, w)
+		h.deliverNext(ctx)
+	}
+	if d := onlyDelivery(t, mem, w); d.State != DeliveryFailed || d.Attempts != webhookMaxAttempts || d.NextAttemptAt != nil {
+		t.Errorf("after %d attempts: %+v", webhookMaxAttempts, d)
+	}
+	makeDue(t, mem, w)
+	if h.deliverNext(ctx) || len(rec.got) != webhookMaxAttempts {
+		t.Errorf("receiver got %d requests, want %d", len(rec.got), webhookMaxAttempts)
+	}
+}
+
+func TestPausedWebhook(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemoryStore()
+	h := newWebhooks(mem, WebhookConfig{Timeout: duration(5 * time.Second)})
+	rec, w := newTestWebhook(t, mem, http.StatusOK)
+
+	h.publish(ctx, webhookEvent{Event: "task.created", Entity: EntityTask, EntityID: 1, TaskID: 1})
+	if _, err := mem.UpdateWebhook(ctx, w.ID, map[string]any{"active": false}); err != nil {
+		t.Fatal(err)
+	}
+	h.deliverNext(ctx)
+	if d := onlyDelivery(t, mem, w); d.State != DeliveryFailed || d.LastError != "webhook is paused" || len(rec.got) != 0 {
+		t.Errorf("delivery to a paused webhook: %+v, %d requests", d, len(rec.got))
+	}
+	// Nothing is queued while it is paused.
+	h.publish(ctx, webhookEvent{Event: "task.updated", Entity: EntityTask, EntityID: 1, TaskID: 1})
+	onlyDelivery(t, mem, w)
+}